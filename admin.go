@@ -0,0 +1,354 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultAuditStoreSize is the default number of audit events retained
+	// by an AuditStore.
+	DefaultAuditStoreSize = 1000
+
+	// DefaultIssuancesPageSize is the default number of issuances returned
+	// by the admin API per page.
+	DefaultIssuancesPageSize = 50
+
+	// MaxIssuancesPageSize is the maximum number of issuances returned by
+	// the admin API per page.
+	MaxIssuancesPageSize = 500
+
+	// DefaultEventsKeepAlive is the interval at which the admin event stream
+	// sends a comment to keep idle connections open.
+	DefaultEventsKeepAlive = 15 * time.Second
+
+	// eventsBuffer is the number of events buffered for each event stream
+	// subscriber. Subscribers that fall this far behind are disconnected.
+	eventsBuffer = 64
+
+	contentTypeEventStream = "text/event-stream"
+	headerLastEventID      = "Last-Event-ID"
+
+	urlParamType      = "type"
+	urlParamSubject   = "subject"
+	urlParamCluster   = "cluster"
+	urlParamSince     = "since"
+	urlParamLimit     = "limit"
+	urlParamPageToken = "page_token"
+)
+
+// ErrInvalidAdminToken indicates an admin API request without a valid bearer
+// token.
+var ErrInvalidAdminToken = errors.New("invalid or missing admin bearer token")
+
+// An AuditQuery filters the events returned by an AuditStore. Zero fields
+// match all events.
+type AuditQuery struct {
+	Type    string
+	Subject string
+	Cluster string
+	Since   time.Time
+
+	// Limit is the maximum number of events to return.
+	Limit int
+
+	// PageToken continues a previous query from where it left off.
+	PageToken string
+}
+
+func (q AuditQuery) matches(e *AuditEvent) bool {
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+	if q.Subject != "" && e.Subject != q.Subject && e.Username != q.Subject {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if q.Cluster == "" {
+		return true
+	}
+	for _, c := range e.Clusters {
+		if c == q.Cluster {
+			return true
+		}
+	}
+	return false
+}
+
+// An AuditStore is an AuditSink that retains the most recent audit events in
+// process memory so that they may be queried, for example by the admin API.
+type AuditStore struct {
+	mu     sync.RWMutex
+	events []*AuditEvent
+	next   uint64
+	size   int
+
+	subscribers map[chan sequencedEvent]bool
+}
+
+// A sequencedEvent is an audit event and its sequence number.
+type sequencedEvent struct {
+	seq uint64
+	e   *AuditEvent
+}
+
+// NewAuditStore returns an AuditStore that retains the supplied number of
+// events, discarding the oldest. At least one event is always retained.
+func NewAuditStore(size int) *AuditStore {
+	if size < 1 {
+		size = 1
+	}
+	return &AuditStore{size: size}
+}
+
+// Record the supplied event, discarding the oldest retained event if the store
+// is full.
+func (s *AuditStore) Record(_ context.Context, e *AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) > 0 && len(s.events) >= s.size {
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, e)
+	s.next++
+
+	for c := range s.subscribers {
+		select {
+		case c <- sequencedEvent{seq: s.next, e: e}:
+		default:
+			// Record must not block on slow subscribers, which may resume
+			// from the last event they received once reconnected.
+			delete(s.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// subscribe returns the retained events recorded after the supplied sequence
+// number, oldest first, if replay is true, and a channel of events recorded
+// subsequently. The channel is closed if the subscriber falls behind, or when
+// the returned cancel function is called.
+func (s *AuditStore) subscribe(after uint64, replay bool) ([]sequencedEvent, <-chan sequencedEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backlog := []sequencedEvent{}
+	if replay {
+		first := s.next - uint64(len(s.events))
+		if after < first {
+			after = first
+		}
+		for seq := after + 1; seq <= s.next; seq++ {
+			backlog = append(backlog, sequencedEvent{seq: seq, e: s.events[seq-1-first]})
+		}
+	}
+
+	c := make(chan sequencedEvent, eventsBuffer)
+	if s.subscribers == nil {
+		s.subscribers = map[chan sequencedEvent]bool{}
+	}
+	s.subscribers[c] = true
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.subscribers[c] {
+			delete(s.subscribers, c)
+			close(c)
+		}
+	}
+	return backlog, c, cancel
+}
+
+// List returns the events matching the supplied query, newest first, and a
+// token from which to continue the query if more events may match.
+func (s *AuditStore) List(q AuditQuery) ([]*AuditEvent, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Events are identified by their sequence number. The oldest retained
+	// event has sequence number first.
+	first := s.next - uint64(len(s.events))
+	before := s.next
+	if q.PageToken != "" {
+		t, err := strconv.ParseUint(q.PageToken, 10, 64)
+		if err != nil || t > s.next {
+			return nil, "", errors.New("invalid page token")
+		}
+		before = t
+	}
+
+	found := []*AuditEvent{}
+	for seq := before; seq > first; seq-- {
+		e := s.events[seq-1-first]
+		if !q.matches(e) {
+			continue
+		}
+		if q.Limit > 0 && len(found) == q.Limit {
+			return found, strconv.FormatUint(seq, 10), nil
+		}
+		found = append(found, e)
+	}
+	return found, "", nil
+}
+
+// An IssuancesResponse is returned by the admin API.
+type IssuancesResponse struct {
+	Issuances     []*AuditEvent `json:"issuances"`
+	NextPageToken string        `json:"nextPageToken,omitempty"`
+}
+
+// AdminIssuances returns a handler that lists the kubeconfigs recently issued,
+// newest first, as recorded in the supplied store. Requests must present the
+// supplied token as a bearer token. Issuances may be filtered using the
+// subject, cluster, and since (RFC 3339) query parameters, and paginated using
+// the limit and page_token query parameters.
+func AdminIssuances(s *AuditStore, token []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kuberos"`)
+			http.Error(w, ErrInvalidAdminToken.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		q := AuditQuery{
+			Type:      AuditEventIssued,
+			Subject:   r.FormValue(urlParamSubject),
+			Cluster:   r.FormValue(urlParamCluster),
+			Limit:     DefaultIssuancesPageSize,
+			PageToken: r.FormValue(urlParamPageToken),
+		}
+		if v := r.FormValue(urlParamSince); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, errors.Wrap(err, "cannot parse since parameter").Error(), http.StatusBadRequest)
+				return
+			}
+			q.Since = t
+		}
+		if v := r.FormValue(urlParamLimit); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > MaxIssuancesPageSize {
+				http.Error(w, errors.Errorf("limit must be between 1 and %d", MaxIssuancesPageSize).Error(), http.StatusBadRequest)
+				return
+			}
+			q.Limit = l
+		}
+
+		ee, next, err := s.List(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, &IssuancesResponse{Issuances: ee, NextPageToken: next})
+	}
+}
+
+// AdminEvents returns a handler that streams audit events as they are recorded
+// in the supplied store, as server-sent events. Requests must present the
+// supplied token as a bearer token. Events may be filtered using the type,
+// subject, and cluster query parameters. Each event's ID is its sequence
+// number, so reconnecting clients that send the Last-Event-ID header first
+// receive any retained events they missed.
+func AdminEvents(s *AuditStore, token []byte, keepAlive time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kuberos"`)
+			http.Error(w, ErrInvalidAdminToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "cannot stream events", http.StatusInternalServerError)
+			return
+		}
+
+		q := AuditQuery{
+			Type:    r.FormValue(urlParamType),
+			Subject: r.FormValue(urlParamSubject),
+			Cluster: r.FormValue(urlParamCluster),
+		}
+		if q.Type != "" && !validAuditEventType(q.Type) {
+			http.Error(w, errors.Errorf("type must be one of %s", strings.Join(auditEventTypes, ", ")).Error(), http.StatusBadRequest)
+			return
+		}
+		after, replay := uint64(0), false
+		if v := r.Header.Get(headerLastEventID); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, errors.Wrap(err, "cannot parse Last-Event-ID header").Error(), http.StatusBadRequest)
+				return
+			}
+			after, replay = id, true
+		}
+
+		backlog, events, cancel := s.subscribe(after, replay)
+		defer cancel()
+
+		w.Header().Set("Content-Type", contentTypeEventStream)
+		// Prevent proxies such as nginx from buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		for _, se := range backlog {
+			if q.matches(se.e) {
+				writeEvent(w, se) // nolint: errcheck, gas
+			}
+		}
+		f.Flush()
+
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case se, ok := <-events:
+				if !ok {
+					return
+				}
+				if !q.matches(se.e) {
+					continue
+				}
+				err = writeEvent(w, se)
+			case <-t.C:
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			}
+			if err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+// writeEvent writes the supplied audit event as a server-sent event.
+func writeEvent(w http.ResponseWriter, se sequencedEvent) error {
+	b, err := json.Marshal(se.e)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode audit event")
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.seq, se.e.Type, b)
+	return errors.Wrap(err, "cannot write audit event")
+}
+
+// validBearerToken returns true if the supplied request presents the supplied
+// bearer token.
+func validBearerToken(r *http.Request, token []byte) bool {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(token) == 0 || !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(h, prefix)), token) == 1
+}
@@ -0,0 +1,194 @@
+package kuberos
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestAuditStoreSize(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+		want []string
+	}{
+		{name: "Negative", size: -1, want: []string{"carol"}},
+		{name: "Zero", size: 0, want: []string{"carol"}},
+		{name: "One", size: 1, want: []string{"carol"}},
+		{name: "Larger", size: 5, want: []string{"carol", "bob", "alice"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewAuditStore(tt.size)
+			for _, sub := range []string{"alice", "bob", "carol"} {
+				s.Record(context.Background(), &AuditEvent{Type: AuditEventIssued, Subject: sub})
+			}
+			events, _, err := s.List(AuditQuery{})
+			if err != nil {
+				t.Fatalf("s.List(...): %v", err)
+			}
+			got := []string{}
+			for _, e := range events {
+				got = append(got, e.Subject)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("s.List(...): want != got %v", diff)
+			}
+		})
+	}
+}
+
+func TestAdminIssuances(t *testing.T) {
+	s := NewAuditStore(3)
+	now := time.Now().UTC()
+	for _, e := range []*AuditEvent{
+		{Type: AuditEventIssued, Subject: "dropped", Time: now.Add(-time.Hour)},
+		{Type: AuditEventIssued, Subject: "alice", Clusters: []string{"a"}, Time: now},
+		{Type: AuditEventFailed, Time: now},
+		{Type: AuditEventIssued, Subject: "bob", Clusters: []string{"a", "b"}, Time: now.Add(3 * time.Second)},
+	} {
+		s.Record(context.Background(), e)
+	}
+	h := AdminIssuances(s, []byte("secret"))
+
+	cases := []struct {
+		name     string
+		token    string
+		query    string
+		code     int
+		subjects []string
+		next     bool
+	}{
+		{name: "Unauthenticated", token: "wrong", code: http.StatusUnauthorized},
+		{name: "All", token: "secret", code: http.StatusOK, subjects: []string{"bob", "alice"}},
+		{name: "BySubject", token: "secret", query: "subject=alice", code: http.StatusOK, subjects: []string{"alice"}},
+		{name: "ByCluster", token: "secret", query: "cluster=b", code: http.StatusOK, subjects: []string{"bob"}},
+		{name: "Since", token: "secret", query: "since=" + url.QueryEscape(now.Add(time.Second).Format(time.RFC3339)), code: http.StatusOK, subjects: []string{"bob"}},
+		{name: "FirstPage", token: "secret", query: "limit=1", code: http.StatusOK, subjects: []string{"bob"}, next: true},
+		{name: "SecondPage", token: "secret", query: "limit=1&page_token=2", code: http.StatusOK, subjects: []string{"alice"}},
+		{name: "InvalidLimit", token: "secret", query: "limit=0", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/v1/admin/issuances?"+tt.query, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			h(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			rsp := &IssuancesResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+			got := []string{}
+			for _, e := range rsp.Issuances {
+				got = append(got, e.Subject)
+			}
+			if diff := deep.Equal(tt.subjects, got); diff != nil {
+				t.Errorf("subjects: want != got %v", diff)
+			}
+			if (rsp.NextPageToken != "") != tt.next {
+				t.Errorf("rsp.NextPageToken: want next page %v, got %q", tt.next, rsp.NextPageToken)
+			}
+		})
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	s := NewAuditStore(3)
+	s.Record(context.Background(), &AuditEvent{Type: AuditEventIssued, Subject: "alice"})
+	s.Record(context.Background(), &AuditEvent{Type: AuditEventFailed, Reason: "expired"})
+	srv := httptest.NewServer(AdminEvents(s, []byte("secret"), time.Hour))
+	defer srv.Close()
+
+	get := func(token, lastEventID string) *http.Response {
+		r, _ := http.NewRequest("GET", srv.URL+"?type=issued", nil) // nolint: gas
+		r.Header.Set("Authorization", "Bearer "+token)
+		if lastEventID != "" {
+			r.Header.Set("Last-Event-ID", lastEventID)
+		}
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("http.DefaultClient.Do(...): %v", err)
+		}
+		return rsp
+	}
+
+	rsp := get("wrong", "")
+	rsp.Body.Close() // nolint: errcheck, gas
+	if rsp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("rsp.StatusCode:\nwant %v\ngot %v\n", http.StatusUnauthorized, rsp.StatusCode)
+	}
+
+	// Resuming from before the first event replays only the retained issuance.
+	rsp = get("secret", "0")
+	defer rsp.Body.Close() // nolint: errcheck
+	if got := rsp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type:\nwant text/event-stream\ngot %v\n", got)
+	}
+	lines := bufio.NewScanner(rsp.Body)
+	next := func() []string {
+		event := []string{}
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		return event
+	}
+	want := []string{"id: 1", "event: issued", `data: {"type":"issued","time":"0001-01-01T00:00:00Z","subject":"alice"}`}
+	if diff := deep.Equal(want, next()); diff != nil {
+		t.Errorf("replayed event: want != got %v", diff)
+	}
+
+	s.Record(context.Background(), &AuditEvent{Type: AuditEventFailed})
+	s.Record(context.Background(), &AuditEvent{Type: AuditEventIssued, Subject: "bob"})
+	want = []string{"id: 4", "event: issued", `data: {"type":"issued","time":"0001-01-01T00:00:00Z","subject":"bob"}`}
+	if diff := deep.Equal(want, next()); diff != nil {
+		t.Errorf("streamed event: want != got %v", diff)
+	}
+}
+
+func TestAdminEventsType(t *testing.T) {
+	srv := httptest.NewServer(AdminEvents(NewAuditStore(1), []byte("secret"), time.Hour))
+	defer srv.Close()
+
+	cases := []struct {
+		name string
+		typ  string
+		code int
+	}{
+		{name: "All", code: http.StatusOK},
+		{name: "Issued", typ: AuditEventIssued, code: http.StatusOK},
+		{name: "Failed", typ: AuditEventFailed, code: http.StatusOK},
+		{name: "LockedOut", typ: AuditEventLockedOut, code: http.StatusOK},
+		{name: "Unknown", typ: "unknown", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", srv.URL+"?type="+tt.typ, nil) // nolint: gas
+			r.Header.Set("Authorization", "Bearer secret")
+			rsp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatalf("http.DefaultClient.Do(...): %v", err)
+			}
+			rsp.Body.Close() // nolint: errcheck, gas
+			if rsp.StatusCode != tt.code {
+				t.Errorf("rsp.StatusCode:\nwant %v\ngot %v\n", tt.code, rsp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// An Overlay is a file system that layers the supplied file systems, for
+// example a directory of customised frontend assets over those embedded in
+// the kuberos binary. Files are opened from the first file system in which
+// they exist.
+type Overlay []http.FileSystem
+
+// Open the named file from the first file system in which it exists.
+func (o Overlay) Open(name string) (http.File, error) {
+	for _, fs := range o {
+		f, err := fs.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, os.ErrNotExist
+}
+
+// DefaultAssetReloadInterval is the default interval at which an
+// AssetReloader checks whether its asset has changed.
+const DefaultAssetReloadInterval = time.Second
+
+// An AssetReloader holds the content of a frontend asset, e.g. index.html,
+// reading it again whenever it is modified. This allows the frontend to be
+// iterated upon without restarting kuberos, and thus without repeating the
+// authentication flow.
+type AssetReloader struct {
+	fs   http.FileSystem
+	name string
+	log  *zap.Logger
+
+	mu      sync.RWMutex
+	content []byte
+	modTime time.Time
+}
+
+// NewAssetReloader returns an AssetReloader that holds the named asset of the
+// supplied file system. The asset is read before NewAssetReloader returns.
+func NewAssetReloader(fs http.FileSystem, name string, log *zap.Logger) (*AssetReloader, error) {
+	a := &AssetReloader{fs: fs, name: name, log: log}
+	_, err := a.reload()
+	return a, err
+}
+
+// Content returns the current content of the asset.
+func (a *AssetReloader) Content() []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.content
+}
+
+// Watch checks whether the asset has been modified every interval until the
+// supplied context is cancelled, reading it again if so. The current content
+// continues to be served if the asset cannot be read.
+func (a *AssetReloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := a.reload()
+			if err != nil {
+				a.log.Info("cannot reload frontend asset", zap.String("name", a.name), zap.Error(err))
+				continue
+			}
+			if reloaded {
+				a.log.Info("reloaded frontend asset", zap.String("name", a.name))
+			}
+		}
+	}
+}
+
+// reload reads the asset if it has been modified since it was last read,
+// returning true if it was.
+func (a *AssetReloader) reload() (bool, error) {
+	f, err := a.fs.Open(a.name)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot open %s", a.name)
+	}
+	defer f.Close() // nolint: errcheck
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot stat %s", a.name)
+	}
+	a.mu.RLock()
+	current := a.content != nil && fi.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+
+	c, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot read %s", a.name)
+	}
+	a.mu.Lock()
+	a.content, a.modTime = c, fi.ModTime()
+	a.mu.Unlock()
+	return true, nil
+}
+
+// DefaultAssetMaxAge is the default duration for which browsers may cache
+// fingerprinted frontend assets.
+const DefaultAssetMaxAge = 365 * 24 * time.Hour
+
+const urlParamVersion = "v"
+
+// assetRef matches references to frontend assets in HTML, e.g.
+// src="dist/build.js".
+var assetRef = regexp.MustCompile(`((?:src|href)="(?:\.\./)*dist)(/[^"?#]+)"`)
+
+// assetDirRef matches relative references to the frontend asset directory in
+// HTML, e.g. src="dist/build.js" or href="dist/app.css".
+var assetDirRef = regexp.MustCompile(`(\s(?:src|href))="dist/`)
+
+// RebaseAssets returns the supplied HTML with each relative reference to a
+// frontend asset prefixed with the supplied relative path, e.g. ../, so that
+// the HTML may be served below the path it was written for.
+func RebaseAssets(html []byte, prefix string) []byte {
+	return assetDirRef.ReplaceAll(html, []byte(`${1}="`+prefix+`dist/`))
+}
+
+// An AssetCache serves frontend assets with strong ETags derived from their
+// content, so that browsers may cache them. Assets requested via the
+// fingerprinted URLs returned by Fingerprint may be cached for MaxAge without
+// revalidation, as their URL changes whenever their content does. Other assets
+// must be revalidated before each use.
+//
+// AssetCache must only serve static assets. Pages that contain credentials
+// must never be cached.
+type AssetCache struct {
+	fs     http.FileSystem
+	files  http.Handler
+	maxAge time.Duration
+
+	mu    sync.RWMutex
+	etags map[string]assetETag
+}
+
+type assetETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// NewAssetCache returns an AssetCache that serves assets from the supplied
+// file system, allowing fingerprinted assets to be cached for the supplied
+// duration.
+func NewAssetCache(fs http.FileSystem, maxAge time.Duration) *AssetCache {
+	return &AssetCache{fs: fs, files: http.FileServer(fs), maxAge: maxAge, etags: map[string]assetETag{}}
+}
+
+// ETag returns the strong ETag of the named asset, which is a digest of its
+// content. Digests are recomputed only when an asset is modified.
+func (c *AssetCache) ETag(name string) (string, error) {
+	f, err := c.fs.Open(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot open %s", name)
+	}
+	defer f.Close() // nolint: errcheck
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot stat %s", name)
+	}
+	if fi.IsDir() {
+		return "", errors.Errorf("%s is a directory", name)
+	}
+	c.mu.RLock()
+	e, ok := c.etags[name]
+	c.mu.RUnlock()
+	if ok && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e.etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "cannot read %s", name)
+	}
+	e = assetETag{modTime: fi.ModTime(), size: fi.Size(), etag: `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`}
+	c.mu.Lock()
+	c.etags[name] = e
+	c.mu.Unlock()
+	return e.etag, nil
+}
+
+// Fingerprint returns the supplied HTML with each reference to an asset under
+// dist/, e.g. src="dist/build.js", suffixed with a digest of the asset's
+// content. References to assets that do not exist are unchanged.
+func (c *AssetCache) Fingerprint(html []byte) []byte {
+	return assetRef.ReplaceAllFunc(html, func(ref []byte) []byte {
+		m := assetRef.FindSubmatch(ref)
+		etag, err := c.ETag(string(m[2]))
+		if err != nil {
+			return ref
+		}
+		return []byte(fmt.Sprintf(`%s%s?%s=%s"`, m[1], m[2], urlParamVersion, etag[1:len(etag)-1]))
+	})
+}
+
+// ServeHTTP serves the asset at the request's path with its ETag, responding
+// 304 Not Modified if the request's If-None-Match header matches it.
+func (c *AssetCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if etag, err := c.ETag(r.URL.Path); err == nil {
+		hdr := w.Header()
+		hdr.Set("ETag", etag)
+		hdr.Del("Pragma")
+		if r.URL.Query().Get(urlParamVersion) == etag[1:len(etag)-1] {
+			hdr.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(c.maxAge.Seconds())))
+		} else {
+			hdr.Set("Cache-Control", "no-cache")
+		}
+	}
+	c.files.ServeHTTP(w, r)
+}
@@ -0,0 +1,193 @@
+package kuberos
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+func TestOverlay(t *testing.T) {
+	custom, embedded := afero.NewMemMapFs(), afero.NewMemMapFs()
+	for fs, files := range map[afero.Fs]map[string]string{
+		custom:   {"/index.html": "custom", "/dist/logo.png": "logo"},
+		embedded: {"/index.html": "embedded", "/dist/build.js": "build"},
+	} {
+		for name, content := range files {
+			if err := afero.WriteFile(fs, name, []byte(content), 0644); err != nil {
+				t.Fatalf("afero.WriteFile(%v): %v", name, err)
+			}
+		}
+	}
+	o := Overlay{afero.NewHttpFs(custom).Dir("/"), afero.NewHttpFs(embedded).Dir("/")}
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{name: "/index.html", want: "custom"},
+		{name: "/dist/logo.png", want: "logo"},
+		{name: "/dist/build.js", want: "build"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := o.Open(tt.name)
+			if err != nil {
+				t.Fatalf("o.Open(%v): %v", tt.name, err)
+			}
+			defer f.Close()
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll(%v): %v", tt.name, err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("o.Open(%v):\nwant %v\ngot %v\n", tt.name, tt.want, string(b))
+			}
+		})
+	}
+
+	if _, err := o.Open("/missing.html"); !os.IsNotExist(err) {
+		t.Errorf("o.Open(/missing.html): want not exist error, got %v", err)
+	}
+}
+
+func TestAssetCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/build.js", []byte("build"), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	c := NewAssetCache(afero.NewHttpFs(fs).Dir("/"), time.Hour)
+
+	etag, err := c.ETag("/build.js")
+	if err != nil {
+		t.Fatalf("c.ETag(...): %v", err)
+	}
+	v := strings.Trim(etag, `"`)
+	html := `<script src="dist/build.js"></script><img src="dist/missing.png">`
+	want := `<script src="dist/build.js?v=` + v + `"></script><img src="dist/missing.png">`
+	if got := string(c.Fingerprint([]byte(html))); got != want {
+		t.Errorf("c.Fingerprint(...):\nwant %v\ngot %v\n", want, got)
+	}
+
+	cases := []struct {
+		name        string
+		url         string
+		ifNoneMatch string
+		code        int
+		cache       string
+	}{
+		{name: "Fingerprinted", url: "/build.js?v=" + v, code: http.StatusOK, cache: "public, max-age=3600, immutable"},
+		{name: "Unversioned", url: "/build.js", code: http.StatusOK, cache: "no-cache"},
+		{name: "StaleVersion", url: "/build.js?v=stale", code: http.StatusOK, cache: "no-cache"},
+		{name: "NotModified", url: "/build.js", ifNoneMatch: etag, code: http.StatusNotModified, cache: "no-cache"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag:\nwant %v\ngot %v\n", etag, got)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tt.cache {
+				t.Errorf("Cache-Control:\nwant %v\ngot %v\n", tt.cache, got)
+			}
+		})
+	}
+
+	if err := afero.WriteFile(fs, "/build.js", []byte("rebuilt"), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	if got, _ := c.ETag("/build.js"); got == etag {
+		t.Errorf("c.ETag(...): want new ETag after modification, got %v", got)
+	}
+}
+
+func TestRebaseAssets(t *testing.T) {
+	cases := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "Script",
+			html: `<script src="dist/build.js?v=abc"></script>`,
+			want: `<script src="../dist/build.js?v=abc"></script>`,
+		},
+		{
+			name: "Stylesheet",
+			html: `<link rel="stylesheet" href="dist/app.css"><link rel="icon" href="dist/favicon.png">`,
+			want: `<link rel="stylesheet" href="../dist/app.css"><link rel="icon" href="../dist/favicon.png">`,
+		},
+		{
+			name: "OtherReferences",
+			html: `<a href="#intro">Intro</a><img src="https://example.org/dist/logo.png"><a data-href="dist/x">`,
+			want: `<a href="#intro">Intro</a><img src="https://example.org/dist/logo.png"><a data-href="dist/x">`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(RebaseAssets([]byte(tt.html), "../")); got != tt.want {
+				t.Errorf("RebaseAssets(...):\nwant %v\ngot %v\n", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAssetReloader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	at := time.Now().Add(-time.Hour)
+	write := func(content string, at time.Time) {
+		t.Helper()
+		if err := afero.WriteFile(fs, "/index.html", []byte(content), 0644); err != nil {
+			t.Fatalf("afero.WriteFile(...): %v", err)
+		}
+		if err := fs.Chtimes("/index.html", at, at); err != nil {
+			t.Fatalf("fs.Chtimes(...): %v", err)
+		}
+	}
+	write("original", at)
+
+	a, err := NewAssetReloader(afero.NewHttpFs(fs).Dir("/"), "/index.html", zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewAssetReloader(...): %v", err)
+	}
+	if got, want := string(a.Content()), "original"; got != want {
+		t.Errorf("a.Content():\nwant %v\ngot %v\n", want, got)
+	}
+
+	if reloaded, err := a.reload(); err != nil || reloaded {
+		t.Errorf("a.reload(): want unmodified asset not to be reloaded, got %v, %v", reloaded, err)
+	}
+
+	write("modified", at.Add(time.Minute))
+	if reloaded, err := a.reload(); err != nil || !reloaded {
+		t.Errorf("a.reload(): want modified asset to be reloaded, got %v, %v", reloaded, err)
+	}
+	if got, want := string(a.Content()), "modified"; got != want {
+		t.Errorf("a.Content():\nwant %v\ngot %v\n", want, got)
+	}
+
+	if err := fs.Remove("/index.html"); err != nil {
+		t.Fatalf("fs.Remove(...): %v", err)
+	}
+	if _, err := a.reload(); err == nil {
+		t.Errorf("a.reload(): want error reading removed asset")
+	}
+	if got, want := string(a.Content()), "modified"; got != want {
+		t.Errorf("a.Content():\nwant %v\ngot %v\n", want, got)
+	}
+}
@@ -0,0 +1,192 @@
+package kuberos
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+// Audit event types.
+const (
+	// AuditEventIssued events are recorded when a kubeconfig is issued.
+	AuditEventIssued = "issued"
+
+	// AuditEventFailed events are recorded when an authentication response
+	// cannot be processed, e.g. because its ID token could not be verified.
+	AuditEventFailed = "failed"
+)
+
+// auditEventTypes are the types of all audit events, including those recorded
+// by lockouts.
+var auditEventTypes = []string{AuditEventIssued, AuditEventFailed, AuditEventLockedOut}
+
+func validAuditEventType(t string) bool {
+	for _, v := range auditEventTypes {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// An AuditEvent records the issuance of cluster credentials, or a failure to
+// authenticate.
+type AuditEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Subject   string    `json:"subject,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"`
+	Clusters  []string  `json:"clusters,omitempty"`
+	ClientIP  string    `json:"clientIP,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+
+	// ForwardedFor is the X-Forwarded-For header of the request, if any. It
+	// is recorded as supplied, and may have been forged by the client. The
+	// ClientIP is the address of the peer that made the request, or the
+	// client address resolved by a trusted proxy.
+	ForwardedFor string `json:"forwardedFor,omitempty"`
+
+	// Code classifies the failure of a failed event.
+	Code string `json:"code,omitempty"`
+
+	// Reason describes the failure of a failed event.
+	Reason string `json:"reason,omitempty"`
+}
+
+// An AuditSink persists audit events, for example in order to answer who
+// obtained cluster credentials and when. Record is called synchronously each
+// time a kubeconfig is issued or authentication fails, and should return
+// promptly.
+type AuditSink interface {
+	Record(ctx context.Context, e *AuditEvent)
+}
+
+// An AuditSinkFunc is a function that records audit events.
+type AuditSinkFunc func(ctx context.Context, e *AuditEvent)
+
+// Record the supplied audit event by calling the AuditSinkFunc.
+func (fn AuditSinkFunc) Record(ctx context.Context, e *AuditEvent) {
+	fn(ctx, e)
+}
+
+// A WriterAuditSink records audit events to an io.Writer, one JSON object per
+// line.
+type WriterAuditSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	log *zap.Logger
+}
+
+// NewWriterAuditSink returns an AuditSink that records audit events to the
+// supplied writer, logging any failure to do so.
+func NewWriterAuditSink(w io.Writer, log *zap.Logger) *WriterAuditSink {
+	return &WriterAuditSink{w: w, log: log}
+}
+
+// Record the supplied audit event as a line of JSON.
+func (s *WriterAuditSink) Record(_ context.Context, e *AuditEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		s.log.Info("cannot encode audit event", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		s.log.Info("cannot write audit event", zap.Error(err))
+	}
+}
+
+// Audit configures the sinks to which audit events are recorded. Events are
+// recorded to every sink.
+func Audit(sinks ...AuditSink) Option {
+	return func(h *Handlers) error {
+		h.audit = append(h.audit, sinks...)
+		return nil
+	}
+}
+
+// Clusters configures the kubecfg template containing the clusters for which
+// kuberos issues credentials, whose names are recorded in audit events.
+func Clusters(cfg *api.Config) Option {
+	return func(h *Handlers) error {
+		h.clusters = clusterNames(cfg)
+		return nil
+	}
+}
+
+// clusterNames returns the sorted names of the clusters in the supplied
+// kubecfg template.
+func clusterNames(cfg *api.Config) []string {
+	names := make([]string, 0, len(cfg.Clusters))
+	for n := range cfg.Clusters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// issued returns an audit event recording the issuance of a kubeconfig for
+// the supplied clusters to the supplied user.
+func issued(p *extractor.OIDCAuthenticationParams, clusters []string) *AuditEvent {
+	c := tokenClaims(p.IDToken)
+	return &AuditEvent{
+		Type:     AuditEventIssued,
+		Subject:  c.Subject,
+		Username: p.Username,
+		Email:    c.Email,
+		Groups:   p.Groups,
+		Issuer:   p.IssuerURL,
+		Clusters: clusters,
+	}
+}
+
+// record records the supplied event, annotated with the time and the client
+// that made the supplied request, to all audit sinks.
+func (h *Handlers) record(r *http.Request, e *AuditEvent) {
+	if len(h.audit) == 0 {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.ClientIP = clientIP(r)
+	e.ForwardedFor = strings.Join(r.Header[headerForwardedFor], ", ")
+	e.UserAgent = r.UserAgent()
+	for _, s := range h.audit {
+		s.Record(r.Context(), e)
+	}
+}
+
+type auditClaims struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+}
+
+// tokenClaims returns the audited claims of the supplied ID token, which must
+// already have been verified. Zero values are returned for unparseable tokens.
+func tokenClaims(token string) auditClaims {
+	c := auditClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c
+	}
+	json.Unmarshal(b, &c) // nolint: errcheck, gas
+	return c
+}
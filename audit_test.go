@@ -0,0 +1,71 @@
+package kuberos
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestAudit(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1234","email":"example@example.org"}`))
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{
+		Username:  "example",
+		IDToken:   "header." + claims + ".signature",
+		IssuerURL: "https://example.org",
+		Groups:    []string{"devs"},
+	}}
+	var got []*AuditEvent
+	sink := AuditSinkFunc(func(_ context.Context, e *AuditEvent) {
+		got = append(got, e)
+	})
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), Audit(sink))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	cfg := &api.Config{Clusters: map[string]*api.Cluster{"b": &api.Cluster{}, "a": &api.Cluster{}}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/kubeconfig?state=state&code=code", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "curl/7.58.0")
+	r.Header.Set(headerForwardedFor, "198.51.100.1")
+	r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+	h.KubeConfig(cfg)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("len(events):\nwant 1\ngot %v\n", len(got))
+	}
+	want := &AuditEvent{
+		Type:         AuditEventIssued,
+		Time:         got[0].Time,
+		Subject:      "1234",
+		Username:     "example",
+		Email:        "example@example.org",
+		Groups:       []string{"devs"},
+		Issuer:       "https://example.org",
+		Clusters:     []string{"a", "b"},
+		ClientIP:     "192.0.2.1",
+		UserAgent:    "curl/7.58.0",
+		ForwardedFor: "198.51.100.1",
+	}
+	if diff := deep.Equal(want, got[0]); diff != nil {
+		t.Errorf("AuditEvent: want != got: %v", diff)
+	}
+}
@@ -0,0 +1,63 @@
+package kuberos
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+// errorCodeNotAuthorized is returned in the X-Kuberos-Error-Code header when
+// an authenticated user is denied a kubeconfig by the authorization policy.
+const errorCodeNotAuthorized = "not_authorized"
+
+// ErrNotAuthorized indicates an authenticated user is not permitted to obtain
+// a kubeconfig.
+var ErrNotAuthorized = errors.New("not authorized: you are not a member of a group permitted to use this cluster")
+
+// A Policy determines which authenticated users may obtain a kubeconfig. Users
+// are authorized if they are a member of any of its groups, or their verified
+// email address is in any of its domains. An empty policy authorizes all
+// users.
+type Policy struct {
+	// Groups whose members are authorized.
+	Groups []string
+
+	// EmailDomains whose users are authorized, e.g. example.org. Users'
+	// email claims, not their usernames, are matched, and only if their
+	// email_verified claim is true.
+	EmailDomains []string
+}
+
+// Authorize returns nil if the supplied user is authorized by the policy.
+func (p Policy) Authorize(u *extractor.OIDCAuthenticationParams) error {
+	if len(p.Groups) == 0 && len(p.EmailDomains) == 0 {
+		return nil
+	}
+	for _, want := range p.Groups {
+		for _, g := range u.Groups {
+			if g == want {
+				return nil
+			}
+		}
+	}
+	if i := strings.LastIndex(u.Email, "@"); i >= 0 && u.EmailVerified {
+		domain := strings.ToLower(u.Email[i+1:])
+		for _, d := range p.EmailDomains {
+			if strings.ToLower(d) == domain {
+				return nil
+			}
+		}
+	}
+	return errors.Wrapf(ErrNotAuthorized, "%q", u.Username)
+}
+
+// Authorization configures the policy that authenticated users must satisfy
+// before they're issued a kubeconfig.
+func Authorization(p Policy) Option {
+	return func(h *Handlers) error {
+		h.policy = p
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestAuthorization(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy Policy
+		user   *extractor.OIDCAuthenticationParams
+		code   int
+	}{
+		{
+			name: "EmptyPolicy",
+			user: &extractor.OIDCAuthenticationParams{Username: "example@example.org"},
+			code: http.StatusOK,
+		},
+		{
+			name:   "AllowedGroup",
+			policy: Policy{Groups: []string{"admins", "devs"}},
+			user:   &extractor.OIDCAuthenticationParams{Username: "example@example.org", Groups: []string{"devs"}},
+			code:   http.StatusOK,
+		},
+		{
+			name:   "AllowedEmailDomain",
+			policy: Policy{Groups: []string{"admins"}, EmailDomains: []string{"Example.org"}},
+			user:   &extractor.OIDCAuthenticationParams{Username: "example", Email: "example@example.org", EmailVerified: true},
+			code:   http.StatusOK,
+		},
+		{
+			name:   "UnverifiedEmailDomain",
+			policy: Policy{Groups: []string{"admins"}, EmailDomains: []string{"example.org"}},
+			user:   &extractor.OIDCAuthenticationParams{Username: "example", Email: "example@example.org"},
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "UsernameInEmailDomain",
+			policy: Policy{Groups: []string{"admins"}, EmailDomains: []string{"example.org"}},
+			user:   &extractor.OIDCAuthenticationParams{Username: "mallory@example.org", Email: "mallory@example.net", EmailVerified: true},
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "Denied",
+			policy: Policy{Groups: []string{"admins"}, EmailDomains: []string{"example.net"}},
+			user:   &extractor.OIDCAuthenticationParams{Username: "example@example.org", Groups: []string{"devs"}},
+			code:   http.StatusForbidden,
+		},
+	}
+
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{p: tt.user}
+			h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), Authorization(tt.policy))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			if tt.code == http.StatusForbidden && w.Header().Get(headerErrorCode) != errorCodeNotAuthorized {
+				t.Errorf("%s:\nwant %v\ngot %v\n", headerErrorCode, errorCodeNotAuthorized, w.Header().Get(headerErrorCode))
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Colors must be CSS hex colors, e.g. #326ce5, so that they may be safely
+// embedded in stylesheets.
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Branding customises the pages kuberos presents to users, so that they are
+// recognisably the organisation's own. Zero fields use kuberos's defaults.
+type Branding struct {
+	// OrgName is the name of the organisation, shown alongside kuberos.
+	OrgName string `json:"orgName,omitempty"`
+
+	// LogoURL is the URL of a logo to show in place of kuberos's own.
+	LogoURL string `json:"logoURL,omitempty"`
+
+	// PrimaryColor is the CSS hex color of headings, links, and buttons.
+	PrimaryColor string `json:"primaryColor,omitempty"`
+
+	// BackgroundColor is the CSS hex color of the page background.
+	BackgroundColor string `json:"backgroundColor,omitempty"`
+
+	// SupportURL is where users may seek help, e.g. a chat channel or a
+	// ticketing system. It may be a mailto: URL.
+	SupportURL string `json:"supportURL,omitempty"`
+}
+
+// Validate returns an error if the branding cannot be safely presented.
+func (b Branding) Validate() error {
+	for _, c := range []string{b.PrimaryColor, b.BackgroundColor} {
+		if c != "" && !hexColor.MatchString(c) {
+			return errors.Errorf("color %q must be a CSS hex color, e.g. #326ce5", c)
+		}
+	}
+	if b.LogoURL != "" {
+		u, err := url.Parse(b.LogoURL)
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse logo URL %q", b.LogoURL)
+		}
+		if u.Scheme != schemeHTTPS && u.Scheme != "" {
+			return errors.Errorf("logo URL %q must be an HTTPS URL or a path", b.LogoURL)
+		}
+	}
+	if b.SupportURL != "" {
+		u, err := url.Parse(b.SupportURL)
+		if err != nil {
+			return errors.Wrapf(err, "cannot parse support URL %q", b.SupportURL)
+		}
+		if u.Scheme != schemeHTTP && u.Scheme != schemeHTTPS && u.Scheme != "mailto" {
+			return errors.Errorf("support URL %q must be an HTTP, HTTPS, or mailto URL", b.SupportURL)
+		}
+	}
+	return nil
+}
+
+// Name returns the name under which kuberos is presented.
+func (b Branding) Name() string {
+	if b.OrgName == "" {
+		return "kuberos"
+	}
+	return b.OrgName + " kuberos"
+}
+
+// ServeHTTP serves the branding as JSON, for use by the frontend.
+func (b Branding) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, b)
+}
+
+// Brand presents error pages with the supplied branding.
+func Brand(b Branding) Option {
+	return func(h *Handlers) error {
+		if err := b.Validate(); err != nil {
+			return errors.Wrap(err, "invalid branding")
+		}
+		h.branding = b
+		return nil
+	}
+}
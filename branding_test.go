@@ -0,0 +1,48 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBranding(t *testing.T) {
+	cases := []struct {
+		name    string
+		b       Branding
+		wantErr bool
+	}{
+		{name: "Valid", b: Branding{OrgName: "Example", LogoURL: "https://example.org/logo.png", PrimaryColor: "#326ce5", BackgroundColor: "#FFF", SupportURL: "mailto:help@example.org"}},
+		{name: "Empty", b: Branding{}},
+		{name: "ColorInjection", b: Branding{PrimaryColor: "red} body { display: none"}, wantErr: true},
+		{name: "InsecureLogo", b: Branding{LogoURL: "http://example.org/logo.png"}, wantErr: true},
+		{name: "ScriptSupportURL", b: Branding{SupportURL: "javascript:alert(1)"}, wantErr: true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.b.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("tt.b.Validate(): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	t.Run("ErrorPage", func(t *testing.T) {
+		c := &oauth2.Config{ClientID: "testClientID", Scopes: DefaultScopes}
+		h, err := NewHandlers(c, &predictableExtractor{}, Brand(cases[0].b))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg", nil)
+		r.Header.Set("Accept", "text/html")
+		h.fail(w, r, http.StatusBadRequest, ErrMissingCode)
+		for _, want := range []string{"- Example kuberos</title>", `<img src="https://example.org/logo.png" alt="Example"`, "color: #326ce5", "background-color: #FFF", `href="mailto:help@example.org"`} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("w.Body: want %q, got\n%s", want, w.Body)
+			}
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	caSchemeHTTPS  = "https://"
+	caSchemeSecret = "secret:"
+
+	// defaultCASecretKey is the key of the CA certificate in secrets of type
+	// kubernetes.io/tls and kubernetes.io/service-account-token.
+	defaultCASecretKey = "ca.crt"
+
+	envServiceHost = "KUBERNETES_SERVICE_HOST"
+	envServicePort = "KUBERNETES_SERVICE_PORT"
+
+	maxCABytes = 1 << 20
+)
+
+// EmbedCertificateAuthorities embeds the CA certificates referenced by the
+// certificate-authority of each cluster in the supplied kubecfg template as
+// certificate-authority-data, so that users need not be distributed the CA
+// separately. A certificate authority may be the path of a file readable by
+// kuberos, an HTTPS URL fetched using the supplied HTTP client, or a Kubernetes
+// secret in the form secret:NAMESPACE/NAME[/KEY], where KEY defaults to ca.crt.
+// Secrets are read from the Kubernetes API server using kuberos's service
+// account. Clusters that already have certificate-authority-data are
+// unchanged.
+func EmbedCertificateAuthorities(ctx context.Context, cfg *api.Config, hc *http.Client) error {
+	for name, c := range cfg.Clusters {
+		if c.CertificateAuthority == "" || len(c.CertificateAuthorityData) > 0 {
+			continue
+		}
+		ca, err := resolveCertificateAuthority(ctx, c.CertificateAuthority, hc)
+		if err != nil {
+			return errors.Wrapf(err, "cannot resolve certificate authority of cluster %s", name)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return errors.Errorf("certificate authority of cluster %s contains no PEM encoded certificates", name)
+		}
+		c.CertificateAuthorityData = ca
+		c.CertificateAuthority = ""
+	}
+	return nil
+}
+
+func resolveCertificateAuthority(ctx context.Context, ref string, hc *http.Client) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, caSchemeHTTPS):
+		return fetchCertificateAuthority(ctx, hc, ref, "")
+	case strings.HasPrefix(ref, caSchemeSecret):
+		return secretCertificateAuthority(ctx, strings.TrimPrefix(ref, caSchemeSecret))
+	default:
+		ca, err := afero.ReadFile(appFs, ref)
+		return ca, errors.Wrapf(err, "cannot read %s", ref)
+	}
+}
+
+// fetchCertificateAuthority returns the body of the supplied URL, presenting
+// the supplied bearer token if it is not empty.
+func fetchCertificateAuthority(ctx context.Context, hc *http.Client, url, token string) ([]byte, error) {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create request for %s", url)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := hc.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get %s", url)
+	}
+	defer rsp.Body.Close() // nolint: errcheck
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot get %s: %s", url, rsp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxCABytes))
+	return b, errors.Wrapf(err, "cannot read %s", url)
+}
+
+type secret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+// secretCertificateAuthority returns the CA certificate stored in the secret
+// referenced in the form NAMESPACE/NAME[/KEY], read from the Kubernetes API
+// server in whose cluster kuberos runs.
+func secretCertificateAuthority(ctx context.Context, ref string) ([]byte, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid secret reference %q: must be secret:NAMESPACE/NAME[/KEY]", caSchemeSecret+ref)
+	}
+	key := defaultCASecretKey
+	if len(parts) == 3 && parts[2] != "" {
+		key = parts[2]
+	}
+
+	host, port := os.Getenv(envServiceHost), os.Getenv(envServicePort)
+	if host == "" || port == "" {
+		return nil, errors.New("cannot read secrets: kuberos is not running in a Kubernetes cluster")
+	}
+	token, err := afero.ReadFile(appFs, filepath.Join(DefaultAPITokenMountPath, v1.ServiceAccountTokenKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read service account token")
+	}
+	rootCA, err := afero.ReadFile(appFs, filepath.Join(DefaultAPITokenMountPath, v1.ServiceAccountRootCAKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read service account CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootCA) {
+		return nil, errors.New("service account CA contains no PEM encoded certificates")
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	url := fmt.Sprintf("https://%s/api/v1/namespaces/%s/secrets/%s", net.JoinHostPort(host, port), parts[0], parts[1])
+	b, err := fetchCertificateAuthority(ctx, hc, url, strings.TrimSpace(string(token)))
+	if err != nil {
+		return nil, err
+	}
+	s := &secret{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode secret %s/%s", parts[0], parts[1])
+	}
+	ca, ok := s.Data[key]
+	if !ok {
+		return nil, errors.Errorf("secret %s/%s has no key %s", parts[0], parts[1], key)
+	}
+	return ca, nil
+}
@@ -0,0 +1,99 @@
+package kuberos
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestEmbedCertificateAuthorities(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	var ca []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ca.pem":
+			w.Write(ca) // nolint: errcheck, gas
+		case "/api/v1/namespaces/kuberos/secrets/ca":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(secret{Data: map[string][]byte{"ca.crt": ca}}) // nolint: errcheck, gas
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ca = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", srv.URL, err)
+	}
+	host, port, _ := net.SplitHostPort(u.Host) // nolint: gas
+	os.Setenv(envServiceHost, host)            // nolint: errcheck, gas
+	os.Setenv(envServicePort, port)            // nolint: errcheck, gas
+	defer os.Unsetenv(envServiceHost)          // nolint: errcheck
+	defer os.Unsetenv(envServicePort)          // nolint: errcheck
+
+	files := map[string][]byte{
+		"/etc/kuberos/ca.pem":                ca,
+		"/etc/kuberos/empty.pem":             []byte("not a certificate"),
+		DefaultAPITokenMountPath + "/token":  []byte("token\n"),
+		DefaultAPITokenMountPath + "/ca.crt": ca,
+	}
+	for name, b := range files {
+		if err := afero.WriteFile(appFs, name, b, 0600); err != nil {
+			t.Fatalf("afero.WriteFile(%v): %v", name, err)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{name: "File", ref: "/etc/kuberos/ca.pem"},
+		{name: "URL", ref: srv.URL + "/ca.pem"},
+		{name: "Secret", ref: "secret:kuberos/ca"},
+		{name: "SecretKey", ref: "secret:kuberos/ca/ca.crt"},
+		{name: "MissingFile", ref: "/etc/kuberos/missing.pem", wantErr: true},
+		{name: "NotPEM", ref: "/etc/kuberos/empty.pem", wantErr: true},
+		{name: "MissingURL", ref: srv.URL + "/missing.pem", wantErr: true},
+		{name: "MissingSecretKey", ref: "secret:kuberos/ca/tls.crt", wantErr: true},
+		{name: "InvalidSecret", ref: "secret:kuberos", wantErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &api.Config{Clusters: map[string]*api.Cluster{"a": {Server: "https://a", CertificateAuthority: tt.ref}}}
+			err := EmbedCertificateAuthorities(context.Background(), cfg, srv.Client())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("EmbedCertificateAuthorities(%v): want error", tt.ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EmbedCertificateAuthorities(%v): %v", tt.ref, err)
+			}
+			c := cfg.Clusters["a"]
+			if got, want := string(c.CertificateAuthorityData), string(ca); got != want {
+				t.Errorf("c.CertificateAuthorityData:\nwant %v\ngot %v\n", want, got)
+			}
+			if c.CertificateAuthority != "" {
+				t.Errorf("c.CertificateAuthority: want empty, got %v", c.CertificateAuthority)
+			}
+		})
+	}
+}
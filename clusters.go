@@ -0,0 +1,66 @@
+package kuberos
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const urlParamClusters = "clusters"
+
+// A ClustersResponse is returned by the clusters API.
+type ClustersResponse struct {
+	// Clusters are the sorted names of the clusters for which kuberos issues
+	// credentials, any subset of which may be requested via the clusters
+	// parameter.
+	Clusters []string `json:"clusters"`
+
+	// CurrentContext is the context kubectl uses by default, if any.
+	CurrentContext string `json:"currentContext,omitempty"`
+}
+
+// ClusterNames returns an HTTP handler that returns the names of the clusters
+// in the supplied kubecfg template as JSON.
+func ClusterNames(cfg *api.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, &ClustersResponse{Clusters: clusterNames(cfg), CurrentContext: cfg.CurrentContext})
+	}
+}
+
+// selectClusters returns a copy of the supplied kubecfg template containing
+// only the clusters requested via the clusters parameter of the supplied
+// request, which may be repeated or comma separated. The template is returned
+// unchanged if no clusters were requested. The current context is retained if
+// its cluster was requested, and is otherwise the first requested cluster.
+func selectClusters(cfg *api.Config, r *http.Request) (*api.Config, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, errors.Wrap(err, "cannot parse form")
+	}
+	names := []string{}
+	for _, v := range r.Form[urlParamClusters] {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return cfg, nil
+	}
+
+	c := *cfg
+	c.Clusters = make(map[string]*api.Cluster, len(names))
+	for _, n := range names {
+		cluster, ok := cfg.Clusters[n]
+		if !ok {
+			return nil, errors.Errorf("unknown cluster %q", n)
+		}
+		c.Clusters[n] = cluster
+	}
+	if _, ok := c.Clusters[c.CurrentContext]; !ok {
+		c.CurrentContext = names[0]
+	}
+	return &c, nil
+}
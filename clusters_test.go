@@ -0,0 +1,61 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestSelectClusters(t *testing.T) {
+	cfg := &api.Config{
+		CurrentContext: "a",
+		Clusters: map[string]*api.Cluster{
+			"a": &api.Cluster{Server: "https://a.example.org", CertificateAuthorityData: []byte("ca")},
+			"b": &api.Cluster{Server: "https://b.example.org", CertificateAuthorityData: []byte("ca")},
+			"c": &api.Cluster{Server: "https://c.example.org", CertificateAuthorityData: []byte("ca")},
+		},
+	}
+
+	cases := []struct {
+		name           string
+		clusters       []string
+		code           int
+		want           []string
+		currentContext string
+	}{
+		{name: "All", code: http.StatusOK, want: []string{"a", "b", "c"}, currentContext: "a"},
+		{name: "CommaSeparated", clusters: []string{"b, c"}, code: http.StatusOK, want: []string{"b", "c"}, currentContext: "b"},
+		{name: "Repeated", clusters: []string{"c", "a"}, code: http.StatusOK, want: []string{"a", "c"}, currentContext: "a"},
+		{name: "Unknown", clusters: []string{"a,d"}, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{"email": {"example@example.org"}, "idToken": {"token"}, urlParamClusters: tt.clusters}
+			w := httptest.NewRecorder()
+			Template(cfg)(w, httptest.NewRequest("GET", "/kubecfg.yaml?"+q.Encode(), nil))
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			got, err := clientcmd.Load(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("clientcmd.Load(...): %v", err)
+			}
+			if diff := deep.Equal(clusterNames(got), tt.want); diff != nil {
+				t.Errorf("clusters: want != got %v", diff)
+			}
+			if got.CurrentContext != tt.currentContext {
+				t.Errorf("got.CurrentContext:\nwant %v\ngot %v\n", tt.currentContext, got.CurrentContext)
+			}
+		})
+	}
+}
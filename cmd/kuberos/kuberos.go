@@ -1,55 +1,288 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"io"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/negz/kuberos"
 	"github.com/negz/kuberos/extractor"
+	"github.com/negz/kuberos/metrics"
 	"github.com/rakyll/statik/fs"
 
 	_ "github.com/negz/kuberos/statik"
 
+	"github.com/Masterminds/sprig"
 	oidc "github.com/coreos/go-oidc"
+	"github.com/ghodss/yaml"
+	"github.com/go-redis/redis"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/oauth2"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
-const indexPath = "/index.html"
+const (
+	indexPath  = "/index.html"
+	eventsPath = "/api/v1/admin/events"
 
+	offlineAuto       = "auto"
+	offlineScope      = "scope"
+	offlineAccessType = "access-type"
+
+	hashCheckWarn     = "warn"
+	hashCheckEnforce  = "enforce"
+	hashCheckDisabled = "disabled"
+
+	logFormatJSON = "json"
+	logFormatText = "text"
+
+	sessionStoreCookie = "cookie"
+	sessionStoreMemory = "memory"
+	sessionStoreRedis  = "redis"
+
+	headerRequestID    = "X-Request-Id"
+	requestIDMaxLength = 128
+)
+
+// A discoveryDocument contains the fields kuberos reads from an OIDC
+// provider's discovery document, beyond those read by go-oidc.
+type discoveryDocument struct {
+	JWKSURI                     string `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	IntrospectionEndpoint       string `json:"introspection_endpoint"`
+	RevocationEndpoint          string `json:"revocation_endpoint"`
+	RegistrationEndpoint        string `json:"registration_endpoint"`
+	EndSessionEndpoint          string `json:"end_session_endpoint"`
+	MTLSEndpointAliases         struct {
+		TokenEndpoint               string `json:"token_endpoint"`
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+		IntrospectionEndpoint       string `json:"introspection_endpoint"`
+		RevocationEndpoint          string `json:"revocation_endpoint"`
+	} `json:"mtls_endpoint_aliases"`
+}
+
+// logRequests logs each request, annotated with a request ID. The ID is read
+// from the X-Request-Id header if the request has a valid one, and generated
+// otherwise. It is returned in the response's X-Request-Id header, and
+// attached to the logger supplied to handlers via the request context.
 func logRequests(h http.Handler, log *zap.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Info("request",
+		id := r.Header.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(headerRequestID, id)
+		l := log.With(zap.String("requestID", id))
+		l.Info("request",
 			zap.String("host", r.Host),
 			zap.String("method", r.Method),
-			zap.String("url", r.URL.String()),
+			zap.String("path", r.URL.Path),
 			zap.String("agent", r.UserAgent()),
 			zap.String("addr", r.RemoteAddr))
-		log.Debug("request", zap.Any("headers", r.Header))
-		h.ServeHTTP(w, r)
+		h.ServeHTTP(w, r.WithContext(extractor.WithLogger(r.Context(), l)))
 	})
 }
 
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMaxLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b) // nolint: errcheck, gas
+	return hex.EncodeToString(b)
+}
+
+// newLogger returns a logger that writes JSON or human readable text at the
+// supplied level.
+func newLogger(format, level string) (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
+	if format == logFormatText {
+		cfg = zap.NewDevelopmentConfig()
+	}
+	if err := cfg.Level.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse log level %q", level)
+	}
+	return cfg.Build()
+}
+
 func main() {
 	var (
-		app         = kingpin.New(filepath.Base(os.Args[0]), "Provides OIDC authentication configuration for kubectl.").DefaultEnvars()
-		listen      = app.Flag("listen", "Address at which to expose HTTP webhook.").Default(":10003").String()
-		debug       = app.Flag("debug", "Run with debug logging.").Short('d').Bool()
-		scopes      = app.Flag("scopes", "List of additional scopes to provide in token.").Default("profile", "email").Strings()
-		emailDomain = app.Flag("email-domain", "The eamil domain to restrict access to.").String()
+		app             = kingpin.New(filepath.Base(os.Args[0]), "Provides OIDC authentication configuration for kubectl.").DefaultEnvars()
+		listen          = app.Flag("listen", "Address at which to expose HTTP webhook.").Default(":10003").String()
+		listenUnix      = app.Flag("listen-unix", "Path of a unix domain socket at which to expose HTTP webhook, instead of --listen. Peers on the socket are trusted proxies.").String()
+		listenUnixMode  = app.Flag("listen-unix-mode", "Octal file mode of --listen-unix.").Default("0660").String()
+		basePath        = app.Flag("base-path", "Path under which to serve kuberos, e.g. /kuberos/ when sharing an ingress. All routes, including /healthz and /metrics, are served under this path.").Default("/").String()
+		tlsCert         = app.Flag("tls-cert", "File containing a PEM encoded TLS certificate with which to serve HTTPS. Reloaded when modified.").ExistingFile()
+		tlsKey          = app.Flag("tls-key", "File containing the PEM encoded private key of --tls-cert.").ExistingFile()
+		tlsClientCA     = app.Flag("tls-client-ca-file", "File containing PEM encoded CA certificates. Clients must present a TLS certificate signed by one of them. Requires TLS.").ExistingFile()
+		tlsClientNames  = app.Flag("tls-client-allowed-name", "Common name or subject alternative name to which client certificates must be issued. May be repeated. Defaults to any name.").Strings()
+		tlsReload       = app.Flag("tls-reload-interval", "How often to check whether --tls-cert or --tls-key have been modified.").Default(kuberos.DefaultCertificateReloadInterval.String()).Duration()
+		acmeHosts       = app.Flag("acme-host", "Public hostname for which to obtain and renew a TLS certificate from an ACME CA such as Let's Encrypt. May be repeated. Incompatible with --tls-cert.").Strings()
+		acmeEmail       = app.Flag("acme-email", "Contact email address with which to register with the ACME CA.").String()
+		acmeCache       = app.Flag("acme-cache-dir", "Directory in which to cache ACME certificates and account keys. Should be persistent.").Default("acme").String()
+		acmeDirectory   = app.Flag("acme-directory-url", "ACME CA directory URL.").Default(autocert.DefaultACMEDirectory).String()
+		acmeHTTP        = app.Flag("acme-http-listen", "Address at which to answer ACME HTTP-01 challenges and redirect HTTP to HTTPS, e.g. :80. TLS-ALPN-01 challenges are answered at --listen regardless.").String()
+		serveH2C        = app.Flag("h2c", "Serve HTTP/2 without TLS (h2c), e.g. behind a service mesh. HTTP/2 is always served when TLS is enabled.").Bool()
+		pprofListen     = app.Flag("pprof-listen", "Address, e.g. localhost:6060, at which to serve net/http/pprof profiles for debugging. Must not be reachable by end users. Disabled if unset.").String()
+		readHdrTimeout  = app.Flag("read-header-timeout", "Maximum time to wait for a client to send request headers.").Default("10s").Duration()
+		readTimeout     = app.Flag("read-timeout", "Maximum time to wait for a client to send a request, including its body.").Default("30s").Duration()
+		writeTimeout    = app.Flag("write-timeout", "Maximum time to spend handling a request and writing its response. Must exceed --idp-timeout.").Default("2m").Duration()
+		idleTimeout     = app.Flag("idle-timeout", "Maximum time to keep idle keep-alive connections open.").Default("2m").Duration()
+		reqTimeout      = app.Flag("request-timeout", "Maximum time to spend handling a request before responding 504 Gateway Timeout. Must exceed --idp-timeout and be less than --write-timeout. Zero disables.").Default(kuberos.DefaultRequestTimeout.String()).Duration()
+		maxHeaderBytes  = app.Flag("max-header-bytes", "Maximum size of request headers.").Default("16KiB").Bytes()
+		maxBodyBytes    = app.Flag("max-body-bytes", "Maximum size of request bodies. Zero disables.").Default("64KiB").Bytes()
+		maxURLLength    = app.Flag("max-url-length", "Maximum length of request URLs, including the query string. Zero disables.").Default(strconv.Itoa(kuberos.DefaultRequestLimits.MaxURLLength)).Int()
+		hstsMaxAge      = app.Flag("hsts-max-age", "Max age of the Strict-Transport-Security header set on HTTPS responses. Zero disables.").Default(kuberos.DefaultSecurityHeaders.HSTSMaxAge.String()).Duration()
+		csp             = app.Flag("content-security-policy", "Content-Security-Policy header to set on all responses, excluding frame-ancestors. Empty disables.").Default(kuberos.DefaultSecurityHeaders.ContentSecurityPolicy).String()
+		frameAncestors  = app.Flag("frame-ancestors", "Sources that may frame kuberos, per the Content-Security-Policy frame-ancestors directive. Empty disables.").Default(kuberos.DefaultSecurityHeaders.FrameAncestors).String()
+		referrerPolicy  = app.Flag("referrer-policy", "Referrer-Policy header to set on all responses. Empty disables.").Default(kuberos.DefaultSecurityHeaders.ReferrerPolicy).String()
+		compress        = app.Flag("compress", "Compress HTML, JSON, YAML, and frontend asset responses using gzip when clients accept it.").Bool()
+		headless        = app.Flag("headless", "Serve only the JSON API, login, and logout endpoints, without the HTML frontend, for developer portals that present their own. Requires --redirect-url.").Bool()
+		redirect        = app.Flag("redirect-url", "URL of the developer portal page to which the OIDC provider returns users when --headless. The page must complete the flow via /api/v1/kubeconfig.").URL()
+		corsOrigins     = app.Flag("cors-allowed-origin", "Origin, e.g. https://portal.example.org, that may call the JSON API cross-origin. May be repeated. * allows any origin, but not with --cors-allow-credentials.").Strings()
+		corsCredentials = app.Flag("cors-allow-credentials", "Allow cross-origin JSON API requests to include cookies.").Bool()
+		corsMaxAge      = app.Flag("cors-max-age", "How long browsers may cache CORS preflight responses.").Default(kuberos.DefaultCORSMaxAge.String()).Duration()
+		debug           = app.Flag("debug", "Run with debug logging. Equivalent to --log-level=debug.").Short('d').Bool()
+		logFormat       = app.Flag("log-format", "Format in which to write logs.").Default(logFormatJSON).Enum(logFormatJSON, logFormatText)
+		logLevel        = app.Flag("log-level", "Minimum level of logs to write.").Default("info").Enum("debug", "info", "warn", "error")
+		traceContext    = app.Flag("trace-context", "Continue W3C traces identified by the traceparent header of requests, propagating them to the OIDC provider. Spans are logged at debug level.").Bool()
+		scopes          = app.Flag("scopes", "List of additional scopes to provide in token.").Default("profile", "email").Strings()
+		reqScopes       = app.Flag("requestable-scope", "Additional scope that users may request via the scope query parameter. May be repeated.").Strings()
+		returnTo        = app.Flag("return-to-prefix", "URL prefix, e.g. https://portal.example.org/, to which users may be returned via the return_to query parameter once authenticated. May be repeated.").Strings()
+		catalogDir      = app.Flag("message-catalog-dir", "Directory of JSON message catalogs named for their language, e.g. de.json, in which to present the frontend and error pages per the Accept-Language header.").ExistingDir()
+		defaultLang     = app.Flag("default-language", "Language in which to present the frontend and error pages when no message catalog matches the Accept-Language header.").Default(kuberos.DefaultLanguage).String()
+		assetsDir       = app.Flag("assets-dir", "Directory of frontend assets, e.g. index.html or dist/logo.png, to serve in place of or in addition to those embedded in kuberos.").ExistingDir()
+		errorTemplate   = app.Flag("error-page-template", "File containing a Go HTML template with which to render error pages, in place of the default. Sprig functions are available.").ExistingFile()
+		providersTmpl   = app.Flag("provider-index-template", "File containing a Go HTML template with which to render the list of OIDC providers at /login, in place of the default. Sprig functions are available.").ExistingFile()
+		clusterNameTmpl = app.Flag("cluster-name-template", "Go template with which to name the clusters of issued kubeconfigs, e.g. {{ .ClusterShortName }}. Defaults to the cluster's name in the kubecfg template.").String()
+		contextNameTmpl = app.Flag("context-name-template", "Go template with which to name the contexts of issued kubeconfigs, e.g. {{ .ClusterShortName }}-{{ .Username }}. Defaults to the cluster's name in the kubecfg template.").String()
+		userNameTmpl    = app.Flag("user-name-template", "Go template with which to name the users of issued kubeconfigs, e.g. {{ .ClusterShortName }}-{{ .Username }}. Defaults to the username.").String()
+		devMode         = app.Flag("dev-mode", "Reload index.html from --assets-dir whenever it is modified, so the frontend may be iterated upon without restarting kuberos. Not for production use.").Bool()
+		assetMaxAge     = app.Flag("asset-max-age", "How long browsers may cache frontend assets referenced by index.html, whose URLs change with their content. Other assets are revalidated before each use.").Default(kuberos.DefaultAssetMaxAge.String()).Duration()
+		brandName       = app.Flag("brand-org-name", "Name of the organisation to present alongside kuberos.").String()
+		brandLogo       = app.Flag("brand-logo-url", "HTTPS URL or path of a logo to present in place of kuberos's own. Other hosts must be allowed by --content-security-policy.").String()
+		brandPrimary    = app.Flag("brand-primary-color", "CSS hex color, e.g. #326ce5, of headings, links, and buttons.").String()
+		brandBackground = app.Flag("brand-background-color", "CSS hex color of the page background.").String()
+		brandSupport    = app.Flag("brand-support-url", "HTTP, HTTPS, or mailto URL at which users may get help, e.g. a chat channel.").String()
+		offline         = app.Flag("offline-access", "How to request a refresh token: via the offline_access scope, via Google's access_type=offline parameter, or auto to detect from the OIDC provider's supported scopes.").Default(offlineAuto).Enum(offlineAuto, offlineScope, offlineAccessType)
+		emailDomain     = app.Flag("email-domain", "The eamil domain to restrict access to.").String()
+		allowedGroups   = app.Flag("allowed-group", "Group whose members may obtain a kubeconfig. May be repeated. Defaults to all authenticated users.").Strings()
+		auditLogFile    = app.Flag("audit-log-file", "File to which to append a JSON audit record of each kubeconfig issued and authentication failure, or - for stdout.").String()
+		downloadTTL     = app.Flag("download-link-ttl", "Return a single-use link from which the kubeconfig may be downloaded within this duration, e.g. from another device. Zero disables.").Duration()
+		webhookURL      = app.Flag("webhook-url", "URL to which to POST a JSON event whenever a kubeconfig is issued or authentication fails.").URL()
+		webhookKey      = app.Flag("webhook-secret-file", "File containing the key with which to sign webhook events using HMAC-SHA256.").ExistingFile()
+		webhookAttempts = app.Flag("webhook-attempts", "Maximum number of attempts to send each webhook event.").Default(strconv.Itoa(kuberos.DefaultWebhookAttempts)).Int()
+		adminTokenFile  = app.Flag("admin-token-file", "File containing a bearer token that grants access to the admin API. The admin API is disabled if unset.").ExistingFile()
+		adminRetention  = app.Flag("admin-audit-retention", "Number of recent audit events retained in memory for the admin API.").Default(strconv.Itoa(kuberos.DefaultAuditStoreSize)).Int()
+		allowedDomains  = app.Flag("allowed-email-domain", "Email domain whose users may obtain a kubeconfig regardless of their groups, if their email address is verified. May be repeated.").Strings()
+		groupsClaim     = app.Flag("groups-claim", "ID token claim from which to read the user's groups. Must match the API server's --oidc-groups-claim.").Default(extractor.DefaultGroupsClaim).String()
+		ipRateLimit     = app.Flag("ip-rate-limit", "Maximum login, callback, refresh, and device flow requests per minute from each client IP address. Zero disables.").Int()
+		subRateLimit    = app.Flag("subject-rate-limit", "Maximum authentications per minute by each user. Zero disables.").Int()
+		lockoutFailures = app.Flag("lockout-failures", "Lock out client IP addresses and users after this many authentication failures within --lockout-window. Zero disables.").Int()
+		lockoutWindow   = app.Flag("lockout-window", "Window within which authentication failures count towards a lockout.").Default(kuberos.DefaultLockoutWindow.String()).Duration()
+		lockoutDuration = app.Flag("lockout-duration", "How long to lock out client IP addresses and users.").Default(kuberos.DefaultLockoutDuration.String()).Duration()
+		allowCIDRs      = app.Flag("allow-cidr", "Network, e.g. 10.0.0.0/8, from which login and API requests are allowed. May be repeated. Defaults to all networks.").Strings()
+		denyCIDRs       = app.Flag("deny-cidr", "Network from which login and API requests are denied, even if allowed by --allow-cidr. May be repeated.").Strings()
+		trustedProxies  = app.Flag("trusted-proxy-cidr", "Network of a proxy, e.g. an ingress controller, whose X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host, and X-Forwarded-Prefix headers are trusted. These headers are ignored when sent by other clients, and from all clients if no proxy is trusted. May be repeated.").Strings()
+		stateKeyFile    = app.Flag("state-key-file", "File containing the key with which to sign state parameters. Replicas must share a key. Derived from the client secret by default.").ExistingFile()
+		stateTTL        = app.Flag("state-ttl", "How long users have to authenticate with the OIDC provider after logging in.").Default(kuberos.DefaultStateTTL.String()).Duration()
+		sessionKeyFiles = app.Flag("session-key-file", "File containing a key with which to encrypt session cookies. May be repeated to rotate keys; the first encrypts new sessions. Derived from the client secret by default.").ExistingFiles()
+		sessionStore    = app.Flag("session-store", "Where to store in-flight authentication flows: in the session cookie, in process memory, or in Redis.").Default(sessionStoreCookie).Enum(sessionStoreCookie, sessionStoreMemory, sessionStoreRedis)
+		redisAddr       = app.Flag("redis-address", "Address (host:port) of the Redis server in which to store sessions.").Default("localhost:6379").String()
+		redisPassword   = app.Flag("redis-password-file", "File containing the password of the Redis server in which to store sessions.").ExistingFile()
+		redisDB         = app.Flag("redis-db", "Redis database in which to store sessions.").Int()
+		pkce            = app.Flag("pkce", "Use PKCE (RFC 7636) when requesting an authorization code.").Bool()
+		publicClient    = app.Flag("public-client", "The OAuth2 client is registered as a public client. Omit the client secret from kubeconfigs and the frontend rather than distributing it to every user. Implies --pkce.").Bool()
+		introspect      = app.Flag("introspect", "Validate tokens using the OIDC provider's introspection endpoint rather than verifying the ID token locally.").Bool()
+		userInfo        = app.Flag("userinfo", "Query the OIDC provider's UserInfo endpoint for claims absent from the ID token.").Bool()
+		audiences       = app.Flag("audience", "Additional acceptable ID token audience. May be repeated. The client ID is always acceptable.").Strings()
+		requireAZP      = app.Flag("require-azp", "Reject ID tokens without an authorized party (azp) claim matching the client ID.").Bool()
+		requireACR      = app.Flag("require-acr", "Reject ID tokens whose acr claim is not one of these values. May be repeated.").Strings()
+		requireAMR      = app.Flag("require-amr", "Reject ID tokens whose amr claim does not include this value (e.g. mfa). May be repeated.").Strings()
+		hostedDomains   = app.Flag("hosted-domain", "Reject ID tokens whose Google hosted domain (hd) claim is not one of these values. May be repeated.").Strings()
+		verifiedEmail   = app.Flag("require-verified-email", "Reject ID tokens whose email_verified claim is not true when the username is read from the email claim.").Bool()
+		maxLifetime     = app.Flag("max-token-lifetime", "Reject ID tokens valid for longer than this duration.").Duration()
+		noRefresh       = app.Flag("disallow-refresh-tokens", "Never request or hand out refresh tokens.").Bool()
+		retries         = app.Flag("token-retries", "Maximum number of attempts to make when token endpoint requests fail due to transient errors.").Default(strconv.Itoa(extractor.DefaultRetryPolicy.MaxAttempts)).Int()
+		idpCAFile       = app.Flag("idp-ca-file", "File containing PEM encoded CA certificates to trust when connecting to the OIDC provider.").ExistingFile()
+		idpCA           = app.Flag("idp-ca", "PEM encoded CA certificates to trust when connecting to the OIDC provider.").String()
+		idpCertFile     = app.Flag("idp-client-cert-file", "File containing a PEM encoded TLS client certificate to present to the OIDC provider.").ExistingFile()
+		idpKeyFile      = app.Flag("idp-client-key-file", "File containing the PEM encoded private key of --idp-client-cert-file.").ExistingFile()
+		tlsClientAuth   = app.Flag("tls-client-auth", "Authenticate to the OIDC provider using the TLS client certificate (RFC 8705) rather than the client secret.").Bool()
+		idpProxy        = app.Flag("idp-proxy", "HTTP proxy through which to connect to the OIDC provider. Defaults to the HTTP_PROXY and HTTPS_PROXY environment variables.").URL()
+		idpNoProxy      = app.Flag("idp-no-proxy", "Host, domain, IP, or CIDR to connect to directly rather than via --idp-proxy. May be repeated.").Strings()
+		idpProxies      = app.Flag("idp-proxy-override", "Proxy to use for a particular host, e.g. accounts.google.com=http://proxy:3128. May be repeated.").StringMap()
+		idpTimeout      = app.Flag("idp-timeout", "Maximum duration of requests to the OIDC provider.").Default(extractor.DefaultHTTPTimeout.String()).Duration()
+		idpDialTimeout  = app.Flag("idp-dial-timeout", "Maximum time to wait to connect to the OIDC provider.").Default(extractor.DefaultDialTimeout.String()).Duration()
+		idpTLSTimeout   = app.Flag("idp-tls-handshake-timeout", "Maximum time to wait for a TLS handshake with the OIDC provider.").Default(extractor.DefaultTLSHandshakeTimeout.String()).Duration()
+		idpRspTimeout   = app.Flag("idp-response-header-timeout", "Maximum time to wait for the OIDC provider's response headers.").Default(extractor.DefaultResponseHeaderTimeout.String()).Duration()
+		idpIdleConns    = app.Flag("idp-max-idle-conns", "Maximum number of idle connections to the OIDC provider to keep open.").Default(strconv.Itoa(extractor.DefaultMaxIdleConns)).Int()
+		atClaims        = app.Flag("access-token-claim", "Claim to merge from the access token, which must be a JWT, when absent from the ID token. May be repeated.").Strings()
+		atAudience      = app.Flag("access-token-audience", "Audience for which the OIDC provider issues access tokens. Defaults to the client ID.").String()
+		claimSources    = app.Flag("claim-source-issuer", "Issuer URL of a trusted provider of aggregated or distributed claims. May be repeated.").Strings()
+		azureOverage    = app.Flag("azure-group-overage", "Resolve Azure AD group memberships via Microsoft Graph when the groups claim is omitted due to a groups overage.").Bool()
+		keycloakRoles   = app.Flag("keycloak-roles", "Add the roles in Keycloak's realm_access and resource_access claims to the user's groups.").Bool()
+		keycloakRealm   = app.Flag("keycloak-realm-role-prefix", "Prefix to prepend to Keycloak realm roles.").String()
+		keycloakPrefix  = app.Flag("keycloak-client-role-prefix", "Prefix to prepend to Keycloak client roles, which are formatted as <client>:<role>.").String()
+		keycloakClients = app.Flag("keycloak-client", "Keycloak client whose roles should be added to the user's groups. May be repeated. Defaults to all clients.").Strings()
+		decryptionKeys  = app.Flag("id-token-decryption-keys", "File containing a JSON Web Key Set or PEM encoded private keys with which to decrypt encrypted ID tokens.").ExistingFile()
+		clientKey       = app.Flag("client-assertion-key", "File containing a JSON Web Key Set or PEM encoded private key with which to sign JWT client assertions (private_key_jwt) rather than authenticating using the client secret. Reloaded when modified.").ExistingFile()
+		hashCheck       = app.Flag("token-hash-check", "How to handle ID tokens whose at_hash or c_hash claims do not match the access token or authorization code.").Default(hashCheckWarn).Enum(hashCheckWarn, hashCheckEnforce, hashCheckDisabled)
+		jwksTTL         = app.Flag("jwks-refresh-interval", "How often to refresh the OIDC provider's cached signing keys in the background.").Default(extractor.DefaultKeySetTTL.String()).Duration()
+		clockSkew       = app.Flag("clock-skew", "Tolerated clock difference between kuberos and the OIDC provider when validating ID token timestamps.").Default(extractor.DefaultClockSkew.String()).Duration()
+		extractorName   = app.Flag("extractor", "Extractor with which to process authentication responses.").Default(extractor.NameOIDC).Enum(extractor.Registered()...)
+		extractorParams = app.Flag("extractor-param", "Configuration parameter for bespoke extractors, e.g. key=value. May be repeated.").StringMap()
+		userTemplate    = app.Flag("username-template", "Go template over the ID token claims from which to derive the username, e.g. {{ .upn | lower }}. Overrides --username-claim.").String()
+		groupsTemplate  = app.Flag("groups-template", "Go template over the ID token claims from which to derive the user's groups, one per line. Overrides --groups-claim.").String()
+		userClaim       = app.Flag("username-claim", "ID token claim to use as the Kubernetes username. Must match the API server's --oidc-username-claim.").Default(extractor.DefaultUsernameClaim).String()
+		nsClaim         = app.Flag("namespace-claim", "ID token claim from which to read the namespace in which the user works by default, e.g. team.").String()
+		groupNamespaces = app.Flag("group-namespace", "Namespace in which members of a group work by default, e.g. team-payments=payments. May be repeated. Overridden by --namespace-claim.").StringMap()
+
+		regFile      = app.Flag("registration-file", "File in which to persist OAuth2 client credentials registered with the OIDC provider. Kuberos registers a client at startup if the file does not exist, and ignores the client-id and client-secret-file arguments.").String()
+		regRedirects = app.Flag("registration-redirect-uri", "Redirect URI to register for the OAuth2 client, e.g. https://kuberos.example.org/ui. May be repeated.").Strings()
+		regToken     = app.Flag("registration-token", "Initial access token with which to authenticate OAuth2 client registration.").String()
+
+		providersFile = app.Flag("providers-file", "YAML file listing additional named OIDC providers, each with a name, issuer, clientID, and clientSecretFile. Users log in with a named provider at /login/<name>.").ExistingFile()
 
-		grace            = app.Flag("shutdown-grace-period", "Wait this long for sessions to end before shutting down.").Default("1m").Duration()
+		grace            = app.Flag("shutdown-grace-period", "Wait this long for in-flight requests, e.g. OIDC callbacks, to complete before shutting down.").Default("1m").Duration()
+		shutdownDelay    = app.Flag("shutdown-delay", "Wait this long after reporting unready before refusing new connections, giving load balancers time to stop routing to kuberos.").Default("0s").Duration()
 		shutdownEndpoint = app.Flag("shutdown-endpoint", "Insecure HTTP endpoint path (e.g., /quitquitquit) that responds to a GET to shut down kuberos.").String()
 
 		issuerURL        = app.Arg("oidc-issuer-url", "OpenID Connect issuer URL.").URL()
@@ -60,79 +293,870 @@ func main() {
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	var log *zap.Logger
-	log, err := zap.NewProduction()
 	if *debug {
-		log, err = zap.NewDevelopment()
+		*logLevel = "debug"
 	}
+	log, err := newLogger(*logFormat, *logLevel)
 	kingpin.FatalIfError(err, "cannot create log")
 
-	clientSecret, err := ioutil.ReadFile(*clientSecretFile)
-	kingpin.FatalIfError(err, "cannot read client secret file")
+	var clientSecret []byte
+	if *clientSecretFile != "" {
+		clientSecret, err = ioutil.ReadFile(*clientSecretFile)
+		kingpin.FatalIfError(err, "cannot read client secret file")
+	}
 
-	ctx := oidc.ClientContext(context.Background(), http.DefaultClient)
-	provider, err := oidc.NewProvider(ctx, (*issuerURL).String())
-	kingpin.FatalIfError(err, "cannot create OIDC provider from issuer %v", *issuerURL)
-	log.Debug("established OIDC provider", zap.String("url", provider.Endpoint().TokenURL))
+	to := []extractor.TransportOption{
+		extractor.Timeout(*idpTimeout),
+		extractor.DialTimeout(*idpDialTimeout),
+		extractor.TLSHandshakeTimeout(*idpTLSTimeout),
+		extractor.ResponseHeaderTimeout(*idpRspTimeout),
+		extractor.MaxIdleConns(*idpIdleConns),
+	}
+	if *idpCAFile != "" {
+		ca, err := ioutil.ReadFile(*idpCAFile)
+		kingpin.FatalIfError(err, "cannot read OIDC provider CA file")
+		to = append(to, extractor.RootCAs(ca))
+	}
+	if *idpCA != "" {
+		to = append(to, extractor.RootCAs([]byte(*idpCA)))
+	}
+	if *idpCertFile != "" || *idpKeyFile != "" {
+		cert, err := ioutil.ReadFile(*idpCertFile)
+		kingpin.FatalIfError(err, "cannot read OIDC provider client certificate file")
+		key, err := ioutil.ReadFile(*idpKeyFile)
+		kingpin.FatalIfError(err, "cannot read OIDC provider client key file")
+		to = append(to, extractor.ClientCertificate(cert, key))
+	}
+	if *idpProxy != nil || len(*idpProxies) > 0 {
+		pc := extractor.ProxyConfig{URL: *idpProxy, NoProxy: *idpNoProxy, Overrides: map[string]*url.URL{}}
+		for host, raw := range *idpProxies {
+			u, err := url.Parse(raw)
+			kingpin.FatalIfError(err, "cannot parse proxy URL for host %s", host)
+			pc.Overrides[host] = u
+		}
+		to = append(to, extractor.Proxy(pc))
+	}
+	hc, err := extractor.NewHTTPClient(to...)
+	kingpin.FatalIfError(err, "cannot create OIDC provider HTTP client")
+	tracer := kuberos.Tracer{Log: log}
+	if *traceContext {
+		hc.Transport = tracer.Transport(hc.Transport)
+	}
 
-	sr := kuberos.ScopeRequests{OfflineAsScope: kuberos.OfflineAsScope(provider), Scopes: *scopes}
-	cfg := &oauth2.Config{
-		ClientID:     *clientID,
-		ClientSecret: strings.TrimSpace(string(clientSecret)),
-		Endpoint:     provider.Endpoint(),
-		Scopes:       sr.Get(),
+	tmpl, err := kuberos.LoadKubeCfgTemplate(*templateFile)
+	kingpin.FatalIfError(err, "cannot load kubecfg template %s", *templateFile)
+	kingpin.FatalIfError(kuberos.EmbedCertificateAuthorities(context.Background(), tmpl, hc), "cannot embed certificate authorities")
+	if *clusterNameTmpl != "" || *contextNameTmpl != "" || *userNameTmpl != "" {
+		n, err := kuberos.ParseNaming(*clusterNameTmpl, *contextNameTmpl, *userNameTmpl)
+		kingpin.FatalIfError(err, "cannot parse naming templates")
+		n.Apply(tmpl)
 	}
-	e, err := extractor.NewOIDC(provider.Verifier(&oidc.Config{ClientID: *clientID}), extractor.Logger(log), extractor.EmailDomain(*emailDomain))
-	kingpin.FatalIfError(err, "cannot setup OIDC extractor")
 
-	h, err := kuberos.NewHandlers(cfg, e, kuberos.Logger(log))
-	kingpin.FatalIfError(err, "cannot setup HTTP handlers")
+	prefix := path.Join("/", *basePath)
+	ho := []kuberos.Option{kuberos.Logger(log), kuberos.HTTPClient(hc), kuberos.RequestableScopes(*reqScopes...), kuberos.ReturnTo(*returnTo...), kuberos.StateTTL(*stateTTL), kuberos.BasePath(prefix)}
+	if *stateKeyFile != "" {
+		key, err := ioutil.ReadFile(*stateKeyFile)
+		kingpin.FatalIfError(err, "cannot read state key file")
+		ho = append(ho, kuberos.StateKey(key))
+	}
+	if len(*sessionKeyFiles) > 0 {
+		keys := make([][]byte, 0, len(*sessionKeyFiles))
+		for _, f := range *sessionKeyFiles {
+			key, err := ioutil.ReadFile(f)
+			kingpin.FatalIfError(err, "cannot read session key file")
+			keys = append(keys, key)
+		}
+		ho = append(ho, kuberos.SessionKeys(keys...))
+	}
+	switch *sessionStore {
+	case sessionStoreMemory:
+		ho = append(ho, kuberos.Sessions(kuberos.NewMemorySessionStore()))
+	case sessionStoreRedis:
+		ro := &redis.Options{Addr: *redisAddr, DB: *redisDB}
+		if *redisPassword != "" {
+			pw, err := ioutil.ReadFile(*redisPassword)
+			kingpin.FatalIfError(err, "cannot read Redis password file")
+			ro.Password = strings.TrimSpace(string(pw))
+		}
+		rc := redis.NewClient(ro)
+		kingpin.FatalIfError(rc.Ping().Err(), "cannot connect to Redis")
+		ho = append(ho, kuberos.Sessions(kuberos.NewRedisSessionStore(rc)))
+	}
+	if *noRefresh {
+		// Don't request offline access via Google's access_type parameter.
+		ho = append(ho, kuberos.AuthCodeOptions(nil))
+	}
+	if *pkce {
+		ho = append(ho, kuberos.PKCE())
+	}
+	if *publicClient {
+		ho = append(ho, kuberos.PublicClient())
+	}
+	if *auditLogFile != "" {
+		f := os.Stdout
+		if *auditLogFile != "-" {
+			f, err = os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			kingpin.FatalIfError(err, "cannot open audit log file")
+		}
+		ho = append(ho, kuberos.Audit(kuberos.NewWriterAuditSink(f, log)))
+	}
+	var wh *kuberos.Webhook
+	if *webhookURL != nil {
+		if *webhookKey == "" {
+			kingpin.Fatalf("--webhook-url requires --webhook-secret-file")
+		}
+		key, err := ioutil.ReadFile(*webhookKey)
+		kingpin.FatalIfError(err, "cannot read webhook secret file")
+		wh = kuberos.NewWebhook((*webhookURL).String(), bytes.TrimSpace(key),
+			kuberos.WebhookRetries(*webhookAttempts, kuberos.DefaultWebhookBackoff),
+			kuberos.WebhookLogger(log))
+		ho = append(ho, kuberos.Audit(wh))
+	}
+	var adminToken []byte
+	var auditStore *kuberos.AuditStore
+	if *adminTokenFile != "" {
+		adminToken, err = ioutil.ReadFile(*adminTokenFile)
+		kingpin.FatalIfError(err, "cannot read admin token file")
+		if adminToken = bytes.TrimSpace(adminToken); len(adminToken) == 0 {
+			kingpin.Fatalf("admin token file %s is empty", *adminTokenFile)
+		}
+		if *adminRetention < 1 {
+			kingpin.Fatalf("--admin-audit-retention must be at least 1")
+		}
+		auditStore = kuberos.NewAuditStore(*adminRetention)
+		ho = append(ho, kuberos.Audit(auditStore))
+	}
+	ho = append(ho, kuberos.Clusters(tmpl))
+	catalogs := map[string]kuberos.Catalog{}
+	if *catalogDir != "" {
+		catalogs, err = kuberos.LoadCatalogs(*catalogDir)
+		kingpin.FatalIfError(err, "cannot load message catalogs")
+	}
+	loc, err := kuberos.NewLocalizer(*defaultLang, catalogs)
+	kingpin.FatalIfError(err, "cannot create localizer")
+	ho = append(ho, kuberos.Localize(loc))
+	brand := kuberos.Branding{
+		OrgName:         *brandName,
+		LogoURL:         *brandLogo,
+		PrimaryColor:    *brandPrimary,
+		BackgroundColor: *brandBackground,
+		SupportURL:      *brandSupport,
+	}
+	kingpin.FatalIfError(brand.Validate(), "invalid branding")
+	ho = append(ho, kuberos.Brand(brand))
+	if *errorTemplate != "" {
+		t, err := ioutil.ReadFile(*errorTemplate)
+		kingpin.FatalIfError(err, "cannot read error page template")
+		ho = append(ho, kuberos.ErrorPageTemplate(string(t)))
+	}
+	pt := providerIndexTemplate
+	if *providersTmpl != "" {
+		t, err := ioutil.ReadFile(*providersTmpl)
+		kingpin.FatalIfError(err, "cannot read provider index template")
+		pt, err = kuberos.ParseHTMLTemplate("providers", string(t))
+		kingpin.FatalIfError(err, "invalid provider index template")
+	}
+	if *headless {
+		if *redirect == nil || !(*redirect).IsAbs() {
+			kingpin.Fatalf("--headless requires an absolute --redirect-url")
+		}
+		ho = append(ho, kuberos.Headless())
+	}
+	if len(*allowedGroups) > 0 || len(*allowedDomains) > 0 {
+		ho = append(ho, kuberos.Authorization(kuberos.Policy{Groups: *allowedGroups, EmailDomains: *allowedDomains}))
+	}
+	if *lockoutFailures > 0 {
+		ho = append(ho, kuberos.LockOut(kuberos.Lockout{Failures: *lockoutFailures, Window: *lockoutWindow, Duration: *lockoutDuration}))
+	}
+	proxies, err := kuberos.ParseCIDRs(*trustedProxies)
+	kingpin.FatalIfError(err, "cannot parse --trusted-proxy-cidr")
+	var filter *kuberos.IPFilter
+	if len(*allowCIDRs)+len(*denyCIDRs) > 0 {
+		filter = &kuberos.IPFilter{TrustedProxies: proxies}
+		filter.Allow, err = kuberos.ParseCIDRs(*allowCIDRs)
+		kingpin.FatalIfError(err, "cannot parse --allow-cidr")
+		filter.Deny, err = kuberos.ParseCIDRs(*denyCIDRs)
+		kingpin.FatalIfError(err, "cannot parse --deny-cidr")
+	}
+	if *ipRateLimit > 0 {
+		ho = append(ho, kuberos.RateLimitByIP(kuberos.RateLimit{Requests: *ipRateLimit, Per: time.Minute}))
+	}
+	if *subRateLimit > 0 {
+		ho = append(ho, kuberos.RateLimitBySubject(kuberos.RateLimit{Requests: *subRateLimit, Per: time.Minute}))
+	}
 
-	tmpl, err := clientcmd.LoadFromFile(*templateFile)
-	kingpin.FatalIfError(err, "cannot load kubecfg template %s", *templateFile)
+	m, err := metrics.New(prometheus.DefaultRegisterer)
+	kingpin.FatalIfError(err, "cannot setup metrics")
+
+	// newHandlers returns handlers that authenticate users with the supplied
+	// OIDC provider. The endpoints of named providers are suffixed with
+	// their name. Only the default provider, whose name is empty, may use
+	// dynamic client registration.
+	newHandlers := func(name, issuer, clientID string, clientSecret []byte) (*kuberos.Handlers, *discoveryDocument) {
+		ctx := oidc.ClientContext(context.Background(), hc)
+		provider, err := oidc.NewProvider(ctx, issuer)
+		kingpin.FatalIfError(err, "cannot create OIDC provider from issuer %v", issuer)
+		log.Debug("established OIDC provider", zap.String("url", provider.Endpoint().TokenURL))
+
+		discovery := &discoveryDocument{}
+		kingpin.FatalIfError(provider.Claims(discovery), "cannot read OIDC provider discovery document")
+
+		oauthEndpoint := provider.Endpoint()
+		if *tlsClientAuth {
+			if *idpCertFile == "" {
+				kingpin.Fatalf("--tls-client-auth requires --idp-client-cert-file")
+			}
+			// See https://tools.ietf.org/html/rfc8705#section-5
+			a := discovery.MTLSEndpointAliases
+			if a.TokenEndpoint != "" {
+				oauthEndpoint.TokenURL = a.TokenEndpoint
+			}
+			if a.DeviceAuthorizationEndpoint != "" {
+				discovery.DeviceAuthorizationEndpoint = a.DeviceAuthorizationEndpoint
+			}
+			if a.IntrospectionEndpoint != "" {
+				discovery.IntrospectionEndpoint = a.IntrospectionEndpoint
+			}
+			if a.RevocationEndpoint != "" {
+				discovery.RevocationEndpoint = a.RevocationEndpoint
+			}
+		}
+
+		if name == "" && *regFile != "" {
+			if discovery.RegistrationEndpoint == "" {
+				kingpin.Fatalf("OIDC provider %v does not advertise a registration endpoint", issuer)
+			}
+			md := &extractor.ClientMetadata{RedirectURIs: *regRedirects, ClientName: app.Name}
+			cr, err := registeredClient(ctx, hc, *regFile, discovery.RegistrationEndpoint, *regToken, md)
+			kingpin.FatalIfError(err, "cannot register OIDC client")
+			clientID, clientSecret = cr.ClientID, []byte(cr.ClientSecret)
+			log.Debug("using registered OIDC client", zap.String("clientID", cr.ClientID))
+		}
+
+		sr := kuberos.ScopeRequests{OfflineAsScope: kuberos.OfflineAsScope(provider), Scopes: *scopes}
+		switch *offline {
+		case offlineScope:
+			sr.OfflineAsScope = true
+		case offlineAccessType:
+			sr.OfflineAsScope = false
+		}
+		if *noRefresh {
+			sr.OfflineAsScope = false
+		}
+		cfg := &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: strings.TrimSpace(string(clientSecret)),
+			Endpoint:     oauthEndpoint,
+			Scopes:       sr.Get(),
+		}
+
+		eo := []extractor.Option{
+			extractor.Logger(log),
+			extractor.Metrics(m),
+			extractor.HTTPClient(hc),
+			extractor.EmailDomain(*emailDomain),
+			extractor.UsernameClaim(*userClaim),
+			extractor.GroupsClaim(*groupsClaim),
+			extractor.Issuer(issuer),
+			extractor.DeviceAuthorizationURL(discovery.DeviceAuthorizationEndpoint),
+			extractor.RevocationURL(discovery.RevocationEndpoint),
+			extractor.EndSessionEndpoint(discovery.EndSessionEndpoint),
+		}
+		rp := extractor.DefaultRetryPolicy
+		rp.MaxAttempts = *retries
+		eo = append(eo, extractor.Retry(rp), extractor.ClockSkew(*clockSkew))
+		if *userTemplate != "" {
+			eo = append(eo, extractor.UsernameTemplate(*userTemplate))
+		}
+		if *groupsTemplate != "" {
+			eo = append(eo, extractor.GroupsTemplate(*groupsTemplate))
+		}
+		if *nsClaim != "" {
+			eo = append(eo, extractor.NamespaceClaim(*nsClaim))
+		}
+		if len(*groupNamespaces) > 0 {
+			eo = append(eo, extractor.GroupNamespaces(*groupNamespaces))
+		}
+		if *userInfo {
+			eo = append(eo, extractor.UserInfo(provider))
+		}
+		switch *hashCheck {
+		case hashCheckEnforce:
+			eo = append(eo, extractor.VerifyHashes(extractor.HashCheckEnforce))
+		case hashCheckDisabled:
+			eo = append(eo, extractor.VerifyHashes(extractor.HashCheckDisabled))
+		}
+		if *decryptionKeys != "" {
+			keys, err := ioutil.ReadFile(*decryptionKeys)
+			kingpin.FatalIfError(err, "cannot read ID token decryption keys")
+			eo = append(eo, extractor.DecryptionKeys(keys))
+		}
+		if *clientKey != "" {
+			eo = append(eo, extractor.PrivateKeyJWT(*clientKey))
+		}
+		if *tlsClientAuth {
+			eo = append(eo, extractor.TLSClientAuth())
+		}
+		if *traceContext {
+			eo = append(eo, extractor.Tracing(tracer))
+		}
+		if *keycloakRoles {
+			eo = append(eo, extractor.KeycloakRoles(extractor.KeycloakRolesConfig{
+				RealmPrefix:  *keycloakRealm,
+				ClientPrefix: *keycloakPrefix,
+				Clients:      *keycloakClients,
+			}))
+		}
+		if len(*atClaims) > 0 {
+			aud := clientID
+			if *atAudience != "" {
+				aud = *atAudience
+			}
+			eo = append(eo, extractor.AccessTokenClaims(provider.Verifier(&oidc.Config{ClientID: aud, SkipNonceCheck: true}), *atClaims...))
+		}
+		if *azureOverage {
+			eo = append(eo, extractor.AzureGroupOverage(extractor.DefaultGraphURL))
+		}
+		if len(*claimSources) > 0 {
+			csv := make([]*oidc.IDTokenVerifier, 0, len(*claimSources))
+			for _, iss := range *claimSources {
+				p, err := oidc.NewProvider(ctx, iss)
+				kingpin.FatalIfError(err, "cannot create claim source provider from issuer %v", iss)
+				// Claim sets need not be issued to us, or expire. The
+				// extractor checks the expiry of those that do.
+				csv = append(csv, p.Verifier(&oidc.Config{SkipClientIDCheck: true, SkipNonceCheck: true, SkipExpiryCheck: true}))
+			}
+			eo = append(eo, extractor.ClaimSources(csv...))
+		}
+		// The extractor checks the nonce and expiry instead of the verifier.
+		vcfg := &oidc.Config{ClientID: clientID, SkipNonceCheck: true, SkipExpiryCheck: true}
+		if len(*audiences) > 0 {
+			// The extractor checks the audience instead of the verifier.
+			vcfg = &oidc.Config{SkipClientIDCheck: true, SkipNonceCheck: true, SkipExpiryCheck: true}
+			eo = append(eo, extractor.Audiences(append([]string{clientID}, *audiences...)...))
+		}
+		if *requireAZP {
+			eo = append(eo, extractor.RequireAuthorizedParty())
+		}
+		if len(*requireACR) > 0 {
+			eo = append(eo, extractor.RequireACR(*requireACR...))
+		}
+		if len(*requireAMR) > 0 {
+			eo = append(eo, extractor.RequireAMR(*requireAMR...))
+		}
+		if *maxLifetime > 0 {
+			eo = append(eo, extractor.MaxLifetime(*maxLifetime))
+		}
+		if *noRefresh {
+			eo = append(eo, extractor.DisallowRefreshTokens())
+		}
+		if len(*hostedDomains) > 0 {
+			eo = append(eo, extractor.RequireHostedDomain(*hostedDomains...))
+		}
+		if *verifiedEmail {
+			eo = append(eo, extractor.RequireVerifiedEmail())
+		}
+		if *introspect {
+			if discovery.IntrospectionEndpoint == "" {
+				kingpin.Fatalf("OIDC provider %v does not advertise an introspection endpoint", issuer)
+			}
+			eo = append(eo, extractor.Introspection(issuer, discovery.IntrospectionEndpoint))
+		} else {
+			ks, err := extractor.NewKeySet(ctx, hc, issuer, discovery.JWKSURI, extractor.KeySetTTL(*jwksTTL), extractor.KeySetLogger(log), extractor.KeySetMetrics(m))
+			kingpin.FatalIfError(err, "cannot fetch OIDC provider signing keys")
+			eo = append(eo, extractor.SigningKeys(ks))
+		}
+		e, err := extractor.New(*extractorName, &extractor.Config{
+			Provider: provider,
+			Verifier: provider.Verifier(vcfg),
+			Options:  eo,
+			Params:   *extractorParams,
+		})
+		kingpin.FatalIfError(err, "cannot setup OIDC extractor")
+
+		endpoint := path.Join(kuberos.DefaultKubeCfgEndpoint, name)
+		if *headless {
+			u := **redirect
+			u.Path = path.Join(u.Path, name)
+			endpoint = u.String()
+		}
+		po := append(append([]kuberos.Option{}, ho...),
+			kuberos.RedirectEndpoint(endpoint),
+			kuberos.LogoutEndpoint(path.Join(kuberos.DefaultLogoutEndpoint, name)))
+		if *downloadTTL > 0 {
+			po = append(po, kuberos.DownloadLinks(tmpl, path.Join(kuberos.DefaultDownloadEndpoint, name), *downloadTTL))
+		}
+		h, err := kuberos.NewHandlers(cfg, e, po...)
+		kingpin.FatalIfError(err, "cannot setup HTTP handlers for issuer %v", issuer)
+		return h, discovery
+	}
+	h, discovery := newHandlers("", (*issuerURL).String(), *clientID, clientSecret)
+
+	var providers []providerConfig
+	if *providersFile != "" {
+		providers, err = readProviders(*providersFile)
+		kingpin.FatalIfError(err, "cannot read providers file")
+	}
+	named := make(map[string]*kuberos.Handlers, len(providers))
+	namedDiscovery := make(map[string]*discoveryDocument, len(providers))
+	for _, p := range providers {
+		secret, err := ioutil.ReadFile(p.ClientSecretFile)
+		kingpin.FatalIfError(err, "cannot read client secret file for provider %s", p.Name)
+		named[p.Name], namedDiscovery[p.Name] = newHandlers(p.Name, p.Issuer, p.ClientID, secret)
+	}
 
 	r := httprouter.New()
-	s := &http.Server{Addr: *listen, Handler: logRequests(r, log)}
+	var root http.Handler = r
+	if prefix != "/" {
+		mux := http.NewServeMux()
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, r))
+		root = mux
+	}
+	sh := kuberos.SecurityHeaders{
+		HSTSMaxAge:            *hstsMaxAge,
+		ContentSecurityPolicy: *csp,
+		FrameAncestors:        *frameAncestors,
+		ReferrerPolicy:        *referrerPolicy,
+	}
+	if *reqTimeout > 0 {
+		// The admin event stream is long lived, and must not be buffered.
+		events := path.Join(prefix, eventsPath)
+		untimed, timed := root, kuberos.TimeoutHandler(root, *reqTimeout, http.HandlerFunc(h.TimedOut))
+		root = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == events {
+				untimed.ServeHTTP(w, r)
+				return
+			}
+			timed.ServeHTTP(w, r)
+		})
+	}
+	rl := kuberos.RequestLimits{
+		MaxBodyBytes: int64(*maxBodyBytes),
+		MaxURLLength: *maxURLLength,
+		Methods:      kuberos.DefaultRequestLimits.Methods,
+	}
+	if *compress {
+		root = kuberos.DefaultCompression.Handler(root)
+	}
+	root = sh.Handler(rl.Handler(root))
+	// X-Forwarded headers are removed from requests not made by a trusted
+	// proxy, so this must wrap every handler that reads them.
+	root = kuberos.TrustedProxies(proxies).Handler(root)
+	if *traceContext {
+		root = tracer.Handler(root)
+	}
+	root = logRequests(root, log)
+	if *serveH2C {
+		root = h2c.NewHandler(root, &http2.Server{IdleTimeout: *idleTimeout})
+	}
+	s := &http.Server{
+		Addr:              *listen,
+		Handler:           root,
+		ReadHeaderTimeout: *readHdrTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    int(*maxHeaderBytes),
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		kingpin.Fatalf("--tls-cert and --tls-key must be specified together")
+	}
+	if *tlsCert != "" && len(*acmeHosts) > 0 {
+		kingpin.Fatalf("--tls-cert and --acme-host are mutually exclusive")
+	}
+	if len(*acmeHosts) > 0 {
+		am := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(*acmeCache),
+			HostPolicy: autocert.HostWhitelist(*acmeHosts...),
+			Email:      *acmeEmail,
+			Client:     &acme.Client{DirectoryURL: *acmeDirectory},
+		}
+		s.TLSConfig = am.TLSConfig()
+		if *acmeHTTP != "" {
+			go func() {
+				log.Info("stopped serving ACME HTTP-01 challenges", zap.Error(http.ListenAndServe(*acmeHTTP, am.HTTPHandler(nil))))
+			}()
+		}
+	}
+	if *tlsCert != "" {
+		cr, err := kuberos.NewCertificateReloader(*tlsCert, *tlsKey, log)
+		kingpin.FatalIfError(err, "cannot load TLS certificate")
+		go cr.Watch(context.Background(), *tlsReload)
+		s.TLSConfig = &tls.Config{
+			GetCertificate: cr.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{http2.NextProtoTLS, "http/1.1"},
+		}
+	}
+	if *tlsClientCA != "" {
+		if s.TLSConfig == nil {
+			kingpin.Fatalf("--tls-client-ca-file requires --tls-cert or --acme-host")
+		}
+		if len(*acmeHosts) > 0 && *acmeHTTP == "" {
+			// The ACME CA cannot present a client certificate when
+			// answering TLS-ALPN-01 challenges.
+			kingpin.Fatalf("--tls-client-ca-file requires --acme-http-listen when used with --acme-host")
+		}
+		ca, err := ioutil.ReadFile(*tlsClientCA)
+		kingpin.FatalIfError(err, "cannot read TLS client CA file")
+		kingpin.FatalIfError(kuberos.RequireClientCertificates(s.TLSConfig, ca, *tlsClientNames), "cannot configure TLS client authentication")
+	} else if len(*tlsClientNames) > 0 {
+		kingpin.Fatalf("--tls-client-allowed-name requires --tls-client-ca-file")
+	}
+
+	if *pprofListen != "" {
+		go func() {
+			log.Info("stopped serving profiles", zap.Error(http.ListenAndServe(*pprofListen, profiles())))
+		}()
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), *grace)
 	done := make(chan struct{})
+	var isReady int32
+	var once sync.Once
 	shutdown := func() {
-		log.Info("shutdown", zap.Error(s.Shutdown(ctx)))
-		close(done)
+		once.Do(func() {
+			atomic.StoreInt32(&isReady, 0)
+			log.Info("shutting down", zap.Duration("delay", *shutdownDelay), zap.Duration("gracePeriod", *grace))
+			time.Sleep(*shutdownDelay)
+			drain(s, wh, *grace, log)
+			close(done)
+		})
 	}
 
 	go func() {
-		sigterm := make(chan os.Signal, 1)
-		signal.Notify(sigterm, syscall.SIGTERM)
-		<-sigterm
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		<-sig
 		shutdown()
 	}()
 
-	frontend, err := fs.New()
-	kingpin.FatalIfError(err, "cannot load frontend")
+	// Custom assets are layered over those embedded in the binary, which
+	// may be omitted from development builds if custom assets are supplied.
+	frontend := kuberos.Overlay{}
+	var assets *kuberos.AssetCache
+	var indexHTML func() []byte
+	if !*headless {
+		if *assetsDir != "" {
+			frontend = append(frontend, http.Dir(*assetsDir))
+		}
+		embedded, err := fs.New()
+		if err != nil && *assetsDir == "" {
+			kingpin.FatalIfError(err, "cannot load embedded frontend")
+		}
+		if err == nil {
+			frontend = append(frontend, embedded)
+		}
+		assets = kuberos.NewAssetCache(frontend, *assetMaxAge)
 
-	index, err := frontend.Open(indexPath)
-	kingpin.FatalIfError(err, "cannot open frontend index %s", indexPath)
+		if *devMode {
+			if *assetsDir == "" {
+				kingpin.Fatalf("--dev-mode requires --assets-dir")
+			}
+			ar, err := kuberos.NewAssetReloader(frontend, indexPath, log)
+			kingpin.FatalIfError(err, "cannot load frontend index %s", indexPath)
+			go ar.Watch(context.Background(), kuberos.DefaultAssetReloadInterval)
+			indexHTML = func() []byte { return assets.Fingerprint(ar.Content()) }
+		} else {
+			index, err := frontend.Open(indexPath)
+			kingpin.FatalIfError(err, "cannot open frontend index %s", indexPath)
+			b, err := ioutil.ReadAll(index)
+			kingpin.FatalIfError(err, "cannot read frontend index %s", indexPath)
+			b = assets.Fingerprint(b)
+			indexHTML = func() []byte { return b }
+		}
+	}
 
-	r.ServeFiles("/dist/*filepath", frontend)
-	r.HandlerFunc("GET", "/ui", content(index, filepath.Base(indexPath)))
-	r.HandlerFunc("GET", "/", h.Login)
-	r.HandlerFunc("GET", "/kubecfg", h.KubeCfg)
-	r.HandlerFunc("GET", "/kubecfg.yaml", kuberos.Template(tmpl))
+	// handle serves and records metrics about the supplied route, which is
+	// subject to any client IP restrictions.
+	handle := func(method, path string, fn http.HandlerFunc) {
+		if filter != nil {
+			fn = filter.Handler(fn).ServeHTTP
+		}
+		r.HandlerFunc(method, path, m.Instrument(path, fn))
+	}
+
+	// api serves the supplied JSON API route, which may be called
+	// cross-origin if any origins are allowed.
+	api := handle
+	if len(*corsOrigins) > 0 {
+		cors := kuberos.CORS{AllowedOrigins: *corsOrigins, AllowCredentials: *corsCredentials, MaxAge: *corsMaxAge}
+		kingpin.FatalIfError(cors.Validate(), "invalid CORS configuration")
+		api = func(method, path string, fn http.HandlerFunc) {
+			handle(method, path, cors.Handler(fn).ServeHTTP)
+			r.Handler(http.MethodOptions, path, cors.Handler(http.NotFoundHandler()))
+		}
+	}
+
+	if !*headless {
+		r.Handler("GET", "/dist/*filepath", http.StripPrefix("/dist", assets))
+		handle("GET", "/ui", content(indexHTML, filepath.Base(indexPath)))
+		handle("GET", "/kubecfg", h.KubeCfg)
+		handle("GET", "/kubecfg.yaml", kuberos.Template(tmpl))
+		handle("GET", "/snippet", kuberos.Snippet)
+		handle("GET", "/messages.json", loc.ServeHTTP)
+		handle("GET", "/branding.json", brand.ServeHTTP)
+	}
+	handle("GET", "/", h.Login)
+	handle("POST", "/kubeconfig.yaml", kuberos.KubeConfigFile(tmpl))
+	api("GET", "/api/v1/kubeconfig", h.KubeConfig(tmpl))
+	api("GET", "/api/v1/session", h.Status)
+	api("GET", "/api/v1/clusters", kuberos.ClusterNames(tmpl))
+	if !*noRefresh {
+		api("POST", "/api/v1/refresh", h.RefreshKubeConfig(tmpl))
+	}
+	if *downloadTTL > 0 {
+		handle("GET", "/download", h.Download)
+	}
 	r.HandlerFunc("GET", "/healthz", ping())
+	r.HandlerFunc("GET", "/readyz", ready(&isReady))
+	r.Handler("GET", "/metrics", promhttp.Handler())
+
+	features := kuberos.APIFeatures{
+		Refresh:    !*noRefresh,
+		DeviceFlow: discovery.DeviceAuthorizationEndpoint != "",
+		Revocation: discovery.RevocationEndpoint != "",
+		Admin:      auditStore != nil,
+	}
+	for _, p := range providers {
+		features.Providers = append(features.Providers, kuberos.ProviderFeatures{
+			Name:       p.Name,
+			DeviceFlow: namedDiscovery[p.Name].DeviceAuthorizationEndpoint != "",
+			Revocation: namedDiscovery[p.Name].RevocationEndpoint != "",
+		})
+	}
+	if auditStore != nil {
+		api("GET", "/api/v1/admin/issuances", kuberos.AdminIssuances(auditStore, adminToken))
+		api("GET", eventsPath, kuberos.AdminEvents(auditStore, adminToken, kuberos.DefaultEventsKeepAlive))
+	}
+	api("GET", "/openapi.json", kuberos.NewOpenAPIDocument(features).ServeHTTP)
+
+	if len(providers) > 0 && !*headless {
+		handle("GET", "/login", providerIndex(pt, providers, loc, brand))
+		// Named provider UIs are served one level below the default UI.
+		ui := func() []byte { return kuberos.RebaseAssets(indexHTML(), "../") }
+		for _, p := range providers {
+			handle("GET", "/ui/"+p.Name, content(ui, filepath.Base(indexPath)))
+			handle("GET", "/kubecfg/"+p.Name, named[p.Name].KubeCfg)
+		}
+	}
+	for _, p := range providers {
+		handle("GET", "/login/"+p.Name, named[p.Name].Login)
+		api("GET", "/api/v1/kubeconfig/"+p.Name, named[p.Name].KubeConfig(tmpl))
+		api("GET", "/api/v1/session/"+p.Name, named[p.Name].Status)
+		if !*noRefresh {
+			api("POST", "/api/v1/refresh/"+p.Name, named[p.Name].RefreshKubeConfig(tmpl))
+		}
+		handle("GET", "/logout/"+p.Name, named[p.Name].EndSession)
+		if *downloadTTL > 0 {
+			handle("GET", "/download/"+p.Name, named[p.Name].Download)
+		}
+		if namedDiscovery[p.Name].DeviceAuthorizationEndpoint != "" {
+			api("POST", "/device/"+p.Name, named[p.Name].StartDeviceFlow)
+			api("POST", "/device/token/"+p.Name, named[p.Name].PollDeviceFlow)
+		}
+		if namedDiscovery[p.Name].RevocationEndpoint != "" {
+			handle("POST", "/logout/"+p.Name, named[p.Name].Logout)
+		}
+	}
+
+	if discovery.DeviceAuthorizationEndpoint != "" {
+		api("POST", "/device", h.StartDeviceFlow)
+		api("POST", "/device/token", h.PollDeviceFlow)
+	}
+
+	handle("GET", "/logout", h.EndSession)
+	if discovery.RevocationEndpoint != "" {
+		handle("POST", "/logout", h.Logout)
+	}
 
 	if *shutdownEndpoint != "" {
 		r.HandlerFunc("GET", *shutdownEndpoint, run(shutdown))
 	}
 
-	log.Info("shutdown", zap.Error(s.ListenAndServe()))
+	l, err := listener(*listen, *listenUnix, *listenUnixMode)
+	kingpin.FatalIfError(err, "cannot listen")
+
+	// The OIDC provider has been discovered and all templates loaded.
+	atomic.StoreInt32(&isReady, 1)
+	if s.TLSConfig != nil {
+		log.Info("shutdown", zap.Error(s.ServeTLS(l, "", "")))
+	} else {
+		log.Info("shutdown", zap.Error(s.Serve(l)))
+	}
 	<-done
-	cancel()
+	log.Sync() // nolint: errcheck, gas
 }
 
-func content(c io.ReadSeeker, filename string) http.HandlerFunc {
+// listener returns a listener at the supplied unix domain socket path with the
+// supplied octal file mode, or at the supplied TCP address if the path is empty.
+// Any existing socket at the path, e.g. left by a previous process, is removed.
+func listener(addr, socket, mode string) (net.Listener, error) {
+	if socket == "" {
+		l, err := net.Listen("tcp", addr)
+		return l, errors.Wrapf(err, "cannot listen at %s", addr)
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse socket mode %q", mode)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "cannot remove existing socket %s", socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen at %s", socket)
+	}
+	if err := os.Chmod(socket, os.FileMode(m)); err != nil {
+		l.Close() // nolint: errcheck, gas
+		return nil, errors.Wrapf(err, "cannot set mode of socket %s", socket)
+	}
+	return l, nil
+}
+
+// profiles returns a handler that serves net/http/pprof profiles. It does not
+// use http.DefaultServeMux, so that profiles are served only where intended.
+func profiles() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// drain stops the supplied server accepting new connections, then waits up to
+// the supplied grace period for in-flight requests to complete before closing
+// any connections that remain. Webhook events recorded by those requests are
+// sent within the same grace period.
+func drain(s *http.Server, wh *kuberos.Webhook, grace time.Duration, log *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Info("cannot drain connections within grace period", zap.Error(err))
+		log.Info("shutdown", zap.Error(s.Close()))
+		return
+	}
+	if wh != nil {
+		if err := wh.Flush(ctx); err != nil {
+			log.Info("cannot flush webhook within grace period", zap.Error(err))
+		}
+	}
+	log.Info("shutdown")
+}
+
+// A providerConfig configures an additional named OIDC provider. Named
+// providers share all configuration other than their issuer and client.
+type providerConfig struct {
+	Name             string `json:"name"`
+	Issuer           string `json:"issuer"`
+	ClientID         string `json:"clientID"`
+	ClientSecretFile string `json:"clientSecretFile"`
+}
+
+var providerName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// readProviders reads and validates the named OIDC providers listed in the
+// supplied YAML file.
+func readProviders(file string) ([]providerConfig, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read file")
+	}
+	var pp []providerConfig
+	if err := yaml.Unmarshal(b, &pp); err != nil {
+		return nil, errors.Wrap(err, "cannot decode providers")
+	}
+	seen := map[string]bool{}
+	for _, p := range pp {
+		if !providerName.MatchString(p.Name) {
+			return nil, errors.Errorf("provider name %q must consist of lower case letters, digits, and hyphens", p.Name)
+		}
+		// Served at /device/<name>, which would clash with /device/token.
+		if p.Name == "token" {
+			return nil, errors.Errorf("provider name %q is reserved", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, errors.Errorf("provider name %q is not unique", p.Name)
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.ClientSecretFile == "" {
+			return nil, errors.Errorf("provider %q must specify an issuer, clientID, and clientSecretFile", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	return pp, nil
+}
+
+var providerIndexTemplate = template.Must(template.New("providers").Funcs(sprig.HtmlFuncMap()).Parse(`<!DOCTYPE html>
+<html lang="{{ .Lang }}">
+<head>
+  <meta charset="utf-8"><title>{{ .Brand.Name }}</title>
+  {{- with .Brand }}{{ if or .PrimaryColor .BackgroundColor }}
+  <style>
+    {{- if .BackgroundColor }} body { background-color: {{ .BackgroundColor }}; }{{ end }}
+    {{- if .PrimaryColor }} h1, a { color: {{ .PrimaryColor }}; }{{ end }}
+  </style>
+  {{- end }}{{ end }}
+</head>
+<body>
+  {{- if .Brand.LogoURL }}
+  <img src="{{ .Brand.LogoURL }}" alt="{{ .Brand.OrgName }}" height="48">
+  {{- end }}
+  <h1>{{ .Title }}</h1>
+  <ul>
+    <li><a href="./">{{ .Default }}</a></li>
+    {{- range .Providers }}
+    <li><a href="login/{{ .Name }}">{{ .Name }}</a></li>
+    {{- end }}
+  </ul>
+</body>
+</html>
+`))
+
+// providerIndex returns a handler that serves a page, rendered by the supplied
+// template, from which users may pick the OIDC provider with which to log in.
+func providerIndex(t *template.Template, pp []providerConfig, loc *kuberos.Localizer, b kuberos.Branding) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, filename, time.Unix(0, 0), c)
+		lang, c := loc.Catalog(r)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Language", lang)
+		t.Execute(w, struct { // nolint: errcheck, gas
+			Lang           string
+			Brand          kuberos.Branding
+			Title, Default template.HTML
+			Providers      []providerConfig
+		}{lang, b, template.HTML(c["providers.title"]), template.HTML(c["providers.default"]), pp})
+		r.Body.Close()
+	}
+}
+
+// registeredClient returns the client registration persisted in the supplied
+// file, registering a new client and persisting it if the file does not exist.
+func registeredClient(ctx context.Context, h *http.Client, file, endpoint, token string, md *extractor.ClientMetadata) (*extractor.ClientRegistration, error) {
+	cr := &extractor.ClientRegistration{}
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		return cr, errors.Wrap(json.Unmarshal(b, cr), "cannot decode registration file")
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "cannot read registration file")
+	}
+
+	cr, err = extractor.RegisterClient(ctx, h, endpoint, token, md)
+	if err != nil {
+		return nil, err
+	}
+	b, err = json.Marshal(cr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode client registration")
+	}
+	return cr, errors.Wrap(ioutil.WriteFile(file, b, 0600), "cannot write registration file")
+}
+
+func content(c func() []byte, filename string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, filename, time.Unix(0, 0), bytes.NewReader(c()))
 		r.Body.Close()
 	}
 }
@@ -152,3 +1176,17 @@ func ping() http.HandlerFunc {
 		r.Body.Close()
 	}
 }
+
+// ready returns a handler that reports whether kuberos is ready to serve
+// traffic, i.e. that it has finished starting up and has not begun shutting
+// down.
+func ready(isReady *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(isReady) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		r.Body.Close()
+	}
+}
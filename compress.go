@@ -0,0 +1,232 @@
+package kuberos
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headerAcceptEncoding  = "Accept-Encoding"
+	headerContentEncoding = "Content-Encoding"
+	headerContentLength   = "Content-Length"
+	headerContentType     = "Content-Type"
+	headerETag            = "ETag"
+	headerVary            = "Vary"
+
+	encodingGzip = "gzip"
+)
+
+// DefaultCompression is the response compression kuberos applies when
+// compression is enabled. Frontend assets are compressed alongside the HTML,
+// JSON, and YAML responses, which grow with the number of clusters.
+var DefaultCompression = Compression{
+	Level:    gzip.DefaultCompression,
+	MinBytes: 1 << 10,
+	ContentTypes: []string{
+		"text/html",
+		"text/plain",
+		"text/css",
+		"application/javascript",
+		"application/json",
+		"application/yaml",
+	},
+}
+
+// Compression configures gzip compression of responses to clients that accept
+// it. Responses that already have a Content-Encoding are never compressed.
+type Compression struct {
+	// Level is the gzip compression level, per compress/gzip.
+	Level int
+
+	// MinBytes is the size below which responses are not compressed, as the
+	// overhead of compression would outweigh its benefit.
+	MinBytes int
+
+	// ContentTypes are the media types of responses that may be compressed.
+	ContentTypes []string
+}
+
+// Handler returns a handler that calls the supplied handler, compressing its
+// responses if the client accepts gzip and the response's media type is one
+// of the configured content types.
+func (c Compression) Handler(h http.Handler) http.Handler {
+	types := map[string]bool{}
+	for _, t := range c.ContentTypes {
+		types[t] = true
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, c.Level) // nolint: gas
+		return w
+	}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(headerVary, headerAcceptEncoding)
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get(headerAcceptEncoding)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, types: types, min: c.MinBytes, pool: pool, code: http.StatusOK}
+		defer cw.Close() // nolint: errcheck
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip returns true if the supplied Accept-Encoding header accepts gzip
+// with a non-zero quality.
+func acceptsGzip(accept string) bool {
+	for _, e := range strings.Split(accept, ",") {
+		parts := strings.Split(e, ";")
+		if name := strings.ToLower(strings.TrimSpace(parts[0])); name != encodingGzip && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[2:], 64) // nolint: gas
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// A compressWriter buffers the start of a response until it is known whether
+// it should be compressed, i.e. until its headers indicate it should not be or
+// it grows beyond the minimum size.
+type compressWriter struct {
+	http.ResponseWriter
+	types map[string]bool
+	min   int
+	pool  *sync.Pool
+
+	code        int
+	wroteHeader bool
+	decided     bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.code, cw.wroteHeader = code, true
+	if !cw.compressible() {
+		cw.passthrough()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.gz != nil:
+		return cw.gz.Write(b)
+	case cw.decided:
+		return cw.ResponseWriter.Write(b)
+	}
+	if cw.Header().Get(headerContentType) == "" {
+		cw.Header().Set(headerContentType, http.DetectContentType(b))
+		if !cw.compressible() {
+			cw.passthrough()
+			return cw.ResponseWriter.Write(b)
+		}
+	}
+	cw.buf.Write(b) // nolint: errcheck, gas
+	if cw.buf.Len() < cw.min {
+		return len(b), nil
+	}
+	if err := cw.compress(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// compressible returns true if the response's headers allow it to be
+// compressed.
+func (cw *compressWriter) compressible() bool {
+	if cw.code < http.StatusOK || cw.code == http.StatusNoContent || cw.code == http.StatusNotModified {
+		return false
+	}
+	if cw.Header().Get(headerContentEncoding) != "" {
+		return false
+	}
+	ct := cw.Header().Get(headerContentType)
+	if ct == "" {
+		// Decided once the first write reveals the content type.
+		return true
+	}
+	mt := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	return cw.types[mt]
+}
+
+// passthrough writes the response's headers and any buffered content
+// uncompressed.
+func (cw *compressWriter) passthrough() {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.code)
+	if cw.buf.Len() > 0 {
+		cw.ResponseWriter.Write(cw.buf.Bytes()) // nolint: errcheck, gas
+		cw.buf.Reset()
+	}
+}
+
+// compress writes the response's headers and any buffered content compressed.
+func (cw *compressWriter) compress() error {
+	cw.decided = true
+	hdr := cw.Header()
+	hdr.Set(headerContentEncoding, encodingGzip)
+	hdr.Del(headerContentLength)
+	// The compressed content differs from the uncompressed, so any strong
+	// validator no longer applies to it.
+	if etag := hdr.Get(headerETag); etag != "" && !strings.HasPrefix(etag, "W/") {
+		hdr.Set(headerETag, "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	cw.gz = cw.pool.Get().(*gzip.Writer)
+	cw.gz.Reset(cw.ResponseWriter)
+	_, err := cw.gz.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+	return err
+}
+
+// Flush sends any buffered content to the client, compressed if the response
+// is being compressed, e.g. for streamed responses.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush() // nolint: errcheck, gas
+	} else if !cw.decided {
+		cw.passthrough()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close flushes the response, compressing it only if it grew beyond the
+// minimum size.
+func (cw *compressWriter) Close() error {
+	if cw.gz == nil {
+		if !cw.wroteHeader {
+			cw.code, cw.wroteHeader = http.StatusOK, true
+		}
+		cw.passthrough()
+		return nil
+	}
+	err := cw.gz.Close()
+	cw.pool.Put(cw.gz)
+	cw.gz = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package kuberos
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("kuberos ", 256)
+	c := Compression{Level: gzip.BestSpeed, MinBytes: 64, ContentTypes: []string{"application/json"}}
+
+	cases := []struct {
+		name       string
+		accept     string
+		h          http.HandlerFunc
+		compressed bool
+		body       string
+	}{
+		{
+			name:   "Compressed",
+			accept: "br, gzip;q=0.5",
+			h: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+				w.Write([]byte(large)) // nolint: errcheck, gas
+			},
+			compressed: true,
+			body:       large,
+		},
+		{
+			name:   "NotAccepted",
+			accept: "gzip;q=0, identity",
+			h: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(large)) // nolint: errcheck, gas
+			},
+			body: large,
+		},
+		{
+			name:   "TooSmall",
+			accept: "gzip",
+			h: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("{}")) // nolint: errcheck, gas
+			},
+			body: "{}",
+		},
+		{
+			name:   "UnexpectedContentType",
+			accept: "gzip",
+			h: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte(large)) // nolint: errcheck, gas
+			},
+			body: large,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			c.Handler(tt.h).ServeHTTP(w, r)
+
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary:\nwant Accept-Encoding\ngot %v\n", got)
+			}
+			var body io.Reader = w.Body
+			if tt.compressed {
+				if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+					t.Fatalf("Content-Encoding:\nwant gzip\ngot %v\n", got)
+				}
+				if got := w.Header().Get("Content-Length"); got != "" {
+					t.Errorf("Content-Length:\nwant none\ngot %v\n", got)
+				}
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader(...): %v", err)
+				}
+				body = gz
+			} else if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding:\nwant none\ngot %v\n", got)
+			}
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll(...): %v", err)
+			}
+			if string(b) != tt.body {
+				t.Errorf("body:\nwant %d bytes\ngot %q\n", len(tt.body), b)
+			}
+		})
+	}
+}
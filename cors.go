@@ -0,0 +1,98 @@
+package kuberos
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCORSMaxAge is the default duration for which browsers may cache the
+// response to a CORS preflight request.
+const DefaultCORSMaxAge = 10 * time.Minute
+
+var (
+	corsAllowedMethods = strings.Join([]string{http.MethodGet, http.MethodPost}, ", ")
+	corsAllowedHeaders = strings.Join([]string{"Content-Type", headerRequestID}, ", ")
+	corsExposedHeaders = strings.Join([]string{headerErrorCode, headerRequestID, "Retry-After"}, ", ")
+)
+
+// CORS configures Cross-Origin Resource Sharing for the JSON API, allowing
+// e.g. a developer portal served from another origin to complete the
+// authentication flow.
+//
+// See https://fetch.spec.whatwg.org/#http-cors-protocol
+type CORS struct {
+	// AllowedOrigins may make cross-origin requests. The special origin *
+	// allows any origin, and may not be used with AllowCredentials.
+	AllowedOrigins []string
+
+	// AllowCredentials allows cross-origin requests to include cookies. The
+	// API requires the session cookie set by the login endpoint. Only
+	// explicitly allowed origins may make requests with credentials.
+	AllowCredentials bool
+
+	// MaxAge is the duration for which browsers may cache preflight
+	// responses.
+	MaxAge time.Duration
+}
+
+// Validate returns an error if the CORS configuration would allow any origin
+// to make requests with the user's cookies.
+func (c CORS) Validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return errors.New("the * origin cannot be allowed to make requests with credentials")
+		}
+	}
+	return nil
+}
+
+func (c CORS) allowed(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		// Any origin could read responses using the user's cookies if * were
+		// allowed with credentials.
+		if (o == "*" && !c.AllowCredentials) || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a handler that sets CORS headers on responses to requests
+// from allowed origins before calling the supplied handler. It answers all
+// OPTIONS requests, i.e. preflight requests, itself.
+func (c CORS) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && c.allowed(origin)
+		if allowed {
+			// Echo the origin rather than *, which browsers reject for
+			// requests with credentials.
+			hdr.Set("Access-Control-Allow-Origin", origin)
+			hdr.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			if c.AllowCredentials {
+				hdr.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if r.Method != http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+			hdr.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			hdr.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			if c.MaxAge > 0 {
+				hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
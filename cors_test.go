@@ -0,0 +1,126 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	c := CORS{AllowedOrigins: []string{"https://portal.example.org"}, AllowCredentials: true, MaxAge: time.Minute}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	cases := []struct {
+		name   string
+		method string
+		origin string
+		code   int
+		want   map[string]string
+	}{
+		{
+			name:   "Allowed",
+			method: "GET",
+			origin: "https://portal.example.org",
+			code:   http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://portal.example.org",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "",
+			},
+		},
+		{
+			name:   "Preflight",
+			method: "OPTIONS",
+			origin: "https://portal.example.org",
+			code:   http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://portal.example.org",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Max-Age":       "60",
+			},
+		},
+		{
+			name:   "Disallowed",
+			method: "GET",
+			origin: "https://evil.example.org",
+			code:   http.StatusOK,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+			},
+		},
+		{
+			name:   "DisallowedPreflight",
+			method: "OPTIONS",
+			origin: "https://evil.example.org",
+			code:   http.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/api/v1/kubeconfig", nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			c.Handler(ok).ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			for h, want := range tt.want {
+				if got := w.Header().Get(h); got != want {
+					t.Errorf("%s:\nwant %v\ngot %v\n", h, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	cases := []struct {
+		name       string
+		cors       CORS
+		wantErr    bool
+		wantOrigin string
+	}{
+		{
+			name:       "WithoutCredentials",
+			cors:       CORS{AllowedOrigins: []string{"*"}},
+			wantOrigin: "https://evil.example.org",
+		},
+		{
+			name:    "WithCredentials",
+			cors:    CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			wantErr: true,
+		},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cors.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("c.Validate(): want error %v, got %v", tt.wantErr, err)
+			}
+
+			// Origins must never be reflected with credentials, even if an
+			// invalid configuration is used.
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/v1/session", nil)
+			r.Header.Set("Origin", "https://evil.example.org")
+			tt.cors.Handler(ok).ServeHTTP(w, r)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin:\nwant %v\ngot %v\n", tt.wantOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+				t.Errorf("Access-Control-Allow-Credentials:\nwant \ngot %v\n", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	// DefaultDownloadTTL is the default duration for which a download link
+	// remains valid.
+	DefaultDownloadTTL = 5 * time.Minute
+
+	// DefaultDownloadEndpoint is the default endpoint, relative to the base
+	// path, at which download links are served.
+	DefaultDownloadEndpoint = "download"
+
+	urlParamToken = "token"
+
+	downloadKeyContext = "kuberos download"
+)
+
+// ErrInvalidDownload indicates a download link that was not issued by kuberos,
+// has expired, or has already been used.
+var ErrInvalidDownload = errors.New("invalid download link: links expire after a few minutes and may be used only once, please log in again")
+
+// A download is a kubeconfig awaiting download via a single-use link.
+type download struct {
+	kubecfg []byte
+	expires time.Time
+}
+
+// A downloadStore tracks the kubeconfigs awaiting download in process memory,
+// ensuring each is downloaded at most once.
+type downloadStore struct {
+	mu        sync.Mutex
+	downloads map[string]download
+}
+
+func (s *downloadStore) put(id string, kubecfg []byte, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, d := range s.downloads {
+		if now.After(d.expires) {
+			delete(s.downloads, k)
+		}
+	}
+	s.downloads[id] = download{kubecfg: kubecfg, expires: expires}
+}
+
+func (s *downloadStore) take(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.downloads[id]
+	if !ok {
+		return nil, false
+	}
+	delete(s.downloads, id)
+	return d.kubecfg, !time.Now().After(d.expires)
+}
+
+// DownloadLinks configures kuberos to return a signed, single-use link from
+// which the kubeconfig populated from the supplied template may be downloaded
+// within the supplied duration, e.g. from a second device or via curl. Links
+// point to the supplied endpoint, relative to the base path, which must be
+// served by Download. The links are tracked in process memory, and thus work
+// only in deployments that run a single replica or route each user to a
+// consistent replica.
+func DownloadLinks(cfg *api.Config, endpoint string, ttl time.Duration) Option {
+	return func(h *Handlers) error {
+		if ttl <= 0 {
+			return errors.New("download link TTL must be positive")
+		}
+		h.template = cfg
+		h.downloadEndpoint = endpoint
+		h.downloadTTL = ttl
+		h.downloads = &downloadStore{downloads: map[string]download{}}
+		return nil
+	}
+}
+
+// newDownload returns a single-use link from which a kubeconfig for the
+// supplied user may be downloaded. Like KubeConfig, the clusters and user URL
+// parameters of the supplied request select the clusters it contains and how
+// the user authenticates.
+func (h *Handlers) newDownload(r *http.Request, p *extractor.OIDCAuthenticationParams) (string, error) {
+	cfg, err := selectClusters(h.template, r)
+	if err != nil {
+		return "", err
+	}
+	user, err := userFormat(r)
+	if err != nil {
+		return "", err
+	}
+	y, err := writeKubeCfg(populateUser(cfg, p, user))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal template to YAML")
+	}
+	id, err := newRandomValue()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot generate download ID")
+	}
+	expires := time.Now().Add(h.downloadTTL)
+	h.downloads.put(id, y, expires)
+
+	token := id + "." + signState(h.stateKey, []byte(downloadKeyContext+"\x00"+id), expires)
+	return redirectURL(r, h.basePath, &url.URL{Path: h.downloadEndpoint, RawQuery: url.Values{urlParamToken: {token}}.Encode()}), nil
+}
+
+// Download serves the kubeconfig identified by the token parameter of a link
+// returned by a previous authentication, then invalidates the link.
+func (h *Handlers) Download(w http.ResponseWriter, r *http.Request) {
+	if h.downloads == nil {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(r.FormValue(urlParamToken), ".", 2)
+	if len(parts) != 2 {
+		h.fail(w, r, http.StatusNotFound, ErrInvalidDownload)
+		return
+	}
+	switch verifyState(h.stateKey, []byte(downloadKeyContext+"\x00"+parts[0]), parts[1], time.Now()) {
+	case nil:
+	case ErrExpiredState:
+		h.fail(w, r, http.StatusGone, ErrInvalidDownload)
+		return
+	default:
+		h.fail(w, r, http.StatusNotFound, ErrInvalidDownload)
+		return
+	}
+	format, err := kubecfgFormat(r)
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	y, ok := h.downloads.take(parts[0])
+	if !ok {
+		h.fail(w, r, http.StatusGone, ErrInvalidDownload)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", contentTypeYAML)
+	if format == formatJSON {
+		j, err := yaml.YAMLToJSON(y)
+		if err != nil {
+			h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot convert kubeconfig to JSON"))
+			return
+		}
+		y = j
+		w.Header().Set("Content-Type", contentTypeJSON)
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=kubeconfig")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if _, err := w.Write(y); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot write response"))
+	}
+}
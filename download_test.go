@@ -0,0 +1,149 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestDownload(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org", IDToken: "token"}}
+	cfg := &api.Config{Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org"}}}
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), DownloadLinks(cfg, DefaultDownloadEndpoint, time.Minute))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+	r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+	h.KubeCfg(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+	rsp := &extractor.OIDCAuthenticationParams{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	if !strings.HasPrefix(rsp.DownloadURL, "http://example.com/download?token=") {
+		t.Fatalf("rsp.DownloadURL: want http://example.com/download?token=..., got %v", rsp.DownloadURL)
+	}
+
+	tampered := strings.Replace(rsp.DownloadURL, "token=", "token=x", 1)
+	cases := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{name: "Tampered", url: tampered, want: http.StatusNotFound},
+		{name: "FirstUse", url: rsp.DownloadURL, want: http.StatusOK},
+		{name: "SecondUse", url: rsp.DownloadURL, want: http.StatusGone},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.Download(w, httptest.NewRequest("GET", tt.url, nil))
+			if w.Code != tt.want {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.want, w.Code, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if !strings.Contains(w.Body.String(), "example@example.org") {
+				t.Errorf("w.Body: want kubeconfig for example@example.org, got\n%s", w.Body)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "private, no-store" {
+				t.Errorf("Cache-Control:\nwant private, no-store\ngot %v\n", got)
+			}
+		})
+	}
+}
+
+func TestDownloadKubeConfig(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org", IDToken: "token"}}
+	cfg := &api.Config{Clusters: map[string]*api.Cluster{
+		"a": &api.Cluster{Server: "https://a.example.org"},
+		"b": &api.Cluster{Server: "https://b.example.org"},
+	}}
+
+	cases := []struct {
+		name         string
+		query        string
+		wantClusters []string
+		wantExec     bool
+	}{
+		{
+			name:         "Default",
+			wantClusters: []string{"a", "b"},
+		},
+		{
+			name:         "SelectedClusters",
+			query:        "&clusters=b",
+			wantClusters: []string{"b"},
+		},
+		{
+			name:         "ExecUser",
+			query:        "&user=exec",
+			wantClusters: []string{"a", "b"},
+			wantExec:     true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), DownloadLinks(cfg, DefaultDownloadEndpoint, time.Minute))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code"+tt.query, nil)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			rsp := &extractor.OIDCAuthenticationParams{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+
+			w = httptest.NewRecorder()
+			h.Download(w, httptest.NewRequest("GET", rsp.DownloadURL, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+			}
+			got, err := clientcmd.Load(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("clientcmd.Load(...): %v", err)
+			}
+			if diff := deep.Equal(clusterNames(got), tt.wantClusters); diff != nil {
+				t.Errorf("clusters: want != got %v", diff)
+			}
+			ai, ok := got.AuthInfos["example@example.org"]
+			if !ok {
+				t.Fatalf("AuthInfos: want example@example.org, got %v", got.AuthInfos)
+			}
+			if (ai.Exec != nil) != tt.wantExec {
+				t.Errorf("ai.Exec: want exec user %v, got %+v", tt.wantExec, ai)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package kuberos
+
+import (
+	"bytes"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Masterminds/sprig"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	headerRequestID = "X-Request-Id"
+
+	contentTypeHTML = "text/html; charset=utf-8"
+)
+
+var errorPageTemplate = template.Must(template.New("error").Funcs(sprig.HtmlFuncMap()).Parse(`<!DOCTYPE html>
+<html lang="{{ .Lang }}">
+<head>
+  <meta charset="utf-8"><title>{{ .Title }} - {{ .Brand.Name }}</title>
+  {{- with .Brand }}{{ if or .PrimaryColor .BackgroundColor }}
+  <style>
+    {{- if .BackgroundColor }} body { background-color: {{ .BackgroundColor }}; }{{ end }}
+    {{- if .PrimaryColor }} h1, a { color: {{ .PrimaryColor }}; }{{ end }}
+  </style>
+  {{- end }}{{ end }}
+</head>
+<body>
+  {{- if .Brand.LogoURL }}
+  <img src="{{ .Brand.LogoURL }}" alt="{{ .Brand.OrgName }}" height="48">
+  {{- end }}
+  <h1>{{ .Title }}</h1>
+  <p>{{ .Explanation }}</p>
+  <p><a href="{{ .RetryURL }}">{{ .Retry }}</a></p>
+  <details>
+    <summary>{{ .Details }}</summary>
+    <pre>{{ .Status }} {{ .StatusText }}: {{ .Detail }}</pre>
+  </details>
+  {{- if .RequestID }}
+  <p>{{ .Reference }} <code>{{ .RequestID }}</code>.</p>
+  {{- end }}
+  {{- if .Brand.SupportURL }}
+  <p><a href="{{ .Brand.SupportURL }}">{{ .Support }}</a></p>
+  {{- end }}
+</body>
+</html>
+`))
+
+// An errorPage explains to a user why their request failed. It is the data of
+// the error page template.
+type errorPage struct {
+	Lang        string
+	Brand       Branding
+	Title       template.HTML
+	Explanation template.HTML
+	Retry       template.HTML
+	Details     template.HTML
+	Reference   template.HTML
+	Support     template.HTML
+	Detail      string
+	Status      int
+	StatusText  string
+	RequestID   string
+	RetryURL    string
+}
+
+// An advisedError annotates an error with advice for the user. Unlike
+// errors.Wrap the advice follows the message of the underlying error.
+type advisedError struct {
+	err    error
+	advice string
+}
+
+func (e *advisedError) Error() string {
+	return e.err.Error() + ": " + e.advice
+}
+
+// Cause returns the underlying error, allowing errors.Cause to unwrap it.
+func (e *advisedError) Cause() error {
+	return e.err
+}
+
+func withAdvice(err error, advice string) error {
+	return &advisedError{err: err, advice: advice}
+}
+
+// describe returns the ID of the catalog messages that title and explain the
+// supplied error to end users, suffixed with .title and .explanation.
+func describe(err error, status int) string {
+	cause := errors.Cause(err)
+	switch cause {
+	case ErrExpiredState:
+		return "error.expiredState"
+	case ErrInvalidState, ErrInvalidSession, ErrMissingNonce, ErrMissingCodeVerifier:
+		return "error.invalidState"
+	case ErrNotAuthorized:
+		return "error.notAuthorized"
+	case ErrLockedOut:
+		return "error.lockedOut"
+	case ErrInvalidDownload:
+		return "error.invalidDownload"
+	case ErrRequestTimeout:
+		return "error.timeout"
+	}
+	if _, ok := cause.(*extractor.AuthenticationContextError); ok {
+		return "error.authenticationContext"
+	}
+
+	switch extractor.Code(err) {
+	case extractor.ErrorCodeExchangeFailed:
+		if _, ok := cause.(net.Error); ok {
+			return "error.unreachable"
+		}
+		return "error.exchangeFailed"
+	case extractor.ErrorCodeClaimsInvalid:
+		return "error.claimsInvalid"
+	case extractor.ErrorCodeTokenMissing, extractor.ErrorCodeVerifyFailed:
+		return "error.verifyFailed"
+	}
+
+	if status >= http.StatusInternalServerError {
+		return "error.internal"
+	}
+	return "error.badRequest"
+}
+
+// acceptsHTML returns true if the supplied request was made by a browser,
+// rather than by the frontend or a programmatic consumer.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// fail writes an error response with the supplied status. Browsers are served
+// a page explaining the error with a link to log in again unless headless,
+// while other clients are served the error as plain text. Both include the
+// request ID with which the error was logged.
+func (h *Handlers) fail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	id := w.Header().Get(headerRequestID)
+	log := h.logger(r)
+	if id == "" {
+		id, _ = newRandomValue() // nolint: gas
+		w.Header().Set(headerRequestID, id)
+		log = log.With(zap.String("requestID", id))
+	}
+	if code := extractor.Code(err); code != "" {
+		log = log.With(zap.String("code", string(code)))
+	}
+	log.Info("request failed", zap.Int("status", status), zap.Error(err))
+
+	if h.headless || !acceptsHTML(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Catalogs are supplied by the operator, and may contain HTML.
+	lang, c := h.localizer.Catalog(r)
+	msg := describe(err, status)
+	p := &errorPage{
+		Lang:        lang,
+		Title:       template.HTML(c[msg+".title"]),       // nolint: gas
+		Explanation: template.HTML(c[msg+".explanation"]), // nolint: gas
+		Retry:       template.HTML(c["error.retry"]),      // nolint: gas
+		Details:     template.HTML(c["error.details"]),    // nolint: gas
+		Reference:   template.HTML(c["error.reference"]),  // nolint: gas
+		Support:     template.HTML(c["support"]),          // nolint: gas
+		Brand:       h.branding,
+		Detail:      err.Error(),
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		RequestID:   id,
+		RetryURL:    redirectURL(r, h.basePath, &url.URL{}),
+	}
+	b := &bytes.Buffer{}
+	if err := h.errorPage.Execute(b, p); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot render error page").Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeHTML)
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	w.Write(b.Bytes()) // nolint: errcheck, gas
+}
@@ -0,0 +1,86 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestErrorPage(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	unreachable := &extractor.Error{
+		Code: extractor.ErrorCodeExchangeFailed,
+		Err:  &url.Error{Op: "Post", URL: "https://token.example.org", Err: errors.New("connection refused")},
+	}
+
+	cases := []struct {
+		name        string
+		accept      string
+		template    string
+		contentType string
+		want        []string
+	}{
+		{
+			name:        "Browser",
+			accept:      "text/html,application/xhtml+xml",
+			contentType: contentTypeHTML,
+			want:        []string{"Identity provider unreachable", "reference <code>req-1</code>", `href="http://example.com/"`},
+		},
+		{
+			name:        "CustomTemplate",
+			accept:      "text/html",
+			template:    `<h1>{{ .StatusText | upper }}</h1><p>{{ .Brand.OrgName | default "Example" }}</p>`,
+			contentType: contentTypeHTML,
+			want:        []string{"<h1>FORBIDDEN</h1>", "<p>Example</p>"},
+		},
+		{
+			name:        "Frontend",
+			accept:      "application/json",
+			contentType: "text/plain; charset=utf-8",
+			want:        []string{"connection refused: please try logging in again"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{StateFunction(func(_ *http.Request) string { return "state" })}
+			if tt.template != "" {
+				opts = append(opts, ErrorPageTemplate(tt.template))
+			}
+			h, err := NewHandlers(c, &predictableExtractor{err: unreachable}, opts...)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			w.Header().Set(headerRequestID, "req-1")
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", http.StatusForbidden, w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type:\nwant %v\ngot %v\n", tt.contentType, got)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("w.Body: want %q, got\n%s", want, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package kuberos
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	urlParamUser = "user"
+
+	// UserAuthProvider users authenticate via kubectl's built in oidc auth
+	// provider, using the ID and refresh tokens issued to kuberos. They must
+	// log in again once the refresh token expires or is revoked.
+	UserAuthProvider = "auth-provider"
+
+	// UserExec users authenticate via the kubelogin exec credential plugin,
+	// i.e. kubectl oidc-login, which obtains and refreshes its own tokens.
+	// See https://github.com/int128/kubelogin
+	UserExec = "exec"
+
+	execCommand = "kubectl"
+
+	extensionInteractiveModes = "kuberos.interactive-modes"
+)
+
+// Exec credential plugin API versions. Recent versions of kubectl warn that
+// v1beta1 is deprecated, while versions older than 1.22 do not support v1.
+const (
+	ExecAPIVersionV1Beta1 = "client.authentication.k8s.io/v1beta1"
+	ExecAPIVersionV1      = "client.authentication.k8s.io/v1"
+)
+
+// Exec credential plugin interactive modes, i.e. whether kubectl allows the
+// plugin to interact with the user, e.g. to open a browser.
+const (
+	InteractiveModeNever       = "Never"
+	InteractiveModeIfAvailable = "IfAvailable"
+	InteractiveModeAlways      = "Always"
+)
+
+// ExecOptions configure the exec credential plugin with which kubelogin users
+// authenticate to a particular cluster.
+type ExecOptions struct {
+	// APIVersion is the exec credential plugin API version. Defaults to
+	// ExecAPIVersionV1Beta1.
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// InteractiveMode is the plugin's interactive mode. It is required by
+	// ExecAPIVersionV1, for which it defaults to InteractiveModeIfAvailable.
+	InteractiveMode string `json:"interactiveMode,omitempty"`
+}
+
+// defaultExecOptions configure the plugins of exec users of clusters that have
+// no exec options.
+var defaultExecOptions = ExecOptions{APIVersion: ExecAPIVersionV1Beta1}
+
+// defaulted returns the supplied options with any defaults applied, or an
+// error if they are invalid.
+func (o ExecOptions) defaulted() (ExecOptions, error) {
+	switch o.APIVersion {
+	case "":
+		o.APIVersion = ExecAPIVersionV1Beta1
+	case ExecAPIVersionV1Beta1, ExecAPIVersionV1:
+	default:
+		return o, errors.Errorf("unsupported exec apiVersion %q: must be %s or %s", o.APIVersion, ExecAPIVersionV1Beta1, ExecAPIVersionV1)
+	}
+	switch o.InteractiveMode {
+	case "":
+		if o.APIVersion == ExecAPIVersionV1 {
+			o.InteractiveMode = InteractiveModeIfAvailable
+		}
+	case InteractiveModeNever, InteractiveModeIfAvailable, InteractiveModeAlways:
+	default:
+		return o, errors.Errorf("unsupported exec interactiveMode %q: must be %s, %s, or %s", o.InteractiveMode, InteractiveModeNever, InteractiveModeIfAvailable, InteractiveModeAlways)
+	}
+	return o, nil
+}
+
+// interactiveModes are the interactive modes of the exec users of a populated
+// kubecfg, keyed by user name, which client-go cannot represent. They are
+// carried as an extension of the kubecfg until it is written.
+type interactiveModes map[string]string
+
+func (m interactiveModes) GetObjectKind() schema.ObjectKind { return schema.EmptyObjectKind }
+
+func (m interactiveModes) DeepCopyObject() runtime.Object {
+	c := make(interactiveModes, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// writeKubeCfg returns the supplied populated kubecfg as YAML, including the
+// interactive modes of its exec users.
+func writeKubeCfg(cfg api.Config) ([]byte, error) {
+	modes, _ := cfg.Extensions[extensionInteractiveModes].(interactiveModes)
+	if len(modes) == 0 {
+		return clientcmd.Write(cfg)
+	}
+	ext := make(map[string]runtime.Object, len(cfg.Extensions))
+	for k, v := range cfg.Extensions {
+		if k != extensionInteractiveModes {
+			ext[k] = v
+		}
+	}
+	cfg.Extensions = ext
+	y, err := clientcmd.Write(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(y, &raw); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal kubecfg")
+	}
+	users, _ := raw["users"].([]interface{})
+	for _, u := range users {
+		named, _ := u.(map[string]interface{})
+		name, _ := named["name"].(string)
+		user, _ := named["user"].(map[string]interface{})
+		exec, _ := user["exec"].(map[string]interface{})
+		if mode, ok := modes[name]; ok && exec != nil {
+			exec["interactiveMode"] = mode
+		}
+	}
+	return yaml.Marshal(raw)
+}
+
+// userFormat returns how the user should authenticate, per the user URL
+// parameter. Users authenticate via kubectl's oidc auth provider by default.
+func userFormat(r *http.Request) (string, error) {
+	switch u := r.FormValue(urlParamUser); u {
+	case UserAuthProvider, UserExec:
+		return u, nil
+	case "":
+		return UserAuthProvider, nil
+	default:
+		return "", errors.Errorf("unsupported user %q: must be %s or %s", u, UserAuthProvider, UserExec)
+	}
+}
+
+// authInfo returns the kubecfg user described by the supplied parameters, who
+// authenticates per the supplied user format. Exec users' plugins are
+// configured per the supplied exec options.
+func authInfo(p *extractor.OIDCAuthenticationParams, user string, o ExecOptions) *api.AuthInfo {
+	if user != UserExec {
+		cfg := map[string]string{
+			templateOIDCClientID:     p.ClientID,
+			templateOIDCIDToken:      p.IDToken,
+			templateOIDCRefreshToken: p.RefreshToken,
+			templateOIDCIssuer:       p.IssuerURL,
+		}
+		// Public clients have no secret.
+		if p.ClientSecret != "" {
+			cfg[templateOIDCClientSecret] = p.ClientSecret
+		}
+		return &api.AuthInfo{AuthProvider: &api.AuthProviderConfig{Name: templateAuthProvider, Config: cfg}}
+	}
+
+	args := []string{"oidc-login", "get-token", "--oidc-issuer-url=" + p.IssuerURL, "--oidc-client-id=" + p.ClientID}
+	if p.ClientSecret != "" {
+		args = append(args, "--oidc-client-secret="+p.ClientSecret)
+	}
+	// kubelogin always requests the openid scope, so request only those
+	// scopes that kuberos requested in addition.
+	for _, s := range p.Scopes {
+		if s = strings.TrimSpace(s); s != "" && s != "openid" {
+			args = append(args, "--oidc-extra-scope="+s)
+		}
+	}
+	return &api.AuthInfo{Exec: &api.ExecConfig{APIVersion: o.APIVersion, Command: execCommand, Args: args}}
+}
@@ -0,0 +1,98 @@
+package kuberos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestExecOptions(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	tmpl := `apiVersion: v1
+kind: Config
+clusters:
+- name: a
+  cluster:
+    server: https://a.example.org
+- name: b
+  cluster:
+    server: https://b.example.org
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      interactiveMode: Never
+- name: c
+  cluster:
+    server: https://c.example.org
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+`
+	if err := afero.WriteFile(appFs, "template.yaml", []byte(tmpl), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	cfg, err := LoadKubeCfgTemplate("template.yaml")
+	if err != nil {
+		t.Fatalf("LoadKubeCfgTemplate(...): %v", err)
+	}
+	p := &extractor.OIDCAuthenticationParams{Username: "alice", ClientID: "id", IssuerURL: "https://example.org"}
+	y, err := writeKubeCfg(populateUser(cfg, p, UserExec))
+	if err != nil {
+		t.Fatalf("writeKubeCfg(...): %v", err)
+	}
+	got, err := clientcmd.Load(y)
+	if err != nil {
+		t.Fatalf("clientcmd.Load(...): %v", err)
+	}
+	wantUsers := map[string]string{"a": "alice", "b": "alice-b", "c": "alice-c"}
+	for cluster, user := range wantUsers {
+		if got.Contexts[cluster] == nil || got.Contexts[cluster].AuthInfo != user {
+			t.Errorf("got.Contexts[%v]: want user %v, got %+v", cluster, user, got.Contexts[cluster])
+		}
+	}
+	wantVersions := map[string]string{"alice": ExecAPIVersionV1Beta1, "alice-b": ExecAPIVersionV1, "alice-c": ExecAPIVersionV1}
+	for user, v := range wantVersions {
+		if got.AuthInfos[user] == nil || got.AuthInfos[user].Exec == nil || got.AuthInfos[user].Exec.APIVersion != v {
+			t.Errorf("got.AuthInfos[%v]: want exec apiVersion %v, got %+v", user, v, got.AuthInfos[user])
+		}
+	}
+
+	// client-go does not load interactive modes, so inspect the YAML.
+	raw := struct {
+		Users []struct {
+			Name string `json:"name"`
+			User struct {
+				Exec map[string]interface{} `json:"exec"`
+			} `json:"user"`
+		} `json:"users"`
+	}{}
+	if err := yaml.Unmarshal(y, &raw); err != nil {
+		t.Fatalf("yaml.Unmarshal(...): %v", err)
+	}
+	modes := map[string]interface{}{}
+	for _, u := range raw.Users {
+		modes[u.Name] = u.User.Exec["interactiveMode"]
+	}
+	wantModes := map[string]interface{}{"alice": nil, "alice-b": InteractiveModeNever, "alice-c": InteractiveModeIfAvailable}
+	if diff := deep.Equal(modes, wantModes); diff != nil {
+		t.Errorf("interactive modes: want != got %v", diff)
+	}
+
+	// Users who authenticate via the auth provider share a single user.
+	if ai := populateUser(cfg, p, UserAuthProvider).AuthInfos; len(ai) != 1 {
+		t.Errorf("populateUser(..., UserAuthProvider).AuthInfos: want 1 user, got %+v", ai)
+	}
+
+	invalid := strings.Replace(tmpl, "client.authentication.k8s.io/v1\n", "client.authentication.k8s.io/v2\n", 1)
+	if err := afero.WriteFile(appFs, "invalid.yaml", []byte(invalid), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	if _, err := LoadKubeCfgTemplate("invalid.yaml"); err == nil {
+		t.Errorf("LoadKubeCfgTemplate(...): want error using unsupported exec apiVersion")
+	}
+}
@@ -0,0 +1,64 @@
+package extractor
+
+import (
+	"context"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// AccessTokenClaims configures the extractor to verify the access token as a
+// JWT using the supplied verifier, and to merge the named claims from it when
+// they are absent from the ID token. This supports providers (e.g. Auth0 and
+// Azure AD) that include groups or roles only in the access token. The
+// verifier validates the access token's signature, issuer, expiry, and
+// audience, so should be configured with the audience for which the provider
+// issues access tokens.
+func AccessTokenClaims(v *oidc.IDTokenVerifier, claims ...string) Option {
+	return func(o *oidcExtractor) error {
+		if v == nil {
+			return errors.New("access token verifier cannot be nil")
+		}
+		if len(claims) == 0 {
+			return errors.New("at least one access token claim is required")
+		}
+		o.atv = v
+		o.atClaims = claims
+		return nil
+	}
+}
+
+// mergeAccessTokenClaims adds the configured claims of the supplied token's
+// access token that are absent from the supplied ID token claims.
+func (o *oidcExtractor) mergeAccessTokenClaims(ctx context.Context, token *oauth2.Token, subject string, claims map[string]interface{}) error {
+	if token.AccessToken == "" {
+		return errors.New("response missing access token")
+	}
+	at, err := o.atv.Verify(ctx, token.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, "cannot verify access token")
+	}
+
+	// Like UserInfo claims, access token claims must describe the same user.
+	if at.Subject != subject {
+		return errors.Errorf("access token subject %q does not match ID token subject %q", at.Subject, subject)
+	}
+
+	ac := map[string]interface{}{}
+	if err := at.Claims(&ac); err != nil {
+		return errors.Wrap(err, "cannot extract claims from access token")
+	}
+	for _, name := range o.atClaims {
+		v, ok := ac[name]
+		if !ok {
+			continue
+		}
+		if _, ok := claims[name]; !ok {
+			claims[name] = v
+		}
+	}
+	o.logger(ctx).Debug("merged access token claims", zap.Strings("claims", o.atClaims))
+	return nil
+}
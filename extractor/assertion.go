@@ -0,0 +1,225 @@
+package extractor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	paramClientAssertion     = "client_assertion"
+	paramClientAssertionType = "client_assertion_type"
+
+	clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// clientAssertionLifetime is how long a client assertion remains valid.
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// A clientAuth authenticates requests to OAuth 2.0 endpoints on behalf of a
+// client, by adding parameters to the request body and/or headers.
+type clientAuth interface {
+	authenticate(cfg *oauth2.Config, endpoint string, v url.Values, h http.Header) error
+}
+
+// secretAuth authenticates using the client secret per
+// https://tools.ietf.org/html/rfc6749#section-2.3.1, or identifies public
+// clients without a secret by their client ID.
+type secretAuth struct{}
+
+func (secretAuth) authenticate(cfg *oauth2.Config, _ string, v url.Values, h http.Header) error {
+	if cfg.ClientSecret == "" {
+		v.Set(paramClientID, cfg.ClientID)
+		return nil
+	}
+	creds := url.QueryEscape(cfg.ClientID) + ":" + url.QueryEscape(cfg.ClientSecret)
+	h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	return nil
+}
+
+// tlsAuth authenticates using the TLS client certificate presented by the
+// transport, identifying the client by its client ID.
+//
+// See https://tools.ietf.org/html/rfc8705#section-2
+type tlsAuth struct{}
+
+func (tlsAuth) authenticate(cfg *oauth2.Config, _ string, v url.Values, _ http.Header) error {
+	v.Set(paramClientID, cfg.ClientID)
+	return nil
+}
+
+// privateKeyJWTAuth authenticates using a JWT client assertion signed by the
+// private key read from a file. The file is read again whenever it is
+// modified, allowing the key to be rotated without restarting.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type privateKeyJWTAuth struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	signer  jose.Signer
+}
+
+func newPrivateKeyJWTAuth(path string) (*privateKeyJWTAuth, error) {
+	a := &privateKeyJWTAuth{path: path}
+	_, err := a.load()
+	return a, err
+}
+
+// load returns a signer for the key file, reading it again if it has been
+// modified since it was last read.
+func (a *privateKeyJWTAuth) load() (jose.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot stat client assertion key")
+	}
+	if a.signer != nil && fi.ModTime().Equal(a.modTime) {
+		return a.signer, nil
+	}
+
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read client assertion key")
+	}
+	keys, err := parsePrivateKeys(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse client assertion key")
+	}
+	s, err := newAssertionSigner(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	a.signer, a.modTime = s, fi.ModTime()
+	return s, nil
+}
+
+// newAssertionSigner returns a signer for the supplied key. The algorithm is
+// read from the key if it specifies one, or derived from the key's type. Keys
+// without an ID are identified by their RFC 7638 thumbprint.
+func newAssertionSigner(k jose.JSONWebKey) (jose.Signer, error) {
+	alg := jose.SignatureAlgorithm(k.Algorithm)
+	if alg == "" {
+		switch key := k.Key.(type) {
+		case *rsa.PrivateKey:
+			alg = jose.RS256
+		case *ecdsa.PrivateKey:
+			switch key.Curve {
+			case elliptic.P256():
+				alg = jose.ES256
+			case elliptic.P384():
+				alg = jose.ES384
+			case elliptic.P521():
+				alg = jose.ES512
+			}
+		}
+	}
+	if !signingAlgs[string(alg)] {
+		return nil, errors.Errorf("unsupported client assertion key type %T", k.Key)
+	}
+	if k.KeyID == "" {
+		pub := k.Public()
+		tp, err := pub.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot compute client assertion key thumbprint")
+		}
+		k.KeyID = base64.RawURLEncoding.EncodeToString(tp)
+	}
+	s, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: k}, nil)
+	return s, errors.Wrap(err, "cannot create client assertion signer")
+}
+
+type clientAssertionJSON struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// authenticate adds a client assertion whose audience is the endpoint to which
+// the request is made, e.g. the token or introspection endpoint.
+func (a *privateKeyJWTAuth) authenticate(cfg *oauth2.Config, endpoint string, v url.Values, _ http.Header) error {
+	s, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return errors.Wrap(err, "cannot generate client assertion ID")
+	}
+	now := time.Now()
+	b, err := json.Marshal(&clientAssertionJSON{
+		Issuer:    cfg.ClientID,
+		Subject:   cfg.ClientID,
+		Audience:  endpoint,
+		ID:        base64.RawURLEncoding.EncodeToString(jti),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot encode client assertion")
+	}
+	jws, err := s.Sign(b)
+	if err != nil {
+		return errors.Wrap(err, "cannot sign client assertion")
+	}
+	assertion, err := jws.CompactSerialize()
+	if err != nil {
+		return errors.Wrap(err, "cannot serialise client assertion")
+	}
+
+	v.Set(paramClientID, cfg.ClientID)
+	v.Set(paramClientAssertionType, clientAssertionTypeJWTBearer)
+	v.Set(paramClientAssertion, assertion)
+	return nil
+}
+
+// PrivateKeyJWT configures the extractor to authenticate to the OIDC
+// provider's endpoints using a JWT client assertion signed with the private
+// key in the supplied file, rather than the client secret. The file may
+// contain a JSON Web Key Set, in which case its first key is used, or a PEM
+// encoded RSA or EC private key. It is read again whenever it is modified,
+// allowing the key to be rotated without restarting.
+func PrivateKeyJWT(path string) Option {
+	return func(o *oidcExtractor) error {
+		a, err := newPrivateKeyJWTAuth(path)
+		if err != nil {
+			return err
+		}
+		o.auth = a
+		return nil
+	}
+}
+
+// TLSClientAuth configures the extractor to authenticate to the OIDC
+// provider's endpoints using mutual-TLS rather than the client secret. The
+// extractor's HTTP client must present the client's certificate; see
+// ClientCertificate.
+//
+// See https://tools.ietf.org/html/rfc8705
+func TLSClientAuth() Option {
+	return func(o *oidcExtractor) error {
+		o.auth = tlsAuth{}
+		return nil
+	}
+}
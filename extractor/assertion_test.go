@@ -0,0 +1,70 @@
+package extractor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestPrivateKeyJWTAuthAudience(t *testing.T) {
+	key := signingKey(t, "key")
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}})
+	if err != nil {
+		t.Fatalf("json.Marshal(...): %v", err)
+	}
+	f, err := ioutil.TempFile("", "kuberos-assertion-key")
+	if err != nil {
+		t.Fatalf("ioutil.TempFile(...): %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		t.Fatalf("f.Write(...): %v", err)
+	}
+	f.Close()
+
+	a, err := newPrivateKeyJWTAuth(f.Name())
+	if err != nil {
+		t.Fatalf("newPrivateKeyJWTAuth(...): %v", err)
+	}
+	cfg := &oauth2.Config{ClientID: testClientID, Endpoint: oauth2.Endpoint{TokenURL: testIssuer + "/token"}}
+
+	cases := []struct {
+		name     string
+		endpoint string
+	}{
+		{name: "Token", endpoint: testIssuer + "/token"},
+		{name: "Introspection", endpoint: testIssuer + "/introspect"},
+		{name: "Revocation", endpoint: testIssuer + "/revoke"},
+		{name: "DeviceAuthorization", endpoint: testIssuer + "/device"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			v := url.Values{}
+			if err := a.authenticate(cfg, tt.endpoint, v, http.Header{}); err != nil {
+				t.Fatalf("a.authenticate(...): %v", err)
+			}
+			jws, err := jose.ParseSigned(v.Get(paramClientAssertion))
+			if err != nil {
+				t.Fatalf("jose.ParseSigned(...): %v", err)
+			}
+			payload, err := jws.Verify(key.Public())
+			if err != nil {
+				t.Fatalf("jws.Verify(...): %v", err)
+			}
+			c := &clientAssertionJSON{}
+			if err := json.Unmarshal(payload, c); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+			if c.Audience != tt.endpoint {
+				t.Errorf("c.Audience: want %v, got %v", tt.endpoint, c.Audience)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package extractor
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// An AuditEvent describes an attempt to process an authentication response.
+// It never includes the token itself.
+type AuditEvent struct {
+	// Time at which processing completed.
+	Time time.Time
+
+	// Issuer of the token. This is the issuer configured via the Issuer
+	// option if processing failed before the token was verified.
+	Issuer string
+
+	// Subject of the token, or an empty string if processing failed before
+	// the token was verified.
+	Subject string
+
+	// ClientID of the OAuth2 client that requested the token.
+	ClientID string
+
+	// Code classifies the failure, or is empty if processing succeeded.
+	Code ErrorCode
+
+	// Reason describes the failure, or is empty if processing succeeded.
+	Reason string
+}
+
+// An AuditSink persists audit events, for example in order to maintain a
+// trail of every kubeconfig issued. Record is called synchronously each time
+// an authentication response is processed, and should return promptly.
+type AuditSink interface {
+	Record(ctx context.Context, e *AuditEvent)
+}
+
+// Audit configures the extractor to record an AuditEvent to the supplied sink
+// each time Process is called.
+func Audit(s AuditSink) Option {
+	return func(o *oidcExtractor) error {
+		if s == nil {
+			return errors.New("audit sink cannot be nil")
+		}
+		o.audit = s
+		return nil
+	}
+}
+
+// record records the outcome of processing an authentication response to the
+// extractor's audit sink, if any.
+func (o *oidcExtractor) record(ctx context.Context, cfg *oauth2.Config, p *processOptions, err error) {
+	if o.audit == nil {
+		return
+	}
+	e := &AuditEvent{Time: time.Now(), Issuer: o.issuer, ClientID: cfg.ClientID}
+	if p.issuer != "" {
+		e.Issuer = p.issuer
+	}
+	if p.verified != nil {
+		e.Issuer = p.verified.issuer
+		e.Subject = p.verified.subject
+	}
+	if err != nil {
+		e.Code = Code(err)
+		e.Reason = err.Error()
+	}
+	o.audit.Record(ctx, e)
+}
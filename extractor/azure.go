@@ -0,0 +1,123 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultGraphURL is the Microsoft Graph API endpoint used to resolve
+	// Azure AD group memberships.
+	DefaultGraphURL = "https://graph.microsoft.com/v1.0"
+
+	claimClaimNames = "_claim_names"
+	claimHasGroups  = "hasgroups"
+
+	graphGetMemberObjects = "/me/getMemberObjects"
+)
+
+// AzureGroupOverage configures the extractor to resolve the user's group
+// memberships via the supplied Microsoft Graph API endpoint when Azure AD
+// omits the groups claim because the user is a member of too many groups.
+// The access token must permit reading the user's group memberships, e.g.
+// via the GroupMember.Read.All permission.
+//
+// See https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens
+func AzureGroupOverage(graphURL string) Option {
+	return func(o *oidcExtractor) error {
+		if graphURL == "" {
+			return errors.New("graph URL cannot be empty")
+		}
+		o.graphURL = strings.TrimSuffix(graphURL, "/")
+		return nil
+	}
+}
+
+// groupsOverage returns true if Azure AD indicated the named groups claim was
+// omitted from the supplied claims, either by referencing it in _claim_names
+// or by setting the hasgroups claim.
+func groupsOverage(claims map[string]interface{}, name string) bool {
+	if _, ok := claims[name]; ok {
+		return false
+	}
+	if names, ok := claims[claimClaimNames].(map[string]interface{}); ok {
+		if _, ok := names[name]; ok {
+			return true
+		}
+	}
+	hasGroups, _ := claims[claimHasGroups].(bool)
+	return hasGroups
+}
+
+type memberObjectsJSON struct {
+	Value []string `json:"value"`
+}
+
+// graphGroups returns the IDs of the security groups of which the user that
+// owns the supplied access token is a transitive member.
+//
+// See https://docs.microsoft.com/en-us/graph/api/directoryobject-getmemberobjects
+func (o *oidcExtractor) graphGroups(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	if token.AccessToken == "" {
+		return nil, errors.New("cannot query Graph API without an access token")
+	}
+
+	body, err := json.Marshal(map[string]bool{"securityEnabledOnly": true})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode Graph API request")
+	}
+	req, err := http.NewRequest(http.MethodPost, o.graphURL+graphGetMemberObjects, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create Graph API request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	rsp, err := o.h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query Graph API")
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, responseMaxBytes))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read Graph API response")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Graph API returned %s: %s", rsp.Status, b)
+	}
+
+	mo := &memberObjectsJSON{}
+	if err := json.Unmarshal(b, mo); err != nil {
+		return nil, errors.Wrap(err, "cannot decode Graph API response")
+	}
+	return mo.Value, nil
+}
+
+// mergeGraphGroups populates the groups claim using the Graph API if Azure AD
+// indicated a groups overage.
+func (o *oidcExtractor) mergeGraphGroups(ctx context.Context, token *oauth2.Token, claims map[string]interface{}) error {
+	if !groupsOverage(claims, o.groupsClaim) {
+		return nil
+	}
+	groups, err := o.graphGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	g := make([]interface{}, len(groups))
+	for i := range groups {
+		g[i] = groups[i]
+	}
+	claims[o.groupsClaim] = g
+	o.logger(ctx).Debug("resolved groups overage", zap.Int("groups", len(groups)))
+	return nil
+}
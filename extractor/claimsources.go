@@ -0,0 +1,147 @@
+package extractor
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	claimClaimSources = "_claim_sources"
+
+	claimSourceJWT         = "JWT"
+	claimSourceEndpoint    = "endpoint"
+	claimSourceAccessToken = "access_token"
+)
+
+// ClaimSources configures the extractor to resolve aggregated and distributed
+// claims referenced by the ID token's _claim_names and _claim_sources claims.
+// A claim set is accepted only if one of the supplied verifiers, each of which
+// trusts a particular claims provider, verifies it, and it has not expired.
+// The supplied verifiers should be configured to skip their own expiry check,
+// which rejects claim sets without an expiry; the extractor instead checks the
+// expiry of claim sets that have one, tolerating the configured ClockSkew.
+// Claims present in the ID token take precedence.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#AggregatedDistributedClaims
+func ClaimSources(v ...*oidc.IDTokenVerifier) Option {
+	return func(o *oidcExtractor) error {
+		if len(v) == 0 {
+			return errors.New("at least one claim source verifier is required")
+		}
+		o.csv = v
+		return nil
+	}
+}
+
+// resolveClaimSources adds any aggregated or distributed claims that are
+// absent from the supplied ID token claims.
+func (o *oidcExtractor) resolveClaimSources(ctx context.Context, token *oauth2.Token, subject string, claims map[string]interface{}) error {
+	names, _ := claims[claimClaimNames].(map[string]interface{})
+	sources, _ := claims[claimClaimSources].(map[string]interface{})
+
+	// Claim sets are keyed by source, which may supply many claims.
+	sets := map[string]map[string]interface{}{}
+	for name, s := range names {
+		if _, ok := claims[name]; ok {
+			continue
+		}
+		src, ok := s.(string)
+		if !ok {
+			return errors.Errorf("invalid claim source for claim %q", name)
+		}
+		set, ok := sets[src]
+		if !ok {
+			cs, ok := sources[src].(map[string]interface{})
+			if !ok {
+				return errors.Errorf("claim %q references unknown claim source %q", name, src)
+			}
+			var err error
+			if set, err = o.claimSet(ctx, token, subject, cs); err != nil {
+				return errors.Wrapf(err, "cannot resolve claim source %q", src)
+			}
+			sets[src] = set
+		}
+		if v, ok := set[name]; ok {
+			claims[name] = v
+		}
+	}
+	o.logger(ctx).Debug("resolved claim sources", zap.Int("sources", len(sets)))
+	return nil
+}
+
+// claimSet returns the verified claims of the supplied claim source.
+func (o *oidcExtractor) claimSet(ctx context.Context, token *oauth2.Token, subject string, cs map[string]interface{}) (map[string]interface{}, error) {
+	raw, ok := cs[claimSourceJWT].(string)
+	if !ok {
+		endpoint, ok := cs[claimSourceEndpoint].(string)
+		if !ok {
+			return nil, errors.New("claim source has neither a JWT nor an endpoint")
+		}
+		at, ok := cs[claimSourceAccessToken].(string)
+		if !ok {
+			at = token.AccessToken
+		}
+		var err error
+		if raw, err = o.fetchClaims(ctx, endpoint, at); err != nil {
+			return nil, err
+		}
+	}
+
+	var t *oidc.IDToken
+	err := errors.New("no claim source verifiers configured")
+	for _, v := range o.csv {
+		if t, err = v.Verify(ctx, raw); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot verify claims")
+	}
+
+	// Claim sets need not expire, but must not be used once they have.
+	if !t.Expiry.IsZero() && time.Now().Add(-o.clockSkew).After(t.Expiry) {
+		return nil, errors.Errorf("claims are expired (expiry: %v)", t.Expiry)
+	}
+
+	if t.Subject != "" && t.Subject != subject {
+		return nil, errors.Errorf("claims subject %q does not match ID token subject %q", t.Subject, subject)
+	}
+
+	set := map[string]interface{}{}
+	return set, errors.Wrap(t.Claims(&set), "cannot extract claims")
+}
+
+// fetchClaims returns the JWT served by a distributed claims endpoint.
+func (o *oidcExtractor) fetchClaims(ctx context.Context, endpoint, accessToken string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create request")
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	rsp, err := o.h.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot make request")
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, responseMaxBytes))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read response")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s returned %s: %s", endpoint, rsp.Status, b)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
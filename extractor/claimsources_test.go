@@ -0,0 +1,79 @@
+package extractor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestClaimSet(t *testing.T) {
+	trusted, untrusted := signingKey(t, "trusted"), signingKey(t, "untrusted")
+	srv := serveProvider(t, trusted)
+	defer srv.Close()
+
+	ctx := context.Background()
+	p, err := oidc.NewProvider(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("oidc.NewProvider(...): %v", err)
+	}
+	o := &oidcExtractor{
+		csv:       []*oidc.IDTokenVerifier{p.Verifier(&oidc.Config{SkipClientIDCheck: true, SkipNonceCheck: true, SkipExpiryCheck: true})},
+		clockSkew: DefaultClockSkew,
+	}
+
+	now := time.Now()
+	cases := []struct {
+		name    string
+		key     jose.JSONWebKey
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:   "NoExpiry",
+			key:    trusted,
+			claims: map[string]interface{}{"iss": srv.URL, "sub": "1234", "groups": []string{"devs"}},
+		},
+		{
+			name:   "NotExpired",
+			key:    trusted,
+			claims: map[string]interface{}{"iss": srv.URL, "sub": "1234", "exp": now.Add(time.Minute).Unix()},
+		},
+		{
+			name:   "ExpiredWithinClockSkew",
+			key:    trusted,
+			claims: map[string]interface{}{"iss": srv.URL, "sub": "1234", "exp": now.Add(-DefaultClockSkew / 2).Unix()},
+		},
+		{
+			name:    "Expired",
+			key:     trusted,
+			claims:  map[string]interface{}{"iss": srv.URL, "sub": "1234", "exp": now.Add(-time.Hour).Unix()},
+			wantErr: true,
+		},
+		{
+			name:    "OtherSubject",
+			key:     trusted,
+			claims:  map[string]interface{}{"iss": srv.URL, "sub": "5678"},
+			wantErr: true,
+		},
+		{
+			name:    "UntrustedSigner",
+			key:     untrusted,
+			claims:  map[string]interface{}{"iss": srv.URL, "sub": "1234"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := map[string]interface{}{claimSourceJWT: sign(t, tt.key, tt.claims)}
+			_, err := o.claimSet(ctx, &oauth2.Token{}, "1234", cs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("o.claimSet(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+const (
+	grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	paramDeviceCode = "device_code"
+
+	errCodeAuthorizationPending = "authorization_pending"
+	errCodeSlowDown             = "slow_down"
+	errCodeAccessDenied         = "access_denied"
+	errCodeExpiredToken         = "expired_token"
+
+	// DefaultDevicePollInterval is the minimum number of seconds a client
+	// should wait between device flow polls if the provider doesn't specify.
+	DefaultDevicePollInterval = 5
+)
+
+var (
+	// ErrDeviceFlowUnsupported indicates the extractor was not configured
+	// with a device authorization endpoint.
+	ErrDeviceFlowUnsupported = errors.New("device authorization grant flow is not supported")
+
+	// ErrAuthorizationPending indicates the user has not yet completed the
+	// device authorization grant flow.
+	ErrAuthorizationPending = errors.New("authorization pending: complete authentication using the supplied user code")
+
+	// ErrSlowDown indicates the device flow is being polled too frequently.
+	ErrSlowDown = errors.New("polling too frequently: slow down")
+
+	// ErrAccessDenied indicates the user declined the device authorization
+	// request.
+	ErrAccessDenied = errors.New("device authorization request was denied")
+
+	// ErrDeviceCodeExpired indicates the device code expired before the user
+	// completed the device authorization grant flow.
+	ErrDeviceCodeExpired = errors.New("device code expired: start a new device authorization flow")
+)
+
+// DeviceAuthorization is a device authorization response.
+//
+// See https://tools.ietf.org/html/rfc8628#section-3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceAuthorizationJSON struct {
+	DeviceAuthorization
+
+	// Google returns verification_url rather than verification_uri.
+	VerificationURL string `json:"verification_url"`
+}
+
+// StartDeviceFlow requests a device and user code from the configured device
+// authorization endpoint.
+func (o *oidcExtractor) StartDeviceFlow(ctx context.Context, cfg *oauth2.Config) (*DeviceAuthorization, error) {
+	if o.deviceURL == "" {
+		return nil, ErrDeviceFlowUnsupported
+	}
+
+	v := url.Values{paramScope: {strings.Join(cfg.Scopes, " ")}}
+	body, err := clientRequest(ctx, o.h, o.auth, cfg, o.deviceURL, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot request device authorization")
+	}
+
+	da := &deviceAuthorizationJSON{}
+	if err := json.Unmarshal(body, da); err != nil {
+		return nil, errors.Wrap(err, "cannot decode device authorization response")
+	}
+	if da.VerificationURI == "" {
+		da.VerificationURI = da.VerificationURL
+	}
+	if da.Interval == 0 {
+		da.Interval = DefaultDevicePollInterval
+	}
+	o.logger(ctx).Debug("device authorization", zap.String("user_code", da.UserCode), zap.String("uri", da.VerificationURI))
+	return &da.DeviceAuthorization, nil
+}
+
+// PollDeviceFlow exchanges the supplied device code for a token. It returns
+// ErrAuthorizationPending or ErrSlowDown if the caller should poll again.
+func (o *oidcExtractor) PollDeviceFlow(ctx context.Context, cfg *oauth2.Config, deviceCode string) (*OIDCAuthenticationParams, error) {
+	if o.deviceURL == "" {
+		return nil, ErrDeviceFlowUnsupported
+	}
+
+	v := url.Values{
+		paramGrantType:  {grantTypeDeviceCode},
+		paramDeviceCode: {deviceCode},
+	}
+	token, err := o.tokenRequest(ctx, cfg, v)
+	if te, ok := err.(*TokenError); ok {
+		switch te.Code {
+		case errCodeAuthorizationPending:
+			return nil, ErrAuthorizationPending
+		case errCodeSlowDown:
+			return nil, ErrSlowDown
+		case errCodeAccessDenied:
+			return nil, ErrAccessDenied
+		case errCodeExpiredToken:
+			return nil, ErrDeviceCodeExpired
+		}
+	}
+	if err != nil {
+		return nil, o.fail(ErrorCodeExchangeFailed, errors.Wrap(err, "cannot exchange device code for token"))
+	}
+	return o.params(ctx, cfg, token, &processOptions{})
+}
@@ -0,0 +1,60 @@
+package extractor
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	paramIDTokenHint           = "id_token_hint"
+	paramPostLogoutRedirectURI = "post_logout_redirect_uri"
+)
+
+// ErrEndSessionUnsupported indicates the extractor was not configured with an
+// end session endpoint.
+var ErrEndSessionUnsupported = errors.New("RP-initiated logout is not supported")
+
+// A SessionEnder extractor can build URLs that log users out of their OIDC
+// provider session.
+type SessionEnder interface {
+	// EndSessionURL returns a URL that ends the session during which the
+	// supplied ID token was issued, then redirects the user to the supplied
+	// URI.
+	EndSessionURL(cfg *oauth2.Config, idToken, postLogoutRedirectURI string) (string, error)
+}
+
+// EndSessionEndpoint enables RP-initiated logout using the supplied end
+// session endpoint.
+func EndSessionEndpoint(u string) Option {
+	return func(o *oidcExtractor) error {
+		o.endSessionURL = u
+		return nil
+	}
+}
+
+// EndSessionURL returns the end session endpoint URL with the supplied ID
+// token hint and post logout redirect URI.
+//
+// See https://openid.net/specs/openid-connect-rpinitiated-1_0.html
+func (o *oidcExtractor) EndSessionURL(cfg *oauth2.Config, idToken, postLogoutRedirectURI string) (string, error) {
+	if o.endSessionURL == "" {
+		return "", ErrEndSessionUnsupported
+	}
+	u, err := url.Parse(o.endSessionURL)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot parse end session endpoint")
+	}
+
+	q := u.Query()
+	if idToken != "" {
+		q.Set(paramIDTokenHint, idToken)
+	}
+	if postLogoutRedirectURI != "" {
+		q.Set(paramPostLogoutRedirectURI, postLogoutRedirectURI)
+	}
+	q.Set(paramClientID, cfg.ClientID)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
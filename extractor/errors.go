@@ -0,0 +1,65 @@
+package extractor
+
+// An ErrorCode is a machine readable classification of an extractor failure.
+type ErrorCode string
+
+// Extractor error codes.
+const (
+	// ErrorCodeExchangeFailed indicates the authorization code or device code
+	// could not be exchanged for a token.
+	ErrorCodeExchangeFailed ErrorCode = "exchange_failed"
+
+	// ErrorCodeTokenMissing indicates the token endpoint did not return an ID
+	// token.
+	ErrorCodeTokenMissing ErrorCode = "token_missing"
+
+	// ErrorCodeVerifyFailed indicates the returned token could not be
+	// verified.
+	ErrorCodeVerifyFailed ErrorCode = "verify_failed"
+
+	// ErrorCodeClaimsInvalid indicates the token was verified, but its claims
+	// were missing or unacceptable.
+	ErrorCodeClaimsInvalid ErrorCode = "claims_invalid"
+)
+
+// An Error is returned by an extractor when it fails to process an
+// authentication response.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Err.Error()
+}
+
+// Cause returns the underlying error, allowing errors.Cause to unwrap it.
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+func newError(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Code returns the ErrorCode of the supplied error, or an empty ErrorCode if
+// it was not returned by an extractor.
+func Code(err error) ErrorCode {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e.Code
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return ""
+}
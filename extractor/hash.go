@@ -0,0 +1,116 @@
+package extractor
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/base64"
+
+	// Register the hash functions used by ID token signing algorithms.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	claimAccessTokenHash = "at_hash"
+	claimCodeHash        = "c_hash"
+)
+
+// A HashCheck determines how the at_hash and c_hash claims of an ID token are
+// checked against the access token and authorization code returned alongside
+// it.
+type HashCheck int
+
+// Hash check modes.
+const (
+	// HashCheckWarn logs ID tokens whose hash claims do not match.
+	HashCheckWarn HashCheck = iota
+
+	// HashCheckEnforce rejects ID tokens whose hash claims do not match.
+	HashCheckEnforce
+
+	// HashCheckDisabled does not check hash claims.
+	HashCheckDisabled
+)
+
+// ErrInvalidTokenHash indicates an ID token's at_hash or c_hash claim did not
+// match the access token or authorization code it was returned with, which
+// may indicate the token was substituted.
+var ErrInvalidTokenHash = errors.New("ID token hash claim does not match")
+
+// VerifyHashes configures how the extractor checks ID token at_hash and
+// c_hash claims. Both claims are optional in the authorization code flow, so
+// only those that are present are checked. The default is HashCheckWarn.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+func VerifyHashes(c HashCheck) Option {
+	return func(o *oidcExtractor) error {
+		o.hashCheck = c
+		return nil
+	}
+}
+
+// tokenHash returns the base64url encoded left-most half of the hash of the
+// supplied value, using the hash function of the supplied signing algorithm.
+func tokenHash(alg, value string) (string, error) {
+	var h crypto.Hash
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.RS256, jose.ES256, jose.PS256, jose.HS256:
+		h = crypto.SHA256
+	case jose.RS384, jose.ES384, jose.PS384, jose.HS384:
+		h = crypto.SHA384
+	case jose.RS512, jose.ES512, jose.PS512, jose.HS512:
+		h = crypto.SHA512
+	default:
+		return "", errors.Errorf("unsupported signing algorithm %q", alg)
+	}
+	hh := h.New()
+	hh.Write([]byte(value)) // nolint: gas
+	sum := hh.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+// checkHashes compares the at_hash and c_hash claims of the supplied signed
+// ID token with the supplied access token and authorization code.
+func checkHashes(raw string, claims map[string]interface{}, accessToken, code string) error {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse ID token")
+	}
+	if len(jws.Signatures) == 0 {
+		return errors.New("ID token is not signed")
+	}
+	alg := jws.Signatures[0].Header.Algorithm
+
+	for claim, value := range map[string]string{claimAccessTokenHash: accessToken, claimCodeHash: code} {
+		want, ok := claims[claim].(string)
+		if !ok || value == "" {
+			continue
+		}
+		got, err := tokenHash(alg, value)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			return errors.Wrap(ErrInvalidTokenHash, claim)
+		}
+	}
+	return nil
+}
+
+// hashes checks the supplied ID token's hash claims per the configured mode.
+func (j *jwtVerifier) hashes(ctx context.Context, raw string, claims map[string]interface{}, accessToken, code string) error {
+	if j.hashCheck == HashCheckDisabled {
+		return nil
+	}
+	err := checkHashes(raw, claims, accessToken, code)
+	if err != nil && j.hashCheck == HashCheckWarn {
+		LoggerFrom(ctx, j.log).Warn("ID token hash check failed", zap.Error(err))
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package extractor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+func TestTokenHash(t *testing.T) {
+	cases := []struct {
+		name    string
+		alg     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			// See https://openid.net/specs/openid-connect-core-1_0.html#code-id_tokenExample
+			name:  "RS256",
+			alg:   string(jose.RS256),
+			value: "jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y",
+			want:  "77QmUPtjPfzWtF2AnpK9RQ",
+		},
+		{
+			name:    "Unsupported",
+			alg:     "none",
+			value:   "value",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenHash(tt.alg, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tokenHash(...): want error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("tokenHash(...):\nwant %v\ngot %v\n", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckHashes(t *testing.T) {
+	key := signingKey(t, "a")
+	atHash, err := tokenHash(string(jose.RS256), "access")
+	if err != nil {
+		t.Fatalf("tokenHash(...): %v", err)
+	}
+	cHash, err := tokenHash(string(jose.RS256), "code")
+	if err != nil {
+		t.Fatalf("tokenHash(...): %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		claims      map[string]interface{}
+		accessToken string
+		code        string
+		wantErr     error
+	}{
+		{
+			name:        "BothMatch",
+			claims:      map[string]interface{}{claimAccessTokenHash: atHash, claimCodeHash: cHash},
+			accessToken: "access",
+			code:        "code",
+		},
+		{
+			name:        "NoHashClaims",
+			claims:      map[string]interface{}{},
+			accessToken: "access",
+			code:        "code",
+		},
+		{
+			name:   "NothingToCompare",
+			claims: map[string]interface{}{claimAccessTokenHash: atHash, claimCodeHash: cHash},
+		},
+		{
+			name:        "AccessTokenMismatch",
+			claims:      map[string]interface{}{claimAccessTokenHash: atHash},
+			accessToken: "other",
+			wantErr:     ErrInvalidTokenHash,
+		},
+		{
+			name:    "CodeMismatch",
+			claims:  map[string]interface{}{claimAccessTokenHash: atHash, claimCodeHash: cHash},
+			code:    "other",
+			wantErr: ErrInvalidTokenHash,
+		},
+		{
+			name:        "HashOfOtherValue",
+			claims:      map[string]interface{}{claimAccessTokenHash: cHash},
+			accessToken: "access",
+			wantErr:     ErrInvalidTokenHash,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := sign(t, key, tt.claims)
+			err := checkHashes(raw, tt.claims, tt.accessToken, tt.code)
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("checkHashes(...): want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierHashes(t *testing.T) {
+	key := signingKey(t, "a")
+	j, stop := newKeySetVerifier(t, key)
+	defer stop()
+	atHash, err := tokenHash(string(jose.RS256), "access")
+	if err != nil {
+		t.Fatalf("tokenHash(...): %v", err)
+	}
+	now := time.Now()
+
+	cases := []struct {
+		name        string
+		check       HashCheck
+		accessToken string
+		wantErr     bool
+	}{
+		{
+			name:        "EnforceMatch",
+			check:       HashCheckEnforce,
+			accessToken: "access",
+		},
+		{
+			name:        "EnforceMismatch",
+			check:       HashCheckEnforce,
+			accessToken: "substituted",
+			wantErr:     true,
+		},
+		{
+			name:        "WarnMismatch",
+			check:       HashCheckWarn,
+			accessToken: "substituted",
+		},
+		{
+			name:        "DisabledMismatch",
+			check:       HashCheckDisabled,
+			accessToken: "substituted",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			j.hashCheck = tt.check
+			raw := sign(t, key, idTokenClaims(now, map[string]interface{}{claimAccessTokenHash: atHash}))
+			token := (&oauth2.Token{AccessToken: tt.accessToken}).WithExtra(map[string]interface{}{tokenFieldIDToken: raw})
+			_, err := j.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, token, &processOptions{nonce: testNonce})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("j.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package extractor
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// DecryptionKeys configures the extractor to decrypt ID tokens encrypted as
+// JWEs before verifying them. The supplied keys may be either a JSON Web Key
+// Set or PEM encoded RSA or EC private keys. The decrypted, signed ID token is
+// returned in place of the encrypted one, as the API server cannot decrypt it.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#Encryption
+func DecryptionKeys(keys []byte) Option {
+	return func(o *oidcExtractor) error {
+		k, err := parsePrivateKeys(keys)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse decryption keys")
+		}
+		o.decryptionKeys = append(o.decryptionKeys, k...)
+		return nil
+	}
+}
+
+func parsePrivateKeys(b []byte) ([]jose.JSONWebKey, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		ks := &jose.JSONWebKeySet{}
+		if err := json.Unmarshal(b, ks); err != nil {
+			return nil, errors.Wrap(err, "cannot decode JSON Web Key Set")
+		}
+		if len(ks.Keys) == 0 {
+			return nil, errors.New("JSON Web Key Set contains no keys")
+		}
+		return ks.Keys, nil
+	}
+
+	var keys []jose.JSONWebKey
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		k, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jose.JSONWebKey{Key: k})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded private keys found")
+	}
+	return keys, nil
+}
+
+func parsePrivateKey(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, errors.Errorf("unsupported PEM block type %q", block.Type)
+}
+
+// isEncrypted returns true if the supplied compact serialised token is a JWE,
+// which has five parts rather than a JWS's three.
+func isEncrypted(raw string) bool {
+	return strings.Count(raw, ".") == 4
+}
+
+// decrypt returns the plaintext of the supplied JWE, trying each key that
+// matches its key ID, or every key if it has none.
+func decrypt(raw string, keys []jose.JSONWebKey) (string, error) {
+	jwe, err := jose.ParseEncrypted(raw)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot parse JWE")
+	}
+
+	err = errors.New("no decryption keys configured")
+	for _, k := range keys {
+		if jwe.Header.KeyID != "" && k.KeyID != "" && jwe.Header.KeyID != k.KeyID {
+			continue
+		}
+		var b []byte
+		if b, err = jwe.Decrypt(k.Key); err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	return "", errors.Wrap(err, "cannot decrypt JWE")
+}
@@ -0,0 +1,226 @@
+package extractor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// decryptionKey returns a new RSA decryption key with the supplied key ID.
+func decryptionKey(t *testing.T, kid string) jose.JSONWebKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(...): %v", err)
+	}
+	return jose.JSONWebKey{Key: k, KeyID: kid, Algorithm: string(jose.RSA_OAEP), Use: "enc"}
+}
+
+// encrypt returns a compact JWE of the supplied plaintext encrypted to the
+// public half of the supplied key, identified by the supplied key ID.
+func encrypt(t *testing.T, key jose.JSONWebKey, kid, plaintext string) string {
+	t.Helper()
+	e, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: key.Public().Key, KeyID: kid}, nil)
+	if err != nil {
+		t.Fatalf("jose.NewEncrypter(...): %v", err)
+	}
+	jwe, err := e.Encrypt([]byte(plaintext))
+	if err != nil {
+		t.Fatalf("e.Encrypt(...): %v", err)
+	}
+	raw, err := jwe.CompactSerialize()
+	if err != nil {
+		t.Fatalf("jwe.CompactSerialize(): %v", err)
+	}
+	return raw
+}
+
+func TestDecrypt(t *testing.T) {
+	a, b := decryptionKey(t, "a"), decryptionKey(t, "b")
+	anonymous := a
+	anonymous.KeyID = ""
+	renamed := a
+	renamed.KeyID = "renamed"
+
+	cases := []struct {
+		name    string
+		raw     string
+		keys    []jose.JSONWebKey
+		wantErr bool
+	}{
+		{
+			name: "MatchingKeyID",
+			raw:  encrypt(t, a, "a", "plaintext"),
+			keys: []jose.JSONWebKey{b, a},
+		},
+		{
+			name: "NoKeyIDInHeader",
+			raw:  encrypt(t, a, "", "plaintext"),
+			keys: []jose.JSONWebKey{b, a},
+		},
+		{
+			name: "NoKeyIDOnKey",
+			raw:  encrypt(t, a, "a", "plaintext"),
+			keys: []jose.JSONWebKey{anonymous},
+		},
+		{
+			name:    "OtherKeyID",
+			raw:     encrypt(t, a, "a", "plaintext"),
+			keys:    []jose.JSONWebKey{renamed},
+			wantErr: true,
+		},
+		{
+			name:    "WrongKey",
+			raw:     encrypt(t, a, "", "plaintext"),
+			keys:    []jose.JSONWebKey{b},
+			wantErr: true,
+		},
+		{
+			name:    "NoKeys",
+			raw:     encrypt(t, a, "a", "plaintext"),
+			wantErr: true,
+		},
+		{
+			name:    "NotJWE",
+			raw:     "a.b.c.d.e",
+			keys:    []jose.JSONWebKey{a},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.raw, tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decrypt(...): want error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && got != "plaintext" {
+				t.Errorf("decrypt(...):\nwant plaintext\ngot %v\n", got)
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeys(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(...): %v", err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	ec, err := x509.MarshalECPrivateKey(ek)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey(...): %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rk)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey(...): %v", err)
+	}
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: rk, KeyID: "a"}}})
+	if err != nil {
+		t.Fatalf("json.Marshal(...): %v", err)
+	}
+	pemBlock := func(typ string, b []byte) []byte { return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}) }
+
+	cases := []struct {
+		name     string
+		keys     []byte
+		wantKeys int
+		wantErr  bool
+	}{
+		{
+			name:     "JSONWebKeySet",
+			keys:     jwks,
+			wantKeys: 1,
+		},
+		{
+			name:    "EmptyJSONWebKeySet",
+			keys:    []byte(`{"keys":[]}`),
+			wantErr: true,
+		},
+		{
+			name:     "PEM",
+			keys:     append(append(pemBlock("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rk)), pemBlock("EC PRIVATE KEY", ec)...), pemBlock("PRIVATE KEY", pkcs8)...),
+			wantKeys: 3,
+		},
+		{
+			name:    "UnsupportedPEMBlock",
+			keys:    pemBlock("CERTIFICATE", []byte("cert")),
+			wantErr: true,
+		},
+		{
+			name:    "NoKeys",
+			keys:    []byte("keys"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parsePrivateKeys(tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrivateKeys(...): want error %v, got %v", tt.wantErr, err)
+			}
+			if len(keys) != tt.wantKeys {
+				t.Errorf("parsePrivateKeys(...): want %d keys, got %d", tt.wantKeys, len(keys))
+			}
+		})
+	}
+}
+
+func TestJWTVerifierEncrypted(t *testing.T) {
+	key, dk := signingKey(t, "a"), decryptionKey(t, "enc")
+	j, stop := newKeySetVerifier(t, key)
+	defer stop()
+	j.keys = []jose.JSONWebKey{dk}
+	signed := sign(t, key, idTokenClaims(time.Now(), nil))
+
+	cases := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{
+			name: "Encrypted",
+			raw:  encrypt(t, dk, "enc", signed),
+		},
+		{
+			name: "Signed",
+			raw:  signed,
+		},
+		{
+			name:    "EncryptedToOtherKey",
+			raw:     encrypt(t, decryptionKey(t, "enc"), "enc", signed),
+			wantErr: true,
+		},
+		{
+			name:    "EncryptedUnsigned",
+			raw:     encrypt(t, dk, "enc", `{"iss":"`+testIssuer+`"}`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			vt, err := j.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, withIDToken(tt.raw), &processOptions{nonce: testNonce})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("j.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && vt.raw != signed {
+				t.Errorf("j.verify(...): want the decrypted, signed ID token")
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// DefaultKeySetTTL is the default interval at which a KeySet refreshes
+	// its cached signing keys.
+	DefaultKeySetTTL = 1 * time.Hour
+
+	// minKeySetRefreshInterval limits how often a token signed by an unknown
+	// key may cause a KeySet to refresh its cached signing keys.
+	minKeySetRefreshInterval = 10 * time.Second
+
+	// keySetRefreshTimeout bounds each refresh of a KeySet's cached signing
+	// keys, which run independently of the requests that wait for them.
+	keySetRefreshTimeout = 30 * time.Second
+
+	keyUseEncryption = "enc"
+)
+
+// signingAlgs are the JWS algorithms permitted for ID token signatures.
+// Symmetric algorithms are excluded; kuberos verifies tokens using published
+// public keys.
+var signingAlgs = map[string]bool{
+	string(jose.RS256): true,
+	string(jose.RS384): true,
+	string(jose.RS512): true,
+	string(jose.ES256): true,
+	string(jose.ES384): true,
+	string(jose.ES512): true,
+	string(jose.PS256): true,
+	string(jose.PS384): true,
+	string(jose.PS512): true,
+}
+
+// A KeySetRecorder records metrics about a KeySet's cached signing keys.
+// Each method is supplied the issuer whose keys are cached.
+type KeySetRecorder interface {
+	// KeyLookup records whether a token's signing key was found in the
+	// cache without refreshing it.
+	KeyLookup(issuer string, hit bool)
+
+	// KeyRefresh records the outcome of refreshing the cached signing keys.
+	KeyRefresh(issuer string, err error)
+}
+
+type nopKeySetRecorder struct{}
+
+func (nopKeySetRecorder) KeyLookup(_ string, _ bool)   {}
+func (nopKeySetRecorder) KeyRefresh(_ string, _ error) {}
+
+// A KeySetOption configures a KeySet.
+type KeySetOption func(*KeySet) error
+
+// KeySetTTL configures the interval at which a KeySet refreshes its cached
+// signing keys in the background.
+func KeySetTTL(d time.Duration) KeySetOption {
+	return func(k *KeySet) error {
+		if d <= 0 {
+			return errors.New("key set TTL must be positive")
+		}
+		k.ttl = d
+		return nil
+	}
+}
+
+// KeySetMetrics configures a KeySet to report metrics to the supplied
+// KeySetRecorder.
+func KeySetMetrics(r KeySetRecorder) KeySetOption {
+	return func(k *KeySet) error {
+		if r == nil {
+			return errors.New("key set metrics recorder cannot be nil")
+		}
+		k.rec = r
+		return nil
+	}
+}
+
+// KeySetLogger configures a KeySet to log background refresh failures to
+// the supplied logger.
+func KeySetLogger(l *zap.Logger) KeySetOption {
+	return func(k *KeySet) error {
+		k.log = l
+		return nil
+	}
+}
+
+// A KeySet caches the signing keys an OIDC provider publishes at its
+// jwks_uri. Keys are refreshed in the background every TTL, and on demand
+// when a token is signed by a key that is not cached.
+type KeySet struct {
+	h      *http.Client
+	issuer string
+	url    string
+	ttl    time.Duration
+	rec    KeySetRecorder
+	log    *zap.Logger
+
+	flight singleflight
+
+	mu      sync.RWMutex
+	keys    []jose.JSONWebKey
+	fetched time.Time
+}
+
+// NewKeySet returns a KeySet that caches the signing keys published by the
+// supplied issuer at the supplied JWKS URL. The keys are fetched before
+// NewKeySet returns, then refreshed in the background until the supplied
+// context is cancelled.
+func NewKeySet(ctx context.Context, h *http.Client, issuer, jwksURL string, ko ...KeySetOption) (*KeySet, error) {
+	if jwksURL == "" {
+		return nil, errors.New("JWKS URL cannot be empty")
+	}
+	k := &KeySet{h: h, issuer: issuer, url: jwksURL, ttl: DefaultKeySetTTL, rec: nopKeySetRecorder{}, log: zap.NewNop()}
+	for _, o := range ko {
+		if err := o(k); err != nil {
+			return nil, errors.Wrap(err, "cannot apply key set option")
+		}
+	}
+	if err := k.update(ctx); err != nil {
+		return nil, err
+	}
+	go k.run(ctx)
+	return k, nil
+}
+
+// run refreshes the cached keys every TTL until the supplied context is
+// cancelled. Keys that cannot be refreshed remain cached until the next
+// successful refresh.
+func (k *KeySet) run(ctx context.Context) {
+	t := time.NewTicker(k.ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := k.flight.do(ctx, k.refresh); err != nil {
+				k.log.Info("cannot refresh signing keys", zap.String("issuer", k.issuer), zap.Error(err))
+			}
+		}
+	}
+}
+
+// refresh fetches and caches the provider's signing keys, independently of
+// any request that is waiting for them, so that a waiting request that is
+// cancelled does not fail the refresh for others that share it.
+func (k *KeySet) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), keySetRefreshTimeout)
+	defer cancel()
+	return k.update(ctx)
+}
+
+// update fetches and caches the provider's signing keys.
+func (k *KeySet) update(ctx context.Context) error {
+	keys, err := k.fetch(ctx)
+	k.rec.KeyRefresh(k.issuer, err)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.fetched = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// fetch returns the signing keys published at the KeySet's JWKS URL.
+func (k *KeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest(http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create JWKS request")
+	}
+	rsp, err := k.h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch JWKS")
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, responseMaxBytes))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read JWKS response")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("JWKS endpoint returned %s: %s", rsp.Status, b)
+	}
+
+	ks := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(b, ks); err != nil {
+		return nil, errors.Wrap(err, "cannot decode JWKS response")
+	}
+	keys := make([]jose.JSONWebKey, 0, len(ks.Keys))
+	for _, key := range ks.Keys {
+		if key.Use != keyUseEncryption {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// lookup returns the cached keys matching the supplied key ID, or all cached
+// keys if the key ID is empty.
+func (k *KeySet) lookup(kid string) []jose.JSONWebKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" {
+		return k.keys
+	}
+	var keys []jose.JSONWebKey
+	for _, key := range k.keys {
+		if key.KeyID == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// refreshFor refreshes the cached keys because a token was signed by the
+// supplied unknown key, unless they were refreshed very recently. Concurrent
+// refreshes, e.g. by many users logging in just after the provider rotated
+// its keys, are coalesced into a single request to the provider. It stops
+// waiting for the refresh when the supplied context is done.
+func (k *KeySet) refreshFor(ctx context.Context, kid string) error {
+	k.mu.RLock()
+	recent := time.Since(k.fetched) < minKeySetRefreshInterval
+	k.mu.RUnlock()
+	if recent {
+		return nil
+	}
+	shared, err := k.flight.do(ctx, k.refresh)
+	k.log.Debug("refreshed signing keys", zap.String("issuer", k.issuer), zap.String("kid", kid), zap.Bool("shared", shared))
+	return err
+}
+
+// verify verifies the signature of the supplied compact serialised JWS,
+// returning its payload.
+func (k *KeySet) verify(ctx context.Context, raw string) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse JWS")
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.Errorf("expected exactly one signature, got %d", len(jws.Signatures))
+	}
+	h := jws.Signatures[0].Header
+	if !signingAlgs[h.Algorithm] {
+		return nil, errors.Errorf("unsupported signing algorithm %q", h.Algorithm)
+	}
+
+	keys := k.lookup(h.KeyID)
+	k.rec.KeyLookup(k.issuer, len(keys) > 0)
+	if len(keys) == 0 {
+		if err := k.refreshFor(ctx, h.KeyID); err != nil {
+			return nil, errors.Wrap(err, "cannot refresh signing keys")
+		}
+		keys = k.lookup(h.KeyID)
+	}
+	for _, key := range keys {
+		if payload, err := jws.Verify(key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.Errorf("cannot verify signature using any signing key with ID %q", h.KeyID)
+}
+
+// SigningKeys configures the extractor to verify ID token signatures using
+// the supplied KeySet, rather than fetching the provider's signing keys as
+// needed while verifying each token. The KeySet's issuer must match the ID
+// token's iss claim.
+func SigningKeys(ks *KeySet) Option {
+	return func(o *oidcExtractor) error {
+		if ks == nil {
+			return errors.New("key set cannot be nil")
+		}
+		o.keySet = ks
+		return nil
+	}
+}
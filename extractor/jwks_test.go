@@ -0,0 +1,239 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// A jwksServer serves a JWKS that may be rotated, counting requests for it.
+type jwksServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	requests int
+
+	// block, if not nil, delays responses until it is closed. started is
+	// signalled when a blocked request arrives.
+	block   chan struct{}
+	started chan struct{}
+}
+
+func newJWKSServer(keys ...jose.JSONWebKey) *jwksServer {
+	s := &jwksServer{}
+	s.rotate(keys...)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		block, started := s.block, s.started
+		ks := jose.JSONWebKeySet{Keys: s.keys}
+		s.mu.Unlock()
+		if block != nil {
+			started <- struct{}{}
+			<-block
+		}
+		json.NewEncoder(w).Encode(ks) // nolint: errcheck
+	}))
+	return s
+}
+
+// rotate replaces the served keys with the public halves of the supplied keys.
+func (s *jwksServer) rotate(keys ...jose.JSONWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = nil
+	for _, k := range keys {
+		s.keys = append(s.keys, k.Public())
+	}
+}
+
+func (s *jwksServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// A waitingContext signals when a caller first waits for it to be done.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func newWaitingContext() *waitingContext {
+	return &waitingContext{Context: context.Background(), waiting: make(chan struct{})}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
+
+func TestKeySetVerify(t *testing.T) {
+	old, rotated, unknown := signingKey(t, "old"), signingKey(t, "rotated"), signingKey(t, "unknown")
+	hmac := jose.JSONWebKey{Key: []byte("secretsecretsecretsecretsecret!!"), KeyID: "old", Algorithm: string(jose.HS256)}
+	claims := map[string]interface{}{claimIssuer: testIssuer}
+
+	cases := []struct {
+		name string
+		// stale keys may be refreshed on demand.
+		stale   bool
+		raw     func(t *testing.T) string
+		wantErr bool
+	}{
+		{
+			name: "CachedKey",
+			raw:  func(t *testing.T) string { return sign(t, old, claims) },
+		},
+		{
+			name:  "RotatedKey",
+			stale: true,
+			raw:   func(t *testing.T) string { return sign(t, rotated, claims) },
+		},
+		{
+			name:    "RotatedKeyRecentlyRefreshed",
+			raw:     func(t *testing.T) string { return sign(t, rotated, claims) },
+			wantErr: true,
+		},
+		{
+			name:    "UnknownKey",
+			stale:   true,
+			raw:     func(t *testing.T) string { return sign(t, unknown, claims) },
+			wantErr: true,
+		},
+		{
+			name: "SymmetricAlgorithm",
+			raw: func(t *testing.T) string {
+				s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: hmac}, nil)
+				if err != nil {
+					t.Fatalf("jose.NewSigner(...): %v", err)
+				}
+				jws, err := s.Sign([]byte(`{"iss":"` + testIssuer + `"}`))
+				if err != nil {
+					t.Fatalf("s.Sign(...): %v", err)
+				}
+				raw, _ := jws.CompactSerialize()
+				return raw
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newJWKSServer(old)
+			defer srv.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			k, err := NewKeySet(ctx, srv.Client(), testIssuer, srv.URL)
+			if err != nil {
+				t.Fatalf("NewKeySet(...): %v", err)
+			}
+			srv.rotate(old, rotated)
+			if tt.stale {
+				k.mu.Lock()
+				k.fetched = time.Now().Add(-2 * minKeySetRefreshInterval)
+				k.mu.Unlock()
+			}
+
+			_, err = k.verify(ctx, tt.raw(t))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("k.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestKeySetRefreshCancelled(t *testing.T) {
+	old, rotated := signingKey(t, "old"), signingKey(t, "rotated")
+	srv := newJWKSServer(old)
+	defer srv.Close()
+
+	bg, stop := context.WithCancel(context.Background())
+	defer stop()
+	k, err := NewKeySet(bg, srv.Client(), testIssuer, srv.URL)
+	if err != nil {
+		t.Fatalf("NewKeySet(...): %v", err)
+	}
+	srv.rotate(old, rotated)
+	k.mu.Lock()
+	k.fetched = time.Now().Add(-2 * minKeySetRefreshInterval)
+	k.mu.Unlock()
+
+	block, started := make(chan struct{}), make(chan struct{}, 1)
+	srv.mu.Lock()
+	srv.block, srv.started = block, started
+	srv.mu.Unlock()
+
+	// The first caller gives up while the refresh is in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() { first <- k.refreshFor(ctx, "rotated") }()
+	<-started
+	cancel()
+	if err := <-first; errors.Cause(err) != context.Canceled {
+		t.Errorf("k.refreshFor(...): want %v, got %v", context.Canceled, err)
+	}
+
+	// Others waiting on the same refresh still receive the rotated key.
+	wctx := newWaitingContext()
+	second := make(chan error)
+	go func() { second <- k.refreshFor(wctx, "rotated") }()
+	<-wctx.waiting
+	close(block)
+	if err := <-second; err != nil {
+		t.Errorf("k.refreshFor(...): %v", err)
+	}
+	if _, err := k.verify(context.Background(), sign(t, rotated, map[string]interface{}{})); err != nil {
+		t.Errorf("k.verify(...): %v", err)
+	}
+	if got, want := srv.count(), 2; got != want {
+		t.Errorf("JWKS requests:\nwant %v\ngot %v\n", want, got)
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	s := &singleflight{}
+	release := make(chan struct{})
+	boom := errors.New("boom")
+	calls := 0
+	fn := func() error {
+		calls++
+		<-release
+		return boom
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.do(ctx, fn); err != context.Canceled {
+		t.Errorf("s.do(cancelled, ...): want %v, got %v", context.Canceled, err)
+	}
+
+	wctx := newWaitingContext()
+	shared, err := make(chan bool, 1), make(chan error, 1)
+	go func() {
+		sh, e := s.do(wctx, func() error { calls++; return nil })
+		shared <- sh
+		err <- e
+	}()
+	<-wctx.waiting
+	close(release)
+	if e := <-err; e != boom {
+		t.Errorf("s.do(...): want %v, got %v", boom, e)
+	}
+	if !<-shared {
+		t.Errorf("s.do(...): want shared result")
+	}
+	if calls != 1 {
+		t.Errorf("calls:\nwant 1\ngot %v\n", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package extractor
+
+import (
+	"sort"
+)
+
+const (
+	claimRealmAccess    = "realm_access"
+	claimResourceAccess = "resource_access"
+	claimRoles          = "roles"
+)
+
+// KeycloakRolesConfig configures how Keycloak roles are added to the user's
+// groups.
+type KeycloakRolesConfig struct {
+	// RealmPrefix is prepended to each realm role.
+	RealmPrefix string
+
+	// ClientPrefix is prepended to each client role, which is otherwise
+	// formatted as <client>:<role>.
+	ClientPrefix string
+
+	// Clients whose roles should be included. The roles of all clients are
+	// included if empty.
+	Clients []string
+}
+
+// KeycloakRoles configures the extractor to add the roles found in Keycloak's
+// realm_access and resource_access claims to the user's groups, removing
+// the need for a Keycloak protocol mapper to populate a groups claim.
+func KeycloakRoles(cfg KeycloakRolesConfig) Option {
+	return func(o *oidcExtractor) error {
+		o.keycloak = &cfg
+		return nil
+	}
+}
+
+// roles returns the Keycloak roles in the supplied claims, prefixed per the
+// config.
+func (cfg *KeycloakRolesConfig) roles(claims map[string]interface{}) []string {
+	var roles []string
+	if ra, ok := claims[claimRealmAccess].(map[string]interface{}); ok {
+		for _, r := range stringsClaim(ra, claimRoles) {
+			roles = append(roles, cfg.RealmPrefix+r)
+		}
+	}
+
+	ra, ok := claims[claimResourceAccess].(map[string]interface{})
+	if !ok {
+		return roles
+	}
+	clients := cfg.Clients
+	if len(clients) == 0 {
+		for c := range ra {
+			clients = append(clients, c)
+		}
+		sort.Strings(clients)
+	}
+	for _, c := range clients {
+		access, ok := ra[c].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, r := range stringsClaim(access, claimRoles) {
+			roles = append(roles, cfg.ClientPrefix+c+":"+r)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,30 @@
+package extractor
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of the supplied context carrying the supplied
+// logger. The extractor logs to the logger carried by the context it is
+// supplied, if any, allowing callers to annotate its log lines, e.g. with a
+// request ID.
+func WithLogger(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger carried by the supplied context, or the
+// supplied fallback logger if it carries none.
+func LoggerFrom(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return fallback
+}
+
+func (o *oidcExtractor) logger(ctx context.Context) *zap.Logger {
+	return LoggerFrom(ctx, o.log)
+}
@@ -0,0 +1,185 @@
+package extractor
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// mappingFuncs are available to claim mapping templates. Functions that
+// operate on a string take it as their final argument so they may be used in
+// pipelines, e.g. {{ .upn | lower | trimSuffix "@example.org" }}.
+var mappingFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, v interface{}) string { return strings.Join(toStrings(v), sep) },
+}
+
+// A claimMapping derives a value from the raw claims of a verified token.
+// Referencing a claim the token does not include is an error; optional claims
+// may be referenced using index, e.g. {{ with index . "nickname" }}.
+type claimMapping struct {
+	t *template.Template
+}
+
+func newClaimMapping(name, text string) (*claimMapping, error) {
+	t, err := template.New(name).Funcs(mappingFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s template", name)
+	}
+	return &claimMapping{t: t}, nil
+}
+
+// apply executes the mapping's template with the supplied claims as its data,
+// returning the trimmed output.
+func (m *claimMapping) apply(claims map[string]interface{}) (string, error) {
+	b := &bytes.Buffer{}
+	if err := m.t.Execute(b, claims); err != nil {
+		return "", errors.Wrapf(err, "cannot execute %s template", m.t.Name())
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// UsernameTemplate configures the extractor to derive the Kubernetes username
+// written to the kubeconfig by executing the supplied Go template with the
+// raw token claims as its data, rather than reading the username claim
+// directly. For example {{ .upn | lower | trimSuffix "@example.org" }}.
+func UsernameTemplate(text string) Option {
+	return func(o *oidcExtractor) error {
+		m, err := newClaimMapping("username", text)
+		if err != nil {
+			return err
+		}
+		o.usernameMapping = m
+		return nil
+	}
+}
+
+// GroupsTemplate configures the extractor to derive the user's groups by
+// executing the supplied Go template with the raw token claims as its data,
+// rather than reading the groups claim directly. The template should emit one
+// group per line; blank lines are ignored. For example
+// {{ range .roles }}{{ . | lower }}{{ "\n" }}{{ end }}.
+func GroupsTemplate(text string) Option {
+	return func(o *oidcExtractor) error {
+		m, err := newClaimMapping("groups", text)
+		if err != nil {
+			return err
+		}
+		o.groupsMapping = m
+		return nil
+	}
+}
+
+// NamespaceClaim configures the extractor to read the namespace in which the
+// user works by default from the supplied ID token claim, e.g. team. The
+// namespace is written to the contexts of the user's kubeconfig.
+func NamespaceClaim(claim string) Option {
+	return func(o *oidcExtractor) error {
+		o.namespaceClaim = claim
+		return nil
+	}
+}
+
+// GroupNamespaces configures the extractor to derive the namespace in which
+// the user works by default from their groups, per the supplied map of group
+// to namespace, e.g. team-payments to payments. A namespace claim takes
+// precedence over groups.
+func GroupNamespaces(m map[string]string) Option {
+	return func(o *oidcExtractor) error {
+		for g, ns := range m {
+			if g == "" || ns == "" {
+				return errors.Errorf("invalid group namespace mapping %q=%q", g, ns)
+			}
+		}
+		o.groupNamespaces = m
+		return nil
+	}
+}
+
+func (o *oidcExtractor) username(claims map[string]interface{}) (string, error) {
+	if o.usernameMapping == nil {
+		username, _ := claims[o.usernameClaim].(string)
+		if username == "" {
+			return "", errors.Errorf("ID token missing username claim %q", o.usernameClaim)
+		}
+		return username, nil
+	}
+
+	username, err := o.usernameMapping.apply(claims)
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		return "", errors.New("username template produced an empty username")
+	}
+	return username, nil
+}
+
+func (o *oidcExtractor) groups(claims map[string]interface{}) ([]string, error) {
+	if o.groupsMapping == nil {
+		return stringsClaim(claims, o.groupsClaim), nil
+	}
+
+	out, err := o.groupsMapping.apply(claims)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, g := range strings.Split(out, "\n") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// namespace returns the user's namespace claim if the token includes one, or
+// else the namespace to which the user's groups are mapped. Users who are
+// members of several mapped groups are assigned the namespace of the group
+// whose name sorts first, so that their kubeconfig is stable.
+func (o *oidcExtractor) namespace(claims map[string]interface{}, groups []string) string {
+	if o.namespaceClaim != "" {
+		if ns, _ := claims[o.namespaceClaim].(string); ns != "" {
+			return ns
+		}
+	}
+	mapped := []string{}
+	for _, g := range groups {
+		if _, ok := o.groupNamespaces[g]; ok {
+			mapped = append(mapped, g)
+		}
+	}
+	if len(mapped) == 0 {
+		return ""
+	}
+	sort.Strings(mapped)
+	return o.groupNamespaces[mapped[0]]
+}
+
+// toStrings converts a claim value to a slice of strings, formatting any
+// non-string elements.
+func toStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			ss = append(ss, fmt.Sprint(e))
+		}
+		return ss
+	}
+	return []string{fmt.Sprint(v)}
+}
@@ -0,0 +1,56 @@
+package extractor
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Recorder records metrics about the extractor's interactions with the OIDC
+// provider, for example in order to export them to Prometheus. Each method is
+// supplied the issuer configured via the Issuer option.
+type Recorder interface {
+	// ObserveExchange records the latency and outcome of a token endpoint
+	// request, including any retries.
+	ObserveExchange(issuer string, d time.Duration, err error)
+
+	// ObserveVerification records the latency and outcome of verifying a
+	// token.
+	ObserveVerification(issuer string, d time.Duration, err error)
+
+	// Failure records a failure to process an authentication response.
+	Failure(issuer string, code ErrorCode)
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) ObserveExchange(_ string, _ time.Duration, _ error)     {}
+func (nopRecorder) ObserveVerification(_ string, _ time.Duration, _ error) {}
+func (nopRecorder) Failure(_ string, _ ErrorCode)                          {}
+
+// Metrics configures the extractor to report metrics to the supplied Recorder.
+func Metrics(r Recorder) Option {
+	return func(o *oidcExtractor) error {
+		if r == nil {
+			return errors.New("metrics recorder cannot be nil")
+		}
+		o.rec = r
+		return nil
+	}
+}
+
+// Issuer configures the issuer URL by which the extractor identifies its OIDC
+// provider when reporting metrics.
+func Issuer(u string) Option {
+	return func(o *oidcExtractor) error {
+		o.issuer = u
+		return nil
+	}
+}
+
+// fail records a failure to process an authentication response, returning it
+// as an *Error with the supplied code.
+func (o *oidcExtractor) fail(code ErrorCode, err error) error {
+	o.rec.Failure(o.issuer, code)
+	return newError(code, err)
+}
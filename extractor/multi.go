@@ -0,0 +1,74 @@
+package extractor
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrMissingIssuer indicates a multi issuer extractor was not told which
+	// issuer a flow was started with.
+	ErrMissingIssuer = errors.New("missing issuer")
+
+	// ErrUnknownIssuer indicates a flow was started with an issuer for which
+	// no extractor is configured.
+	ErrUnknownIssuer = errors.New("unknown issuer")
+)
+
+// ForIssuer supplies the issuer URL of the OIDC provider with which the flow
+// being processed was started. It is required by multi issuer extractors.
+func ForIssuer(u string) ProcessOption {
+	return func(p *processOptions) {
+		p.issuer = u
+	}
+}
+
+// An IssuerConfig configures how a multi issuer extractor processes flows
+// started with a particular issuer.
+type IssuerConfig struct {
+	// Extractor processes the issuer's authentication responses.
+	Extractor Extractor
+
+	// OAuth2 configures the issuer's OAuth 2.0 client. Its RedirectURL is
+	// ignored in favour of that of the config supplied to Process.
+	OAuth2 *oauth2.Config
+}
+
+type multiIssuerExtractor struct {
+	issuers map[string]IssuerConfig
+}
+
+// NewMultiIssuer creates an extractor that processes authentication responses
+// using the extractor and OAuth 2.0 client configured for the issuer supplied
+// via ForIssuer, allowing one kuberos to serve several OIDC providers.
+func NewMultiIssuer(issuers map[string]IssuerConfig) (Extractor, error) {
+	if len(issuers) == 0 {
+		return nil, errors.New("at least one issuer is required")
+	}
+	for iss, ic := range issuers {
+		if ic.Extractor == nil || ic.OAuth2 == nil {
+			return nil, errors.Errorf("issuer %q requires an extractor and an OAuth2 config", iss)
+		}
+	}
+	return &multiIssuerExtractor{issuers: issuers}, nil
+}
+
+func (m *multiIssuerExtractor) Process(ctx context.Context, cfg *oauth2.Config, code string, po ...ProcessOption) (*OIDCAuthenticationParams, error) {
+	p := &processOptions{}
+	for _, opt := range po {
+		opt(p)
+	}
+	if p.issuer == "" {
+		return nil, newError(ErrorCodeExchangeFailed, ErrMissingIssuer)
+	}
+	ic, ok := m.issuers[p.issuer]
+	if !ok {
+		return nil, newError(ErrorCodeExchangeFailed, errors.Wrapf(ErrUnknownIssuer, "%q", p.issuer))
+	}
+
+	c := *ic.OAuth2
+	c.RedirectURL = cfg.RedirectURL
+	return ic.Extractor.Process(ctx, &c, code, po...)
+}
@@ -3,42 +3,183 @@ package extractor
 import (
 	"context"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
 )
 
-const tokenFieldIDToken = "id_token"
+const (
+	tokenFieldIDToken = "id_token"
 
-// ErrMissingIDToken indicates a response that does not contain an id_token.
-var ErrMissingIDToken = errors.New("response missing ID token")
+	claimEmail = "email"
+)
+
+const (
+	// DefaultUsernameClaim is the ID token claim used as the Kubernetes
+	// username when no other claim is configured.
+	DefaultUsernameClaim = claimEmail
+
+	// DefaultGroupsClaim is the ID token claim from which the user's groups
+	// are read when no other claim is configured.
+	DefaultGroupsClaim = "groups"
+)
+
+var (
+	// ErrMissingIDToken indicates a response that does not contain an
+	// id_token.
+	ErrMissingIDToken = errors.New("response missing ID token")
+
+	// ErrInvalidNonce indicates an ID token's nonce claim did not match the
+	// nonce sent with the authentication request.
+	ErrInvalidNonce = errors.New("ID token nonce does not match authentication request")
+)
 
 // OIDCAuthenticationParams are the parameters required for kubectl to
 // authenticate to Kubernetes via OIDC.
 type OIDCAuthenticationParams struct {
-	Username     string `json:"email" schema:"email"` // TODO(negz): Support other claims.
-	ClientID     string `json:"clientID" schema:"clientID"`
-	ClientSecret string `json:"clientSecret" schema:"clientSecret"`
-	IDToken      string `json:"idToken" schema:"idToken"`
-	RefreshToken string `json:"refreshToken" schema:"refreshToken"`
-	IssuerURL    string `json:"issuer" schema:"issuer"`
+	Username     string    `json:"email" schema:"email"`
+	ClientID     string    `json:"clientID" schema:"clientID"`
+	ClientSecret string    `json:"clientSecret" schema:"clientSecret"`
+	IDToken      string    `json:"idToken" schema:"idToken"`
+	RefreshToken string    `json:"refreshToken" schema:"refreshToken"`
+	IssuerURL    string    `json:"issuer" schema:"issuer"`
+	Scopes       []string  `json:"scopes,omitempty" schema:"scopes"`
+	Groups       []string  `json:"groups,omitempty" schema:"groups"`
+	Namespace    string    `json:"namespace,omitempty" schema:"namespace"`
+	ACR          string    `json:"acr,omitempty" schema:"acr"`
+	AMR          []string  `json:"amr,omitempty" schema:"amr"`
+	Expiry       time.Time `json:"expiry" schema:"expiry"`
+	IssuedAt     time.Time `json:"issuedAt" schema:"issuedAt"`
+	LogoutURL    string    `json:"logoutURL,omitempty" schema:"logoutURL"`
+	DownloadURL  string    `json:"downloadURL,omitempty" schema:"downloadURL"`
+	ReturnURL    string    `json:"returnURL,omitempty" schema:"returnURL"`
+
+	// Email is the user's email claim, which may differ from their username.
+	// EmailVerified is true if the OIDC provider has verified it. Neither is
+	// sent to clients.
+	Email         string `json:"-" schema:"-"`
+	EmailVerified bool   `json:"-" schema:"-"`
+}
+
+// An Extractor exchanges an OAuth 2.0 authorization code for the information
+// required for Kubernetes authentication.
+type Extractor interface {
+	Process(ctx context.Context, cfg *oauth2.Config, code string, po ...ProcessOption) (*OIDCAuthenticationParams, error)
+}
+
+// A DeviceFlow extractor supports the OAuth 2.0 device authorization grant.
+type DeviceFlow interface {
+	// StartDeviceFlow begins a device authorization grant flow.
+	StartDeviceFlow(ctx context.Context, cfg *oauth2.Config) (*DeviceAuthorization, error)
+
+	// PollDeviceFlow checks whether the user has completed the device
+	// authorization grant flow identified by the supplied device code.
+	PollDeviceFlow(ctx context.Context, cfg *oauth2.Config, deviceCode string) (*OIDCAuthenticationParams, error)
+}
+
+// A Refresher extractor can exchange a refresh token for a new ID token.
+type Refresher interface {
+	// Refresh exchanges the supplied refresh token for a new ID token,
+	// verifying it and extracting the information required for Kubernetes
+	// authentication.
+	Refresh(ctx context.Context, cfg *oauth2.Config, refreshToken string) (*OIDCAuthenticationParams, error)
 }
 
 // An OIDC extractor performs OIDC validation, extracting and storing the
 // information required for Kubernetes authentication along the way.
 type OIDC interface {
-	Process(ctx context.Context, cfg *oauth2.Config, code string) (*OIDCAuthenticationParams, error)
+	Extractor
+	DeviceFlow
+	Refresher
+	Revoker
+	SessionEnder
+}
+
+// A ProcessOption configures a single call to Process.
+type ProcessOption func(*processOptions)
+
+type processOptions struct {
+	codeVerifier string
+	nonce        string
+	issuer       string
+	code         string
+
+	// verified is set once the token has been verified.
+	verified *verifiedToken
+}
+
+// Nonce supplies the nonce sent with the authentication request. The ID token
+// must contain a matching nonce claim. The ID token verifier supplied to
+// NewOIDC should be configured to skip its own nonce check.
+func Nonce(nonce string) ProcessOption {
+	return func(p *processOptions) {
+		p.nonce = nonce
+	}
+}
+
+// CodeVerifier supplies the PKCE code verifier from which the code challenge
+// sent with the authorization request was derived. The verifier is sent along
+// with the authorization code when it is exchanged for a token.
+//
+// See https://tools.ietf.org/html/rfc7636
+func CodeVerifier(verifier string) ProcessOption {
+	return func(p *processOptions) {
+		p.codeVerifier = verifier
+	}
 }
 
 type oidcExtractor struct {
-	log         *zap.Logger
-	v           *oidc.IDTokenVerifier
-	h           *http.Client
-	emailDomain string
+	log           *zap.Logger
+	v             verifier
+	h             *http.Client
+	auth          clientAuth
+	emailDomain   string
+	usernameClaim string
+	groupsClaim   string
+	deviceURL     string
+	revocationURL string
+	endSessionURL string
+	userInfo      *oidc.Provider
+	graphURL      string
+	keycloak      *KeycloakRolesConfig
+
+	atv      *oidc.IDTokenVerifier
+	atClaims []string
+
+	csv []*oidc.IDTokenVerifier
+
+	usernameMapping *claimMapping
+	groupsMapping   *claimMapping
+	namespaceClaim  string
+	groupNamespaces map[string]string
+
+	policies        []policy
+	disallowRefresh bool
+	retry           RetryPolicy
+
+	rec    Recorder
+	tracer Tracer
+	audit  AuditSink
+	issuer string
+
+	idv        *oidc.IDTokenVerifier
+	audiences  []string
+	requireAZP bool
+	clockSkew  time.Duration
+
+	decryptionKeys []jose.JSONWebKey
+	keySet         *KeySet
+	hashCheck      HashCheck
+
+	// introspection maps issuers to their token introspection endpoints.
+	introspection map[string]string
 }
 
 // An Option represents a OIDC extractor option.
@@ -68,6 +209,106 @@ func EmailDomain(domain string) Option {
 	}
 }
 
+// UsernameClaim configures the ID token claim used as the Kubernetes username.
+// This should match the API server's --oidc-username-claim flag.
+func UsernameClaim(claim string) Option {
+	return func(o *oidcExtractor) error {
+		if claim == "" {
+			return errors.New("username claim cannot be empty")
+		}
+		o.usernameClaim = claim
+		return nil
+	}
+}
+
+// GroupsClaim configures the ID token claim from which the user's groups are
+// read. This should match the API server's --oidc-groups-claim flag.
+func GroupsClaim(claim string) Option {
+	return func(o *oidcExtractor) error {
+		if claim == "" {
+			return errors.New("groups claim cannot be empty")
+		}
+		o.groupsClaim = claim
+		return nil
+	}
+}
+
+// DeviceAuthorizationURL enables the device authorization grant flow using the
+// supplied device authorization endpoint.
+func DeviceAuthorizationURL(u string) Option {
+	return func(o *oidcExtractor) error {
+		o.deviceURL = u
+		return nil
+	}
+}
+
+// UserInfo configures the extractor to query the supplied provider's UserInfo
+// endpoint after verifying the ID token. Claims returned by the UserInfo
+// endpoint are used when they are absent from the ID token, which is useful
+// for providers that issue sparse ID tokens.
+func UserInfo(p *oidc.Provider) Option {
+	return func(o *oidcExtractor) error {
+		o.userInfo = p
+		return nil
+	}
+}
+
+// Introspection configures the extractor to validate tokens issued by the
+// supplied issuer using its token introspection endpoint rather than verifying
+// the ID token locally. This supports providers that issue opaque or reference
+// tokens. The ID token is introspected if present, otherwise the access token.
+// Tokens of other issuers are verified locally. The introspection response
+// must identify this client via its aud or client_id, and an expiry.
+//
+// See https://tools.ietf.org/html/rfc7662
+func Introspection(issuer, endpoint string) Option {
+	return func(o *oidcExtractor) error {
+		if issuer == "" || endpoint == "" {
+			return errors.New("introspection issuer and endpoint cannot be empty")
+		}
+		if o.introspection == nil {
+			o.introspection = map[string]string{}
+		}
+		o.introspection[issuer] = endpoint
+		return nil
+	}
+}
+
+// Audiences configures the set of acceptable ID token audiences. A token is
+// accepted if any of its audiences is in the set. The supplied ID token
+// verifier should be configured to skip its own client ID check in order for
+// audiences other than the client ID to be accepted.
+func Audiences(aud ...string) Option {
+	return func(o *oidcExtractor) error {
+		o.audiences = aud
+		return nil
+	}
+}
+
+// RequireAuthorizedParty configures the extractor to reject ID tokens that do
+// not include an azp (authorized party) claim matching the client ID. When
+// Audiences are configured any azp claim must match the client ID regardless.
+func RequireAuthorizedParty() Option {
+	return func(o *oidcExtractor) error {
+		o.requireAZP = true
+		return nil
+	}
+}
+
+// ClockSkew configures how much clock difference between kuberos and the OIDC
+// provider is tolerated when validating an ID token's exp, iat, and nbf
+// claims. The supplied ID token verifier should be configured to skip its own
+// expiry check in order for expired tokens to be tolerated.
+func ClockSkew(d time.Duration) Option {
+	return func(o *oidcExtractor) error {
+		if d < 0 {
+			return errors.New("clock skew cannot be negative")
+		}
+		o.clockSkew = d
+		return nil
+	}
+}
+
 // NewOIDC creates a new OIDC extractor.
 func NewOIDC(v *oidc.IDTokenVerifier, oo ...Option) (OIDC, error) {
 	l, err := zap.NewProduction()
@@ -75,49 +316,205 @@ func NewOIDC(v *oidc.IDTokenVerifier, oo ...Option) (OIDC, error) {
 		return nil, errors.Wrap(err, "cannot create default logger")
 	}
 
-	oe := &oidcExtractor{log: l, v: v, h: http.DefaultClient}
+	h, err := NewHTTPClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default HTTP client")
+	}
+
+	oe := &oidcExtractor{log: l, idv: v, h: h, auth: secretAuth{}, usernameClaim: DefaultUsernameClaim, groupsClaim: DefaultGroupsClaim, clockSkew: DefaultClockSkew, rec: nopRecorder{}, tracer: nopTracer{}}
 
 	for _, o := range oo {
 		if err := o(oe); err != nil {
 			return nil, errors.Wrap(err, "cannot apply OIDC option")
 		}
 	}
+
+	oe.v = &jwtVerifier{v: oe.idv, audiences: oe.audiences, requireAZP: oe.requireAZP, leeway: oe.clockSkew, keys: oe.decryptionKeys, ks: oe.keySet, hashCheck: oe.hashCheck, log: oe.log}
+	if len(oe.introspection) > 0 {
+		iv := &issuerVerifiers{issuers: map[string]verifier{}, def: oe.v}
+		for iss, endpoint := range oe.introspection {
+			iv.issuers[iss] = &introspectionVerifier{h: oe.h, auth: oe.auth, issuer: iss, endpoint: endpoint, audiences: oe.audiences, leeway: oe.clockSkew}
+		}
+		oe.v = iv
+	}
 	return oe, nil
 }
 
-func (o *oidcExtractor) Process(ctx context.Context, cfg *oauth2.Config, code string) (*OIDCAuthenticationParams, error) {
-	o.log.Debug("exchange ", zap.String("code", code))
-	octx := oidc.ClientContext(ctx, o.h)
-	token, err := cfg.Exchange(octx, code)
+func (o *oidcExtractor) Process(ctx context.Context, cfg *oauth2.Config, code string, po ...ProcessOption) (*OIDCAuthenticationParams, error) {
+	p := &processOptions{code: code}
+	for _, opt := range po {
+		opt(p)
+	}
+
+	params, err := o.process(ctx, cfg, code, p)
+	o.record(ctx, cfg, p, err)
+	return params, err
+}
+
+func (o *oidcExtractor) process(ctx context.Context, cfg *oauth2.Config, code string, p *processOptions) (*OIDCAuthenticationParams, error) {
+	o.logger(ctx).Debug("exchanging authorization code")
+	v := url.Values{
+		paramGrantType:   {grantTypeAuthorizationCode},
+		paramCode:        {code},
+		paramRedirectURI: {cfg.RedirectURL},
+	}
+	if p.codeVerifier != "" {
+		v.Set(paramCodeVerifier, p.codeVerifier)
+	}
+	token, err := o.tokenRequest(ctx, cfg, v)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot exchange code for token")
+		return nil, o.fail(ErrorCodeExchangeFailed, errors.Wrap(err, "cannot exchange code for token"))
 	}
+	return o.params(ctx, cfg, token, p)
+}
 
-	id, ok := token.Extra(tokenFieldIDToken).(string)
-	if !ok {
-		return nil, ErrMissingIDToken
+// params verifies the supplied OAuth 2.0 token and extracts the parameters
+// required for kubectl authentication.
+func (o *oidcExtractor) params(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, p *processOptions) (*OIDCAuthenticationParams, error) {
+	vctx, span := o.tracer.Start(ctx, spanVerify)
+	start := time.Now()
+	vt, err := o.v.verify(vctx, cfg, token, p)
+	o.rec.ObserveVerification(o.issuer, time.Since(start), err)
+	endSpan(span, err)
+	if err == ErrMissingIDToken {
+		return nil, o.fail(ErrorCodeTokenMissing, err)
+	}
+	if err != nil {
+		return nil, o.fail(ErrorCodeVerifyFailed, err)
 	}
-	o.log.Debug("token", zap.String("id", id), zap.Any("token", token))
+	p.verified = vt
+
+	cctx, span := o.tracer.Start(ctx, spanClaims)
+	params, err := o.extract(cctx, cfg, token, vt)
+	endSpan(span, err)
+	return params, err
+}
+
+// extract extracts the parameters required for kubectl authentication from
+// the supplied verified token.
+func (o *oidcExtractor) extract(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, vt *verifiedToken) (*OIDCAuthenticationParams, error) {
+	claims := vt.claims
 
-	idt, err := o.v.Verify(ctx, id)
+	if o.userInfo != nil {
+		if err := o.mergeUserInfo(ctx, token, vt.subject, claims); err != nil {
+			return nil, o.fail(ErrorCodeVerifyFailed, errors.Wrap(err, "cannot merge UserInfo claims"))
+		}
+	}
+
+	if o.atv != nil {
+		if err := o.mergeAccessTokenClaims(ctx, token, vt.subject, claims); err != nil {
+			return nil, o.fail(ErrorCodeVerifyFailed, errors.Wrap(err, "cannot merge access token claims"))
+		}
+	}
+
+	if o.graphURL != "" {
+		if err := o.mergeGraphGroups(ctx, token, claims); err != nil {
+			return nil, o.fail(ErrorCodeVerifyFailed, errors.Wrap(err, "cannot resolve Azure AD groups overage"))
+		}
+	}
+
+	if len(o.csv) > 0 {
+		if err := o.resolveClaimSources(ctx, token, vt.subject, claims); err != nil {
+			return nil, o.fail(ErrorCodeVerifyFailed, errors.Wrap(err, "cannot resolve aggregated and distributed claims"))
+		}
+	}
+
+	username, err := o.username(claims)
+	if err != nil {
+		return nil, o.fail(ErrorCodeClaimsInvalid, err)
+	}
+	groups, err := o.groups(claims)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot verify ID token")
+		return nil, o.fail(ErrorCodeClaimsInvalid, err)
+	}
+	if o.keycloak != nil {
+		for _, r := range o.keycloak.roles(claims) {
+			if !contains(groups, r) {
+				groups = append(groups, r)
+			}
+		}
 	}
 
 	params := &OIDCAuthenticationParams{
+		Username:     username,
 		ClientID:     cfg.ClientID,
 		ClientSecret: cfg.ClientSecret,
-		IDToken:      id,
+		IDToken:      vt.raw,
 		RefreshToken: token.RefreshToken,
-		IssuerURL:    idt.Issuer,
+		IssuerURL:    vt.issuer,
+		Scopes:       cfg.Scopes,
+		Groups:       groups,
+		Namespace:    o.namespace(claims, groups),
+		Expiry:       vt.expiry,
+		IssuedAt:     vt.issuedAt,
+		AMR:          stringsClaim(claims, claimAMR),
 	}
-	if err := idt.Claims(params); err != nil {
-		return nil, errors.Wrap(err, "cannot extract claims from ID token")
+	params.ACR, _ = claims[claimACR].(string)
+	params.Email, _ = claims[claimEmail].(string)
+	params.EmailVerified = emailVerified(claims)
+	if o.disallowRefresh && params.RefreshToken != "" {
+		o.logger(ctx).Debug("discarding refresh token")
+		params.RefreshToken = ""
+	}
+
+	if o.emailDomain != "" {
+		email, _ := claims[claimEmail].(string)
+		if !strings.HasSuffix(email, "@"+o.emailDomain) {
+			return nil, o.fail(ErrorCodeClaimsInvalid, errors.New("Invalid email domain, expecting "+o.emailDomain))
+		}
 	}
 
-	if o.emailDomain != "" && !strings.HasSuffix(params.Username, "@"+o.emailDomain) {
-		return nil, errors.New("Invalid email domain, expecting " + o.emailDomain)
+	for _, p := range o.policies {
+		if err := p(vt); err != nil {
+			return nil, o.fail(ErrorCodeClaimsInvalid, err)
+		}
 	}
 
 	return params, nil
 }
+
+// mergeUserInfo adds any claims returned by the UserInfo endpoint that are
+// absent from the supplied ID token claims.
+func (o *oidcExtractor) mergeUserInfo(ctx context.Context, token *oauth2.Token, subject string, claims map[string]interface{}) error {
+	ui, err := o.userInfo.UserInfo(oidc.ClientContext(ctx, o.h), oauth2.StaticTokenSource(token))
+	if err != nil {
+		return errors.Wrap(err, "cannot query UserInfo endpoint")
+	}
+
+	// The UserInfo subject must match the ID token subject, lest we merge the
+	// claims of a different user. See
+	// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+	if ui.Subject != subject {
+		return errors.Errorf("UserInfo subject %q does not match ID token subject %q", ui.Subject, subject)
+	}
+
+	uc := map[string]interface{}{}
+	if err := ui.Claims(&uc); err != nil {
+		return errors.Wrap(err, "cannot extract claims from UserInfo response")
+	}
+	for k, v := range uc {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	o.logger(ctx).Debug("merged UserInfo claims", zap.Any("claims", uc))
+	return nil
+}
+
+// stringsClaim returns the named claim as a slice of strings. Claims may be
+// either a single string or an array of strings; anything else is ignored.
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
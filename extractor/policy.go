@@ -0,0 +1,205 @@
+package extractor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	claimACR           = "acr"
+	claimAMR           = "amr"
+	claimHostedDomain  = "hd"
+	claimEmailVerified = "email_verified"
+)
+
+// A policy determines whether a verified token is acceptable, returning an
+// error if it is not.
+type policy func(vt *verifiedToken) error
+
+// An AuthenticationContextError indicates a token did not meet the required
+// authentication context, for example because the user did not authenticate
+// using multiple factors.
+type AuthenticationContextError struct {
+	ACR     string
+	AMR     []string
+	WantACR []string
+	WantAMR []string
+}
+
+func (e *AuthenticationContextError) Error() string {
+	if len(e.WantACR) > 0 {
+		return fmt.Sprintf("insufficient authentication context: want acr one of %q, got %q", e.WantACR, e.ACR)
+	}
+	return fmt.Sprintf("insufficient authentication methods: want amr all of %q, got %q", e.WantAMR, e.AMR)
+}
+
+// RequireACR configures the extractor to reject tokens whose acr
+// (authentication context class reference) claim is not one of the supplied
+// values.
+func RequireACR(acr ...string) Option {
+	return func(o *oidcExtractor) error {
+		if len(acr) == 0 {
+			return errors.New("at least one acr value is required")
+		}
+		o.policies = append(o.policies, func(vt *verifiedToken) error {
+			got, _ := vt.claims[claimACR].(string)
+			for _, want := range acr {
+				if got == want {
+					return nil
+				}
+			}
+			return &AuthenticationContextError{ACR: got, AMR: stringsClaim(vt.claims, claimAMR), WantACR: acr}
+		})
+		return nil
+	}
+}
+
+// RequireAMR configures the extractor to reject tokens whose amr
+// (authentication methods references) claim does not include all of the
+// supplied values, e.g. "mfa".
+func RequireAMR(amr ...string) Option {
+	return func(o *oidcExtractor) error {
+		if len(amr) == 0 {
+			return errors.New("at least one amr value is required")
+		}
+		o.policies = append(o.policies, func(vt *verifiedToken) error {
+			got := stringsClaim(vt.claims, claimAMR)
+			for _, want := range amr {
+				if !contains(got, want) {
+					acr, _ := vt.claims[claimACR].(string)
+					return &AuthenticationContextError{ACR: acr, AMR: got, WantAMR: amr}
+				}
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// A HostedDomainError indicates a token was not issued to a member of an
+// allowed Google Workspace (G Suite) domain, for example because the user
+// authenticated using a personal Gmail account.
+type HostedDomainError struct {
+	HostedDomain string
+	Want         []string
+}
+
+func (e *HostedDomainError) Error() string {
+	if e.HostedDomain == "" {
+		return fmt.Sprintf("token has no hosted domain claim: want one of %q", e.Want)
+	}
+	return fmt.Sprintf("invalid hosted domain: want one of %q, got %q", e.Want, e.HostedDomain)
+}
+
+// RequireHostedDomain configures the extractor to reject tokens whose hd
+// (Google hosted domain) claim is not one of the supplied domains. Tokens for
+// personal Google accounts have no hd claim, and are always rejected.
+//
+// See https://developers.google.com/identity/protocols/OpenIDConnect#hd-param
+func RequireHostedDomain(domains ...string) Option {
+	return func(o *oidcExtractor) error {
+		if len(domains) == 0 {
+			return errors.New("at least one hosted domain is required")
+		}
+		o.policies = append(o.policies, func(vt *verifiedToken) error {
+			hd, _ := vt.claims[claimHostedDomain].(string)
+			for _, d := range domains {
+				if hd != "" && strings.EqualFold(hd, d) {
+					return nil
+				}
+			}
+			return &HostedDomainError{HostedDomain: hd, Want: domains}
+		})
+		return nil
+	}
+}
+
+// ErrEmailUnverified indicates a token's email address, which would be used as
+// the Kubernetes username, has not been verified by the OIDC provider.
+var ErrEmailUnverified = errors.New("email address is not verified")
+
+// RequireVerifiedEmail configures the extractor to reject tokens whose
+// email_verified claim is false or absent when the username is read from the
+// email claim. It has no effect when the username is derived from any other
+// claim, or by a username template.
+func RequireVerifiedEmail() Option {
+	return func(o *oidcExtractor) error {
+		o.policies = append(o.policies, func(vt *verifiedToken) error {
+			if o.usernameClaim != claimEmail || o.usernameMapping != nil {
+				return nil
+			}
+			if emailVerified(vt.claims) {
+				return nil
+			}
+			return ErrEmailUnverified
+		})
+		return nil
+	}
+}
+
+// emailVerified returns true if the email_verified claim of the supplied
+// claims is true.
+func emailVerified(claims map[string]interface{}) bool {
+	// Some providers, e.g. AWS Cognito, encode this claim as a string.
+	switch v := claims[claimEmailVerified].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// A LifetimeError indicates a token's lifetime exceeded the configured
+// maximum.
+type LifetimeError struct {
+	Lifetime time.Duration
+	Max      time.Duration
+}
+
+func (e *LifetimeError) Error() string {
+	return fmt.Sprintf("token lifetime %v exceeds maximum of %v", e.Lifetime, e.Max)
+}
+
+// MaxLifetime configures the extractor to reject ID tokens whose lifetime,
+// i.e. the difference between their exp and iat claims, exceeds the supplied
+// duration. Tokens without an iat claim are rejected.
+func MaxLifetime(d time.Duration) Option {
+	return func(o *oidcExtractor) error {
+		if d <= 0 {
+			return errors.New("maximum token lifetime must be positive")
+		}
+		o.policies = append(o.policies, func(vt *verifiedToken) error {
+			if vt.issuedAt.IsZero() {
+				return errors.New("cannot determine token lifetime: token has no issued at claim")
+			}
+			if l := vt.expiry.Sub(vt.issuedAt); l > d {
+				return &LifetimeError{Lifetime: l, Max: d}
+			}
+			return nil
+		})
+		return nil
+	}
+}
+
+// DisallowRefreshTokens configures the extractor to discard any refresh token
+// issued by the OIDC provider, ensuring users receive only credentials that
+// expire along with their ID token.
+func DisallowRefreshTokens() Option {
+	return func(o *oidcExtractor) error {
+		o.disallowRefresh = true
+		return nil
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
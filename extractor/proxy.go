@@ -0,0 +1,69 @@
+package extractor
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig configures an HTTP proxy for requests to the OIDC provider.
+type ProxyConfig struct {
+	// URL of the proxy through which to route requests. Requests are made
+	// directly if nil.
+	URL *url.URL
+
+	// NoProxy lists hosts to which requests are always made directly. Each
+	// entry may be a hostname, a domain (e.g. .example.org, which matches
+	// example.org and its subdomains), an IP address, a CIDR, or * to match
+	// all hosts.
+	NoProxy []string
+
+	// Overrides maps hosts (e.g. the issuer's hostname) to the proxy through
+	// which requests to that host should be routed, taking precedence over
+	// URL and NoProxy.
+	Overrides map[string]*url.URL
+}
+
+// Proxy configures the transport to route requests through an HTTP proxy
+// rather than consulting the HTTP_PROXY and NO_PROXY environment variables.
+func Proxy(cfg ProxyConfig) TransportOption {
+	return func(hc *httpClient) error {
+		hc.t.Proxy = cfg.proxy
+		return nil
+	}
+}
+
+func (cfg ProxyConfig) proxy(r *http.Request) (*url.URL, error) {
+	host := r.URL.Hostname()
+	if u, ok := cfg.Overrides[host]; ok {
+		return u, nil
+	}
+	if cfg.URL == nil || cfg.bypass(host) {
+		return nil, nil
+	}
+	return cfg.URL, nil
+}
+
+func (cfg ProxyConfig) bypass(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, np := range cfg.NoProxy {
+		np = strings.ToLower(strings.TrimSpace(np))
+		switch {
+		case np == "":
+			continue
+		case np == "*":
+			return true
+		case ip != nil && strings.Contains(np, "/"):
+			if _, n, err := net.ParseCIDR(np); err == nil && n.Contains(ip) {
+				return true
+			}
+		case host == strings.TrimPrefix(np, "."):
+			return true
+		case strings.HasSuffix(host, "."+strings.TrimPrefix(np, ".")):
+			return true
+		}
+	}
+	return false
+}
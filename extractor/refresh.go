@@ -0,0 +1,50 @@
+package extractor
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	grantTypeRefreshToken = "refresh_token"
+
+	paramRefreshToken = "refresh_token"
+)
+
+var (
+	// ErrMissingRefreshToken indicates an attempt to refresh without a
+	// refresh token.
+	ErrMissingRefreshToken = errors.New("missing refresh token")
+
+	// ErrRefreshUnsupported indicates the extractor cannot refresh tokens.
+	ErrRefreshUnsupported = errors.New("token refresh is not supported")
+)
+
+// Refresh exchanges the supplied refresh token for a new ID token. Providers
+// need not rotate refresh tokens, so the supplied refresh token is returned
+// unless the provider issued a new one.
+//
+// See https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokens
+func (o *oidcExtractor) Refresh(ctx context.Context, cfg *oauth2.Config, refreshToken string) (*OIDCAuthenticationParams, error) {
+	if refreshToken == "" {
+		return nil, o.fail(ErrorCodeExchangeFailed, ErrMissingRefreshToken)
+	}
+
+	v := url.Values{
+		paramGrantType:    {grantTypeRefreshToken},
+		paramRefreshToken: {refreshToken},
+	}
+	token, err := o.tokenRequest(ctx, cfg, v)
+	if err != nil {
+		return nil, o.fail(ErrorCodeExchangeFailed, errors.Wrap(err, "cannot exchange refresh token for token"))
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+
+	// Refreshed ID tokens need not include a nonce, so none is checked.
+	return o.params(ctx, cfg, token, &processOptions{})
+}
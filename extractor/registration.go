@@ -0,0 +1,89 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ClientMetadata describes an OAuth 2.0 client to be registered with an OIDC
+// provider.
+//
+// See https://tools.ietf.org/html/rfc7591#section-2
+type ClientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// ClientRegistration is the response to a successful client registration.
+//
+// See https://tools.ietf.org/html/rfc7591#section-3.2.1
+type ClientRegistration struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+// RegisterClient dynamically registers a client with the supplied OIDC
+// provider registration endpoint. The initial access token may be empty if
+// the provider permits open registration.
+//
+// See https://tools.ietf.org/html/rfc7591
+func RegisterClient(ctx context.Context, h *http.Client, endpoint, initialAccessToken string, md *ClientMetadata) (*ClientRegistration, error) {
+	if len(md.RedirectURIs) == 0 {
+		return nil, errors.New("at least one redirect URI is required")
+	}
+	body, err := json.Marshal(md)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode client metadata")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if initialAccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+initialAccessToken)
+	}
+
+	rsp, err := h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot make request")
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, responseMaxBytes))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read response")
+	}
+	if rsp.StatusCode != http.StatusCreated && rsp.StatusCode != http.StatusOK {
+		te := &TokenError{StatusCode: rsp.StatusCode}
+		if err := json.Unmarshal(b, te); err != nil || te.Code == "" {
+			return nil, &statusError{StatusCode: rsp.StatusCode, Endpoint: endpoint, Status: rsp.Status, Body: b}
+		}
+		return nil, te
+	}
+
+	cr := &ClientRegistration{}
+	if err := json.Unmarshal(b, cr); err != nil {
+		return nil, errors.Wrap(err, "cannot decode client registration")
+	}
+	if cr.ClientID == "" {
+		return nil, errors.New("client registration missing client ID")
+	}
+	return cr, nil
+}
@@ -0,0 +1,82 @@
+package extractor
+
+import (
+	"sort"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+)
+
+// NameOIDC is the name under which the built in OIDC extractor is registered.
+const NameOIDC = "oidc"
+
+// Config is supplied to a Factory in order to create an Extractor.
+type Config struct {
+	// Provider is the OIDC provider discovered at the configured issuer URL.
+	Provider *oidc.Provider
+
+	// Verifier verifies ID tokens issued by the OIDC provider.
+	Verifier *oidc.IDTokenVerifier
+
+	// Options configure the built in OIDC extractor. Other extractors may
+	// ignore them.
+	Options []Option
+
+	// Params are arbitrary key value configuration parameters for bespoke
+	// extractors.
+	Params map[string]string
+}
+
+// A Factory creates an Extractor.
+type Factory func(c *Config) (Extractor, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func init() {
+	Register(NameOIDC, func(c *Config) (Extractor, error) {
+		return NewOIDC(c.Verifier, c.Options...)
+	})
+}
+
+// Register makes an Extractor available by the supplied name. It is intended
+// to be called from the init function of packages that implement extractors,
+// and panics if called twice with the same name.
+func Register(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f == nil {
+		panic("extractor: cannot register nil factory " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("extractor: factory already registered for " + name)
+	}
+	registry[name] = f
+}
+
+// Registered returns the sorted names of all registered extractors.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for n := range registry {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the Extractor registered by the supplied name.
+func New(name string, c *Config) (Extractor, error) {
+	registryMu.RLock()
+	f, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown extractor %q", name)
+	}
+	e, err := f(c)
+	return e, errors.Wrapf(err, "cannot create %s extractor", name)
+}
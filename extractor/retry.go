@@ -0,0 +1,119 @@
+package extractor
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultRetryPolicy retries requests that failed due to network errors or
+// transient server errors up to three times.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Jitter:         0.2,
+	RetryableStatusCodes: []int{
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+// A RetryPolicy configures how requests to the token endpoint are retried when
+// they fail due to network errors or transient server errors.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request will be made. A
+	// value less than two disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the time to wait before the first retry. The backoff
+	// doubles with each subsequent retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the time to wait between retries.
+	MaxBackoff time.Duration
+
+	// Jitter randomly varies each backoff by up to this fraction of its
+	// duration, e.g. 0.2 for +/- 20%.
+	Jitter float64
+
+	// RetryableStatusCodes are the HTTP status codes that will be retried.
+	// Requests that fail due to network errors are always retried, while
+	// requests that could not be made are never retried.
+	RetryableStatusCodes []int
+}
+
+// Retry configures the extractor to retry token endpoint requests per the
+// supplied policy.
+func Retry(p RetryPolicy) Option {
+	return func(o *oidcExtractor) error {
+		if p.Jitter < 0 || p.Jitter > 1 {
+			return errors.New("retry jitter must be between 0 and 1")
+		}
+		o.retry = p
+		return nil
+	}
+}
+
+// backoff returns the time to wait before the supplied retry attempt, where
+// the first retry is attempt 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(p.Jitter * float64(d) * (2*rand.Float64() - 1)) // nolint: gas
+	}
+	return d
+}
+
+// retryable returns true if the supplied error should be retried.
+func (p RetryPolicy) retryable(err error) bool {
+	code := 0
+	switch e := err.(type) {
+	case *TokenError:
+		code = e.StatusCode
+	case *statusError:
+		code = e.StatusCode
+	case *transportError:
+		return true
+	default:
+		// e.g. the client could not authenticate, which will not succeed on
+		// a retry.
+		return false
+	}
+	for _, c := range p.RetryableStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls fn until it succeeds, returns an error that should not be retried,
+// or the policy's maximum attempts are exhausted.
+func (p RetryPolicy) do(ctx context.Context, log *zap.Logger, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt < p.MaxAttempts && err != nil && p.retryable(err); attempt++ {
+		d := p.backoff(attempt)
+		log.Debug("retrying", zap.Int("attempt", attempt), zap.Duration("backoff", d), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+		err = fn()
+	}
+	return err
+}
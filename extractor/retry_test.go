@@ -0,0 +1,90 @@
+package extractor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// countingAuth counts client authentications, failing them if err is set.
+type countingAuth struct {
+	calls int
+	err   error
+}
+
+func (a *countingAuth) authenticate(_ *oauth2.Config, _ string, _ url.Values, _ http.Header) error {
+	a.calls++
+	return a.err
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cases := []struct {
+		name      string
+		endpoint  string
+		status    int
+		authErr   error
+		wantCalls int
+	}{
+		{
+			name:      "Success",
+			endpoint:  srv.URL,
+			status:    http.StatusOK,
+			wantCalls: 1,
+		},
+		{
+			name:      "ClientAuthenticationFailed",
+			endpoint:  srv.URL,
+			status:    http.StatusOK,
+			authErr:   errors.New("boom"),
+			wantCalls: 1,
+		},
+		{
+			name:      "RetryableStatus",
+			endpoint:  srv.URL,
+			status:    http.StatusServiceUnavailable,
+			wantCalls: 3,
+		},
+		{
+			name:      "UnretryableStatus",
+			endpoint:  srv.URL,
+			status:    http.StatusBadRequest,
+			wantCalls: 1,
+		},
+		{
+			name:      "NetworkError",
+			endpoint:  closed.URL,
+			wantCalls: 3,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			a := &countingAuth{err: tt.authErr}
+			p := RetryPolicy{MaxAttempts: 3, RetryableStatusCodes: DefaultRetryPolicy.RetryableStatusCodes}
+			cfg := &oauth2.Config{ClientID: testClientID}
+			p.do(context.Background(), zap.NewNop(), func() error {
+				_, err := clientRequest(context.Background(), http.DefaultClient, a, cfg, tt.endpoint, url.Values{})
+				return err
+			})
+			if a.calls != tt.wantCalls {
+				t.Errorf("p.do(...): want %v attempts, got %v", tt.wantCalls, a.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package extractor
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const tokenTypeHintRefreshToken = "refresh_token"
+
+// ErrRevocationUnsupported indicates the extractor was not configured with a
+// token revocation endpoint.
+var ErrRevocationUnsupported = errors.New("token revocation is not supported")
+
+// A Revoker extractor can revoke the refresh tokens it obtains.
+type Revoker interface {
+	// Revoke invalidates the supplied refresh token at the OIDC provider.
+	Revoke(ctx context.Context, cfg *oauth2.Config, refreshToken string) error
+}
+
+// RevocationURL enables token revocation using the supplied revocation
+// endpoint.
+func RevocationURL(u string) Option {
+	return func(o *oidcExtractor) error {
+		o.revocationURL = u
+		return nil
+	}
+}
+
+// Revoke invalidates the supplied refresh token, and any access tokens issued
+// using it, at the OIDC provider's revocation endpoint. Providers respond
+// successfully to requests to revoke invalid or already revoked tokens.
+//
+// See https://tools.ietf.org/html/rfc7009
+func (o *oidcExtractor) Revoke(ctx context.Context, cfg *oauth2.Config, refreshToken string) error {
+	if o.revocationURL == "" {
+		return ErrRevocationUnsupported
+	}
+	if refreshToken == "" {
+		return ErrMissingRefreshToken
+	}
+
+	v := url.Values{
+		paramToken:         {refreshToken},
+		paramTokenTypeHint: {tokenTypeHintRefreshToken},
+	}
+	err := o.retry.do(ctx, o.logger(ctx), func() error {
+		_, err := clientRequest(ctx, o.h, o.auth, cfg, o.revocationURL, v)
+		return err
+	})
+	return errors.Wrap(err, "cannot revoke refresh token")
+}
@@ -0,0 +1,51 @@
+package extractor
+
+import (
+	"context"
+	"sync"
+)
+
+// A singleflight coalesces concurrent calls to do into a single call, in the
+// manner of golang.org/x/sync/singleflight. Callers that arrive while a call
+// is in flight wait for it and share its result.
+type singleflight struct {
+	mu sync.Mutex
+	c  *flight
+}
+
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do calls fn unless a call is already in flight, in which case it waits for
+// that call to complete. It returns whether the call's result was shared
+// with other callers, and fn's error. The call runs independently of its
+// callers, each of which stops waiting for it when their supplied context is
+// done, returning the context's error. The call is unaffected, so fn should
+// bound its own duration.
+func (s *singleflight) do(ctx context.Context, fn func() error) (shared bool, err error) {
+	s.mu.Lock()
+	c := s.c
+	if c != nil {
+		shared = true
+	} else {
+		c = &flight{done: make(chan struct{})}
+		s.c = c
+		go func() {
+			c.err = fn()
+			s.mu.Lock()
+			s.c = nil
+			s.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return shared, c.err
+	case <-ctx.Done():
+		return shared, ctx.Err()
+	}
+}
@@ -0,0 +1,163 @@
+package extractor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	grantTypeAuthorizationCode = "authorization_code"
+
+	paramGrantType    = "grant_type"
+	paramCode         = "code"
+	paramRedirectURI  = "redirect_uri"
+	paramClientID     = "client_id"
+	paramCodeVerifier = "code_verifier"
+	paramScope        = "scope"
+
+	responseMaxBytes = 1 << 20 // 1MB
+)
+
+// A TokenError is an error response returned by an OAuth 2.0 endpoint.
+//
+// See https://tools.ietf.org/html/rfc6749#section-5.2
+type TokenError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	URI         string `json:"error_uri"`
+}
+
+func (e *TokenError) Error() string {
+	msg := e.Code
+	if e.Description != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Description)
+	}
+	if e.URI != "" {
+		msg = fmt.Sprintf("%s (see %s)", msg, e.URI)
+	}
+	return msg
+}
+
+// A statusError indicates an OAuth 2.0 endpoint returned an unexpected HTTP
+// status code without a well formed error response.
+type statusError struct {
+	StatusCode int
+	Endpoint   string
+	Status     string
+	Body       []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.Endpoint, e.Status, e.Body)
+}
+
+// A transportError is returned when a request to an OAuth 2.0 endpoint fails
+// before a response is received, e.g. due to a network error.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying error.
+func (e *transportError) Cause() error {
+	return e.err
+}
+
+type tokenJSON struct {
+	AccessToken  string      `json:"access_token"`
+	TokenType    string      `json:"token_type"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+}
+
+// clientRequest POSTs the supplied parameters to an OAuth 2.0 endpoint,
+// authenticating as the client described by the supplied config using the
+// supplied clientAuth. Error responses are returned as a *TokenError where
+// possible.
+func clientRequest(ctx context.Context, h *http.Client, a clientAuth, cfg *oauth2.Config, endpoint string, v url.Values) ([]byte, error) {
+	hdr := http.Header{}
+	if err := a.authenticate(cfg, endpoint, v, hdr); err != nil {
+		return nil, errors.Wrap(err, "cannot authenticate client")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	req.Header = hdr
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := h.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &transportError{err: errors.Wrap(err, "cannot make request")}
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, responseMaxBytes))
+	if err != nil {
+		return nil, &transportError{err: errors.Wrap(err, "cannot read response")}
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		te := &TokenError{StatusCode: rsp.StatusCode}
+		if err := json.Unmarshal(body, te); err != nil || te.Code == "" {
+			return nil, &statusError{StatusCode: rsp.StatusCode, Endpoint: endpoint, Status: rsp.Status, Body: body}
+		}
+		return nil, te
+	}
+	return body, nil
+}
+
+// tokenRequest makes a request to the token endpoint of the supplied config
+// per https://tools.ietf.org/html/rfc6749#section-3.2, retrying transient
+// failures per the extractor's retry policy. Unlike oauth2.Config.Exchange it
+// allows arbitrary parameters (e.g. a PKCE code verifier) to be sent with the
+// request.
+func (o *oidcExtractor) tokenRequest(ctx context.Context, cfg *oauth2.Config, v url.Values) (*oauth2.Token, error) {
+	ctx, span := o.tracer.Start(ctx, spanExchange)
+	var body []byte
+	start := time.Now()
+	err := o.retry.do(ctx, o.logger(ctx), func() error {
+		var err error
+		body, err = clientRequest(ctx, o.h, o.auth, cfg, cfg.Endpoint.TokenURL, v)
+		return err
+	})
+	o.rec.ObserveExchange(o.issuer, time.Since(start), err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	tj := &tokenJSON{}
+	if err := json.Unmarshal(body, tj); err != nil {
+		return nil, errors.Wrap(err, "cannot decode token response")
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.Wrap(err, "cannot decode token response")
+	}
+
+	t := &oauth2.Token{
+		AccessToken:  tj.AccessToken,
+		TokenType:    tj.TokenType,
+		RefreshToken: tj.RefreshToken,
+	}
+	if s, err := tj.ExpiresIn.Int64(); err == nil && s > 0 {
+		t.Expiry = time.Now().Add(time.Duration(s) * time.Second)
+	}
+	return t.WithExtra(raw), nil
+}
@@ -0,0 +1,63 @@
+package extractor
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Span names.
+const (
+	spanExchange = "kuberos.extractor.exchange"
+	spanVerify   = "kuberos.extractor.verify"
+	spanClaims   = "kuberos.extractor.claims"
+)
+
+// A Tracer starts spans around the extractor's interactions with the OIDC
+// provider. It is a subset of OpenTelemetry's trace.Tracer, which may be
+// adapted to satisfy it.
+type Tracer interface {
+	// Start a span as a child of any span in the supplied context, returning
+	// a context containing the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is a traced operation.
+type Span interface {
+	// RecordError records that the operation failed.
+	RecordError(err error)
+
+	// End the span.
+	End()
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) RecordError(_ error) {}
+func (nopSpan) End()                {}
+
+// Tracing configures the extractor to trace code exchange, token
+// verification, and claims extraction using the supplied Tracer. Spans are
+// started as children of any span in the context supplied to the extractor.
+func Tracing(t Tracer) Option {
+	return func(o *oidcExtractor) error {
+		if t == nil {
+			return errors.New("tracer cannot be nil")
+		}
+		o.tracer = t
+		return nil
+	}
+}
+
+func endSpan(s Span, err error) {
+	if err != nil {
+		s.RecordError(err)
+	}
+	s.End()
+}
@@ -0,0 +1,166 @@
+package extractor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the HTTP client used to communicate with the OIDC provider.
+const (
+	DefaultDialTimeout           = 30 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultHTTPTimeout           = 1 * time.Minute
+	DefaultMaxIdleConns          = 100
+)
+
+// httpClient is an HTTP client under construction.
+type httpClient struct {
+	c *http.Client
+	t *http.Transport
+	d *net.Dialer
+}
+
+// A TransportOption configures the HTTP client and transport used to
+// communicate with the OIDC provider.
+type TransportOption func(*httpClient) error
+
+// RootCAs configures the transport to trust the supplied PEM encoded CA
+// certificates, in addition to the system's trusted CAs, when verifying the
+// OIDC provider's TLS certificate.
+func RootCAs(pem []byte) TransportOption {
+	return func(hc *httpClient) error {
+		c := tlsConfig(hc.t)
+		if c.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			c.RootCAs = pool
+		}
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("cannot parse any PEM encoded CA certificates")
+		}
+		return nil
+	}
+}
+
+// ClientCertificate configures the transport to present the supplied PEM
+// encoded certificate and private key when the OIDC provider requests a TLS
+// client certificate, e.g. for mutual-TLS client authentication.
+//
+// See https://tools.ietf.org/html/rfc8705
+func ClientCertificate(cert, key []byte) TransportOption {
+	return func(hc *httpClient) error {
+		c, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse client certificate")
+		}
+		tc := tlsConfig(hc.t)
+		tc.Certificates = append(tc.Certificates, c)
+		return nil
+	}
+}
+
+// DialTimeout configures the maximum time to wait for a TCP connection to the
+// OIDC provider to be established.
+func DialTimeout(d time.Duration) TransportOption {
+	return func(hc *httpClient) error {
+		if d <= 0 {
+			return errors.New("dial timeout must be positive")
+		}
+		hc.d.Timeout = d
+		return nil
+	}
+}
+
+// TLSHandshakeTimeout configures the maximum time to wait for a TLS handshake
+// with the OIDC provider to complete.
+func TLSHandshakeTimeout(d time.Duration) TransportOption {
+	return func(hc *httpClient) error {
+		if d <= 0 {
+			return errors.New("TLS handshake timeout must be positive")
+		}
+		hc.t.TLSHandshakeTimeout = d
+		return nil
+	}
+}
+
+// ResponseHeaderTimeout configures the maximum time to wait for the OIDC
+// provider's response headers after sending a request.
+func ResponseHeaderTimeout(d time.Duration) TransportOption {
+	return func(hc *httpClient) error {
+		if d <= 0 {
+			return errors.New("response header timeout must be positive")
+		}
+		hc.t.ResponseHeaderTimeout = d
+		return nil
+	}
+}
+
+// Timeout configures the maximum time a request to the OIDC provider may
+// take, including connecting, following redirects, and reading the response
+// body.
+func Timeout(d time.Duration) TransportOption {
+	return func(hc *httpClient) error {
+		if d <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		hc.c.Timeout = d
+		return nil
+	}
+}
+
+// MaxIdleConns configures the maximum number of idle connections to the OIDC
+// provider kept open for reuse.
+func MaxIdleConns(n int) TransportOption {
+	return func(hc *httpClient) error {
+		if n < 0 {
+			return errors.New("maximum idle connections cannot be negative")
+		}
+		hc.t.MaxIdleConns = n
+		hc.t.MaxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// NewHTTPClient returns an HTTP client suitable for communicating with an
+// OIDC provider. Absent any options it resembles http.DefaultClient, except
+// that its requests time out rather than waiting indefinitely for a response.
+func NewHTTPClient(to ...TransportOption) (*http.Client, error) {
+	hc := &httpClient{
+		d: &net.Dialer{
+			Timeout:   DefaultDialTimeout,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		},
+		t: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			MaxIdleConns:          DefaultMaxIdleConns,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   DefaultTLSHandshakeTimeout,
+			ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+	hc.c = &http.Client{Transport: hc.t, Timeout: DefaultHTTPTimeout}
+	for _, o := range to {
+		if err := o(hc); err != nil {
+			return nil, errors.Wrap(err, "cannot apply transport option")
+		}
+	}
+	hc.t.DialContext = hc.d.DialContext
+	return hc.c, nil
+}
+
+func tlsConfig(t *http.Transport) *tls.Config {
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t.TLSClientConfig
+}
@@ -0,0 +1,383 @@
+package extractor
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	paramToken         = "token"
+	paramTokenTypeHint = "token_type_hint"
+
+	tokenTypeHintAccessToken = "access_token"
+
+	claimAudience        = "aud"
+	claimAuthorizedParty = "azp"
+	claimExpiry          = "exp"
+	claimIssuedAt        = "iat"
+	claimIssuer          = "iss"
+	claimNonce           = "nonce"
+	claimNotBefore       = "nbf"
+	claimSubject         = "sub"
+
+	// DefaultClockSkew is the default tolerance for clock differences between
+	// kuberos and the OIDC provider when validating ID token timestamps.
+	DefaultClockSkew = 30 * time.Second
+)
+
+// ErrTokenInactive indicates the introspection endpoint reported a token as
+// inactive, i.e. expired, revoked, or otherwise invalid.
+var ErrTokenInactive = errors.New("token is not active")
+
+// A verifiedToken is a token whose authenticity has been established.
+type verifiedToken struct {
+	raw      string
+	issuer   string
+	subject  string
+	audience []string
+	expiry   time.Time
+	issuedAt time.Time
+	claims   map[string]interface{}
+}
+
+// A verifier establishes the authenticity of the token returned by a token
+// endpoint, returning its claims.
+type verifier interface {
+	verify(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, p *processOptions) (*verifiedToken, error)
+}
+
+// jwtVerifier verifies the supplied token's ID token locally, using the
+// provider's published signing keys.
+type jwtVerifier struct {
+	v          *oidc.IDTokenVerifier
+	audiences  []string
+	requireAZP bool
+	leeway     time.Duration
+	keys       []jose.JSONWebKey
+	ks         *KeySet
+	hashCheck  HashCheck
+	log        *zap.Logger
+}
+
+func (j *jwtVerifier) verify(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, p *processOptions) (*verifiedToken, error) {
+	raw, ok := token.Extra(tokenFieldIDToken).(string)
+	if !ok {
+		return nil, ErrMissingIDToken
+	}
+
+	if isEncrypted(raw) {
+		var err error
+		if raw, err = decrypt(raw, j.keys); err != nil {
+			return nil, errors.Wrap(err, "cannot decrypt ID token")
+		}
+	}
+
+	vt, err := j.authenticate(ctx, cfg.ClientID, raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot verify ID token")
+	}
+	claims := vt.claims
+
+	if err := checkTimes(vt, time.Now(), j.leeway); err != nil {
+		return nil, errors.Wrap(err, "cannot verify ID token")
+	}
+
+	if err := checkNonce(claims, p.nonce); err != nil {
+		return nil, err
+	}
+
+	if err := j.hashes(ctx, raw, claims, token.AccessToken, p.code); err != nil {
+		return nil, errors.Wrap(err, "cannot verify ID token")
+	}
+
+	if len(j.audiences) > 0 && !containsAny(j.audiences, vt.audience) {
+		return nil, errors.Errorf("cannot verify ID token: expected one of audiences %q got %q", j.audiences, vt.audience)
+	}
+
+	// See https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+	if len(j.audiences) > 0 || j.requireAZP {
+		azp, ok := claims[claimAuthorizedParty].(string)
+		if ok && azp != cfg.ClientID {
+			return nil, errors.Errorf("cannot verify ID token: expected authorized party %q got %q", cfg.ClientID, azp)
+		}
+		if !ok && j.requireAZP {
+			return nil, errors.New("cannot verify ID token: missing authorized party claim")
+		}
+	}
+
+	return vt, nil
+}
+
+// authenticate verifies the signature, issuer, and audience of the supplied
+// raw ID token, returning its claims. Signatures are verified using the
+// jwtVerifier's KeySet if it has one, or by the underlying OIDC library
+// otherwise.
+func (j *jwtVerifier) authenticate(ctx context.Context, clientID, raw string) (*verifiedToken, error) {
+	if j.ks == nil {
+		idt, err := j.v.Verify(ctx, raw)
+		if err != nil {
+			return nil, err
+		}
+		claims := map[string]interface{}{}
+		if err := idt.Claims(&claims); err != nil {
+			return nil, errors.Wrap(err, "cannot extract claims from ID token")
+		}
+		return &verifiedToken{
+			raw:      raw,
+			issuer:   idt.Issuer,
+			subject:  idt.Subject,
+			audience: idt.Audience,
+			expiry:   idt.Expiry,
+			issuedAt: idt.IssuedAt,
+			claims:   claims,
+		}, nil
+	}
+
+	payload, err := j.ks.verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "cannot extract claims from ID token")
+	}
+	vt := &verifiedToken{
+		raw:      raw,
+		audience: toStrings(claims[claimAudience]),
+		expiry:   timeClaim(claims, claimExpiry),
+		issuedAt: timeClaim(claims, claimIssuedAt),
+		claims:   claims,
+	}
+	vt.issuer, _ = claims[claimIssuer].(string)
+	vt.subject, _ = claims[claimSubject].(string)
+
+	if vt.issuer != j.ks.issuer {
+		return nil, errors.Errorf("expected issuer %q got %q", j.ks.issuer, vt.issuer)
+	}
+	// Additional audiences are checked by the caller.
+	if len(j.audiences) == 0 && !contains(vt.audience, clientID) {
+		return nil, errors.Errorf("expected audience %q got %q", clientID, vt.audience)
+	}
+	return vt, nil
+}
+
+// timeClaim returns the time represented by the named NumericDate claim, or
+// the zero time if the claim is absent.
+func timeClaim(claims map[string]interface{}, name string) time.Time {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(v), 0)
+}
+
+// checkTimes validates the supplied ID token's exp, iat, and nbf claims,
+// tolerating clock differences of up to the supplied leeway.
+func checkTimes(vt *verifiedToken, now time.Time, leeway time.Duration) error {
+	if vt.expiry.IsZero() {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-leeway).After(vt.expiry) {
+		return errors.Errorf("token is expired (expiry: %v)", vt.expiry)
+	}
+	if !vt.issuedAt.IsZero() && now.Add(leeway).Before(vt.issuedAt) {
+		return errors.Errorf("token used before issued (issued at: %v)", vt.issuedAt)
+	}
+	if nbf, ok := vt.claims[claimNotBefore].(float64); ok {
+		if t := time.Unix(int64(nbf), 0); now.Add(leeway).Before(t) {
+			return errors.Errorf("token is not valid yet (not before: %v)", t)
+		}
+	}
+	return nil
+}
+
+// checkNonce returns ErrInvalidNonce unless the nonce claim of the supplied
+// claims matches the supplied nonce. Any nonce is accepted if the supplied
+// nonce is empty.
+func checkNonce(claims map[string]interface{}, nonce string) error {
+	if nonce == "" {
+		return nil
+	}
+	if n, _ := claims[claimNonce].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return ErrInvalidNonce
+	}
+	return nil
+}
+
+// unverifiedClaims returns the claims of the supplied JWS without verifying
+// its signature, or false if it is not a JWS.
+func unverifiedClaims(raw string) (map[string]interface{}, bool) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, false
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+// issuerVerifiers verifies tokens using the verifier configured for their
+// issuer, or a default verifier for tokens of other issuers. The issuer of an
+// ID token is read from its unverified iss claim, and is subsequently verified
+// by the chosen verifier. The issuer of an opaque token is the issuer
+// supplied via ForIssuer, or the sole issuer with a verifier if there is only
+// one.
+type issuerVerifiers struct {
+	issuers map[string]verifier
+	def     verifier
+}
+
+func (iv *issuerVerifiers) verify(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, p *processOptions) (*verifiedToken, error) {
+	return iv.verifierFor(token, p).verify(ctx, cfg, token, p)
+}
+
+func (iv *issuerVerifiers) verifierFor(token *oauth2.Token, p *processOptions) verifier {
+	raw, ok := token.Extra(tokenFieldIDToken).(string)
+	if ok && isEncrypted(raw) {
+		// Only the default verifier can decrypt ID tokens.
+		return iv.def
+	}
+	issuer := p.issuer
+	if claims, ok := unverifiedClaims(raw); ok {
+		issuer, _ = claims[claimIssuer].(string)
+	} else if issuer == "" && len(iv.issuers) == 1 {
+		for iss := range iv.issuers {
+			issuer = iss
+		}
+	}
+	if v, ok := iv.issuers[issuer]; ok {
+		return v
+	}
+	return iv.def
+}
+
+// introspectionVerifier verifies the supplied token by querying the issuer's
+// token introspection endpoint per https://tools.ietf.org/html/rfc7662
+type introspectionVerifier struct {
+	h         *http.Client
+	auth      clientAuth
+	issuer    string
+	endpoint  string
+	audiences []string
+	leeway    time.Duration
+}
+
+type introspectionJSON struct {
+	Active    bool   `json:"active"`
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Expiry    int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	TokenType string `json:"token_type"`
+	ClientID  string `json:"client_id"`
+}
+
+// The introspection endpoint vouches for the token's authenticity, but not
+// that it was issued to this client, for this authentication request, or that
+// it has not expired, so these are checked as they would be for an ID token.
+func (i *introspectionVerifier) verify(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token, p *processOptions) (*verifiedToken, error) {
+	v := url.Values{}
+	raw, isIDToken := token.Extra(tokenFieldIDToken).(string)
+	if !isIDToken {
+		raw = token.AccessToken
+		v.Set(paramTokenTypeHint, tokenTypeHintAccessToken)
+	}
+	if raw == "" {
+		return nil, ErrMissingIDToken
+	}
+	v.Set(paramToken, raw)
+
+	body, err := clientRequest(ctx, i.h, i.auth, cfg, i.endpoint, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot introspect token")
+	}
+
+	ij := &introspectionJSON{}
+	if err := json.Unmarshal(body, ij); err != nil {
+		return nil, errors.Wrap(err, "cannot decode introspection response")
+	}
+	if !ij.Active {
+		return nil, ErrTokenInactive
+	}
+	if ij.Issuer != "" && ij.Issuer != i.issuer {
+		return nil, errors.Errorf("token issued by a different provider, expected %q got %q", i.issuer, ij.Issuer)
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, errors.Wrap(err, "cannot decode introspection response")
+	}
+
+	vt := &verifiedToken{raw: raw, issuer: i.issuer, subject: ij.Subject, audience: toStrings(claims[claimAudience]), claims: claims}
+	if ij.Expiry > 0 {
+		vt.expiry = time.Unix(ij.Expiry, 0)
+	}
+	if ij.IssuedAt > 0 {
+		vt.issuedAt = time.Unix(ij.IssuedAt, 0)
+	}
+
+	if err := i.checkAudience(cfg.ClientID, vt.audience, ij.ClientID); err != nil {
+		return nil, errors.Wrap(err, "cannot verify token")
+	}
+	if err := checkTimes(vt, time.Now(), i.leeway); err != nil {
+		return nil, errors.Wrap(err, "cannot verify token")
+	}
+	if isIDToken {
+		// Introspection responses need not include the nonce, but an
+		// introspected JWT ID token must. An opaque ID token carries no
+		// nonce to check.
+		nc, ok := claims, true
+		if _, found := nc[claimNonce]; !found {
+			nc, ok = unverifiedClaims(raw)
+		}
+		if ok {
+			if err := checkNonce(nc, p.nonce); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vt, nil
+}
+
+// checkAudience returns an error unless a token with the supplied audience and
+// client_id was issued to the supplied client. Tokens that identify neither
+// are rejected.
+func (i *introspectionVerifier) checkAudience(clientID string, aud []string, tokenClientID string) error {
+	if len(aud) == 0 && tokenClientID == "" {
+		return errors.New("introspection response identifies neither audience nor client_id")
+	}
+	want := []string{clientID}
+	if len(i.audiences) > 0 {
+		want = i.audiences
+	}
+	if len(aud) > 0 && !containsAny(want, aud) {
+		return errors.Errorf("expected one of audiences %q got %q", want, aud)
+	}
+	if tokenClientID != "" && tokenClientID != clientID {
+		return errors.Errorf("expected client_id %q got %q", clientID, tokenClientID)
+	}
+	return nil
+}
+
+func containsAny(want, got []string) bool {
+	for _, w := range want {
+		for _, g := range got {
+			if w == g {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,541 @@
+package extractor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	testIssuer   = "https://issuer.example.org"
+	testClientID = "kuberos"
+	testNonce    = "nonce"
+)
+
+// signingKey returns a new RSA signing key with the supplied key ID.
+func signingKey(t *testing.T, kid string) jose.JSONWebKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(...): %v", err)
+	}
+	return jose.JSONWebKey{Key: k, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+// sign returns a compact JWS of the supplied claims signed with the supplied
+// key.
+func sign(t *testing.T, key jose.JSONWebKey, claims map[string]interface{}) string {
+	t.Helper()
+	s, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("jose.NewSigner(...): %v", err)
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("json.Marshal(...): %v", err)
+	}
+	jws, err := s.Sign(b)
+	if err != nil {
+		t.Fatalf("s.Sign(...): %v", err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("jws.CompactSerialize(): %v", err)
+	}
+	return raw
+}
+
+// idTokenClaims returns the claims of a valid ID token issued at the supplied
+// time, overridden by the supplied claims. Claims overridden with nil are
+// removed.
+func idTokenClaims(now time.Time, override map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		claimIssuer:   testIssuer,
+		claimSubject:  "1234",
+		claimAudience: testClientID,
+		claimExpiry:   now.Add(time.Hour).Unix(),
+		claimIssuedAt: now.Unix(),
+		claimNonce:    testNonce,
+	}
+	for k, v := range override {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// serveProvider serves OIDC discovery for an issuer whose signing keys are
+// the public halves of the supplied keys. The issuer URL is the server's URL.
+func serveProvider(t *testing.T, keys ...jose.JSONWebKey) *httptest.Server {
+	t.Helper()
+	ks := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		ks.Keys = append(ks.Keys, k.Public())
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"}) // nolint: errcheck
+		case "/keys":
+			json.NewEncoder(w).Encode(ks) // nolint: errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func withIDToken(raw string) *oauth2.Token {
+	return (&oauth2.Token{AccessToken: "access"}).WithExtra(map[string]interface{}{tokenFieldIDToken: raw})
+}
+
+// newKeySetVerifier returns a verifier of ID tokens issued by testIssuer and
+// signed by the supplied key, and a function that stops it.
+func newKeySetVerifier(t *testing.T, key jose.JSONWebKey) (*jwtVerifier, func()) {
+	t.Helper()
+	srv := newJWKSServer(key)
+	ctx, cancel := context.WithCancel(context.Background())
+	ks, err := NewKeySet(ctx, srv.Client(), testIssuer, srv.URL)
+	if err != nil {
+		cancel()
+		srv.Close()
+		t.Fatalf("NewKeySet(...): %v", err)
+	}
+	j := &jwtVerifier{ks: ks, leeway: DefaultClockSkew, hashCheck: HashCheckEnforce, log: zap.NewNop()}
+	return j, func() {
+		cancel()
+		srv.Close()
+	}
+}
+
+func TestJWTVerifierNonce(t *testing.T) {
+	key := signingKey(t, "a")
+	j, stop := newKeySetVerifier(t, key)
+	defer stop()
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		claims  map[string]interface{}
+		nonce   string
+		wantErr error
+	}{
+		{
+			name:  "Match",
+			nonce: testNonce,
+		},
+		{
+			name: "NotExpected",
+		},
+		{
+			name:    "Mismatch",
+			nonce:   "other",
+			wantErr: ErrInvalidNonce,
+		},
+		{
+			name:    "Prefix",
+			nonce:   testNonce + "x",
+			wantErr: ErrInvalidNonce,
+		},
+		{
+			name:    "Missing",
+			claims:  map[string]interface{}{claimNonce: nil},
+			nonce:   testNonce,
+			wantErr: ErrInvalidNonce,
+		},
+		{
+			name:    "NotAString",
+			claims:  map[string]interface{}{claimNonce: 42},
+			nonce:   "42",
+			wantErr: ErrInvalidNonce,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			token := withIDToken(sign(t, key, idTokenClaims(now, tt.claims)))
+			_, err := j.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, token, &processOptions{nonce: tt.nonce})
+			if err != tt.wantErr {
+				t.Errorf("j.verify(...): want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierAudiences(t *testing.T) {
+	key := signingKey(t, "a")
+	j, stop := newKeySetVerifier(t, key)
+	defer stop()
+	now := time.Now()
+
+	cases := []struct {
+		name       string
+		claims     map[string]interface{}
+		audiences  []string
+		requireAZP bool
+		wantErr    bool
+	}{
+		{
+			name: "ClientID",
+		},
+		{
+			name:    "OtherAudience",
+			claims:  map[string]interface{}{claimAudience: "other"},
+			wantErr: true,
+		},
+		{
+			name:      "ExtraAudience",
+			claims:    map[string]interface{}{claimAudience: []string{"portal"}, claimAuthorizedParty: testClientID},
+			audiences: []string{testClientID, "portal"},
+		},
+		{
+			name:      "ExtraAudienceWithoutAZP",
+			claims:    map[string]interface{}{claimAudience: []string{"portal"}},
+			audiences: []string{testClientID, "portal"},
+		},
+		{
+			name:      "UnexpectedAudience",
+			claims:    map[string]interface{}{claimAudience: []string{"other"}, claimAuthorizedParty: testClientID},
+			audiences: []string{testClientID, "portal"},
+			wantErr:   true,
+		},
+		{
+			name:      "OtherAuthorizedParty",
+			claims:    map[string]interface{}{claimAudience: []string{testClientID, "portal"}, claimAuthorizedParty: "portal"},
+			audiences: []string{testClientID, "portal"},
+			wantErr:   true,
+		},
+		{
+			name:       "RequiredAuthorizedParty",
+			claims:     map[string]interface{}{claimAuthorizedParty: testClientID},
+			requireAZP: true,
+		},
+		{
+			name:       "MissingRequiredAuthorizedParty",
+			requireAZP: true,
+			wantErr:    true,
+		},
+		{
+			name:       "OtherRequiredAuthorizedParty",
+			claims:     map[string]interface{}{claimAuthorizedParty: "other"},
+			requireAZP: true,
+			wantErr:    true,
+		},
+		{
+			name:   "AuthorizedPartyNotChecked",
+			claims: map[string]interface{}{claimAuthorizedParty: "other"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			j.audiences, j.requireAZP = tt.audiences, tt.requireAZP
+			token := withIDToken(sign(t, key, idTokenClaims(now, tt.claims)))
+			_, err := j.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, token, &processOptions{nonce: testNonce})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("j.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckTimes(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	leeway := DefaultClockSkew
+
+	cases := []struct {
+		name     string
+		expiry   time.Time
+		issuedAt time.Time
+		nbf      time.Time
+		wantErr  bool
+	}{
+		{
+			name:   "Valid",
+			expiry: now.Add(time.Hour),
+		},
+		{
+			name:    "NoExpiry",
+			wantErr: true,
+		},
+		{
+			name:   "ExpiredWithinLeeway",
+			expiry: now.Add(-leeway),
+		},
+		{
+			name:    "ExpiredBeyondLeeway",
+			expiry:  now.Add(-leeway - time.Second),
+			wantErr: true,
+		},
+		{
+			name:     "IssuedWithinLeeway",
+			expiry:   now.Add(time.Hour),
+			issuedAt: now.Add(leeway),
+		},
+		{
+			name:     "IssuedBeyondLeeway",
+			expiry:   now.Add(time.Hour),
+			issuedAt: now.Add(leeway + time.Second),
+			wantErr:  true,
+		},
+		{
+			name:   "NotBeforeWithinLeeway",
+			expiry: now.Add(time.Hour),
+			nbf:    now.Add(leeway),
+		},
+		{
+			name:    "NotBeforeBeyondLeeway",
+			expiry:  now.Add(time.Hour),
+			nbf:     now.Add(leeway + time.Second),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			vt := &verifiedToken{expiry: tt.expiry, issuedAt: tt.issuedAt, claims: map[string]interface{}{}}
+			if !tt.nbf.IsZero() {
+				vt.claims[claimNotBefore] = float64(tt.nbf.Unix())
+			}
+			err := checkTimes(vt, now, leeway)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkTimes(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierExpiry(t *testing.T) {
+	key := signingKey(t, "a")
+	j, stop := newKeySetVerifier(t, key)
+	defer stop()
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:   "IssuedWithinClockSkew",
+			claims: map[string]interface{}{claimIssuedAt: now.Add(DefaultClockSkew / 2).Unix()},
+		},
+		{
+			name:    "IssuedInFuture",
+			claims:  map[string]interface{}{claimIssuedAt: now.Add(2 * DefaultClockSkew).Unix()},
+			wantErr: true,
+		},
+		{
+			name:   "ExpiredWithinClockSkew",
+			claims: map[string]interface{}{claimExpiry: now.Add(-DefaultClockSkew / 2).Unix()},
+		},
+		{
+			name:    "Expired",
+			claims:  map[string]interface{}{claimExpiry: now.Add(-2 * DefaultClockSkew).Unix()},
+			wantErr: true,
+		},
+		{
+			name:    "NoExpiry",
+			claims:  map[string]interface{}{claimExpiry: nil},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			token := withIDToken(sign(t, key, idTokenClaims(now, tt.claims)))
+			_, err := j.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, token, &processOptions{nonce: testNonce})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("j.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIntrospectionVerifier(t *testing.T) {
+	now := time.Now()
+	key := signingKey(t, "a")
+	idToken := sign(t, key, idTokenClaims(now, nil))
+
+	cases := []struct {
+		name      string
+		token     *oauth2.Token
+		nonce     string
+		audiences []string
+		response  map[string]interface{}
+		wantErr   bool
+	}{
+		{
+			name:     "ActiveIDToken",
+			token:    withIDToken(idToken),
+			nonce:    testNonce,
+			response: map[string]interface{}{"active": true, "iss": testIssuer, "sub": "1234", "aud": testClientID, "exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:     "ActiveAccessToken",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			nonce:    testNonce,
+			response: map[string]interface{}{"active": true, "sub": "1234", "client_id": testClientID, "exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:      "ExtraAudience",
+			token:     &oauth2.Token{AccessToken: "opaque"},
+			audiences: []string{testClientID, "portal"},
+			response:  map[string]interface{}{"active": true, "aud": []string{"portal"}, "exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:     "Inactive",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": false},
+			wantErr:  true,
+		},
+		{
+			name:     "OtherIssuer",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "iss": "https://evil.example.org", "client_id": testClientID, "exp": now.Add(time.Hour).Unix()},
+			wantErr:  true,
+		},
+		{
+			name:     "OtherAudience",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "aud": "other", "exp": now.Add(time.Hour).Unix()},
+			wantErr:  true,
+		},
+		{
+			name:     "OtherClient",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "client_id": "other", "exp": now.Add(time.Hour).Unix()},
+			wantErr:  true,
+		},
+		{
+			name:     "NoAudienceOrClient",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "exp": now.Add(time.Hour).Unix()},
+			wantErr:  true,
+		},
+		{
+			name:     "Expired",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "client_id": testClientID, "exp": now.Add(-time.Hour).Unix()},
+			wantErr:  true,
+		},
+		{
+			name:     "NoExpiry",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			response: map[string]interface{}{"active": true, "client_id": testClientID},
+			wantErr:  true,
+		},
+		{
+			name:     "OpaqueIDToken",
+			token:    withIDToken("opaque"),
+			nonce:    testNonce,
+			response: map[string]interface{}{"active": true, "sub": "1234", "aud": testClientID, "exp": now.Add(time.Hour).Unix()},
+		},
+		{
+			name:     "OpaqueIDTokenWrongNonce",
+			token:    withIDToken("opaque"),
+			nonce:    testNonce,
+			response: map[string]interface{}{"active": true, "sub": "1234", "aud": testClientID, "exp": now.Add(time.Hour).Unix(), "nonce": "other"},
+			wantErr:  true,
+		},
+		{
+			name:     "WrongNonce",
+			token:    withIDToken(idToken),
+			nonce:    "other",
+			response: map[string]interface{}{"active": true, "aud": testClientID, "exp": now.Add(time.Hour).Unix()},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(tt.response) // nolint: errcheck
+			}))
+			defer srv.Close()
+
+			i := &introspectionVerifier{h: srv.Client(), auth: secretAuth{}, issuer: testIssuer, endpoint: srv.URL, audiences: tt.audiences, leeway: DefaultClockSkew}
+			_, err := i.verify(context.Background(), &oauth2.Config{ClientID: testClientID}, tt.token, &processOptions{nonce: tt.nonce})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("i.verify(...): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+type namedVerifier string
+
+func (n namedVerifier) verify(_ context.Context, _ *oauth2.Config, _ *oauth2.Token, _ *processOptions) (*verifiedToken, error) {
+	return &verifiedToken{issuer: string(n)}, nil
+}
+
+func TestIssuerVerifiers(t *testing.T) {
+	key := signingKey(t, "a")
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		issuers map[string]verifier
+		token   *oauth2.Token
+		issuer  string
+		want    string
+	}{
+		{
+			name:    "IDTokenOfIntrospectedIssuer",
+			issuers: map[string]verifier{testIssuer: namedVerifier("introspect")},
+			token:   withIDToken(sign(t, key, idTokenClaims(now, nil))),
+			want:    "introspect",
+		},
+		{
+			name:    "IDTokenOfOtherIssuer",
+			issuers: map[string]verifier{"https://other.example.org": namedVerifier("introspect")},
+			token:   withIDToken(sign(t, key, idTokenClaims(now, nil))),
+			want:    "default",
+		},
+		{
+			name:    "OpaqueTokenForIssuer",
+			issuers: map[string]verifier{testIssuer: namedVerifier("a"), "https://other.example.org": namedVerifier("b")},
+			token:   &oauth2.Token{AccessToken: "opaque"},
+			issuer:  "https://other.example.org",
+			want:    "b",
+		},
+		{
+			name:    "OpaqueTokenSoleIssuer",
+			issuers: map[string]verifier{testIssuer: namedVerifier("introspect")},
+			token:   &oauth2.Token{AccessToken: "opaque"},
+			want:    "introspect",
+		},
+		{
+			name:    "OpaqueTokenAmbiguousIssuer",
+			issuers: map[string]verifier{testIssuer: namedVerifier("a"), "https://other.example.org": namedVerifier("b")},
+			token:   &oauth2.Token{AccessToken: "opaque"},
+			want:    "default",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			iv := &issuerVerifiers{issuers: tt.issuers, def: namedVerifier("default")}
+			vt, err := iv.verify(context.Background(), &oauth2.Config{}, tt.token, &processOptions{issuer: tt.issuer})
+			if err != nil {
+				t.Fatalf("iv.verify(...): %v", err)
+			}
+			if vt.issuer != tt.want {
+				t.Errorf("verifier:\nwant %v\ngot %v\n", tt.want, vt.issuer)
+			}
+		})
+	}
+}
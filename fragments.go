@@ -0,0 +1,98 @@
+package kuberos
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	urlParamFragments = "fragments"
+
+	contentTypeZip = "application/zip"
+)
+
+// fragmentsRequested returns true if the fragments URL parameter of the
+// supplied request, which must have been parsed, requests kubecfg fragments.
+func fragmentsRequested(r *http.Request) (bool, error) {
+	v := r.Form.Get(urlParamFragments)
+	if v == "" {
+		return false, nil
+	}
+	f, err := strconv.ParseBool(v)
+	return f, errors.Wrapf(err, "invalid %s parameter %q", urlParamFragments, v)
+}
+
+// fragments returns one minimal kubecfg per cluster of the supplied populated
+// kubecfg, keyed by cluster name. Each contains only the cluster, its context,
+// and the user, and sets no current context, so that it may be merged with an
+// existing kubecfg via the KUBECONFIG environment variable without changing
+// the context kubectl uses by default.
+func fragments(cfg api.Config) map[string]api.Config {
+	modes, _ := cfg.Extensions[extensionInteractiveModes].(interactiveModes)
+	out := make(map[string]api.Config, len(cfg.Clusters))
+	for name, ctx := range cfg.Contexts {
+		f := api.Config{
+			Clusters:  map[string]*api.Cluster{ctx.Cluster: cfg.Clusters[ctx.Cluster]},
+			Contexts:  map[string]*api.Context{name: ctx},
+			AuthInfos: map[string]*api.AuthInfo{ctx.AuthInfo: cfg.AuthInfos[ctx.AuthInfo]},
+		}
+		if mode := modes[ctx.AuthInfo]; mode != "" {
+			f.Extensions = map[string]runtime.Object{extensionInteractiveModes: interactiveModes{ctx.AuthInfo: mode}}
+		}
+		out[ctx.Cluster] = f
+	}
+	return out
+}
+
+// writeFragments writes a zip archive containing a kubecfg fragment per
+// cluster of the supplied populated kubecfg in the supplied format, named for
+// the cluster, e.g. prod.yaml.
+func writeFragments(w http.ResponseWriter, cfg api.Config, format, filename string) {
+	b := &bytes.Buffer{}
+	z := zip.NewWriter(b)
+	frags := fragments(cfg)
+	for _, name := range clusterNames(&cfg) {
+		y, err := marshalKubeCfg(frags[name], format)
+		if err != nil {
+			http.Error(w, errors.Wrapf(err, "cannot marshal fragment for cluster %s", name).Error(), http.StatusInternalServerError)
+			return
+		}
+		f, err := z.Create(safeFilename(name) + "." + format)
+		if err != nil {
+			http.Error(w, errors.Wrapf(err, "cannot create fragment for cluster %s", name).Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := f.Write(y); err != nil {
+			http.Error(w, errors.Wrapf(err, "cannot write fragment for cluster %s", name).Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := z.Close(); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot write fragments").Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeZip)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
+	}
+}
+
+// fragmentsFilename returns the filename of the archive of the supplied user's
+// kubecfg fragments, e.g. kubeconfig-alice@example.org-2018-01-02.zip.
+func fragmentsFilename(p *extractor.OIDCAuthenticationParams) string {
+	return kubeConfigFilename(p, "zip")
+}
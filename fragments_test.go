@@ -0,0 +1,96 @@
+package kuberos
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestFragments(t *testing.T) {
+	cfg := &api.Config{
+		Clusters: map[string]*api.Cluster{
+			"a": &api.Cluster{Server: "https://example.org"},
+			"b": &api.Cluster{Server: "https://example.net"},
+		},
+		CurrentContext: "a",
+	}
+	form := url.Values{
+		"email":     {"alice@example.org"},
+		"idToken":   {"token"},
+		"issuedAt":  {"2018-01-02T02:04:05Z"},
+		"fragments": {"true"},
+	}
+	r := httptest.NewRequest("POST", "/kubeconfig.yaml", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	KubeConfigFile(cfg)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+	want := map[string]string{
+		"Content-Type":        "application/zip",
+		"Content-Disposition": `attachment; filename="kubeconfig-alice@example.org-2018-01-02.zip"`,
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s:\nwant %v\ngot %v\n", k, v, got)
+		}
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader(...): %v", err)
+	}
+	names := []string{}
+	for _, f := range z.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("f.Open(): %v", err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close() // nolint: errcheck, gas
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll(%v): %v", f.Name, err)
+		}
+		frag, err := clientcmd.Load(b)
+		if err != nil {
+			t.Fatalf("clientcmd.Load(%v): %v", f.Name, err)
+		}
+		cluster := strings.TrimSuffix(f.Name, ".yaml")
+		if diff := deep.Equal(clusterNames(frag), []string{cluster}); diff != nil {
+			t.Errorf("%v clusters: want != got %v", f.Name, diff)
+		}
+		if ctx, ok := frag.Contexts[cluster]; !ok || ctx.AuthInfo != "alice@example.org" {
+			t.Errorf("%v contexts: want context %v for alice@example.org, got %+v", f.Name, cluster, frag.Contexts)
+		}
+		if frag.AuthInfos["alice@example.org"] == nil {
+			t.Errorf("%v users: want alice@example.org, got %+v", f.Name, frag.AuthInfos)
+		}
+		if frag.CurrentContext != "" {
+			t.Errorf("%v current-context: want none, got %v", f.Name, frag.CurrentContext)
+		}
+	}
+	if diff := deep.Equal(names, []string{"a.yaml", "b.yaml"}); diff != nil {
+		t.Errorf("fragments: want != got %v", diff)
+	}
+
+	r = httptest.NewRequest("POST", "/kubeconfig.yaml", strings.NewReader("fragments=maybe"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	KubeConfigFile(cfg)(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code:\nwant %v\ngot %v\n", http.StatusBadRequest, w.Code)
+	}
+}
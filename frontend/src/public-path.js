@@ -0,0 +1,3 @@
+// Load assets relative to build.js, which may be served from a parent of the
+// current page, e.g. for /ui/<provider>.
+__webpack_public_path__ = document.currentScript.src.replace(/[^\/]*$/, '');
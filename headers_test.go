@@ -0,0 +1,68 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	cases := []struct {
+		name  string
+		sh    SecurityHeaders
+		https bool
+		want  map[string]string
+	}{
+		{
+			name:  "DefaultHTTPS",
+			sh:    DefaultSecurityHeaders,
+			https: true,
+			want: map[string]string{
+				"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+				"Content-Security-Policy":   DefaultSecurityHeaders.ContentSecurityPolicy + "; frame-ancestors 'none'",
+				"X-Frame-Options":           "DENY",
+				"X-Content-Type-Options":    "nosniff",
+				"Referrer-Policy":           "no-referrer",
+				"Cache-Control":             "no-store",
+			},
+		},
+		{
+			name: "DefaultHTTP",
+			sh:   DefaultSecurityHeaders,
+			want: map[string]string{
+				"Strict-Transport-Security": "",
+				"X-Frame-Options":           "DENY",
+			},
+		},
+		{
+			name:  "FramingAllowed",
+			sh:    SecurityHeaders{FrameAncestors: "https://portal.example.org"},
+			https: true,
+			want: map[string]string{
+				"Strict-Transport-Security": "",
+				"Content-Security-Policy":   "frame-ancestors https://portal.example.org",
+				"X-Frame-Options":           "",
+				"Referrer-Policy":           "",
+				"X-Content-Type-Options":    "nosniff",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.https {
+				r.Header.Set(headerForwardedProto, schemeHTTPS)
+			}
+			tt.sh.Handler(ok).ServeHTTP(w, r)
+			for h, want := range tt.want {
+				if got := w.Header().Get(h); got != want {
+					t.Errorf("%s:\nwant %v\ngot %v\n", h, want, got)
+				}
+			}
+		})
+	}
+}
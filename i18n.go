@@ -0,0 +1,182 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/text/language"
+)
+
+// DefaultLanguage is the language of DefaultCatalog.
+const DefaultLanguage = "en"
+
+// A Catalog maps message IDs to the messages kuberos presents to users in a
+// single language. Messages may contain HTML.
+type Catalog map[string]string
+
+// DefaultCatalog contains every message kuberos presents to users, in
+// English. Other catalogs need contain only the messages they translate.
+var DefaultCatalog = Catalog{
+	"error.retry":     "Try again",
+	"error.details":   "Details",
+	"error.reference": "If the problem persists, contact your administrator quoting reference",
+
+	"error.expiredState.title":                "Your login expired",
+	"error.expiredState.explanation":          "Logins must be completed within a few minutes of starting them.",
+	"error.invalidState.title":                "Your login could not be completed",
+	"error.invalidState.explanation":          "Your login was started in a different browser, or your browser did not send kuberos's cookies. Please log in again from this browser.",
+	"error.notAuthorized.title":               "Access denied",
+	"error.notAuthorized.explanation":         "You are not a member of a group that is allowed to use these clusters. Ask your administrator for access.",
+	"error.lockedOut.title":                   "Too many failed attempts",
+	"error.lockedOut.explanation":             "Logins from your network or account are temporarily blocked after repeated failures. Please wait a few minutes before trying again.",
+	"error.invalidDownload.title":             "Download link expired",
+	"error.invalidDownload.explanation":       "Download links expire after a few minutes and may be used only once. Log in again to get a new link.",
+	"error.authenticationContext.title":       "Stronger authentication required",
+	"error.authenticationContext.explanation": "Please log in again using a stronger authentication method, for example multi-factor authentication.",
+	"error.unreachable.title":                 "Identity provider unreachable",
+	"error.unreachable.explanation":           "kuberos could not contact your identity provider. Please try again in a few minutes.",
+	"error.timeout.title":                     "Request timed out",
+	"error.timeout.explanation":               "Your identity provider took too long to respond. Please try again in a few minutes.",
+	"error.exchangeFailed.title":              "Authentication failed",
+	"error.exchangeFailed.explanation":        "Your identity provider did not accept the login. Please try again.",
+	"error.claimsInvalid.title":               "Missing account details",
+	"error.claimsInvalid.explanation":         "Your identity provider did not supply the details kuberos requires, such as your email address or groups. Ask your administrator for access.",
+	"error.verifyFailed.title":                "Authentication failed",
+	"error.verifyFailed.explanation":          "Your identity provider's response could not be verified.",
+	"error.internal.title":                    "Something went wrong",
+	"error.internal.explanation":              "kuberos could not complete your request.",
+	"error.badRequest.title":                  "Your request could not be completed",
+	"error.badRequest.explanation":            "kuberos did not understand your request.",
+
+	"support": "Get help",
+
+	"providers.title":   "Log in with",
+	"providers.default": "Default provider",
+
+	"ui.authenticated":         "Successfully Authenticated",
+	"ui.gettingStarted":        "Getting Started",
+	"ui.gettingStarted.save":   "Save the file below as <code>~/.kube/config</code> to enable OIDC based <code>kubectl</code> authentication.",
+	"ui.gettingStarted.button": "Download Config File",
+	"ui.runningKubectl":        "Running kubectl",
+	"ui.runningKubectl.intro":  "Once you've saved the above <code>~/.kube/config</code> file you should be able to run <code>kubectl</code>",
+	"ui.advanced":              "Advanced",
+	"ui.manual":                "Authenticate Manually",
+	"ui.manual.intro":          "If you want to maintain your existing <code>~/.kube/config</code> file you can run the following to add your user:",
+}
+
+// A Localizer selects the catalog in which to present messages to a user per
+// the Accept-Language header of their request.
+type Localizer struct {
+	tags     []language.Tag
+	catalogs []Catalog
+	matcher  language.Matcher
+}
+
+// NewLocalizer returns a Localizer that selects among the supplied catalogs,
+// keyed by BCP 47 language tag. The catalog of the supplied default language
+// is selected when no other catalog matches. Messages missing from a catalog
+// fall back to the default language, then to DefaultCatalog.
+func NewLocalizer(def string, catalogs map[string]Catalog) (*Localizer, error) {
+	dt, err := language.Parse(def)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse default language %q", def)
+	}
+	tags := map[language.Tag]Catalog{}
+	for k, c := range catalogs {
+		t, err := language.Parse(k)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse catalog language %q", k)
+		}
+		tags[t] = c
+	}
+
+	base := mergeCatalogs(DefaultCatalog, tags[dt])
+	l := &Localizer{tags: []language.Tag{dt}, catalogs: []Catalog{base}}
+	others := make([]language.Tag, 0, len(tags))
+	for t := range tags {
+		if t != dt {
+			others = append(others, t)
+		}
+	}
+	// Sort for a deterministic match among equally good catalogs.
+	sort.Slice(others, func(i, j int) bool { return others[i].String() < others[j].String() })
+	for _, t := range others {
+		l.tags = append(l.tags, t)
+		l.catalogs = append(l.catalogs, mergeCatalogs(base, tags[t]))
+	}
+	l.matcher = language.NewMatcher(l.tags)
+	return l, nil
+}
+
+func mergeCatalogs(base, c Catalog) Catalog {
+	m := make(Catalog, len(base))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range c {
+		m[k] = v
+	}
+	return m
+}
+
+// LoadCatalogs loads the message catalogs in the supplied directory. Each
+// catalog is a JSON object mapping message IDs to messages, in a file named
+// for its language tag, e.g. de.json or pt-BR.json.
+func LoadCatalogs(dir string) (map[string]Catalog, error) {
+	fi, err := afero.ReadDir(appFs, dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read message catalog directory")
+	}
+	catalogs := map[string]Catalog{}
+	for _, f := range fi {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		b, err := afero.ReadFile(appFs, filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read message catalog %s", f.Name())
+		}
+		c := Catalog{}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode message catalog %s", f.Name())
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = c
+	}
+	return catalogs, nil
+}
+
+// Catalog returns the language and catalog that best match the Accept-Language
+// header of the supplied request. A nil Localizer always returns
+// DefaultCatalog.
+func (l *Localizer) Catalog(r *http.Request) (string, Catalog) {
+	if l == nil {
+		return DefaultLanguage, DefaultCatalog
+	}
+	// A malformed header selects the default catalog.
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")) // nolint: gas
+	_, i, _ := l.matcher.Match(tags...)
+	return l.tags[i].String(), l.catalogs[i]
+}
+
+// ServeHTTP serves the catalog that best matches the request's Accept-Language
+// header as JSON, for use by the frontend.
+func (l *Localizer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lang, c := l.Catalog(r)
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", lang)
+	writeJSON(w, c)
+}
+
+// Localize presents error pages in the language of the supplied Localizer's
+// catalog that best matches each request's Accept-Language header.
+func Localize(l *Localizer) Option {
+	return func(h *Handlers) error {
+		h.localizer = l
+		return nil
+	}
+}
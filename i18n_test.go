@@ -0,0 +1,72 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestLocalizer(t *testing.T) {
+	l, err := NewLocalizer("en", map[string]Catalog{
+		"de":    {"error.retry": "Erneut versuchen"},
+		"pt-BR": {"error.retry": "Tentar novamente"},
+	})
+	if err != nil {
+		t.Fatalf("NewLocalizer(...): %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		acceptLanguage string
+		wantLang       string
+		wantRetry      string
+	}{
+		{name: "Exact", acceptLanguage: "de", wantLang: "de", wantRetry: "Erneut versuchen"},
+		{name: "Region", acceptLanguage: "de-CH, en;q=0.5", wantLang: "de", wantRetry: "Erneut versuchen"},
+		{name: "Weighted", acceptLanguage: "fr, pt-BR;q=0.8, de;q=0.5", wantLang: "pt-BR", wantRetry: "Tentar novamente"},
+		{name: "NoMatch", acceptLanguage: "fr", wantLang: "en", wantRetry: DefaultCatalog["error.retry"]},
+		{name: "Malformed", acceptLanguage: "de;q=x", wantLang: "en", wantRetry: DefaultCatalog["error.retry"]},
+		{name: "Missing", wantLang: "en", wantRetry: DefaultCatalog["error.retry"]},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/messages.json", nil)
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+			lang, c := l.Catalog(r)
+			if lang != tt.wantLang {
+				t.Errorf("l.Catalog(...): want language %v, got %v", tt.wantLang, lang)
+			}
+			if c["error.retry"] != tt.wantRetry {
+				t.Errorf("c[error.retry]:\nwant %v\ngot %v\n", tt.wantRetry, c["error.retry"])
+			}
+			if c["error.details"] != DefaultCatalog["error.details"] {
+				t.Errorf("c[error.details]: want fallback to default catalog, got %v", c["error.details"])
+			}
+		})
+	}
+
+	t.Run("ErrorPage", func(t *testing.T) {
+		c := &oauth2.Config{ClientID: "testClientID", Scopes: DefaultScopes}
+		h, err := NewHandlers(c, &predictableExtractor{}, Localize(l))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg", nil)
+		r.Header.Set("Accept", "text/html")
+		r.Header.Set("Accept-Language", "de-DE")
+		h.fail(w, r, http.StatusBadRequest, ErrMissingCode)
+		if got := w.Header().Get("Content-Language"); got != "de" {
+			t.Errorf("Content-Language:\nwant de\ngot %v\n", got)
+		}
+		for _, want := range []string{`<html lang="de">`, "Erneut versuchen", DefaultCatalog["error.badRequest.title"]} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("w.Body: want %q, got\n%s", want, w.Body)
+			}
+		}
+	})
+}
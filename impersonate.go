@@ -0,0 +1,45 @@
+package kuberos
+
+import "github.com/pkg/errors"
+
+// An Impersonation configures the users of a cluster to impersonate another
+// user and groups, e.g. to generate break-glass contexts. The user must be
+// permitted to impersonate them by the cluster's RBAC policy.
+//
+// See https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
+type Impersonation struct {
+	// As is the user to impersonate.
+	As string
+
+	// AsGroups are the groups to impersonate.
+	AsGroups []string
+
+	// ForGroups restricts impersonation to the members of these groups.
+	// Other users of the cluster do not impersonate. All users impersonate if
+	// ForGroups is empty.
+	ForGroups []string
+}
+
+func (i *Impersonation) validate() error {
+	// The API server rejects requests that impersonate groups but no user.
+	if i.As == "" {
+		return errors.New("as is required to impersonate")
+	}
+	return nil
+}
+
+// appliesTo returns true if a user who is a member of the supplied groups
+// should impersonate.
+func (i *Impersonation) appliesTo(groups []string) bool {
+	if len(i.ForGroups) == 0 {
+		return true
+	}
+	for _, want := range i.ForGroups {
+		for _, g := range groups {
+			if g == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package kuberos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/spf13/afero"
+
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestImpersonation(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	tmpl := `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.org
+- name: breakglass
+  cluster:
+    server: https://prod.example.org
+    as: breakglass-admin
+    as-groups:
+    - system:masters
+    as-for-groups:
+    - sre
+`
+	if err := afero.WriteFile(appFs, "template.yaml", []byte(tmpl), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	cfg, err := LoadKubeCfgTemplate("template.yaml")
+	if err != nil {
+		t.Fatalf("LoadKubeCfgTemplate(...): %v", err)
+	}
+
+	sre := &extractor.OIDCAuthenticationParams{Username: "alice", IDToken: "token", Groups: []string{"dev", "sre"}}
+	y, err := writeKubeCfg(populateUser(cfg, sre, UserAuthProvider))
+	if err != nil {
+		t.Fatalf("writeKubeCfg(...): %v", err)
+	}
+	got, err := clientcmd.Load(y)
+	if err != nil {
+		t.Fatalf("clientcmd.Load(...): %v", err)
+	}
+	if ctx := got.Contexts["breakglass"]; ctx == nil || ctx.AuthInfo != "alice-breakglass" {
+		t.Fatalf("got.Contexts[breakglass]: want user alice-breakglass, got %+v", ctx)
+	}
+	ai := got.AuthInfos["alice-breakglass"]
+	if ai.Impersonate != "breakglass-admin" {
+		t.Errorf("ai.Impersonate:\nwant %v\ngot %v\n", "breakglass-admin", ai.Impersonate)
+	}
+	if diff := deep.Equal(ai.ImpersonateGroups, []string{"system:masters"}); diff != nil {
+		t.Errorf("ai.ImpersonateGroups: want != got %v", diff)
+	}
+	if ai.AuthProvider == nil || ai.AuthProvider.Config[templateOIDCIDToken] != "token" {
+		t.Errorf("ai.AuthProvider: want ID token, got %+v", ai.AuthProvider)
+	}
+	if shared := got.AuthInfos[got.Contexts["prod"].AuthInfo]; shared.Impersonate != "" {
+		t.Errorf("got.AuthInfos[alice].Impersonate: want none, got %v", shared.Impersonate)
+	}
+
+	// Users who are not members of the groups do not impersonate.
+	dev := &extractor.OIDCAuthenticationParams{Username: "bob", IDToken: "token", Groups: []string{"dev"}}
+	c := populateUser(cfg, dev, UserAuthProvider)
+	if len(c.AuthInfos) != 1 || c.AuthInfos["bob"] == nil || c.AuthInfos["bob"].Impersonate != "" {
+		t.Errorf("populateUser(...).AuthInfos: want one user who does not impersonate, got %+v", c.AuthInfos)
+	}
+
+	invalid := strings.Replace(tmpl, "    as: breakglass-admin\n", "", 1)
+	if err := afero.WriteFile(appFs, "invalid.yaml", []byte(invalid), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	if _, err := LoadKubeCfgTemplate("invalid.yaml"); err == nil {
+		t.Errorf("LoadKubeCfgTemplate(...): want error impersonating groups but no user")
+	}
+}
@@ -0,0 +1,101 @@
+package kuberos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIPNotAllowed indicates a request from a client IP address that may not
+// use kuberos.
+var ErrIPNotAllowed = errors.New("requests from your IP address are not allowed")
+
+type clientIPKey struct{}
+
+// An IPFilter restricts the client IP addresses that may make requests, e.g.
+// to corporate ranges or VPN egress addresses.
+type IPFilter struct {
+	// Allow are the networks from which requests are allowed. Requests from
+	// any network are allowed if empty.
+	Allow []*net.IPNet
+
+	// Deny are the networks from which requests are denied, even if they
+	// are also allowed.
+	Deny []*net.IPNet
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For
+	// header is trusted. The client IP address is the last address in the
+	// chain of forwarding proxies that is not a trusted proxy. The
+	// X-Forwarded-For header is ignored if empty.
+	TrustedProxies []*net.IPNet
+}
+
+// ParseCIDRs parses the supplied networks in CIDR notation. Bare IP addresses
+// are parsed as single address networks.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.Errorf("cannot parse IP address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse CIDR %q", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made the supplied
+// request, walking the X-Forwarded-For header back through any trusted
+// proxies.
+func (f IPFilter) clientIP(r *http.Request) net.IP {
+	return TrustedProxies(f.TrustedProxies).clientIP(r)
+}
+
+func (f IPFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if contains(f.Deny, ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || contains(f.Allow, ip)
+}
+
+// Handler returns a handler that responds with 403 Forbidden to requests from
+// client IP addresses that are not allowed, and calls the supplied handler
+// otherwise. The client IP address is also used for rate limiting and audit
+// events.
+func (f IPFilter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := f.clientIP(r)
+		if !f.allowed(ip) {
+			http.Error(w, ErrIPNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip.String())))
+	})
+}
@@ -0,0 +1,72 @@
+package kuberos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	nets := func(cidrs ...string) []*net.IPNet {
+		n, err := ParseCIDRs(cidrs)
+		if err != nil {
+			t.Fatalf("ParseCIDRs(%v): %v", cidrs, err)
+		}
+		return n
+	}
+	f := IPFilter{
+		Allow:          nets("192.0.2.0/24", "2001:db8::/32"),
+		Deny:           nets("192.0.2.66"),
+		TrustedProxies: nets("10.0.0.0/8"),
+	}
+
+	cases := []struct {
+		name   string
+		remote string
+		xff    string
+		unix   bool
+		code   int
+		ip     string
+	}{
+		{name: "Allowed", remote: "192.0.2.1:1234", code: http.StatusOK, ip: "192.0.2.1"},
+		{name: "AllowedIPv6", remote: "[2001:db8::1]:1234", code: http.StatusOK, ip: "2001:db8::1"},
+		{name: "NotAllowed", remote: "198.51.100.1:1234", code: http.StatusForbidden},
+		{name: "Denied", remote: "192.0.2.66:1234", code: http.StatusForbidden},
+		{name: "BehindTrustedProxies", remote: "10.0.0.1:1234", xff: "198.51.100.1, 192.0.2.1, 10.0.0.2", code: http.StatusOK, ip: "192.0.2.1"},
+		{name: "SpoofedBehindTrustedProxy", remote: "10.0.0.1:1234", xff: "192.0.2.1, 198.51.100.1", code: http.StatusForbidden},
+		{name: "UntrustedProxy", remote: "198.51.100.1:1234", xff: "192.0.2.1", code: http.StatusForbidden},
+		{name: "UnixSocket", remote: "@", unix: true, xff: "192.0.2.1", code: http.StatusOK, ip: "192.0.2.1"},
+		{name: "UnixSocketNotAllowed", remote: "@", unix: true, xff: "198.51.100.1", code: http.StatusForbidden},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var ip string
+			h := f.Handler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { ip = clientIP(r) }))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.unix {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/kuberos.sock", Net: "unix"}))
+			}
+			if tt.xff != "" {
+				r.Header.Set(headerForwardedFor, tt.xff)
+			}
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if ip != tt.ip {
+				t.Errorf("clientIP(r):\nwant %v\ngot %v\n", tt.ip, ip)
+			}
+		})
+	}
+
+	if _, err := ParseCIDRs([]string{"192.0.2.0/33"}); err == nil {
+		t.Errorf("ParseCIDRs(192.0.2.0/33): want error")
+	}
+}
@@ -1,24 +1,32 @@
 package kuberos
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/negz/kuberos/extractor"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/ghodss/yaml"
 	"github.com/gorilla/schema"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"k8s.io/api/core/v1"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
@@ -27,6 +35,10 @@ const (
 	// be redirected after authentication.
 	DefaultKubeCfgEndpoint = "ui"
 
+	// DefaultLogoutEndpoint is the default endpoint at which users may log out
+	// of their OIDC provider session.
+	DefaultLogoutEndpoint = "logout"
+
 	// DefaultAPITokenMountPath is the default mount path for API tokens
 	DefaultAPITokenMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
 
@@ -35,13 +47,33 @@ const (
 
 	headerForwardedProto  = "X-Forwarded-Proto"
 	headerForwardedFor    = "X-Forwarded-For"
+	headerForwardedHost   = "X-Forwarded-Host"
 	headerForwardedPrefix = "X-Forwarded-Prefix"
+	headerErrorCode       = "X-Kuberos-Error-Code"
 
 	urlParamState            = "state"
 	urlParamCode             = "code"
 	urlParamError            = "error"
 	urlParamErrorDescription = "error_description"
 	urlParamErrorURI         = "error_uri"
+	urlParamDeviceCode       = "device_code"
+	urlParamRefreshToken     = "refresh_token"
+	urlParamIDTokenHint      = "id_token_hint"
+	urlParamScope            = "scope"
+	urlParamPrompt           = "prompt"
+	urlParamLoginHint        = "login_hint"
+	urlParamAccessType       = "access_type"
+	urlParamFormat           = "format"
+
+	formatYAML = "yaml"
+	formatJSON = "json"
+
+	contentTypeYAML = "text/x-yaml; charset=utf-8"
+	contentTypeJSON = "application/json; charset=utf-8"
+	contentTypeText = "text/plain; charset=utf-8"
+
+	contentTypeKubeConfigFile     = "application/yaml"
+	contentTypeKubeConfigFileJSON = "application/json"
 
 	templateAuthProvider     = "oidc"
 	templateOIDCClientID     = "client-id"
@@ -51,6 +83,14 @@ const (
 	templateOIDCRefreshToken = "refresh-token"
 
 	templateFormParseMemory = 32 << 20 // 32MB
+
+	cookieMaxAge = 600 // 10 minutes
+
+	randomValueBytes = 32
+
+	pkceCodeChallenge           = "code_challenge"
+	pkceCodeChallengeMethod     = "code_challenge_method"
+	pkceCodeChallengeMethodS256 = "S256"
 )
 
 var (
@@ -62,12 +102,36 @@ var (
 	ErrInvalidKubeCfgEndpoint = errors.New("invalid redirect endpoint")
 
 	// ErrInvalidState indicates the provided state param was not as expected.
-	ErrInvalidState = errors.New("invalid state parameter: user agent or IP address changed between requests")
+	ErrInvalidState = errors.New("invalid state parameter: authentication was not started by this browser")
+
+	// ErrExpiredState indicates the provided state param was valid, but the
+	// user took too long to authenticate.
+	ErrExpiredState = errors.New("expired state parameter: please log in again")
 
 	// ErrMissingCode indicates a response without an OAuth 2.0 authorization
 	// code
 	ErrMissingCode = errors.New("response missing authorization code")
 
+	// ErrMissingCodeVerifier indicates a PKCE code verifier was expected but
+	// not found, typically because the user agent discarded our session
+	// cookie.
+	ErrMissingCodeVerifier = errors.New("missing PKCE code verifier: ensure cookies are enabled")
+
+	// ErrMissingNonce indicates the nonce sent with the authentication request
+	// could not be found, typically because the user agent discarded our
+	// session cookie.
+	ErrMissingNonce = errors.New("missing nonce: ensure cookies are enabled")
+
+	// ErrScopeNotAllowed indicates a request for a scope that was not
+	// configured as requestable.
+	ErrScopeNotAllowed = errors.New("scope may not be requested")
+
+	// ErrInvalidPrompt indicates a request for an unknown prompt value.
+	ErrInvalidPrompt = errors.New("invalid prompt: must be one of none, login, consent, or select_account")
+
+	// ErrInvalidAccessType indicates a request for an unknown access type.
+	ErrInvalidAccessType = errors.New("invalid access type: must be online or offline")
+
 	// ErrNoYAMLSerializer indicates we're unable to serialize Kubernetes
 	// objects as YAML.
 	ErrNoYAMLSerializer = errors.New("no YAML serializer registered")
@@ -76,25 +140,16 @@ var (
 
 	appFs = afero.NewOsFs()
 
-	approvalConsent = oauth2.SetAuthURLParam("prompt", "consent")
+	approvalConsent = oauth2.SetAuthURLParam(urlParamPrompt, "consent")
+
+	prompts     = map[string]bool{"none": true, "login": true, "consent": true, "select_account": true}
+	accessTypes = map[string]bool{"online": true, "offline": true}
 )
 
 // A StateFn should take an HTTP request and return a difficult to predict yet
 // deterministic state string.
 type StateFn func(*http.Request) string
 
-func defaultStateFn(secret []byte) StateFn {
-	// Writing to a hash never returns an error.
-	// nolint: errcheck, gas
-	return func(r *http.Request) string {
-		h := sha256.New()
-		h.Write(secret)
-		h.Write([]byte(r.Host))
-		h.Write([]byte(r.UserAgent()))
-		return fmt.Sprintf("%x", h.Sum(nil))
-	}
-}
-
 // OfflineAsScope determines whether an offline refresh token is requested via
 // a scope per the spec or via Google's custom access_type=offline method.
 //
@@ -137,17 +192,44 @@ func (r *ScopeRequests) Get() []string {
 type Handlers struct {
 	log        *zap.Logger
 	cfg        *oauth2.Config
-	e          extractor.OIDC
+	e          extractor.Extractor
 	oo         []oauth2.AuthCodeOption
 	state      StateFn
+	stateKey   []byte
+	stateTTL   time.Duration
+	sessions   *cookieCodec
+	store      SessionStore
 	httpClient *http.Client
 	endpoint   *url.URL
+	logout     string
+	basePath   string
+	pkce       bool
+	public     bool
+	scopes     map[string]bool
+	policy     Policy
+	audit      []AuditSink
+	clusters   []string
+	returnTo   []*url.URL
+	localizer  *Localizer
+	branding   Branding
+	headless   bool
+	errorPage  *template.Template
+
+	template         *api.Config
+	downloadEndpoint string
+	downloadTTL      time.Duration
+	downloads        *downloadStore
+
+	ipLimiter      *limiter
+	subjectLimiter *limiter
+	lockouts       *lockouts
 }
 
 // An Option represents a Handlers option.
 type Option func(*Handlers) error
 
-// StateFunction allows the use of a bespoke state generator function.
+// StateFunction allows the use of a bespoke state generator function in place
+// of signed, expiring state parameters.
 func StateFunction(fn StateFn) Option {
 	return func(h *Handlers) error {
 		h.state = fn
@@ -179,8 +261,90 @@ func Logger(l *zap.Logger) Option {
 	}
 }
 
+// BasePath configures the path under which kuberos is served, e.g. /kuberos/
+// when it shares an ingress with other services. Redirect URLs and cookies
+// are scoped to this path unless the request includes an X-Forwarded-Prefix
+// header, which takes precedence.
+func BasePath(p string) Option {
+	return func(h *Handlers) error {
+		if !strings.HasPrefix(p, "/") {
+			return errors.Errorf("base path %q must be absolute", p)
+		}
+		h.basePath = basePath(p)
+		return nil
+	}
+}
+
+// RedirectEndpoint configures the endpoint, relative to the base path, to which
+// clients are redirected after authentication. The default is ui. An absolute
+// URL, e.g. of a developer portal page, may also be supplied.
+func RedirectEndpoint(e string) Option {
+	return func(h *Handlers) error {
+		u, err := url.Parse(e)
+		if err != nil {
+			return errors.Wrap(ErrInvalidKubeCfgEndpoint, err.Error())
+		}
+		h.endpoint = u
+		return nil
+	}
+}
+
+// Headless serves errors as plain text, even to browsers, for deployments in
+// which a developer portal presents the user-facing flow in place of the
+// kuberos frontend.
+func Headless() Option {
+	return func(h *Handlers) error {
+		h.headless = true
+		return nil
+	}
+}
+
+// LogoutEndpoint configures the endpoint, relative to the base path, at which
+// EndSession is served. The default is logout.
+func LogoutEndpoint(e string) Option {
+	return func(h *Handlers) error {
+		h.logout = e
+		return nil
+	}
+}
+
+// PKCE enables Proof Key for Code Exchange using the S256 challenge method.
+// This allows kuberos to be registered as a public client with identity
+// providers that require PKCE.
+//
+// See https://tools.ietf.org/html/rfc7636
+func PKCE() Option {
+	return func(h *Handlers) error {
+		h.pkce = true
+		return nil
+	}
+}
+
+// PublicClient configures kuberos to omit the OAuth2 client secret from the
+// kubecfgs and authentication parameters it returns, for clients registered
+// with the identity provider as public clients. This avoids distributing a
+// shared secret to every user. kubectl then refreshes ID tokens without
+// authenticating as the client. PublicClient implies PKCE.
+func PublicClient() Option {
+	return func(h *Handlers) error {
+		h.public, h.pkce = true, true
+		return nil
+	}
+}
+
+// RequestableScopes allows the supplied scopes to be requested in addition to
+// the configured scopes via the scope query parameter of a login request.
+func RequestableScopes(scopes ...string) Option {
+	return func(h *Handlers) error {
+		for _, s := range scopes {
+			h.scopes[s] = true
+		}
+		return nil
+	}
+}
+
 // NewHandlers returns a new set of Kuberos HTTP handlers.
-func NewHandlers(c *oauth2.Config, e extractor.OIDC, ho ...Option) (*Handlers, error) {
+func NewHandlers(c *oauth2.Config, e extractor.Extractor, ho ...Option) (*Handlers, error) {
 	l, err := zap.NewProduction()
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create default logger")
@@ -191,9 +355,13 @@ func NewHandlers(c *oauth2.Config, e extractor.OIDC, ho ...Option) (*Handlers, e
 		cfg:        c,
 		e:          e,
 		oo:         []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, approvalConsent},
-		state:      defaultStateFn([]byte(c.ClientSecret)),
+		stateTTL:   DefaultStateTTL,
 		httpClient: http.DefaultClient,
 		endpoint:   &url.URL{Path: DefaultKubeCfgEndpoint},
+		logout:     DefaultLogoutEndpoint,
+		basePath:   "/",
+		scopes:     map[string]bool{},
+		errorPage:  errorPageTemplate,
 	}
 
 	// Assume we're using a Googley request for offline access.
@@ -209,30 +377,248 @@ func NewHandlers(c *oauth2.Config, e extractor.OIDC, ho ...Option) (*Handlers, e
 			return nil, errors.Wrap(err, "cannot apply handlers option")
 		}
 	}
+	if h.stateKey == nil {
+		if h.stateKey, err = defaultKey(c.ClientSecret, stateKeyContext); err != nil {
+			return nil, errors.Wrap(err, "cannot derive state signing key")
+		}
+	}
+	if h.sessions == nil {
+		k, err := defaultKey(c.ClientSecret, sessionKeyContext)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot derive session key")
+		}
+		if h.sessions, err = newCookieCodec(k); err != nil {
+			return nil, err
+		}
+	}
 	return h, nil
 }
 
-// Login redirects to an OIDC provider per the supplied oauth2 config.
+// Login redirects to an OIDC provider per the supplied oauth2 config. The
+// scope, prompt, login_hint, and access_type query parameters may be used to
+// customise the authentication request, and the return_to query parameter to
+// return the user whence they came once authenticated.
 func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
+	if !limit(w, h.ipLimiter, clientIP(r)) {
+		return
+	}
 	c := &oauth2.Config{
 		ClientID:     h.cfg.ClientID,
 		ClientSecret: h.cfg.ClientSecret,
 		Endpoint:     h.cfg.Endpoint,
 		Scopes:       h.cfg.Scopes,
-		RedirectURL:  redirectURL(r, h.endpoint),
+		RedirectURL:  redirectURL(r, h.basePath, h.endpoint),
+	}
+
+	nonce, err := newRandomValue()
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot generate nonce"))
+		return
+	}
+	s := &Session{Nonce: nonce}
+
+	oo := append([]oauth2.AuthCodeOption{oidc.Nonce(nonce)}, h.oo...)
+	if h.pkce {
+		if s.Verifier, err = newRandomValue(); err != nil {
+			h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot generate PKCE code verifier"))
+			return
+		}
+		oo = append(oo,
+			oauth2.SetAuthURLParam(pkceCodeChallenge, codeChallengeS256(s.Verifier)),
+			oauth2.SetAuthURLParam(pkceCodeChallengeMethod, pkceCodeChallengeMethodS256))
 	}
 
-	u := c.AuthCodeURL(h.state(r), h.oo...)
-	h.log.Debug("redirect", zap.String("url", u))
+	ro, err := h.requestOptions(r, c)
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	oo = append(oo, ro...)
+
+	if rt := r.FormValue(urlParamReturnTo); rt != "" {
+		if s.ReturnTo, err = h.returnURL(rt); err != nil {
+			h.fail(w, r, http.StatusBadRequest, errors.Wrapf(err, "%q", rt))
+			return
+		}
+	}
+
+	s.State = h.newState(r, nonce, c.RedirectURL)
+	if err := h.setSession(w, r, s); err != nil {
+		h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot store session"))
+		return
+	}
+
+	u := c.AuthCodeURL(s.State, oo...)
+	h.logger(r).Debug("redirect", zap.String("url", u))
 	http.Redirect(w, r, u, http.StatusSeeOther)
 }
 
+// requestOptions returns any authentication request options supplied via the
+// query parameters of a login request, adding any requested scopes to the
+// supplied config.
+func (h *Handlers) requestOptions(r *http.Request, c *oauth2.Config) ([]oauth2.AuthCodeOption, error) {
+	if s := r.FormValue(urlParamScope); s != "" {
+		scopes := append([]string{}, c.Scopes...)
+		for _, scope := range strings.Fields(s) {
+			if !h.scopes[scope] {
+				return nil, errors.Wrapf(ErrScopeNotAllowed, "%q", scope)
+			}
+			scopes = append(scopes, scope)
+		}
+		c.Scopes = scopes
+	}
+
+	oo := []oauth2.AuthCodeOption{}
+	if p := r.FormValue(urlParamPrompt); p != "" {
+		if !prompts[p] {
+			return nil, ErrInvalidPrompt
+		}
+		oo = append(oo, oauth2.SetAuthURLParam(urlParamPrompt, p))
+	}
+	if at := r.FormValue(urlParamAccessType); at != "" {
+		if !accessTypes[at] {
+			return nil, ErrInvalidAccessType
+		}
+		oo = append(oo, oauth2.SetAuthURLParam(urlParamAccessType, at))
+	}
+	if hint := r.FormValue(urlParamLoginHint); hint != "" {
+		oo = append(oo, oauth2.SetAuthURLParam(urlParamLoginHint, hint))
+	}
+	return oo, nil
+}
+
 // KubeCfg returns a handler that forms helpers for kubecfg authentication.
 func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
-	if r.FormValue(urlParamState) != h.state(r) {
-		http.Error(w, ErrInvalidState.Error(), http.StatusForbidden)
+	if rsp, ok := h.complete(w, r); ok {
+		h.record(r, issued(rsp, h.clusters))
+		writeJSON(w, rsp)
+	}
+}
+
+// A KubeConfigResponse is returned by the kubeconfig API.
+type KubeConfigResponse struct {
+	Params     *extractor.OIDCAuthenticationParams `json:"params"`
+	KubeConfig json.RawMessage                     `json:"kubeconfig"`
+}
+
+// KubeConfig returns a handler that completes the authentication flow like
+// KubeCfg, but returns the populated kubecfg along with the authentication
+// parameters as JSON, for consumption by tools rather than the frontend. The
+// clusters URL parameter may select a subset of the template's clusters, and
+// the user URL parameter how the user authenticates.
+func (h *Handlers) KubeConfig(cfg *api.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validate the requested clusters and user before the authorization
+		// code is exchanged, so that a typo does not waste it.
+		c, err := selectClusters(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := userFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rsp, ok := h.complete(w, r); ok {
+			h.writeKubeConfig(w, r, c, user, rsp)
+		}
+	}
+}
+
+// RefreshKubeConfig returns a handler that exchanges the refresh token
+// supplied via the refresh_token form parameter for a new ID token, returning
+// the refreshed kubecfg and authentication parameters as JSON like
+// KubeConfig. This allows tools to renew expiring credentials without a
+// browser.
+func (h *Handlers) RefreshKubeConfig(cfg *api.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limit(w, h.ipLimiter, clientIP(r)) || h.lockedOut(w, r, ipLockoutKey(r)) {
+			return
+		}
+		token := r.FormValue(urlParamRefreshToken)
+		if token == "" {
+			http.Error(w, extractor.ErrMissingRefreshToken.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := selectClusters(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := userFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rf, ok := h.e.(extractor.Refresher)
+		if !ok {
+			http.Error(w, extractor.ErrRefreshUnsupported.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		rsp, err := rf.Refresh(r.Context(), h.cfg, token)
+		if err != nil {
+			h.processError(w, r, errors.Wrap(err, "cannot refresh token"))
+			return
+		}
+		h.logger(r).Info("refreshed", zap.String("subject", rsp.Username))
+		h.omitSecret(rsp)
+		if !h.authorize(w, r, rsp) {
+			return
+		}
+		if !limit(w, h.subjectLimiter, rsp.Username) {
+			return
+		}
+		h.writeKubeConfig(w, r, c, user, rsp)
+	}
+}
+
+// writeKubeConfig records the issuance of a kubecfg for the supplied user,
+// then writes it along with their authentication parameters as JSON.
+func (h *Handlers) writeKubeConfig(w http.ResponseWriter, r *http.Request, cfg *api.Config, user string, rsp *extractor.OIDCAuthenticationParams) {
+	y, err := writeKubeCfg(populateUser(cfg, rsp, user))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot marshal template to YAML").Error(), http.StatusInternalServerError)
 		return
 	}
+	j, err := yaml.YAMLToJSON(y)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "cannot convert template to JSON").Error(), http.StatusInternalServerError)
+		return
+	}
+	h.record(r, issued(rsp, clusterNames(cfg)))
+	writeJSON(w, &KubeConfigResponse{Params: rsp, KubeConfig: j})
+}
+
+// complete completes the authentication flow by processing the authorization
+// code supplied to the redirect endpoint. It writes an error response and
+// returns false if the flow could not be completed.
+func (h *Handlers) complete(w http.ResponseWriter, r *http.Request) (*extractor.OIDCAuthenticationParams, bool) {
+	if !limit(w, h.ipLimiter, clientIP(r)) || h.lockedOut(w, r, ipLockoutKey(r)) {
+		return nil, false
+	}
+	returnURL := redirectURL(r, h.basePath, h.endpoint)
+	s, err := h.session(w, r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrInvalidSession {
+			status = http.StatusBadRequest
+			h.countFailure(r, "")
+		}
+		h.fail(w, r, status, err)
+		return nil, false
+	}
+	if err := h.checkState(r, s, returnURL); err != nil {
+		status := http.StatusForbidden
+		if err == ErrMissingNonce {
+			status = http.StatusBadRequest
+		}
+		h.countFailure(r, "")
+		h.fail(w, r, status, err)
+		return nil, false
+	}
 
 	if e := r.FormValue(urlParamError); e != "" {
 		msg := e
@@ -242,14 +628,14 @@ func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
 		if uri := r.FormValue(urlParamErrorURI); uri != "" {
 			msg = fmt.Sprintf("%s (see %s)", msg, uri)
 		}
-		http.Error(w, msg, http.StatusForbidden)
-		return
+		h.fail(w, r, http.StatusForbidden, errors.New(msg))
+		return nil, false
 	}
 
 	code := r.FormValue(urlParamCode)
 	if code == "" {
-		http.Error(w, ErrMissingCode.Error(), http.StatusBadRequest)
-		return
+		h.fail(w, r, http.StatusBadRequest, ErrMissingCode)
+		return nil, false
 	}
 
 	c := &oauth2.Config{
@@ -257,32 +643,312 @@ func (h *Handlers) KubeCfg(w http.ResponseWriter, r *http.Request) {
 		ClientSecret: h.cfg.ClientSecret,
 		Endpoint:     h.cfg.Endpoint,
 		Scopes:       h.cfg.Scopes,
-		RedirectURL:  redirectURL(r, h.endpoint),
+		RedirectURL:  returnURL,
+	}
+
+	if s.Nonce == "" {
+		h.fail(w, r, http.StatusBadRequest, ErrMissingNonce)
+		return nil, false
+	}
+	po := []extractor.ProcessOption{extractor.Nonce(s.Nonce)}
+
+	if h.pkce {
+		if s.Verifier == "" {
+			h.fail(w, r, http.StatusBadRequest, ErrMissingCodeVerifier)
+			return nil, false
+		}
+		po = append(po, extractor.CodeVerifier(s.Verifier))
+	}
+
+	rsp, err := h.e.Process(r.Context(), c, code, po...)
+	if err != nil {
+		h.processError(w, r, errors.Wrap(err, "cannot process OAuth2 code"))
+		return nil, false
+	}
+	h.logger(r).Info("authenticated", zap.String("subject", rsp.Username))
+	h.omitSecret(rsp)
+	if !h.authorize(w, r, rsp) {
+		return nil, false
+	}
+	if !limit(w, h.subjectLimiter, rsp.Username) {
+		return nil, false
+	}
+	if se, ok := h.e.(extractor.SessionEnder); ok {
+		// Log out via our own endpoint, which clears our session before
+		// redirecting to the provider's end session endpoint.
+		_, err := se.EndSessionURL(c, rsp.IDToken, "")
+		switch err {
+		case nil:
+			q := url.Values{urlParamIDTokenHint: {rsp.IDToken}}
+			rsp.LogoutURL = redirectURL(r, h.basePath, &url.URL{Path: h.logout, RawQuery: q.Encode()})
+		case extractor.ErrEndSessionUnsupported:
+		default:
+			h.logger(r).Info("cannot build end session URL", zap.Error(err))
+		}
+	}
+	if h.downloads != nil {
+		u, err := h.newDownload(r, rsp)
+		if err != nil {
+			h.logger(r).Info("cannot create download link", zap.Error(err))
+		}
+		rsp.DownloadURL = u
+	}
+	rsp.ReturnURL = s.ReturnTo
+	h.setStatus(w, r, rsp)
+	return rsp, true
+}
+
+// omitSecret omits the client secret from the supplied parameters if the
+// client is public, before they are returned to the user.
+func (h *Handlers) omitSecret(p *extractor.OIDCAuthenticationParams) {
+	if h.public {
+		p.ClientSecret = ""
+	}
+}
+
+// authorize writes a 403 Forbidden response and returns false if the supplied
+// user is not authorized by the handlers' policy, or a 429 Too Many Requests
+// response if they are locked out.
+func (h *Handlers) authorize(w http.ResponseWriter, r *http.Request, u *extractor.OIDCAuthenticationParams) bool {
+	if h.lockedOut(w, r, "subject:"+u.Username) {
+		return false
+	}
+	err := h.policy.Authorize(u)
+	if err == nil {
+		return true
+	}
+	h.logger(r).Info("denied", zap.String("subject", u.Username), zap.Strings("groups", u.Groups))
+	h.countFailure(r, u.Username)
+	w.Header().Set(headerErrorCode, errorCodeNotAuthorized)
+	h.fail(w, r, http.StatusForbidden, err)
+	return false
+}
+
+// processError renders an error returned by the extractor, explaining what
+// went wrong according to its class. The class is also returned in the
+// X-Kuberos-Error-Code header for programmatic consumers.
+func (h *Handlers) processError(w http.ResponseWriter, r *http.Request, err error) {
+	code := extractor.Code(err)
+	h.record(r, &AuditEvent{Type: AuditEventFailed, Code: string(code), Reason: err.Error()})
+	h.countFailure(r, "")
+	if code != "" {
+		w.Header().Set(headerErrorCode, string(code))
 	}
 
-	rsp, err := h.e.Process(r.Context(), c, code)
+	if _, ok := errors.Cause(err).(*extractor.AuthenticationContextError); ok {
+		h.fail(w, r, http.StatusForbidden, withAdvice(err, "please log in again using a stronger authentication method (e.g. multi-factor authentication)"))
+		return
+	}
+
+	switch code {
+	case extractor.ErrorCodeExchangeFailed:
+		h.fail(w, r, http.StatusForbidden, withAdvice(err, "please try logging in again"))
+	case extractor.ErrorCodeTokenMissing:
+		h.fail(w, r, http.StatusBadGateway, withAdvice(err, "the identity provider did not issue an ID token; ensure the openid scope is requested"))
+	case extractor.ErrorCodeVerifyFailed:
+		h.fail(w, r, http.StatusForbidden, withAdvice(err, "the identity provider's response could not be verified"))
+	case extractor.ErrorCodeClaimsInvalid:
+		h.fail(w, r, http.StatusForbidden, withAdvice(err, "your account is not permitted to use this cluster"))
+	default:
+		h.fail(w, r, http.StatusForbidden, err)
+	}
+}
+
+// newRandomValue returns a high entropy value suitable for use as a nonce or
+// PKCE code verifier.
+func newRandomValue() (string, error) {
+	b := make([]byte, randomValueBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallengeS256 derives a PKCE code challenge from the supplied verifier.
+func codeChallengeS256(verifier string) string {
+	s := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(s[:])
+}
+
+// isHTTPS returns true if the supplied request was made via HTTPS, either
+// directly or via a TLS terminating proxy.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	for _, proto := range r.Header[headerForwardedProto] {
+		if proto == schemeHTTPS {
+			return true
+		}
+	}
+	return false
+}
+
+// StartDeviceFlow begins an OAuth 2.0 device authorization grant flow,
+// returning a JSON payload containing the user code and verification URI the
+// user should visit on another device.
+func (h *Handlers) StartDeviceFlow(w http.ResponseWriter, r *http.Request) {
+	if !limit(w, h.ipLimiter, clientIP(r)) || h.lockedOut(w, r, ipLockoutKey(r)) {
+		return
+	}
+	df, ok := h.e.(extractor.DeviceFlow)
+	if !ok {
+		http.Error(w, extractor.ErrDeviceFlowUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	da, err := df.StartDeviceFlow(r.Context(), h.cfg)
+	if err == extractor.ErrDeviceFlowUnsupported {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
 	if err != nil {
-		http.Error(w, errors.Wrap(err, "cannot process OAuth2 code").Error(), http.StatusForbidden)
+		http.Error(w, errors.Wrap(err, "cannot start device flow").Error(), http.StatusBadGateway)
 		return
 	}
+	writeJSON(w, da)
+}
 
-	j, err := json.Marshal(rsp)
+// PollDeviceFlow returns a JSON payload of the parameters required by kubectl
+// once the user has completed the device authorization grant flow identified
+// by the device_code parameter.
+func (h *Handlers) PollDeviceFlow(w http.ResponseWriter, r *http.Request) {
+	if !limit(w, h.ipLimiter, clientIP(r)) || h.lockedOut(w, r, ipLockoutKey(r)) {
+		return
+	}
+	code := r.FormValue(urlParamDeviceCode)
+	if code == "" {
+		http.Error(w, ErrMissingCode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	df, ok := h.e.(extractor.DeviceFlow)
+	if !ok {
+		http.Error(w, extractor.ErrDeviceFlowUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	rsp, err := df.PollDeviceFlow(r.Context(), h.cfg, code)
+	switch err {
+	case nil:
+	case extractor.ErrAuthorizationPending:
+		http.Error(w, err.Error(), http.StatusAccepted)
+		return
+	case extractor.ErrSlowDown:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case extractor.ErrDeviceCodeExpired:
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case extractor.ErrDeviceFlowUnsupported:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	default:
+		h.processError(w, r, errors.Wrap(err, "cannot complete device flow"))
+		return
+	}
+	h.logger(r).Info("authenticated", zap.String("subject", rsp.Username))
+	h.omitSecret(rsp)
+	if !h.authorize(w, r, rsp) {
+		return
+	}
+	if !limit(w, h.subjectLimiter, rsp.Username) {
+		return
+	}
+	h.record(r, issued(rsp, h.clusters))
+	writeJSON(w, rsp)
+}
+
+// EndSession clears any kuberos session and session status, then redirects to
+// the OIDC provider's end session endpoint with the ID token supplied via the
+// id_token_hint query parameter, ending the user's single sign-on session. The
+// provider returns the user to the login page once they have logged out.
+func (h *Handlers) EndSession(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.session(w, r); err != nil {
+		h.logger(r).Debug("cannot clear session", zap.Error(err))
+	}
+	h.clearStatus(w)
+
+	se, ok := h.e.(extractor.SessionEnder)
+	if !ok {
+		h.fail(w, r, http.StatusNotImplemented, extractor.ErrEndSessionUnsupported)
+		return
+	}
+	u, err := se.EndSessionURL(h.cfg, r.FormValue(urlParamIDTokenHint), redirectURL(r, h.basePath, &url.URL{}))
+	if err == extractor.ErrEndSessionUnsupported {
+		h.fail(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, errors.Wrap(err, "cannot build end session URL"))
+		return
+	}
+	http.Redirect(w, r, u, http.StatusSeeOther)
+}
+
+// Logout revokes the refresh token supplied via the refresh_token form
+// parameter, for example when a user discards the kubeconfig kuberos just
+// generated.
+func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue(urlParamRefreshToken)
+	if token == "" {
+		http.Error(w, extractor.ErrMissingRefreshToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rv, ok := h.e.(extractor.Revoker)
+	if !ok {
+		http.Error(w, extractor.ErrRevocationUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	err := rv.Revoke(r.Context(), h.cfg, token)
+	if errors.Cause(err) == extractor.ErrRevocationUnsupported {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		h.logger(r).Info("cannot revoke refresh token", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logger returns the logger carried by the supplied request's context, e.g.
+// one annotated with a request ID, or the handlers' logger if it carries none.
+func (h *Handlers) logger(r *http.Request) *zap.Logger {
+	return extractor.LoggerFrom(r.Context(), h.log)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, errors.Wrap(err, "cannot marshal JSON").Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Type", contentTypeJSON)
 	if _, err := w.Write(j); err != nil {
 		http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
 	}
 }
 
-func redirectURL(r *http.Request, endpoint *url.URL) string {
+// basePath returns the supplied path prefix as a clean, absolute path with a
+// trailing slash, against which relative endpoints may be resolved.
+func basePath(p string) string {
+	p = path.Join("/", p)
+	if p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+func redirectURL(r *http.Request, base string, endpoint *url.URL) string {
 	if r.URL.IsAbs() {
 		return fmt.Sprint(r.URL.ResolveReference(endpoint))
 	}
-	u := &url.URL{}
+	u := &url.URL{Path: base}
 	u.Scheme = schemeHTTP
 	if r.TLS != nil {
 		u.Scheme = schemeHTTPS
@@ -300,36 +966,77 @@ func redirectURL(r *http.Request, endpoint *url.URL) string {
 		case headerForwardedPrefix:
 			// Redirect includes X-Forwarded-Prefix if exists
 			for _, prefix := range v {
-				u.Path = prefix
+				u.Path = basePath(prefix)
 			}
 		}
 	}
 	// TODO(negz): Set port if X-Forwarded-Port exists?
 	u.Host = r.Host
+	if host := forwardedHost(r); host != "" {
+		u.Host = host
+	}
 	return fmt.Sprint(u.ResolveReference(endpoint))
 }
 
 // Template returns an HTTP handler that returns a new kubecfg by taking a
 // template with existing clusters and adding a user and context for each based
-// on the URL parameters passed to it.
+// on the URL parameters passed to it. The clusters URL parameter may select a
+// subset of the template's clusters, and the user URL parameter how the user
+// authenticates. The kubecfg is returned as YAML unless JSON is requested via
+// the format URL parameter or the Accept header.
 func Template(cfg *api.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.ParseMultipartForm(templateFormParseMemory) //nolint:errcheck
 		p := &extractor.OIDCAuthenticationParams{}
 
+		format, err := kubecfgFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, err := selectClusters(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := userFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frag, err := fragmentsRequested(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form := url.Values{}
+		for k, v := range r.Form {
+			if k != urlParamFormat && k != urlParamClusters && k != urlParamUser && k != urlParamFragments {
+				form[k] = v
+			}
+		}
+
 		// TODO(negz): Return an error if any required parameter is absent.
-		if err := decoder.Decode(p, r.Form); err != nil {
+		if err := decoder.Decode(p, form); err != nil {
 			http.Error(w, errors.Wrap(err, "cannot parse URL parameter").Error(), http.StatusBadRequest)
 			return
 		}
 
-		y, err := clientcmd.Write(populateUser(cfg, p))
+		if frag {
+			writeFragments(w, populateUser(c, p, user), format, fragmentsFilename(p))
+			return
+		}
+		y, err := marshalKubeCfg(populateUser(c, p, user), format)
 		if err != nil {
-			http.Error(w, errors.Wrap(err, "cannot marshal template to YAML").Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("Content-Type", contentTypeYAML)
+		if format == formatJSON {
+			w.Header().Set("Content-Type", contentTypeJSON)
+		}
 		w.Header().Set("Content-Disposition", "attachment")
 		if _, err := w.Write(y); err != nil {
 			http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
@@ -337,24 +1044,147 @@ func Template(cfg *api.Config) http.HandlerFunc {
 	}
 }
 
-func populateUser(cfg *api.Config, p *extractor.OIDCAuthenticationParams) api.Config {
+// KubeConfigFile returns an HTTP handler that returns a new kubecfg like
+// Template, but takes its parameters from a POSTed form so that tokens do not
+// appear in URLs or access logs. The kubecfg is returned as a YAML or JSON
+// attachment named for the user and the date on which their ID token was
+// issued, and may not be cached.
+func KubeConfigFile(cfg *api.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := selectClusters(cfg, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format, err := kubecfgFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, err := userFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		frag, err := fragmentsRequested(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form := url.Values{}
+		for k, v := range r.PostForm {
+			if k != urlParamFormat && k != urlParamClusters && k != urlParamUser && k != urlParamFragments {
+				form[k] = v
+			}
+		}
+		p := &extractor.OIDCAuthenticationParams{}
+		if err := decoder.Decode(p, form); err != nil {
+			http.Error(w, errors.Wrap(err, "cannot parse form parameter").Error(), http.StatusBadRequest)
+			return
+		}
+
+		if frag {
+			writeFragments(w, populateUser(c, p, user), format, fragmentsFilename(p))
+			return
+		}
+		y, err := marshalKubeCfg(populateUser(c, p, user), format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Vary", "Accept")
+		w.Header().Set("Content-Type", contentTypeKubeConfigFile)
+		if format == formatJSON {
+			w.Header().Set("Content-Type", contentTypeKubeConfigFileJSON)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(y)))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", kubeConfigFilename(p, format)))
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Pragma", "no-cache")
+		if _, err := w.Write(y); err != nil {
+			http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// kubeConfigFilename returns the filename of the supplied user's kubecfg with
+// the supplied extension, e.g. kubeconfig-alice@example.org-2018-01-02.yaml.
+// Characters that are not safe in filenames on common platforms are replaced.
+func kubeConfigFilename(p *extractor.OIDCAuthenticationParams, ext string) string {
+	at := p.IssuedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	user := safeFilename(p.Username)
+	if user == "" {
+		return "kubeconfig-" + at.UTC().Format("2006-01-02") + "." + ext
+	}
+	return "kubeconfig-" + user + "-" + at.UTC().Format("2006-01-02") + "." + ext
+}
+
+// safeFilename replaces the characters of the supplied string that are not
+// safe in filenames on common platforms.
+func safeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("@._-", r):
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// marshalKubeCfg returns the supplied populated kubecfg in the supplied format.
+// kubectl accepts kubecfg files in either format.
+func marshalKubeCfg(cfg api.Config, format string) ([]byte, error) {
+	y, err := writeKubeCfg(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal kubecfg to YAML")
+	}
+	if format != formatJSON {
+		return y, nil
+	}
+	j, err := yaml.YAMLToJSON(y)
+	return j, errors.Wrap(err, "cannot convert kubecfg to JSON")
+}
+
+// kubecfgFormat returns the format in which the kubecfg should be returned.
+// The format URL parameter takes precedence over the Accept header. YAML is
+// returned unless the Accept header prefers JSON.
+func kubecfgFormat(r *http.Request) (string, error) {
+	switch f := r.FormValue(urlParamFormat); f {
+	case formatYAML, formatJSON:
+		return f, nil
+	case "":
+	default:
+		return "", errors.Errorf("unsupported format %q: must be %s or %s", f, formatYAML, formatJSON)
+	}
+
+	// Honour the first YAML or JSON media type in the Accept header. Media
+	// types are usually listed in order of preference; q values are ignored.
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt := strings.TrimSpace(strings.SplitN(a, ";", 2)[0])
+		switch {
+		case mt == "application/json":
+			return formatJSON, nil
+		case strings.HasSuffix(mt, "/yaml"), strings.HasSuffix(mt, "/x-yaml"):
+			return formatYAML, nil
+		}
+	}
+	return formatYAML, nil
+}
+
+func populateUser(cfg *api.Config, p *extractor.OIDCAuthenticationParams, user string) api.Config {
 	c := api.Config{}
 	c.AuthInfos = make(map[string]*api.AuthInfo)
 	c.Clusters = make(map[string]*api.Cluster)
 	c.Contexts = make(map[string]*api.Context)
 	c.CurrentContext = cfg.CurrentContext
-	c.AuthInfos[p.Username] = &api.AuthInfo{
-		AuthProvider: &api.AuthProviderConfig{
-			Name: templateAuthProvider,
-			Config: map[string]string{
-				templateOIDCClientID:     p.ClientID,
-				templateOIDCClientSecret: p.ClientSecret,
-				templateOIDCIDToken:      p.IDToken,
-				templateOIDCRefreshToken: p.RefreshToken,
-				templateOIDCIssuer:       p.IssuerURL,
-			},
-		},
-	}
+	c.AuthInfos[p.Username] = authInfo(p, user, defaultExecOptions)
+	shared := len(cfg.Clusters) == 0
+	modes := interactiveModes{}
 
 	for name, cluster := range cfg.Clusters {
 		// If the cluster definition does not come with certificate-authority-data nor
@@ -371,10 +1201,47 @@ func populateUser(cfg *api.Config, p *extractor.OIDCAuthenticationParams) api.Co
 			}
 		}
 		c.Clusters[name] = cluster
+		// Exec users of clusters that have their own exec options, and users
+		// who impersonate, need their own user, e.g. alice@example.org-prod.
+		authName := p.Username
+		o := optionsOf(cfg, name)
+		exec := o.exec != nil && user == UserExec
+		impersonate := o.impersonate != nil && o.impersonate.appliesTo(p.Groups)
+		if exec || impersonate {
+			authName = p.Username + "-" + name
+			eo := defaultExecOptions
+			if exec {
+				eo = *o.exec
+			}
+			ai := authInfo(p, user, eo)
+			if impersonate {
+				ai.Impersonate = o.impersonate.As
+				ai.ImpersonateGroups = o.impersonate.AsGroups
+			}
+			c.AuthInfos[authName] = ai
+			if exec && eo.InteractiveMode != "" {
+				modes[authName] = eo.InteractiveMode
+			}
+		}
+		shared = shared || authName == p.Username
 		c.Contexts[name] = &api.Context{
 			Cluster:  name,
-			AuthInfo: p.Username,
+			AuthInfo: authName,
+		}
+		// Users land in their own namespace, if they have one, or else the
+		// cluster's default namespace.
+		if tc, ok := cfg.Contexts[name]; ok {
+			c.Contexts[name].Namespace = tc.Namespace
+		}
+		if p.Namespace != "" {
+			c.Contexts[name].Namespace = p.Namespace
 		}
 	}
-	return c
+	if !shared {
+		delete(c.AuthInfos, p.Username)
+	}
+	if len(modes) > 0 {
+		c.Extensions = map[string]runtime.Object{extensionInteractiveModes: modes}
+	}
+	return rename(cfg, c, p)
 }
@@ -2,17 +2,23 @@ package kuberos
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 	"golang.org/x/oauth2"
 
 	"github.com/negz/kuberos/extractor"
 
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
 
@@ -21,10 +27,54 @@ type predictableExtractor struct {
 	err error
 }
 
-func (p *predictableExtractor) Process(_ context.Context, _ *oauth2.Config, _ string) (*extractor.OIDCAuthenticationParams, error) {
+func (p *predictableExtractor) Process(_ context.Context, _ *oauth2.Config, _ string, _ ...extractor.ProcessOption) (*extractor.OIDCAuthenticationParams, error) {
 	return p.p, p.err
 }
 
+func (p *predictableExtractor) StartDeviceFlow(_ context.Context, _ *oauth2.Config) (*extractor.DeviceAuthorization, error) {
+	return nil, extractor.ErrDeviceFlowUnsupported
+}
+
+func (p *predictableExtractor) PollDeviceFlow(_ context.Context, _ *oauth2.Config, _ string) (*extractor.OIDCAuthenticationParams, error) {
+	return p.p, p.err
+}
+
+func (p *predictableExtractor) Refresh(_ context.Context, _ *oauth2.Config, _ string) (*extractor.OIDCAuthenticationParams, error) {
+	return p.p, p.err
+}
+
+func (p *predictableExtractor) Revoke(_ context.Context, _ *oauth2.Config, _ string) error {
+	return p.err
+}
+
+func (p *predictableExtractor) EndSessionURL(_ *oauth2.Config, _, _ string) (string, error) {
+	return "", extractor.ErrEndSessionUnsupported
+}
+
+// loginSession returns the session stored by a call to h.Login.
+func loginSession(t *testing.T, h *Handlers, w *httptest.ResponseRecorder) *Session {
+	t.Helper()
+	s := &Session{}
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == cookieSession {
+			if err := h.sessions.open(cookieSession, ck.Value, s); err != nil {
+				t.Fatalf("h.sessions.open(...): %v", err)
+			}
+		}
+	}
+	return s
+}
+
+// sessionCookie returns a session cookie that h can read.
+func sessionCookie(t *testing.T, h *Handlers, s *Session) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := h.setSession(w, httptest.NewRequest("GET", "/", nil), s); err != nil {
+		t.Fatalf("h.setSession(...): %v", err)
+	}
+	return w.Result().Cookies()[0]
+}
+
 func TestAuthCodeURL(t *testing.T) {
 	cases := []struct {
 		name string
@@ -42,7 +92,7 @@ func TestAuthCodeURL(t *testing.T) {
 				RedirectURL:  "https://example.org/redirect",
 			},
 			s:   func(_ *http.Request) string { return "state" },
-			url: "https://auth.example.org?access_type=offline&client_id=testClientID&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid&state=state",
+			url: "https://auth.example.org?access_type=offline&client_id=testClientID&nonce=NONCE&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid&state=state",
 		},
 		{
 			name: "CustomScopes",
@@ -54,7 +104,7 @@ func TestAuthCodeURL(t *testing.T) {
 				RedirectURL:  "https://example.org/redirect",
 			},
 			s:   func(_ *http.Request) string { return "state" },
-			url: "https://auth.example.org?client_id=testClientID&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid+offline_access&state=state",
+			url: "https://auth.example.org?client_id=testClientID&nonce=NONCE&prompt=consent&redirect_uri=http%3A%2F%2Fexample.com%2Fui&response_type=code&scope=openid+offline_access&state=state",
 		},
 	}
 
@@ -72,20 +122,485 @@ func TestAuthCodeURL(t *testing.T) {
 			if w.Code != http.StatusSeeOther {
 				t.Fatalf("w.Code:\nwant %v\ngot %v\n", http.StatusSeeOther, w.Code)
 			}
+			want := strings.Replace(tt.url, "NONCE", loginSession(t, h, w).Nonce, 1)
 			for _, u := range w.Header()["Location"] {
-				if u != tt.url {
-					t.Errorf("u:\nwant %v\ngot %v\n", tt.url, u)
+				if u != want {
+					t.Errorf("u:\nwant %v\ngot %v\n", want, u)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   []string{oidc.ScopeOpenID, oidc.ScopeOfflineAccess},
+	}
+
+	cases := []struct {
+		name  string
+		query string
+		code  int
+		want  url.Values
+	}{
+		{
+			name:  "Overrides",
+			query: "scope=groups&prompt=select_account&login_hint=alice%40example.org&access_type=online",
+			code:  http.StatusSeeOther,
+			want: url.Values{
+				"scope":       {"openid offline_access groups"},
+				"prompt":      {"select_account"},
+				"login_hint":  {"alice@example.org"},
+				"access_type": {"online"},
+			},
+		},
+		{name: "ScopeNotAllowed", query: "scope=admin", code: http.StatusBadRequest},
+		{name: "InvalidPrompt", query: "prompt=always", code: http.StatusBadRequest},
+		{name: "InvalidAccessType", query: "access_type=forever", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{}
+			h, err := NewHandlers(c, e, RequestableScopes("groups"))
+			if err != nil {
+				t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+			}
+
+			w := httptest.NewRecorder()
+			h.Login(w, httptest.NewRequest("GET", "/?"+tt.query, nil))
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+
+			u, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+			}
+			for k := range tt.want {
+				if got, want := u.Query().Get(k), tt.want.Get(k); got != want {
+					t.Errorf("%s:\nwant %v\ngot %v\n", k, want, got)
+				}
+			}
+		})
+	}
+
+	if got, want := strings.Join(c.Scopes, " "), "openid offline_access"; got != want {
+		t.Errorf("c.Scopes:\nwant %v\ngot %v\n", want, got)
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	cases := []struct {
+		name      string
+		base      string
+		prefix    string
+		host      string
+		untrusted bool
+		want      string
+	}{
+		{name: "Root", base: "/", want: "http://example.com/ui"},
+		{name: "BasePath", base: basePath("/kuberos"), want: "http://example.com/kuberos/ui"},
+		{name: "ForwardedPrefix", base: "/", prefix: "/kuberos", want: "http://example.com/kuberos/ui"},
+		{name: "ForwardedPrefixOverridesBasePath", base: basePath("/kuberos/"), prefix: "/other/", want: "http://example.com/other/ui"},
+		{name: "ForwardedHost", base: "/", host: "kuberos.example.org", want: "http://kuberos.example.org/ui"},
+		{name: "ForwardedHostNearestProxy", base: "/", host: "evil.example.org, kuberos.example.org", want: "http://kuberos.example.org/ui"},
+		{name: "ForwardedHostUntrusted", base: "/", host: "evil.example.org", untrusted: true, want: "http://example.com/ui"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.prefix != "" {
+				r.Header.Set(headerForwardedPrefix, tt.prefix)
+			}
+			if tt.host != "" {
+				r.Header.Set(headerForwardedHost, tt.host)
+			}
+			if !tt.untrusted {
+				r = r.WithContext(context.WithValue(r.Context(), forwardedKey{}, true))
+			}
+			if got := redirectURL(r, tt.base, &url.URL{Path: DefaultKubeCfgEndpoint}); got != tt.want {
+				t.Errorf("redirectURL(...):\nwant %v\ngot %v\n", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRedirectEndpoint(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	h, err := NewHandlers(c, &predictableExtractor{}, BasePath("/kuberos"), RedirectEndpoint("ui/corp"))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Login(w, httptest.NewRequest("GET", "/kuberos/login/corp", nil))
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+	}
+	want := "http://example.com/kuberos/ui/corp"
+	if got := u.Query().Get("redirect_uri"); got != want {
+		t.Errorf("redirect_uri:\nwant %v\ngot %v\n", want, got)
+	}
+
+	if _, err := NewHandlers(c, &predictableExtractor{}, RedirectEndpoint("%zz")); errors.Cause(err) != ErrInvalidKubeCfgEndpoint {
+		t.Errorf("NewHandlers(..., RedirectEndpoint(%q)):\nwant %v\ngot %v\n", "%zz", ErrInvalidKubeCfgEndpoint, err)
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{}}
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), PKCE())
+	if err != nil {
+		t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Login(w, httptest.NewRequest("GET", "/", nil))
+
+	s := loginSession(t, h, w)
+	verifier := s.Verifier
+	if verifier == "" {
+		t.Fatalf("Login(...): missing PKCE code verifier")
+	}
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+	}
+	if got, want := u.Query().Get(pkceCodeChallenge), codeChallengeS256(verifier); got != want {
+		t.Errorf("%s:\nwant %v\ngot %v\n", pkceCodeChallenge, want, got)
+	}
+	if got, want := u.Query().Get(pkceCodeChallengeMethod), pkceCodeChallengeMethodS256; got != want {
+		t.Errorf("%s:\nwant %v\ngot %v\n", pkceCodeChallengeMethod, want, got)
+	}
+
+	t.Run("MissingVerifier", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+		r.AddCookie(sessionCookie(t, h, &Session{Nonce: s.Nonce}))
+		h.KubeCfg(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("w.Code:\nwant %v\ngot %v\n", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("WithVerifier", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+		r.AddCookie(sessionCookie(t, h, s))
+		h.KubeCfg(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code:\nwant %v\ngot %v\n", http.StatusOK, w.Code)
+		}
+	})
+}
+
+func TestKubeConfig(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org", IDToken: "token"}}
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }))
+	if err != nil {
+		t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+	}
+	cfg := &api.Config{
+		Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PEM")}},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/kubeconfig?state=state&code=code", nil)
+	r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+	h.KubeConfig(cfg)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+
+	rsp := &struct {
+		Params     *extractor.OIDCAuthenticationParams `json:"params"`
+		KubeConfig struct {
+			Users []struct {
+				Name string `json:"name"`
+			} `json:"users"`
+			Clusters []struct {
+				Name string `json:"name"`
+			} `json:"clusters"`
+		} `json:"kubeconfig"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	if diff := deep.Equal(rsp.Params, e.p); diff != nil {
+		t.Errorf("rsp.Params: got != want: %v", diff)
+	}
+	if len(rsp.KubeConfig.Users) != 1 || rsp.KubeConfig.Users[0].Name != e.p.Username {
+		t.Errorf("rsp.KubeConfig.Users:\nwant [%v]\ngot %v\n", e.p.Username, rsp.KubeConfig.Users)
+	}
+	if len(rsp.KubeConfig.Clusters) != 1 || rsp.KubeConfig.Clusters[0].Name != "a" {
+		t.Errorf("rsp.KubeConfig.Clusters:\nwant [a]\ngot %v\n", rsp.KubeConfig.Clusters)
+	}
+}
+
+func TestKubeCfgErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{
+			name: "ExchangeFailed",
+			err:  &extractor.Error{Code: extractor.ErrorCodeExchangeFailed, Err: errors.New("boom")},
+			code: http.StatusForbidden,
+		},
+		{
+			name: "TokenMissing",
+			err:  &extractor.Error{Code: extractor.ErrorCodeTokenMissing, Err: extractor.ErrMissingIDToken},
+			code: http.StatusBadGateway,
+		},
+		{
+			name: "ClaimsInvalid",
+			err:  &extractor.Error{Code: extractor.ErrorCodeClaimsInvalid, Err: &extractor.AuthenticationContextError{WantAMR: []string{"mfa"}}},
+			code: http.StatusForbidden,
+		},
+	}
+
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{err: tt.err}
+			h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }))
+			if err != nil {
+				t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if got, want := w.Header().Get(headerErrorCode), string(extractor.Code(tt.err)); got != want {
+				t.Errorf("%s:\nwant %v\ngot %v\n", headerErrorCode, want, got)
+			}
+		})
+	}
+}
+
+func TestHeadless(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	h, err := NewHandlers(c, &predictableExtractor{}, Headless(), RedirectEndpoint("https://portal.example.org/kuberos/callback"))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Login(w, httptest.NewRequest("GET", "/", nil))
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+	}
+	if got, want := u.Query().Get("redirect_uri"), "https://portal.example.org/kuberos/callback"; got != want {
+		t.Errorf("redirect_uri:\nwant %v\ngot %v\n", want, got)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v1/kubeconfig", nil)
+	r.Header.Set("Accept", "text/html")
+	h.fail(w, r, http.StatusBadRequest, ErrMissingCode)
+	if got, want := w.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("Content-Type:\nwant %v\ngot %v\n", want, got)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		err  error
+		code int
+	}{
+		{name: "Revoked", body: "refresh_token=token", code: http.StatusNoContent},
+		{name: "MissingToken", code: http.StatusBadRequest},
+		{name: "Unsupported", body: "refresh_token=token", err: extractor.ErrRevocationUnsupported, code: http.StatusNotImplemented},
+		{name: "Failed", body: "refresh_token=token", err: errors.New("boom"), code: http.StatusBadGateway},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{err: tt.err}
+			h, err := NewHandlers(&oauth2.Config{}, e)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/logout", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.Logout(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+		})
+	}
+}
+
+type endSessionExtractor struct {
+	predictableExtractor
+}
+
+func (e *endSessionExtractor) EndSessionURL(_ *oauth2.Config, idToken, postLogoutRedirectURI string) (string, error) {
+	q := url.Values{"id_token_hint": {idToken}, "post_logout_redirect_uri": {postLogoutRedirectURI}}
+	return "https://idp.example.org/logout?" + q.Encode(), nil
+}
+
+func TestEndSession(t *testing.T) {
+	cases := []struct {
+		name     string
+		e        extractor.Extractor
+		code     int
+		location string
+	}{
+		{
+			name:     "Redirected",
+			e:        &endSessionExtractor{},
+			code:     http.StatusSeeOther,
+			location: "https://idp.example.org/logout?id_token_hint=token&post_logout_redirect_uri=http%3A%2F%2Fexample.com%2F",
+		},
+		{name: "Unsupported", e: &predictableExtractor{}, code: http.StatusNotImplemented},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandlers(&oauth2.Config{}, tt.e)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/logout?id_token_hint=token", nil)
+			r.AddCookie(sessionCookie(t, h, &Session{State: "state", Expires: time.Now().Add(time.Minute).Unix()}))
+			h.EndSession(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location:\nwant %v\ngot %v\n", tt.location, got)
+			}
+			cleared := false
+			for _, ck := range w.Result().Cookies() {
+				if ck.Name == cookieSession && ck.MaxAge < 0 {
+					cleared = true
 				}
 			}
+			if !cleared {
+				t.Errorf("session cookie was not cleared")
+			}
 		})
 	}
 }
+
+func TestRefreshKubeConfig(t *testing.T) {
+	cfg := &api.Config{Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org"}}}
+	cases := []struct {
+		name string
+		body string
+		err  error
+		code int
+	}{
+		{name: "Refreshed", body: "refresh_token=token", code: http.StatusOK},
+		{name: "MissingToken", code: http.StatusBadRequest},
+		{name: "Failed", body: "refresh_token=token", err: &extractor.Error{Code: extractor.ErrorCodeExchangeFailed, Err: errors.New("boom")}, code: http.StatusForbidden},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org", IDToken: "new", RefreshToken: "token"}, err: tt.err}
+			h, err := NewHandlers(&oauth2.Config{}, e)
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/v1/refresh", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			h.RefreshKubeConfig(cfg)(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			rsp := &KubeConfigResponse{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+			if diff := deep.Equal(rsp.Params, e.p); diff != nil {
+				t.Errorf("rsp.Params: got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	cfg := &api.Config{Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org"}}}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org", ClientID: "id", ClientSecret: "secret", IDToken: "new", RefreshToken: "token"}}
+	h, err := NewHandlers(&oauth2.Config{ClientID: "id", ClientSecret: "secret"}, e, PublicClient())
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	if !h.pkce {
+		t.Errorf("h.pkce: want PublicClient to imply PKCE")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/refresh", strings.NewReader("refresh_token=token"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.RefreshKubeConfig(cfg)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("w.Body: want no client secret, got %s", w.Body)
+	}
+}
+
 func TestPopulateUser(t *testing.T) {
 	cases := []struct {
 		name   string
 		cfg    *api.Config
 		files  map[string]string
 		params *extractor.OIDCAuthenticationParams
+		user   string
 		want   api.Config
 	}{
 		{
@@ -174,6 +689,97 @@ func TestPopulateUser(t *testing.T) {
 				CurrentContext: "a",
 			},
 		},
+		{
+			name: "MultiClusterWithNamespace",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+					"b": &api.Cluster{Server: "https://example.net", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a": &api.Context{Cluster: "a", Namespace: "sandbox"},
+				},
+			},
+			files: map[string]string{},
+			params: &extractor.OIDCAuthenticationParams{
+				Username:     "example@example.org",
+				ClientID:     "id",
+				ClientSecret: "secret",
+				IDToken:      "token",
+				RefreshToken: "refresh",
+				IssuerURL:    "https://example.org",
+			},
+			want: api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+					"b": &api.Cluster{Server: "https://example.net", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a": &api.Context{AuthInfo: "example@example.org", Cluster: "a", Namespace: "sandbox"},
+					"b": &api.Context{AuthInfo: "example@example.org", Cluster: "b"},
+				},
+				AuthInfos: map[string]*api.AuthInfo{
+					"example@example.org": &api.AuthInfo{
+						AuthProvider: &api.AuthProviderConfig{
+							Name: templateAuthProvider,
+							Config: map[string]string{
+								templateOIDCClientID:     "id",
+								templateOIDCClientSecret: "secret",
+								templateOIDCIDToken:      "token",
+								templateOIDCRefreshToken: "refresh",
+								templateOIDCIssuer:       "https://example.org",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "UserNamespace",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+					"b": &api.Cluster{Server: "https://example.net", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a": &api.Context{Cluster: "a", Namespace: "sandbox"},
+				},
+			},
+			files: map[string]string{},
+			params: &extractor.OIDCAuthenticationParams{
+				Username:     "example@example.org",
+				ClientID:     "id",
+				ClientSecret: "secret",
+				IDToken:      "token",
+				RefreshToken: "refresh",
+				IssuerURL:    "https://example.org",
+				Namespace:    "payments",
+			},
+			want: api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+					"b": &api.Cluster{Server: "https://example.net", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a": &api.Context{AuthInfo: "example@example.org", Cluster: "a", Namespace: "payments"},
+					"b": &api.Context{AuthInfo: "example@example.org", Cluster: "b", Namespace: "payments"},
+				},
+				AuthInfos: map[string]*api.AuthInfo{
+					"example@example.org": &api.AuthInfo{
+						AuthProvider: &api.AuthProviderConfig{
+							Name: templateAuthProvider,
+							Config: map[string]string{
+								templateOIDCClientID:     "id",
+								templateOIDCClientSecret: "secret",
+								templateOIDCIDToken:      "token",
+								templateOIDCRefreshToken: "refresh",
+								templateOIDCIssuer:       "https://example.org",
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "SingleClusterWithCAOnDisk",
 			cfg: &api.Config{
@@ -215,6 +821,50 @@ func TestPopulateUser(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "ExecUser",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+			},
+			files: map[string]string{},
+			params: &extractor.OIDCAuthenticationParams{
+				Username:     "example@example.org",
+				ClientID:     "id",
+				ClientSecret: "secret",
+				IDToken:      "token",
+				RefreshToken: "refresh",
+				IssuerURL:    "https://example.org",
+				Scopes:       []string{"openid", "email", "offline_access"},
+			},
+			user: UserExec,
+			want: api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a": &api.Context{AuthInfo: "example@example.org", Cluster: "a"},
+				},
+				AuthInfos: map[string]*api.AuthInfo{
+					"example@example.org": &api.AuthInfo{
+						Exec: &api.ExecConfig{
+							APIVersion: "client.authentication.k8s.io/v1beta1",
+							Command:    "kubectl",
+							Args: []string{
+								"oidc-login",
+								"get-token",
+								"--oidc-issuer-url=https://example.org",
+								"--oidc-client-id=id",
+								"--oidc-client-secret=secret",
+								"--oidc-extra-scope=email",
+								"--oidc-extra-scope=offline_access",
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "SingleClusterWithoutCA",
 			cfg: &api.Config{
@@ -265,10 +915,177 @@ func TestPopulateUser(t *testing.T) {
 				}
 			}
 
-			got := populateUser(tt.cfg, tt.params)
+			got := populateUser(tt.cfg, tt.params, tt.user)
 			if diff := deep.Equal(got, tt.want); diff != nil {
 				t.Errorf("populateUser(...): got != want: %v", diff)
 			}
 		})
 	}
 }
+
+func TestTemplate(t *testing.T) {
+	cfg := &api.Config{
+		Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org"}},
+	}
+	base := url.Values{
+		"email":    {"example@example.org"},
+		"idToken":  {"token"},
+		"expiry":   {"2018-01-02T03:04:05Z"},
+		"issuedAt": {"2018-01-02T02:04:05Z"},
+	}
+
+	cases := []struct {
+		name        string
+		format      string
+		accept      string
+		code        int
+		contentType string
+	}{
+		{name: "Default", code: http.StatusOK, contentType: contentTypeYAML},
+		{name: "AcceptJSON", accept: "application/json", code: http.StatusOK, contentType: contentTypeJSON},
+		{name: "AcceptYAML", accept: "application/yaml, application/json", code: http.StatusOK, contentType: contentTypeYAML},
+		{name: "FormatJSON", format: formatJSON, accept: "application/yaml", code: http.StatusOK, contentType: contentTypeJSON},
+		{name: "FormatYAML", format: formatYAML, accept: "application/json", code: http.StatusOK, contentType: contentTypeYAML},
+		{name: "UnsupportedFormat", format: "toml", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range base {
+				q[k] = v
+			}
+			if tt.format != "" {
+				q.Set(urlParamFormat, tt.format)
+			}
+			r := httptest.NewRequest("GET", "/kubecfg.yaml?"+q.Encode(), nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+			Template(cfg)(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type:\nwant %v\ngot %v\n", tt.contentType, got)
+			}
+			if tt.contentType == contentTypeJSON && !json.Valid(w.Body.Bytes()) {
+				t.Errorf("w.Body: invalid JSON: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestKubeConfigFile(t *testing.T) {
+	cfg := &api.Config{
+		Clusters: map[string]*api.Cluster{"a": &api.Cluster{Server: "https://example.org"}},
+	}
+	form := url.Values{
+		"email":    {"alice/../@example.org"},
+		"idToken":  {"token"},
+		"expiry":   {"2018-01-02T03:04:05Z"},
+		"issuedAt": {"2018-01-02T02:04:05Z"},
+	}
+	r := httptest.NewRequest("POST", "/kubeconfig.yaml", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	KubeConfigFile(cfg)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+	want := map[string]string{
+		"Content-Type":        "application/yaml",
+		"Content-Disposition": `attachment; filename="kubeconfig-alice_.._@example.org-2018-01-02.yaml"`,
+		"Cache-Control":       "private, no-store",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s:\nwant %v\ngot %v\n", k, v, got)
+		}
+	}
+	if !strings.Contains(w.Body.String(), "id-token: token") {
+		t.Errorf("w.Body: want populated kubecfg\ngot:\n%s", w.Body)
+	}
+
+	// JSON kubecfgs may be requested for tools that post-process them.
+	form.Set("format", "json")
+	r = httptest.NewRequest("POST", "/kubeconfig.yaml", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	KubeConfigFile(cfg)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+	}
+	want = map[string]string{
+		"Content-Type":        "application/json",
+		"Content-Disposition": `attachment; filename="kubeconfig-alice_.._@example.org-2018-01-02.json"`,
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s:\nwant %v\ngot %v\n", k, v, got)
+		}
+	}
+	if !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("w.Body: want JSON\ngot:\n%s", w.Body)
+	}
+	got, err := clientcmd.Load(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("clientcmd.Load(...): %v", err)
+	}
+	if ai := got.AuthInfos["alice/../@example.org"]; ai == nil || ai.AuthProvider.Config[templateOIDCIDToken] != "token" {
+		t.Errorf("got.AuthInfos: want populated user, got %+v", got.AuthInfos)
+	}
+}
+
+func TestLoadKubeCfgTemplate(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	tmpl := `apiVersion: v1
+kind: Config
+clusters:
+{{- range $name := list "prod" "staging" }}
+- name: {{ $name }}
+  cluster:
+    server: https://{{ $name | lower }}.example.org
+    certificate-authority-data: {{ "ca" | b64enc }}
+    {{- if eq $name "staging" }}
+    namespace: sandbox
+    {{- end }}
+{{- end }}
+`
+	if err := afero.WriteFile(appFs, "template.yaml", []byte(tmpl), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	cfg, err := LoadKubeCfgTemplate("template.yaml")
+	if err != nil {
+		t.Fatalf("LoadKubeCfgTemplate(...): %v", err)
+	}
+	if diff := deep.Equal(clusterNames(cfg), []string{"prod", "staging"}); diff != nil {
+		t.Errorf("clusters: want != got %v", diff)
+	}
+	if got, want := cfg.Clusters["staging"].Server, "https://staging.example.org"; got != want {
+		t.Errorf("cfg.Clusters[staging].Server:\nwant %v\ngot %v\n", want, got)
+	}
+	if got, want := string(cfg.Clusters["prod"].CertificateAuthorityData), "ca"; got != want {
+		t.Errorf("cfg.Clusters[prod].CertificateAuthorityData:\nwant %v\ngot %v\n", want, got)
+	}
+	if _, ok := cfg.Contexts["prod"]; ok {
+		t.Errorf("cfg.Contexts[prod]: want no context for cluster without namespace")
+	}
+	if ctx, ok := cfg.Contexts["staging"]; !ok || ctx.Namespace != "sandbox" {
+		t.Errorf("cfg.Contexts[staging]: want namespace sandbox, got %+v", ctx)
+	}
+
+	// Functions that read the environment are not available.
+	if err := afero.WriteFile(appFs, "env.yaml", []byte(`{{ env "HOME" }}`), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	if _, err := LoadKubeCfgTemplate("env.yaml"); err == nil {
+		t.Errorf("LoadKubeCfgTemplate(...): want error using env")
+	}
+}
@@ -0,0 +1,61 @@
+package kuberos
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultRequestLimits are the request limits kuberos enforces by default.
+// Kuberos accepts only small form encoded request bodies, and URLs no longer
+// than those of a typical OIDC authentication response.
+var DefaultRequestLimits = RequestLimits{
+	MaxBodyBytes: 64 << 10,
+	MaxURLLength: 8 << 10,
+	Methods:      []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions},
+}
+
+// RequestLimits bound the requests kuberos handles, limiting its exposure to
+// oversized or unexpected requests. Zero or empty fields impose no limit.
+type RequestLimits struct {
+	// MaxBodyBytes is the maximum size of a request body.
+	MaxBodyBytes int64
+
+	// MaxURLLength is the maximum length of a request URI, including its
+	// query string.
+	MaxURLLength int
+
+	// Methods are the request methods that may be used.
+	Methods []string
+}
+
+// Handler returns a handler that rejects requests that exceed the configured
+// limits before calling the supplied handler. Request bodies are limited
+// as they are read, so bodies of unknown length that exceed the limit are
+// truncated.
+func (l RequestLimits) Handler(h http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, m := range l.Methods {
+		allowed[m] = true
+	}
+	allow := strings.Join(l.Methods, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(allowed) > 0 && !allowed[r.Method] {
+			w.Header().Set("Allow", allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if l.MaxURLLength > 0 && len(r.RequestURI) > l.MaxURLLength {
+			http.Error(w, http.StatusText(http.StatusRequestURITooLong), http.StatusRequestURITooLong)
+			return
+		}
+		if l.MaxBodyBytes > 0 {
+			if r.ContentLength > l.MaxBodyBytes {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodyBytes)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,53 @@
+package kuberos
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimits(t *testing.T) {
+	l := RequestLimits{MaxBodyBytes: 8, MaxURLLength: 16, Methods: []string{http.MethodGet, http.MethodPost}}
+	var body string
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = string(b)
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		url    string
+		body   io.Reader
+		code   int
+	}{
+		{name: "Allowed", method: "POST", url: "/", body: strings.NewReader("small"), code: http.StatusOK},
+		{name: "UnexpectedMethod", method: "TRACE", url: "/", code: http.StatusMethodNotAllowed},
+		{name: "LongURL", method: "GET", url: "/?q=" + strings.Repeat("a", 16), code: http.StatusRequestURITooLong},
+		{name: "LargeBody", method: "POST", url: "/", body: strings.NewReader("far too large"), code: http.StatusRequestEntityTooLarge},
+		{name: "LargeBodyOfUnknownLength", method: "POST", url: "/", body: ioutil.NopCloser(strings.NewReader("far too large")), code: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, tt.body))
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if tt.code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, POST" {
+				t.Errorf("Allow:\nwant GET, POST\ngot %v\n", w.Header().Get("Allow"))
+			}
+		})
+	}
+	if body != "small" {
+		t.Errorf("body:\nwant small\ngot %v\n", body)
+	}
+}
@@ -0,0 +1,157 @@
+package kuberos
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Lockout defaults.
+const (
+	DefaultLockoutWindow   = 10 * time.Minute
+	DefaultLockoutDuration = 15 * time.Minute
+)
+
+// AuditEventLockedOut events are recorded when a client IP address or user is
+// locked out after repeated authentication failures.
+const AuditEventLockedOut = "locked_out"
+
+// ErrLockedOut indicates a client IP address or user that is temporarily
+// locked out after repeated authentication failures.
+var ErrLockedOut = errors.New("too many failed authentication attempts: please try again later")
+
+// A Lockout locks out a client IP address or user for Duration once Failures
+// authentication attempts have failed within Window.
+type Lockout struct {
+	Failures int
+	Window   time.Duration
+	Duration time.Duration
+}
+
+// A strike records the recent failures of a client IP address or user.
+type strike struct {
+	failures int
+	first    time.Time
+	until    time.Time
+}
+
+// A lockouts applies a Lockout to each of many keys, e.g. IP addresses.
+type lockouts struct {
+	lockout Lockout
+
+	mu      sync.Mutex
+	strikes map[string]*strike
+	swept   time.Time
+}
+
+func newLockouts(l Lockout) (*lockouts, error) {
+	if l.Failures < 1 || l.Window <= 0 || l.Duration <= 0 {
+		return nil, errors.New("lockout must follow at least one failure within a positive window, for a positive duration")
+	}
+	return &lockouts{lockout: l, strikes: map[string]*strike{}}, nil
+}
+
+// fail records a failure for the supplied key at the supplied time, returning
+// true if the key is now locked out as a result.
+func (l *lockouts) fail(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > l.lockout.Window {
+		for k, s := range l.strikes {
+			if now.Sub(s.first) > l.lockout.Window && now.After(s.until) {
+				delete(l.strikes, k)
+			}
+		}
+		l.swept = now
+	}
+
+	s, ok := l.strikes[key]
+	if !ok || now.Sub(s.first) > l.lockout.Window {
+		s = &strike{first: now}
+		l.strikes[key] = s
+	}
+	if now.Before(s.until) {
+		return false
+	}
+	s.failures++
+	if s.failures < l.lockout.Failures {
+		return false
+	}
+	s.until = now.Add(l.lockout.Duration)
+	s.failures, s.first = 0, now
+	return true
+}
+
+// locked returns how much longer the supplied key is locked out for at the
+// supplied time, or zero if it is not.
+func (l *lockouts) locked(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.strikes[key]
+	if !ok || !now.Before(s.until) {
+		return 0
+	}
+	return s.until.Sub(now)
+}
+
+// LockOut temporarily locks out client IP addresses whose authentication
+// responses repeatedly fail to be processed, e.g. due to invalid state or ID
+// tokens that cannot be verified, and users who are repeatedly denied access.
+// Locked out clients are refused before their requests reach the OIDC
+// provider. Lockouts are tracked in process memory, and are thus per replica.
+func LockOut(lo Lockout) Option {
+	return func(h *Handlers) error {
+		l, err := newLockouts(lo)
+		if err != nil {
+			return err
+		}
+		h.lockouts = l
+		return nil
+	}
+}
+
+// countFailure records an authentication failure by the client that made the
+// supplied request, and by the supplied user if any, recording an audit event
+// for each that is locked out as a result.
+func (h *Handlers) countFailure(r *http.Request, subject string) {
+	if h.lockouts == nil {
+		return
+	}
+	now := time.Now()
+	if ip := clientIP(r); h.lockouts.fail(ipLockoutKey(r), now) {
+		h.logger(r).Info("locked out", zap.String("ip", ip))
+		h.record(r, &AuditEvent{Type: AuditEventLockedOut, Reason: "repeated authentication failures from client IP address"})
+	}
+	if subject != "" && h.lockouts.fail("subject:"+subject, now) {
+		h.logger(r).Info("locked out", zap.String("subject", subject))
+		h.record(r, &AuditEvent{Type: AuditEventLockedOut, Username: subject, Reason: "repeated authentication failures by user"})
+	}
+}
+
+// ipLockoutKey returns the lockout key of the client that made the supplied
+// request. Clients are identified by the address of their peer, or by the
+// address resolved by a trusted proxy, never by headers they can forge.
+func ipLockoutKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// lockedOut writes a 429 Too Many Requests response and returns true if the
+// supplied key is locked out.
+func (h *Handlers) lockedOut(w http.ResponseWriter, r *http.Request, key string) bool {
+	if h.lockouts == nil {
+		return false
+	}
+	wait := h.lockouts.locked(key, time.Now())
+	if wait == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	h.fail(w, r, http.StatusTooManyRequests, ErrLockedOut)
+	return true
+}
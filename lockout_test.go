@@ -0,0 +1,104 @@
+package kuberos
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestLockOut(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+
+	t.Run("ByIP", func(t *testing.T) {
+		events := []*AuditEvent{}
+		sink := AuditSinkFunc(func(_ context.Context, e *AuditEvent) { events = append(events, e) })
+		e := &predictableExtractor{err: &extractor.Error{Code: extractor.ErrorCodeVerifyFailed, Err: errors.New("bad signature")}}
+		h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }),
+			LockOut(Lockout{Failures: 2, Window: time.Minute, Duration: time.Minute}), Audit(sink))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			// Clients may not evade the lockout by spoofing their address.
+			r.Header.Set(headerForwardedFor, fmt.Sprintf("198.51.100.%d", i))
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			if w.Code != want {
+				t.Errorf("request %d: w.Code:\nwant %v\ngot %v\n", i, want, w.Code)
+			}
+			if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+				t.Errorf("request %d: Retry-After:\nwant 60\ngot %v\n", i, w.Header().Get("Retry-After"))
+			}
+		}
+		// Nor may they obtain credentials via the device flow instead.
+		for name, fn := range map[string]http.HandlerFunc{"/device": h.StartDeviceFlow, "/device/token": h.PollDeviceFlow} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", name+"?device_code=code", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			fn(w, r)
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("%s: w.Code:\nwant %v\ngot %v\n", name, http.StatusTooManyRequests, w.Code)
+			}
+		}
+		// Nor may they lock out others by spoofing theirs.
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+		r.RemoteAddr = "198.51.100.1:1234"
+		r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+		h.KubeCfg(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("other IP: w.Code:\nwant %v\ngot %v\n", http.StatusForbidden, w.Code)
+		}
+
+		locked := 0
+		for _, e := range events {
+			if e.Type == AuditEventLockedOut {
+				locked++
+			}
+		}
+		if locked != 1 {
+			t.Errorf("locked out events: want 1, got %d", locked)
+		}
+	})
+
+	t.Run("BySubject", func(t *testing.T) {
+		e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "mallory@example.org"}}
+		h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }),
+			LockOut(Lockout{Failures: 1, Window: time.Minute, Duration: time.Minute}), Authorization(Policy{Groups: []string{"admins"}}))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		// The user remains locked out when they move to another IP.
+		for i, tt := range []struct {
+			remote string
+			want   int
+		}{
+			{remote: "192.0.2.1:1234", want: http.StatusForbidden},
+			{remote: "192.0.2.2:1234", want: http.StatusTooManyRequests},
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.RemoteAddr = tt.remote
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			if w.Code != tt.want {
+				t.Errorf("request %d: w.Code:\nwant %v\ngot %v\n", i, tt.want, w.Code)
+			}
+		}
+	})
+}
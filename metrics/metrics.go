@@ -0,0 +1,177 @@
+// Package metrics exports Prometheus metrics about kuberos' HTTP endpoints and
+// its interactions with the OIDC provider.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	namespace = "kuberos"
+
+	labelRoute  = "route"
+	labelMethod = "method"
+	labelCode   = "code"
+	labelIssuer = "issuer"
+	labelResult = "result"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+	resultHit     = "hit"
+	resultMiss    = "miss"
+)
+
+// Metrics records Prometheus metrics. It implements extractor.Recorder and
+// extractor.KeySetRecorder.
+type Metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	exchanges     *prometheus.HistogramVec
+	verifications *prometheus.HistogramVec
+	failures      *prometheus.CounterVec
+	keyLookups    *prometheus.CounterVec
+	keyRefreshes  *prometheus.CounterVec
+}
+
+var (
+	_ extractor.Recorder       = &Metrics{}
+	_ extractor.KeySetRecorder = &Metrics{}
+)
+
+// New returns Metrics registered with the supplied Registerer.
+func New(r prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests served, by route, method, and status code.",
+		}, []string{labelRoute, labelMethod, labelCode}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route, method, and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{labelRoute, labelMethod, labelCode}),
+		exchanges: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "oidc",
+			Name:      "exchange_duration_seconds",
+			Help:      "Time taken to exchange codes or refresh tokens at the OIDC provider's token endpoint, by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{labelIssuer, labelResult}),
+		verifications: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "oidc",
+			Name:      "verification_duration_seconds",
+			Help:      "Time taken to verify tokens issued by the OIDC provider, by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{labelIssuer, labelResult}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oidc",
+			Name:      "failures_total",
+			Help:      "Authentication responses that could not be processed, by error code.",
+		}, []string{labelIssuer, labelCode}),
+		keyLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oidc",
+			Name:      "signing_key_lookups_total",
+			Help:      "Lookups of the OIDC provider's cached signing keys, by whether the key was cached.",
+		}, []string{labelIssuer, labelResult}),
+		keyRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oidc",
+			Name:      "signing_key_refreshes_total",
+			Help:      "Refreshes of the OIDC provider's cached signing keys, by outcome.",
+		}, []string{labelIssuer, labelResult}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.requestDuration, m.exchanges, m.verifications, m.failures, m.keyLookups, m.keyRefreshes} {
+		if err := r.Register(c); err != nil {
+			return nil, errors.Wrap(err, "cannot register metric")
+		}
+	}
+	return m, nil
+}
+
+// Instrument returns a handler that records metrics about requests served by
+// the supplied handler under the supplied route name.
+func (m *Metrics) Instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		h(sw, r)
+		code := strconv.Itoa(sw.code)
+		m.requests.WithLabelValues(route, r.Method, code).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveExchange records the latency and outcome of a token endpoint
+// request.
+func (m *Metrics) ObserveExchange(issuer string, d time.Duration, err error) {
+	m.exchanges.WithLabelValues(issuer, result(err)).Observe(d.Seconds())
+}
+
+// ObserveVerification records the latency and outcome of verifying a token.
+func (m *Metrics) ObserveVerification(issuer string, d time.Duration, err error) {
+	m.verifications.WithLabelValues(issuer, result(err)).Observe(d.Seconds())
+}
+
+// Failure records a failure to process an authentication response.
+func (m *Metrics) Failure(issuer string, code extractor.ErrorCode) {
+	m.failures.WithLabelValues(issuer, string(code)).Inc()
+}
+
+// KeyLookup records whether a token's signing key was cached.
+func (m *Metrics) KeyLookup(issuer string, hit bool) {
+	r := resultMiss
+	if hit {
+		r = resultHit
+	}
+	m.keyLookups.WithLabelValues(issuer, r).Inc()
+}
+
+// KeyRefresh records the outcome of refreshing the cached signing keys.
+func (m *Metrics) KeyRefresh(issuer string, err error) {
+	m.keyRefreshes.WithLabelValues(issuer, result(err)).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// statusWriter records the status code written to an http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends any buffered data to the client, if the underlying
+// http.ResponseWriter supports flushing, e.g. for streamed responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,165 @@
+package kuberos
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const extensionNaming = "kuberos.naming"
+
+// NameData is the data with which naming templates are executed.
+type NameData struct {
+	// Cluster is the name of the cluster in the kubecfg template.
+	Cluster string
+
+	// ClusterShortName is the name of the cluster up to its first dot, e.g.
+	// prod for prod.example.org.
+	ClusterShortName string
+
+	// Server is the address of the cluster's API server.
+	Server string
+
+	// Username is the user's Kubernetes username.
+	Username string
+
+	// Groups are the user's groups.
+	Groups []string
+
+	// Namespace is the namespace in which the user works in the cluster by
+	// default, if any.
+	Namespace string
+}
+
+// A Naming names the clusters, contexts, and users of issued kubeconfigs by
+// executing Go templates with NameData, so that they do not collide with the
+// entries of kubeconfigs with which they are merged. Entries are named for the
+// cluster, and the user for their username, unless the template for their kind
+// of entry is set. Templates must produce a unique name for each cluster.
+type Naming struct {
+	Cluster *template.Template
+	Context *template.Template
+	User    *template.Template
+}
+
+// ParseNaming parses the supplied cluster, context, and user naming templates,
+// any of which may be empty. Sprig's hermetic functions are available to them,
+// e.g. {{ .ClusterShortName }}-{{ .Username | lower }}.
+func ParseNaming(cluster, context, user string) (*Naming, error) {
+	n := &Naming{}
+	for _, t := range []struct {
+		name string
+		text string
+		t    **template.Template
+	}{
+		{name: "cluster name", text: cluster, t: &n.Cluster},
+		{name: "context name", text: context, t: &n.Context},
+		{name: "user name", text: user, t: &n.User},
+	} {
+		if t.text == "" {
+			continue
+		}
+		tmpl, err := template.New(t.name).Funcs(sprig.HermeticTxtFuncMap()).Option("missingkey=error").Parse(t.text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse %s template", t.name)
+		}
+		// Catch references to fields NameData does not have at startup.
+		if _, err := executeName(tmpl, NameData{Cluster: "cluster", ClusterShortName: "cluster", Username: "user"}, ""); err != nil {
+			return nil, err
+		}
+		*t.t = tmpl
+	}
+	return n, nil
+}
+
+// Apply configures the supplied kubecfg template to name the entries of
+// kubeconfigs issued for its clusters per the Naming.
+func (n *Naming) Apply(cfg *api.Config) {
+	cfg.Extensions[extensionNaming] = n
+}
+
+// GetObjectKind satisfies runtime.Object, allowing a Naming to be carried as an
+// extension of a kubecfg template.
+func (n *Naming) GetObjectKind() schema.ObjectKind { return schema.EmptyObjectKind }
+
+// DeepCopyObject satisfies runtime.Object. Namings are immutable.
+func (n *Naming) DeepCopyObject() runtime.Object { return n }
+
+// executeName returns the output of the supplied naming template, or the
+// supplied default name if the template is nil.
+func executeName(t *template.Template, d NameData, def string) (string, error) {
+	if t == nil {
+		return def, nil
+	}
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, d); err != nil {
+		return "", errors.Wrapf(err, "cannot execute %s template", t.Name())
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" {
+		return "", errors.Errorf("%s template produced an empty name", t.Name())
+	}
+	return name, nil
+}
+
+// rename returns the supplied kubecfg, populated for the supplied user, with
+// its entries named per the Naming of the supplied kubecfg template, if any.
+// Entries whose templates fail are named by default.
+func rename(tmpl *api.Config, c api.Config, p *extractor.OIDCAuthenticationParams) api.Config {
+	n, ok := tmpl.Extensions[extensionNaming].(*Naming)
+	if !ok || len(c.Contexts) == 0 {
+		return c
+	}
+	modes, _ := c.Extensions[extensionInteractiveModes].(interactiveModes)
+
+	out := c
+	out.Clusters = make(map[string]*api.Cluster, len(c.Clusters))
+	out.Contexts = make(map[string]*api.Context, len(c.Contexts))
+	out.AuthInfos = make(map[string]*api.AuthInfo, len(c.AuthInfos))
+	out.Extensions = nil
+	renamedModes := interactiveModes{}
+	for name, ctx := range c.Contexts {
+		cluster := c.Clusters[ctx.Cluster]
+		d := NameData{
+			Cluster:          ctx.Cluster,
+			ClusterShortName: strings.SplitN(ctx.Cluster, ".", 2)[0],
+			Server:           cluster.Server,
+			Username:         p.Username,
+			Groups:           p.Groups,
+			Namespace:        ctx.Namespace,
+		}
+		clusterName := nameOrDefault(n.Cluster, d, ctx.Cluster)
+		contextName := nameOrDefault(n.Context, d, name)
+		userName := nameOrDefault(n.User, d, ctx.AuthInfo)
+
+		out.Clusters[clusterName] = cluster
+		out.AuthInfos[userName] = c.AuthInfos[ctx.AuthInfo]
+		out.Contexts[contextName] = &api.Context{Cluster: clusterName, AuthInfo: userName, Namespace: ctx.Namespace}
+		if mode, ok := modes[ctx.AuthInfo]; ok {
+			renamedModes[userName] = mode
+		}
+		if c.CurrentContext == name {
+			out.CurrentContext = contextName
+		}
+	}
+	if len(renamedModes) > 0 {
+		out.Extensions = map[string]runtime.Object{extensionInteractiveModes: renamedModes}
+	}
+	return out
+}
+
+func nameOrDefault(t *template.Template, d NameData, def string) string {
+	name, err := executeName(t, d, def)
+	if err != nil {
+		return def
+	}
+	return name
+}
@@ -0,0 +1,54 @@
+package kuberos
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/negz/kuberos/extractor"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestNaming(t *testing.T) {
+	n, err := ParseNaming("{{ .ClusterShortName }}", "{{ .ClusterShortName }}-{{ .Username | lower }}", "{{ .ClusterShortName }}-{{ .Username | lower }}")
+	if err != nil {
+		t.Fatalf("ParseNaming(...): %v", err)
+	}
+	cfg := &api.Config{
+		Clusters: map[string]*api.Cluster{
+			"prod.example.org":    &api.Cluster{Server: "https://prod.example.org"},
+			"staging.example.org": &api.Cluster{Server: "https://staging.example.org"},
+		},
+		Contexts:       map[string]*api.Context{},
+		Extensions:     map[string]runtime.Object{},
+		CurrentContext: "prod.example.org",
+	}
+	n.Apply(cfg)
+
+	p := &extractor.OIDCAuthenticationParams{Username: "Alice", IDToken: "token"}
+	got := populateUser(cfg, p, UserAuthProvider)
+	if diff := deep.Equal(clusterNames(&got), []string{"prod", "staging"}); diff != nil {
+		t.Errorf("clusters: want != got %v", diff)
+	}
+	want := map[string]*api.Context{
+		"prod-alice":    &api.Context{Cluster: "prod", AuthInfo: "prod-alice"},
+		"staging-alice": &api.Context{Cluster: "staging", AuthInfo: "staging-alice"},
+	}
+	if diff := deep.Equal(got.Contexts, want); diff != nil {
+		t.Errorf("contexts: want != got %v", diff)
+	}
+	for _, u := range []string{"prod-alice", "staging-alice"} {
+		if got.AuthInfos[u] == nil || got.AuthInfos[u].AuthProvider == nil {
+			t.Errorf("got.AuthInfos[%v]: want auth provider user, got %+v", u, got.AuthInfos[u])
+		}
+	}
+	if got.CurrentContext != "prod-alice" {
+		t.Errorf("got.CurrentContext:\nwant %v\ngot %v\n", "prod-alice", got.CurrentContext)
+	}
+
+	if _, err := ParseNaming("", "{{ .Nope }}", ""); err == nil {
+		t.Errorf("ParseNaming(...): want error referencing unknown field")
+	}
+}
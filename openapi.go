@@ -0,0 +1,430 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const openAPIVersion = "3.0.3"
+
+// An OpenAPIDocument describes the kuberos JSON API per the OpenAPI 3
+// specification, allowing API clients to be generated.
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Servers    []OpenAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo describes the API.
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// An OpenAPIServer is a URL at which the API is served.
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+// OpenAPIComponents are the reusable parts of an OpenAPIDocument.
+type OpenAPIComponents struct {
+	Schemas         map[string]*OpenAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]*OpenAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// An OpenAPISecurityScheme describes how operations are authenticated.
+type OpenAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+// An OpenAPIOperation describes a single API operation on a path.
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+// An OpenAPIParameter describes a URL parameter of an operation.
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// An OpenAPIRequestBody describes the request body of an operation.
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+// An OpenAPIResponse describes a response to an operation.
+type OpenAPIResponse struct {
+	Description string                       `json:"description"`
+	Headers     map[string]*OpenAPIHeader    `json:"headers,omitempty"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// An OpenAPIHeader describes a response header.
+type OpenAPIHeader struct {
+	Description string         `json:"description,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// An OpenAPIMediaType describes a request or response body.
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// An OpenAPISchema describes a data type.
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+// APIFeatures are the optional parts of the JSON API that are served, and
+// thus described by the OpenAPI document.
+type APIFeatures struct {
+	// Refresh is true if the refresh endpoint is served.
+	Refresh bool
+
+	// DeviceFlow is true if the device flow endpoints are served for the
+	// default OIDC provider.
+	DeviceFlow bool
+
+	// Revocation is true if the refresh token revocation endpoint is served
+	// for the default OIDC provider.
+	Revocation bool
+
+	// Admin is true if the admin API is served.
+	Admin bool
+
+	// Providers are any additional OIDC providers, whose endpoints are
+	// suffixed with their name.
+	Providers []ProviderFeatures
+}
+
+// ProviderFeatures are the optional parts of the JSON API that are served for
+// an additional OIDC provider.
+type ProviderFeatures struct {
+	// Name is the name of the provider.
+	Name string
+
+	// DeviceFlow is true if the device flow endpoints are served.
+	DeviceFlow bool
+
+	// Revocation is true if the refresh token revocation endpoint is served.
+	Revocation bool
+}
+
+// NewOpenAPIDocument returns an OpenAPI document describing the supplied
+// features of the JSON API. Request and response schemas are derived from the
+// types the API returns, so the document remains in sync with them.
+func NewOpenAPIDocument(f APIFeatures) *OpenAPIDocument {
+	d := &OpenAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info:    OpenAPIInfo{Title: "kuberos", Version: "v1"},
+		// Relative to the URL of the document, which is served at the
+		// base path.
+		Servers: []OpenAPIServer{{URL: "."}},
+		Paths:   map[string]map[string]*OpenAPIOperation{},
+		Components: OpenAPIComponents{Schemas: map[string]*OpenAPISchema{
+			"KubeConfigResponse":       schemaOf(reflect.TypeOf(KubeConfigResponse{})),
+			"OIDCAuthenticationParams": schemaOf(reflect.TypeOf(extractor.OIDCAuthenticationParams{})),
+			"DeviceAuthorization":      schemaOf(reflect.TypeOf(extractor.DeviceAuthorization{})),
+			"IssuancesResponse":        schemaOf(reflect.TypeOf(IssuancesResponse{})),
+			"SessionStatus":            schemaOf(reflect.TypeOf(SessionStatus{})),
+			"ClustersResponse":         schemaOf(reflect.TypeOf(ClustersResponse{})),
+		}},
+	}
+
+	// providers returns the names of the additional OIDC providers that serve
+	// an optional feature.
+	providers := func(serves func(ProviderFeatures) bool) []string {
+		var names []string
+		for _, p := range f.Providers {
+			if serves(p) {
+				names = append(names, p.Name)
+			}
+		}
+		return names
+	}
+	all := providers(func(ProviderFeatures) bool { return true })
+
+	// addFor adds an operation served for the default OIDC provider if def is
+	// true, and for the named additional OIDC providers.
+	addFor := func(path, method string, op *OpenAPIOperation, def bool, names []string) {
+		if def {
+			d.addOperation(path, method, op)
+		}
+		if len(names) == 0 {
+			return
+		}
+		provider := &OpenAPIParameter{Name: "provider", In: "path", Required: true, Description: "The name of an additional OIDC provider.", Schema: &OpenAPISchema{Type: "string", Enum: names}}
+		n := *op
+		n.OperationID += "ForProvider"
+		n.Parameters = append([]*OpenAPIParameter{provider}, op.Parameters...)
+		d.addOperation(path+"/{provider}", method, &n)
+	}
+	add := func(path, method string, op *OpenAPIOperation, named bool) {
+		var names []string
+		if named {
+			names = all
+		}
+		addFor(path, method, op, true, names)
+	}
+
+	clusters := &OpenAPIParameter{Name: urlParamClusters, In: "query", Description: "Comma separated names of the clusters to include. All clusters are included by default.", Schema: &OpenAPISchema{Type: "string"}}
+	user := &OpenAPIParameter{Name: urlParamUser, In: "query", Description: "How the user authenticates: via kubectl's oidc auth provider using the issued tokens, or via the kubelogin exec credential plugin.", Schema: &OpenAPISchema{Type: "string", Enum: []string{UserAuthProvider, UserExec}}}
+
+	add("/api/v1/kubeconfig", http.MethodGet, &OpenAPIOperation{
+		OperationID: "getKubeConfig",
+		Summary:     "Complete the authentication flow, returning a kubeconfig.",
+		Tags:        []string{"kubeconfig"},
+		Parameters: []*OpenAPIParameter{
+			{Name: urlParamCode, In: "query", Required: true, Description: "The authorization code returned by the OIDC provider.", Schema: &OpenAPISchema{Type: "string"}},
+			{Name: urlParamState, In: "query", Required: true, Description: "The state returned by the OIDC provider.", Schema: &OpenAPISchema{Type: "string"}},
+			clusters,
+			user,
+		},
+		Responses: withErrors(map[string]*OpenAPIResponse{"200": jsonResponse("The kubeconfig and the parameters used to populate it.", "KubeConfigResponse")},
+			http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadGateway),
+	}, true)
+
+	add("/api/v1/session", http.MethodGet, &OpenAPIOperation{
+		OperationID: "getSessionStatus",
+		Summary:     "Report whether the browser has completed an authentication flow whose ID token is still valid.",
+		Tags:        []string{"kubeconfig"},
+		Responses:   map[string]*OpenAPIResponse{"200": jsonResponse("The status of the most recently completed authentication flow.", "SessionStatus")},
+	}, true)
+
+	add("/api/v1/clusters", http.MethodGet, &OpenAPIOperation{
+		OperationID: "listClusters",
+		Summary:     "List the clusters for which kuberos issues credentials.",
+		Tags:        []string{"kubeconfig"},
+		Responses:   map[string]*OpenAPIResponse{"200": jsonResponse("The names of the clusters.", "ClustersResponse")},
+	}, false)
+
+	if f.Refresh {
+		add("/api/v1/refresh", http.MethodPost, &OpenAPIOperation{
+			OperationID: "refreshKubeConfig",
+			Summary:     "Exchange a refresh token for a kubeconfig containing a new ID token.",
+			Tags:        []string{"kubeconfig"},
+			Parameters:  []*OpenAPIParameter{clusters, user},
+			RequestBody: formBody(urlParamRefreshToken),
+			Responses: withErrors(map[string]*OpenAPIResponse{"200": jsonResponse("The kubeconfig and the parameters used to populate it.", "KubeConfigResponse")},
+				http.StatusBadRequest, http.StatusForbidden, http.StatusTooManyRequests, http.StatusNotImplemented),
+		}, true)
+	}
+
+	devices := providers(func(p ProviderFeatures) bool { return p.DeviceFlow })
+	addFor("/device", http.MethodPost, &OpenAPIOperation{
+		OperationID: "startDeviceFlow",
+		Summary:     "Begin an OAuth 2.0 device authorization grant flow.",
+		Tags:        []string{"device"},
+		Responses: withErrors(map[string]*OpenAPIResponse{"200": jsonResponse("The user code and the URI the user should visit.", "DeviceAuthorization")},
+			http.StatusNotImplemented, http.StatusBadGateway),
+	}, f.DeviceFlow, devices)
+	addFor("/device/token", http.MethodPost, &OpenAPIOperation{
+		OperationID: "pollDeviceFlow",
+		Summary:     "Poll for the completion of a device authorization grant flow.",
+		Tags:        []string{"device"},
+		RequestBody: formBody(urlParamDeviceCode),
+		Responses: withErrors(map[string]*OpenAPIResponse{"200": jsonResponse("The parameters required by kubectl.", "OIDCAuthenticationParams")},
+			http.StatusAccepted, http.StatusBadRequest, http.StatusForbidden, http.StatusGone, http.StatusTooManyRequests, http.StatusNotImplemented),
+	}, f.DeviceFlow, devices)
+
+	revokers := providers(func(p ProviderFeatures) bool { return p.Revocation })
+	addFor("/logout", http.MethodPost, &OpenAPIOperation{
+		OperationID: "revokeRefreshToken",
+		Summary:     "Revoke a refresh token issued by kuberos.",
+		Tags:        []string{"kubeconfig"},
+		RequestBody: formBody(urlParamRefreshToken),
+		Responses: withErrors(map[string]*OpenAPIResponse{"204": {Description: "The refresh token was revoked."}},
+			http.StatusBadRequest, http.StatusNotImplemented, http.StatusBadGateway),
+	}, f.Revocation, revokers)
+
+	if f.Admin {
+		d.Components.SecuritySchemes = map[string]*OpenAPISecurityScheme{"adminToken": {Type: "http", Scheme: "bearer"}}
+		add("/api/v1/admin/issuances", http.MethodGet, &OpenAPIOperation{
+			OperationID: "listIssuances",
+			Summary:     "List recently issued kubeconfigs, newest first.",
+			Tags:        []string{"admin"},
+			Security:    []map[string][]string{{"adminToken": {}}},
+			Parameters: []*OpenAPIParameter{
+				{Name: urlParamSubject, In: "query", Description: "Return only issuances to this subject or username.", Schema: &OpenAPISchema{Type: "string"}},
+				{Name: urlParamCluster, In: "query", Description: "Return only issuances for this cluster.", Schema: &OpenAPISchema{Type: "string"}},
+				{Name: urlParamSince, In: "query", Description: "Return only issuances at or after this time.", Schema: &OpenAPISchema{Type: "string", Format: "date-time"}},
+				{Name: urlParamLimit, In: "query", Description: "The maximum number of issuances to return.", Schema: &OpenAPISchema{Type: "integer"}},
+				{Name: urlParamPageToken, In: "query", Description: "The nextPageToken of a previous response.", Schema: &OpenAPISchema{Type: "string"}},
+			},
+			Responses: withErrors(map[string]*OpenAPIResponse{"200": jsonResponse("A page of recent issuances.", "IssuancesResponse")},
+				http.StatusBadRequest, http.StatusUnauthorized),
+		}, false)
+		add("/api/v1/admin/events", http.MethodGet, &OpenAPIOperation{
+			OperationID: "streamEvents",
+			Summary:     "Stream audit events as they are recorded, as server-sent events.",
+			Tags:        []string{"admin"},
+			Security:    []map[string][]string{{"adminToken": {}}},
+			Parameters: []*OpenAPIParameter{
+				{Name: urlParamType, In: "query", Description: "Stream only events of this type.", Schema: &OpenAPISchema{Type: "string", Enum: auditEventTypes}},
+				{Name: urlParamSubject, In: "query", Description: "Stream only events concerning this subject or username.", Schema: &OpenAPISchema{Type: "string"}},
+				{Name: urlParamCluster, In: "query", Description: "Stream only issuances for this cluster.", Schema: &OpenAPISchema{Type: "string"}},
+				{Name: headerLastEventID, In: "header", Description: "The ID of the last event received, after which to resume the stream.", Schema: &OpenAPISchema{Type: "integer"}},
+			},
+			Responses: withErrors(map[string]*OpenAPIResponse{"200": {
+				Description: "A stream of audit events, each encoded as JSON.",
+				Content:     map[string]*OpenAPIMediaType{contentTypeEventStream: {Schema: &OpenAPISchema{Type: "string"}}},
+			}}, http.StatusBadRequest, http.StatusUnauthorized),
+		}, false)
+	}
+
+	add("/healthz", http.MethodGet, &OpenAPIOperation{
+		OperationID: "getHealth",
+		Summary:     "Report whether kuberos is alive.",
+		Tags:        []string{"health"},
+		Responses:   map[string]*OpenAPIResponse{"200": {Description: "Kuberos is alive."}},
+	}, false)
+	add("/readyz", http.MethodGet, &OpenAPIOperation{
+		OperationID: "getReadiness",
+		Summary:     "Report whether kuberos is ready to serve traffic.",
+		Tags:        []string{"health"},
+		Responses: map[string]*OpenAPIResponse{
+			"200": {Description: "Kuberos is ready."},
+			"503": {Description: "Kuberos is starting up or shutting down."},
+		},
+	}, false)
+
+	return d
+}
+
+func (d *OpenAPIDocument) addOperation(path, method string, op *OpenAPIOperation) {
+	if d.Paths[path] == nil {
+		d.Paths[path] = map[string]*OpenAPIOperation{}
+	}
+	d.Paths[path][strings.ToLower(method)] = op
+}
+
+// ServeHTTP serves the OpenAPI document as JSON.
+func (d *OpenAPIDocument) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, d)
+}
+
+func jsonResponse(description, schema string) *OpenAPIResponse {
+	return &OpenAPIResponse{
+		Description: description,
+		Content:     map[string]*OpenAPIMediaType{contentTypeJSON: {Schema: &OpenAPISchema{Ref: "#/components/schemas/" + schema}}},
+	}
+}
+
+func formBody(required ...string) *OpenAPIRequestBody {
+	s := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}, Required: required}
+	for _, p := range required {
+		s.Properties[p] = &OpenAPISchema{Type: "string"}
+	}
+	return &OpenAPIRequestBody{Required: true, Content: map[string]*OpenAPIMediaType{"application/x-www-form-urlencoded": {Schema: s}}}
+}
+
+// withErrors adds the supplied error statuses to the supplied responses.
+// Errors are returned as plain text, classified by the X-Kuberos-Error-Code
+// header where possible.
+func withErrors(rsp map[string]*OpenAPIResponse, statuses ...int) map[string]*OpenAPIResponse {
+	for _, s := range statuses {
+		rsp[strconv.Itoa(s)] = &OpenAPIResponse{
+			Description: http.StatusText(s),
+			Headers: map[string]*OpenAPIHeader{headerErrorCode: {
+				Description: "A machine readable classification of the error, if known.",
+				Schema:      &OpenAPISchema{Type: "string"},
+			}},
+			Content: map[string]*OpenAPIMediaType{"text/plain": {Schema: &OpenAPISchema{Type: "string"}}},
+		}
+	}
+	return rsp
+}
+
+var (
+	typeTime       = reflect.TypeOf(time.Time{})
+	typeRawMessage = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf derives a schema from the supplied type according to its JSON
+// encoding. Fields that are not omitted when empty are required.
+func schemaOf(t reflect.Type) *OpenAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == typeTime:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}
+	case t == typeRawMessage:
+		return &OpenAPISchema{Type: "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &OpenAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &OpenAPISchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &OpenAPISchema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &OpenAPISchema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &OpenAPISchema{Type: "object", Properties: map[string]*OpenAPISchema{}}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s.Properties[name] = schemaOf(f.Type)
+			if !hasOption(tag[1:], "omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	return &OpenAPISchema{}
+}
+
+func hasOption(opts []string, o string) bool {
+	for _, opt := range opts {
+		if opt == o {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	d := NewOpenAPIDocument(APIFeatures{Refresh: true, Providers: []ProviderFeatures{{Name: "okta", DeviceFlow: true}, {Name: "dex", Revocation: true}}})
+
+	for _, p := range []string{"/api/v1/kubeconfig", "/api/v1/kubeconfig/{provider}", "/api/v1/session", "/api/v1/refresh", "/api/v1/refresh/{provider}", "/healthz", "/readyz"} {
+		if _, ok := d.Paths[p]; !ok {
+			t.Errorf("d.Paths: want %v", p)
+		}
+	}
+	if _, ok := d.Paths["/device"]; ok {
+		t.Errorf("d.Paths: want no /device when the device flow is not served")
+	}
+	if _, ok := d.Paths["/logout"]; ok {
+		t.Errorf("d.Paths: want no /logout when revocation is not served")
+	}
+
+	cases := map[string]struct {
+		path string
+		want []string
+	}{
+		"Kubeconfig":      {path: "/api/v1/kubeconfig/{provider}", want: []string{"okta", "dex"}},
+		"DeviceFlow":      {path: "/device/{provider}", want: []string{"okta"}},
+		"DeviceFlowToken": {path: "/device/token/{provider}", want: []string{"okta"}},
+		"Revocation":      {path: "/logout/{provider}", want: []string{"dex"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var op *OpenAPIOperation
+			for _, o := range d.Paths[tc.path] {
+				op = o
+			}
+			if op == nil {
+				t.Fatalf("d.Paths: want %v", tc.path)
+			}
+			if diff := deep.Equal(op.Parameters[0].Schema.Enum, tc.want); diff != nil {
+				t.Errorf("provider enum: want != got %v", diff)
+			}
+		})
+	}
+	if op := d.Paths["/api/v1/refresh"]["post"]; op == nil || op.Responses["200"] == nil {
+		t.Errorf("d.Paths[/api/v1/refresh][post]: want 200 response")
+	}
+
+	params := d.Components.Schemas["OIDCAuthenticationParams"]
+	if diff := deep.Equal(params.Properties["groups"], &OpenAPISchema{Type: "array", Items: &OpenAPISchema{Type: "string"}}); diff != nil {
+		t.Errorf("groups: want != got %v", diff)
+	}
+	if diff := deep.Equal(params.Properties["expiry"], &OpenAPISchema{Type: "string", Format: "date-time"}); diff != nil {
+		t.Errorf("expiry: want != got %v", diff)
+	}
+	for _, r := range params.Required {
+		if r == "groups" {
+			t.Errorf("params.Required: want groups to be optional")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if !json.Valid(w.Body.Bytes()) {
+		t.Errorf("w.Body: invalid JSON: %s", w.Body)
+	}
+}
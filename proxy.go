@@ -0,0 +1,105 @@
+package kuberos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaderPrefix prefixes the headers set by proxies to describe the
+// original request, e.g. X-Forwarded-For.
+const forwardedHeaderPrefix = "X-Forwarded-"
+
+// forwardedKey marks requests whose X-Forwarded headers were set by a trusted
+// proxy.
+type forwardedKey struct{}
+
+// TrustedProxies are the networks of proxies, e.g. ingress controllers, whose
+// X-Forwarded headers are trusted.
+type TrustedProxies []*net.IPNet
+
+// peerIP returns the IP address of the peer that made the supplied request,
+// which may be a proxy.
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// trusted returns true if the supplied request was made by a trusted proxy.
+// Peers connected via a unix domain socket, which have no IP address, are
+// always trusted; only local processes such as a sidecar proxy may connect.
+func (p TrustedProxies) trusted(r *http.Request) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	ip := peerIP(r)
+	return ip != nil && contains(p, ip)
+}
+
+// clientIP returns the IP address of the client that made the supplied
+// request, walking the X-Forwarded-For header back through any trusted
+// proxies.
+func (p TrustedProxies) clientIP(r *http.Request) net.IP {
+	ip := peerIP(r)
+	if !p.trusted(r) {
+		return ip
+	}
+
+	hops := []string{}
+	for _, xff := range r.Header[headerForwardedFor] {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// The chain cannot be trusted beyond a malformed hop.
+			return ip
+		}
+		ip = hop
+		if !contains(p, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// Handler returns a handler that removes all X-Forwarded headers, e.g.
+// X-Forwarded-For and X-Forwarded-Host, from requests that were not made by a
+// trusted proxy before calling the supplied handler, so that clients cannot
+// spoof their IP address or the URLs to which kuberos redirects them. All
+// X-Forwarded headers are removed if there are no trusted proxies, unless the
+// request was made via a unix domain socket. The client IP address is used for
+// rate limiting, lockouts, and audit events.
+func (p TrustedProxies) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if !p.trusted(r) {
+			for k := range r.Header {
+				if strings.HasPrefix(k, forwardedHeaderPrefix) {
+					r.Header.Del(k)
+				}
+			}
+		} else {
+			ctx = context.WithValue(ctx, forwardedKey{}, true)
+		}
+		if ip := p.clientIP(r); ip != nil {
+			ctx = context.WithValue(ctx, clientIPKey{}, ip.String())
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forwardedHost returns the host added to the X-Forwarded-Host header of the
+// supplied request by the nearest proxy, if the request was made by a trusted
+// proxy.
+func forwardedHost(r *http.Request) string {
+	if trusted, _ := r.Context().Value(forwardedKey{}).(bool); !trusted {
+		return ""
+	}
+	hosts := strings.Split(r.Header.Get(headerForwardedHost), ",")
+	return strings.TrimSpace(hosts[len(hosts)-1])
+}
@@ -0,0 +1,61 @@
+package kuberos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("ParseCIDRs(...): %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		proxies    TrustedProxies
+		remoteAddr string
+		unix       bool
+		xff        string
+		wantIP     string
+		wantURL    string
+		wantPort   string
+	}{
+		{name: "FromTrustedProxy", proxies: proxies, remoteAddr: "10.0.0.1:1234", xff: "192.0.2.1, 10.0.0.2", wantIP: "192.0.2.1", wantURL: "https://kuberos.example.org/ui", wantPort: "443"},
+		{name: "FromClient", proxies: proxies, remoteAddr: "198.51.100.1:1234", xff: "192.0.2.1", wantIP: "198.51.100.1", wantURL: "http://example.com/ui"},
+		{name: "NoTrustedProxies", remoteAddr: "10.0.0.1:1234", xff: "192.0.2.1", wantIP: "10.0.0.1", wantURL: "http://example.com/ui"},
+		{name: "UnixSocket", remoteAddr: "@", unix: true, xff: "192.0.2.1", wantIP: "192.0.2.1", wantURL: "https://kuberos.example.org/ui", wantPort: "443"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var ip, u, port string
+			h := tt.proxies.Handler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				ip, u, port = clientIP(r), redirectURL(r, "/", &url.URL{Path: DefaultKubeCfgEndpoint}), r.Header.Get("X-Forwarded-Port")
+			}))
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.unix {
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/kuberos.sock", Net: "unix"}))
+			}
+			r.Header.Set(headerForwardedFor, tt.xff)
+			r.Header.Set(headerForwardedProto, schemeHTTPS)
+			r.Header.Set(headerForwardedHost, "kuberos.example.org")
+			r.Header.Set("X-Forwarded-Port", "443")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if ip != tt.wantIP {
+				t.Errorf("clientIP(...):\nwant %v\ngot %v\n", tt.wantIP, ip)
+			}
+			if u != tt.wantURL {
+				t.Errorf("redirectURL(...):\nwant %v\ngot %v\n", tt.wantURL, u)
+			}
+			if port != tt.wantPort {
+				t.Errorf("r.Header.Get(%q):\nwant %q\ngot %q\n", "X-Forwarded-Port", tt.wantPort, port)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package kuberos
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRateLimited indicates a client exceeded its rate limit.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// rateLimitSweepInterval is how often idle rate limit buckets are discarded.
+const rateLimitSweepInterval = 1 * time.Minute
+
+// A RateLimit permits up to Requests requests per the supplied duration. Up to
+// Requests requests may be made in a burst, after which requests are permitted
+// at an even rate.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// A bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A limiter applies a RateLimit to each of many keys, e.g. IP addresses.
+type limiter struct {
+	limit RateLimit
+	rate  float64 // Tokens per second.
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(l RateLimit) (*limiter, error) {
+	if l.Requests < 1 || l.Per <= 0 {
+		return nil, errors.New("rate limit must permit at least one request per positive duration")
+	}
+	return &limiter{limit: l, rate: float64(l.Requests) / l.Per.Seconds(), buckets: map[string]*bucket{}}, nil
+}
+
+// allow returns true if a request for the supplied key is permitted at the
+// supplied time. If it is not it returns how long the caller should wait
+// before retrying.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.limit.Requests)
+	if now.Sub(l.swept) > rateLimitSweepInterval {
+		// Buckets that have refilled are indistinguishable from new ones.
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// RateLimitByIP limits the rate at which each client IP address may make
+// login and callback requests. The client IP address is the address of the
+// peer that made the request, unless the request passed through an IPFilter or
+// TrustedProxies that resolved it from the X-Forwarded-For header.
+func RateLimitByIP(rl RateLimit) Option {
+	return func(h *Handlers) error {
+		l, err := newLimiter(rl)
+		if err != nil {
+			return err
+		}
+		h.ipLimiter = l
+		return nil
+	}
+}
+
+// RateLimitBySubject limits the rate at which each authenticated user may
+// complete authentication. Requests that exceed the limit are rejected after
+// the OIDC provider has authenticated the user, but before any kubeconfig is
+// returned.
+func RateLimitBySubject(rl RateLimit) Option {
+	return func(h *Handlers) error {
+		l, err := newLimiter(rl)
+		if err != nil {
+			return err
+		}
+		h.subjectLimiter = l
+		return nil
+	}
+}
+
+// limit returns true if the supplied limiter, if any, permits a request for
+// the supplied key. It responds with 429 Too Many Requests if it does not.
+func limit(w http.ResponseWriter, l *limiter, key string) bool {
+	if l == nil {
+		return true
+	}
+	ok, wait := l.allow(key, time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// clientIP returns the IP address of the client that made the supplied
+// request, as determined by any IPFilter or TrustedProxies through which it
+// passed, or the address of its peer otherwise. The X-Forwarded-For header is
+// never read directly, because any client may set it.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,94 @@
+package kuberos
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestRateLimit(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org"}}
+
+	t.Run("ByIP", func(t *testing.T) {
+		h, err := NewHandlers(c, e, RateLimitByIP(RateLimit{Requests: 2, Per: time.Minute}))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		for i, want := range []int{http.StatusSeeOther, http.StatusSeeOther, http.StatusTooManyRequests} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			// Clients may not evade the limit by spoofing their address.
+			r.Header.Set(headerForwardedFor, fmt.Sprintf("198.51.100.%d", i))
+			h.Login(w, r)
+			if w.Code != want {
+				t.Errorf("request %d: w.Code:\nwant %v\ngot %v\n", i, want, w.Code)
+			}
+			if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "30" {
+				t.Errorf("request %d: Retry-After:\nwant 30\ngot %v\n", i, w.Header().Get("Retry-After"))
+			}
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.2:1234"
+		h.Login(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("other IP: w.Code:\nwant %v\ngot %v\n", http.StatusSeeOther, w.Code)
+		}
+	})
+
+	t.Run("BySubject", func(t *testing.T) {
+		h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), RateLimitBySubject(RateLimit{Requests: 1, Per: time.Minute}))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			if w.Code != want {
+				t.Errorf("request %d: w.Code:\nwant %v\ngot %v\n", i, want, w.Code)
+			}
+		}
+	})
+
+	t.Run("DeviceFlow", func(t *testing.T) {
+		h, err := NewHandlers(c, e, RateLimitByIP(RateLimit{Requests: 3, Per: time.Minute}), RateLimitBySubject(RateLimit{Requests: 1, Per: time.Minute}))
+		if err != nil {
+			t.Fatalf("NewHandlers(...): %v", err)
+		}
+		for i, tt := range []struct {
+			name string
+			fn   http.HandlerFunc
+			want int
+		}{
+			{name: "/device", fn: h.StartDeviceFlow, want: http.StatusNotImplemented},
+			{name: "/device/token", fn: h.PollDeviceFlow, want: http.StatusOK},
+			// The subject has already been issued credentials.
+			{name: "/device/token", fn: h.PollDeviceFlow, want: http.StatusTooManyRequests},
+			// The client IP has made too many requests.
+			{name: "/device", fn: h.StartDeviceFlow, want: http.StatusTooManyRequests},
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", tt.name+"?device_code=code", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			tt.fn(w, r)
+			if w.Code != tt.want {
+				t.Errorf("request %d: %s: w.Code:\nwant %v\ngot %v\n", i, tt.name, tt.want, w.Code)
+			}
+		}
+	})
+}
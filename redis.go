@@ -0,0 +1,75 @@
+package kuberos
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// DefaultRedisKeyPrefix is the default prefix of the Redis keys under which
+// sessions are stored.
+const DefaultRedisKeyPrefix = "kuberos:session:"
+
+// A RedisSessionStore stores sessions in Redis, allowing any replica to
+// complete an authentication flow started by another.
+type RedisSessionStore struct {
+	c      *redis.Client
+	prefix string
+}
+
+// A RedisSessionStoreOption configures a RedisSessionStore.
+type RedisSessionStoreOption func(*RedisSessionStore)
+
+// RedisKeyPrefix configures the prefix of the Redis keys under which sessions
+// are stored.
+func RedisKeyPrefix(p string) RedisSessionStoreOption {
+	return func(s *RedisSessionStore) {
+		s.prefix = p
+	}
+}
+
+// NewRedisSessionStore returns a SessionStore that stores sessions using the
+// supplied Redis client.
+func NewRedisSessionStore(c *redis.Client, ro ...RedisSessionStoreOption) *RedisSessionStore {
+	s := &RedisSessionStore{c: c, prefix: DefaultRedisKeyPrefix}
+	for _, o := range ro {
+		o(s)
+	}
+	return s
+}
+
+// Put stores the supplied session in Redis. Redis discards it once the
+// supplied duration has elapsed.
+func (s *RedisSessionStore) Put(ctx context.Context, id string, ss *Session, ttl time.Duration) error {
+	b, err := json.Marshal(ss)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode session")
+	}
+	return errors.Wrap(s.c.WithContext(ctx).Set(s.prefix+id, b, ttl).Err(), "cannot write session to Redis")
+}
+
+// Take atomically returns and deletes the session stored under the supplied
+// ID, ensuring each session is used at most once.
+func (s *RedisSessionStore) Take(ctx context.Context, id string) (*Session, error) {
+	var get *redis.StringCmd
+	_, err := s.c.WithContext(ctx).TxPipelined(func(p redis.Pipeliner) error {
+		get = p.Get(s.prefix + id)
+		p.Del(s.prefix + id)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read session from Redis")
+	}
+	b, err := get.Bytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read session from Redis")
+	}
+	ss := &Session{}
+	return ss, errors.Wrap(json.Unmarshal(b, ss), "cannot decode session")
+}
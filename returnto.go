@@ -0,0 +1,79 @@
+package kuberos
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const urlParamReturnTo = "return_to"
+
+// ErrReturnToNotAllowed indicates a return_to URL that does not match any of
+// the allowed prefixes.
+var ErrReturnToNotAllowed = errors.New("return_to URL is not allowed")
+
+// ReturnTo allows users to be returned to the URL supplied via the return_to
+// query parameter of a login request once their kubeconfig is issued, e.g. to
+// the developer portal that sent them to kuberos. Only absolute HTTP or HTTPS
+// URLs that match the scheme and host of one of the supplied prefixes, and
+// fall under its path, are allowed.
+func ReturnTo(prefixes ...string) Option {
+	return func(h *Handlers) error {
+		for _, p := range prefixes {
+			u, err := url.Parse(p)
+			if err != nil {
+				return errors.Wrapf(err, "cannot parse return_to prefix %q", p)
+			}
+			if (u.Scheme != schemeHTTP && u.Scheme != schemeHTTPS) || u.Host == "" {
+				return errors.Errorf("return_to prefix %q must be an absolute HTTP or HTTPS URL", p)
+			}
+			if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+				return errors.Errorf("return_to prefix %q must not include credentials, a query, or a fragment", p)
+			}
+			h.returnTo = append(h.returnTo, u)
+		}
+		return nil
+	}
+}
+
+// returnURL validates the supplied return_to URL, returning it in canonical
+// form if it is allowed.
+func (h *Handlers) returnURL(raw string) (string, error) {
+	// Browsers treat backslashes as slashes and ignore some control
+	// characters, so a URL containing either may not go where it appears to.
+	if strings.ContainsAny(raw, "\\\t\r\n") {
+		return "", ErrReturnToNotAllowed
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil || u.Opaque != "" {
+		return "", ErrReturnToNotAllowed
+	}
+	for _, p := range h.returnTo {
+		if u.Scheme != p.Scheme || !strings.EqualFold(u.Host, p.Host) {
+			continue
+		}
+		if underPath(u.Path, p.Path) {
+			return u.String(), nil
+		}
+	}
+	return "", ErrReturnToNotAllowed
+}
+
+// underPath returns true if the supplied unescaped path is prefix, or falls
+// under it without traversing back out via a dot-dot segment.
+func underPath(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if p == prefix {
+		return true
+	}
+	if !strings.HasPrefix(p, prefix+"/") {
+		return false
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestReturnTo(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{Username: "example@example.org"}}
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), ReturnTo("https://portal.example.org/clusters/"))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		returnTo string
+		want     int
+	}{
+		{name: "Prefix", returnTo: "https://portal.example.org/clusters", want: http.StatusSeeOther},
+		{name: "UnderPrefix", returnTo: "https://portal.example.org/clusters/prod?tab=access#top", want: http.StatusSeeOther},
+		{name: "OtherPath", returnTo: "https://portal.example.org/clustersevil", want: http.StatusBadRequest},
+		{name: "DotDot", returnTo: "https://portal.example.org/clusters/../admin", want: http.StatusBadRequest},
+		{name: "OtherScheme", returnTo: "http://portal.example.org/clusters/", want: http.StatusBadRequest},
+		{name: "OtherHost", returnTo: "https://portal.example.org.evil.org/clusters/", want: http.StatusBadRequest},
+		{name: "Credentials", returnTo: "https://evil.org@portal.example.org/clusters/", want: http.StatusBadRequest},
+		{name: "Relative", returnTo: "//evil.org/clusters/", want: http.StatusBadRequest},
+		{name: "Backslash", returnTo: "https://portal.example.org\\@evil.org/clusters/", want: http.StatusBadRequest},
+		{name: "Script", returnTo: "javascript:alert(1)", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.Login(w, httptest.NewRequest("GET", "/?"+url.Values{urlParamReturnTo: {tt.returnTo}}.Encode(), nil))
+			if w.Code != tt.want {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.want, w.Code, w.Body)
+			}
+			if tt.want != http.StatusSeeOther {
+				return
+			}
+
+			s := loginSession(t, h, w)
+			if s.ReturnTo != tt.returnTo {
+				t.Errorf("s.ReturnTo:\nwant %v\ngot %v\n", tt.returnTo, s.ReturnTo)
+			}
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.AddCookie(sessionCookie(t, h, s))
+			h.KubeCfg(w, r)
+			rsp := &extractor.OIDCAuthenticationParams{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v\n%s", err, w.Body)
+			}
+			if rsp.ReturnURL != tt.returnTo {
+				t.Errorf("rsp.ReturnURL:\nwant %v\ngot %v\n", tt.returnTo, rsp.ReturnURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cookieSession = "kuberos_session"
+
+	sessionKeyContext = "kuberos session"
+
+	// sessionTTL is how long users have to complete an authentication flow.
+	sessionTTL = cookieMaxAge * time.Second
+)
+
+// ErrInvalidSession indicates the session cookie could not be decrypted,
+// typically because the session keys were rotated mid flow.
+var ErrInvalidSession = errors.New("invalid session cookie: please log in again")
+
+// A Session contains the data that must survive the round trip to the
+// OIDC provider.
+type Session struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v,omitempty"`
+	ReturnTo string `json:"r,omitempty"`
+	Expires  int64  `json:"e"`
+}
+
+// A SessionStore stores in-flight authentication flows on the server side.
+// The session cookie then contains only an opaque session ID. By default
+// sessions are stored in the session cookie itself.
+type SessionStore interface {
+	// Put stores the supplied session under the supplied ID for the supplied
+	// duration.
+	Put(ctx context.Context, id string, s *Session, ttl time.Duration) error
+
+	// Take returns and deletes the session stored under the supplied ID. It
+	// returns nil if no session is stored or it has expired.
+	Take(ctx context.Context, id string) (*Session, error)
+}
+
+type memorySession struct {
+	s       *Session
+	expires time.Time
+}
+
+// A MemorySessionStore stores sessions in process memory. It is suitable only
+// for deployments that run a single replica.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+// NewMemorySessionStore returns a SessionStore that stores sessions in
+// process memory.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]memorySession{}}
+}
+
+// Put stores the supplied session in memory, discarding any expired sessions.
+func (m *MemorySessionStore) Put(_ context.Context, id string, s *Session, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, ms := range m.sessions {
+		if now.After(ms.expires) {
+			delete(m.sessions, k)
+		}
+	}
+	m.sessions[id] = memorySession{s: s, expires: now.Add(ttl)}
+	return nil
+}
+
+// Take returns and deletes the session stored under the supplied ID.
+func (m *MemorySessionStore) Take(_ context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.sessions, id)
+	if time.Now().After(ms.expires) {
+		return nil, nil
+	}
+	return ms.s, nil
+}
+
+// A cookieCodec encrypts and authenticates cookie values. Values are
+// encrypted using the first of its keys, and may be decrypted using any of
+// them, allowing keys to be rotated.
+type cookieCodec struct {
+	aeads []cipher.AEAD
+}
+
+func newCookieCodec(keys ...[]byte) (*cookieCodec, error) {
+	c := &cookieCodec{aeads: make([]cipher.AEAD, 0, len(keys))}
+	for _, k := range keys {
+		// Keys of any length are hashed to derive an AES-256 key.
+		sum := sha256.Sum256(k)
+		b, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create session cipher")
+		}
+		a, err := cipher.NewGCM(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create session cipher")
+		}
+		c.aeads = append(c.aeads, a)
+	}
+	return c, nil
+}
+
+// seal returns the encrypted JSON encoding of the supplied value, bound to
+// the supplied cookie name.
+func (c *cookieCodec) seal(name string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode session")
+	}
+	a := c.aeads[0]
+	nonce := make([]byte, a.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "cannot generate session nonce")
+	}
+	return base64.RawURLEncoding.EncodeToString(a.Seal(nonce, nonce, b, []byte(name))), nil
+}
+
+// open decrypts a value produced by seal into the supplied value.
+func (c *cookieCodec) open(name, value string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return ErrInvalidSession
+	}
+	for _, a := range c.aeads {
+		if len(b) < a.NonceSize() {
+			continue
+		}
+		p, err := a.Open(nil, b[:a.NonceSize()], b[a.NonceSize():], []byte(name))
+		if err != nil {
+			continue
+		}
+		return errors.Wrap(json.Unmarshal(p, v), "cannot decode session")
+	}
+	return ErrInvalidSession
+}
+
+// defaultKey derives a key for the supplied purpose from the supplied client
+// secret, allowing replicas that share a client secret to read each other's
+// state parameters and sessions. A random key is generated for public clients
+// without a secret.
+func defaultKey(secret, context string) ([]byte, error) {
+	if secret == "" {
+		k := make([]byte, randomValueBytes)
+		_, err := rand.Read(k)
+		return k, errors.Wrap(err, "cannot generate key")
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(context)) // nolint: errcheck, gas
+	return m.Sum(nil), nil
+}
+
+// SessionKeys configures the keys used to encrypt the session cookie that
+// stores in-flight authentication flows. The first key is used to encrypt new
+// sessions, while any key may decrypt an existing one, allowing keys to be
+// rotated without interrupting users mid flow. All replicas serving the same
+// users must share keys. By default the key is derived from the OAuth2 client
+// secret, or generated at random for public clients.
+func SessionKeys(keys ...[]byte) Option {
+	return func(h *Handlers) error {
+		if len(keys) == 0 {
+			return errors.New("at least one session key is required")
+		}
+		for _, k := range keys {
+			if len(k) == 0 {
+				return errors.New("session key cannot be empty")
+			}
+		}
+		c, err := newCookieCodec(keys...)
+		if err != nil {
+			return err
+		}
+		h.sessions = c
+		return nil
+	}
+}
+
+// Sessions configures the handlers to store in-flight authentication flows in
+// the supplied SessionStore, rather than in the session cookie.
+func Sessions(s SessionStore) Option {
+	return func(h *Handlers) error {
+		if s == nil {
+			return errors.New("session store cannot be nil")
+		}
+		h.store = s
+		return nil
+	}
+}
+
+// setSession stores the supplied in-flight flow in an encrypted cookie, or in
+// the configured SessionStore under an ID stored in an encrypted cookie.
+func (h *Handlers) setSession(w http.ResponseWriter, r *http.Request, s *Session) error {
+	s.Expires = time.Now().Add(sessionTTL).Unix()
+	var v interface{} = s
+	if h.store != nil {
+		id, err := newRandomValue()
+		if err != nil {
+			return errors.Wrap(err, "cannot generate session ID")
+		}
+		if err := h.store.Put(r.Context(), id, s, sessionTTL); err != nil {
+			return errors.Wrap(err, "cannot store session")
+		}
+		v = id
+	}
+	value, err := h.sessions.seal(cookieSession, v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieSession,
+		Value:    value,
+		Path:     h.basePath,
+		MaxAge:   cookieMaxAge,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		// Lax cookies are sent with the top level redirect from the OIDC
+		// provider, but not with cross-site subrequests.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// session returns and clears the in-flight flow stored by setSession. It
+// returns an empty session if the cookie is absent or has expired.
+func (h *Handlers) session(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	s := &Session{}
+	ck, err := r.Cookie(cookieSession)
+	if err != nil {
+		return s, nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookieSession, Path: h.basePath, MaxAge: -1})
+	if h.store == nil {
+		if err := h.sessions.open(cookieSession, ck.Value, s); err != nil {
+			return nil, err
+		}
+	} else {
+		var id string
+		if err := h.sessions.open(cookieSession, ck.Value, &id); err != nil {
+			return nil, err
+		}
+		if s, err = h.store.Take(r.Context(), id); err != nil {
+			return nil, errors.Wrap(err, "cannot load session")
+		}
+		if s == nil {
+			return &Session{}, nil
+		}
+	}
+	if time.Now().Unix() > s.Expires {
+		return &Session{}, nil
+	}
+	return s, nil
+}
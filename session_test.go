@@ -0,0 +1,78 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestSessionKeys(t *testing.T) {
+	c := &oauth2.Config{ClientID: "testClientID"}
+	e := &predictableExtractor{}
+	old, err := NewHandlers(c, e, SessionKeys([]byte("old")))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	rotated, err := NewHandlers(c, e, SessionKeys([]byte("new"), []byte("old")))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	other, err := NewHandlers(c, e, SessionKeys([]byte("other")))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	want := &Session{State: "state", Nonce: "nonce"}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(sessionCookie(t, old, want))
+
+	got, err := rotated.session(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("rotated.session(...): %v", err)
+	}
+	if got.Nonce != want.Nonce || got.State != want.State {
+		t.Errorf("rotated.session(...):\nwant %+v\ngot %+v\n", want, got)
+	}
+	if _, err := other.session(httptest.NewRecorder(), r); err != ErrInvalidSession {
+		t.Errorf("other.session(...):\nwant %v\ngot %v\n", ErrInvalidSession, err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{}}
+	h, err := NewHandlers(c, e, Sessions(NewMemorySessionStore()))
+	if err != nil {
+		t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Login(w, httptest.NewRequest("GET", "/", nil))
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+	}
+	ck := w.Result().Cookies()[0]
+	if !ck.HttpOnly || ck.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie: want HttpOnly and SameSite=Lax, got %v", ck)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/kubecfg?code=code&state="+url.QueryEscape(u.Query().Get(urlParamState)), nil)
+		r.AddCookie(ck)
+		h.KubeCfg(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: w.Code:\nwant %v\ngot %v\n", i, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package kuberos
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	urlParamShell = "shell"
+
+	// ShellPOSIX selects snippets for POSIX shells such as sh, bash, and zsh.
+	ShellPOSIX = "sh"
+
+	// ShellFish selects snippets for the fish shell.
+	ShellFish = "fish"
+
+	// ShellPowerShell selects snippets for PowerShell.
+	ShellPowerShell = "powershell"
+)
+
+// A shell describes how to write commands for a particular shell.
+type shell struct {
+	// quote returns its argument quoted such that the shell passes it to
+	// commands unchanged.
+	quote func(string) string
+
+	// continuation ends a line that continues on the next.
+	continuation string
+
+	// export returns a statement setting an environment variable.
+	export func(k, v string) string
+
+	// ref returns a reference to an environment variable.
+	ref func(k string) string
+}
+
+var shells = map[string]shell{
+	ShellPOSIX: {
+		quote:        func(s string) string { return "'" + strings.Replace(s, "'", `'\''`, -1) + "'" },
+		continuation: ` \`,
+		export:       func(k, v string) string { return fmt.Sprintf("export %s=%s", k, v) },
+		ref:          func(k string) string { return "${" + k + "}" },
+	},
+	ShellFish: {
+		quote: func(s string) string {
+			return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+		},
+		continuation: ` \`,
+		export:       func(k, v string) string { return fmt.Sprintf("set -x %s %s", k, v) },
+		ref:          func(k string) string { return "$" + k },
+	},
+	ShellPowerShell: {
+		quote:        func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" },
+		continuation: " `",
+		export:       func(k, v string) string { return fmt.Sprintf("$env:%s = '%s'", k, v) },
+		ref:          func(k string) string { return "$env:" + k },
+	},
+}
+
+// SetupSnippet returns commands that add the user described by the supplied
+// parameters to an existing kubeconfig, written for the supplied shell.
+func SetupSnippet(sh string, p *extractor.OIDCAuthenticationParams) (string, error) {
+	s, ok := shells[sh]
+	if !ok {
+		return "", errors.Errorf("unsupported shell %q: must be %s, %s, or %s", sh, ShellPOSIX, ShellFish, ShellPowerShell)
+	}
+	arg := func(k, v string) string { return s.quote("--auth-provider-arg=" + k + "=" + v) }
+	args := []string{"--auth-provider=" + templateAuthProvider, arg(templateOIDCClientID, p.ClientID)}
+	// Public clients have no secret.
+	if p.ClientSecret != "" {
+		args = append(args, arg(templateOIDCClientSecret, p.ClientSecret))
+	}
+	args = append(args, arg(templateOIDCIDToken, p.IDToken), arg(templateOIDCRefreshToken, p.RefreshToken), arg(templateOIDCIssuer, p.IssuerURL))
+
+	lines := []string{"# Add your user to kubectl", "kubectl config set-credentials " + s.quote(p.Username) + s.continuation}
+	for i, a := range args {
+		if i < len(args)-1 {
+			a += s.continuation
+		}
+		lines = append(lines, "  "+a)
+	}
+	lines = append(lines,
+		"",
+		"# Associate your user with an existing cluster",
+		s.export("CLUSTER", "coolcluster"),
+		s.export("CONTEXT", "coolcontext"),
+	)
+	ctx := fmt.Sprintf("kubectl config set-context %s --cluster %s --user=%s", s.ref("CONTEXT"), s.ref("CLUSTER"), s.quote(p.Username))
+	if p.Namespace != "" {
+		ctx += " --namespace=" + s.quote(p.Namespace)
+	}
+	lines = append(lines, ctx)
+	return strings.Join(lines, "\n"), nil
+}
+
+// Snippet is an HTTP handler that returns commands that add the user described
+// by the URL parameters passed to it to an existing kubeconfig, as plain text.
+// The commands are written for the shell selected via the shell URL parameter;
+// POSIX sh by default.
+func Snippet(w http.ResponseWriter, r *http.Request) {
+	r.ParseMultipartForm(templateFormParseMemory) //nolint:errcheck
+	p := &extractor.OIDCAuthenticationParams{}
+
+	sh := r.FormValue(urlParamShell)
+	if sh == "" {
+		sh = ShellPOSIX
+	}
+	form := url.Values{}
+	for k, v := range r.Form {
+		if k != urlParamShell {
+			form[k] = v
+		}
+	}
+	if err := decoder.Decode(p, form); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot parse URL parameter").Error(), http.StatusBadRequest)
+		return
+	}
+
+	snippet, err := SetupSnippet(sh, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeText)
+	if _, err := w.Write([]byte(snippet + "\n")); err != nil {
+		http.Error(w, errors.Wrap(err, "cannot write response").Error(), http.StatusInternalServerError)
+	}
+}
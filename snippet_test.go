@@ -0,0 +1,65 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	base := url.Values{
+		"email":    {"o'brien@example.org"},
+		"idToken":  {"token"},
+		"issuer":   {"https://issuer.example.org"},
+		"expiry":   {"2018-01-02T03:04:05Z"},
+		"issuedAt": {"2018-01-02T02:04:05Z"},
+	}
+
+	cases := []struct {
+		shell string
+		code  int
+		want  []string
+	}{
+		{shell: "", code: http.StatusOK, want: []string{
+			`kubectl config set-credentials 'o'\''brien@example.org' \`,
+			`  '--auth-provider-arg=idp-issuer-url=https://issuer.example.org'`,
+			`export CLUSTER=coolcluster`,
+			`kubectl config set-context ${CONTEXT} --cluster ${CLUSTER}`,
+		}},
+		{shell: ShellFish, code: http.StatusOK, want: []string{
+			`kubectl config set-credentials 'o\'brien@example.org' \`,
+			`set -x CLUSTER coolcluster`,
+			`kubectl config set-context $CONTEXT --cluster $CLUSTER`,
+		}},
+		{shell: ShellPowerShell, code: http.StatusOK, want: []string{
+			"kubectl config set-credentials 'o''brien@example.org' `",
+			`$env:CLUSTER = 'coolcluster'`,
+			`kubectl config set-context $env:CONTEXT --cluster $env:CLUSTER`,
+		}},
+		{shell: "csh", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.shell, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range base {
+				q[k] = v
+			}
+			if tt.shell != "" {
+				q.Set(urlParamShell, tt.shell)
+			}
+			w := httptest.NewRecorder()
+			Snippet(w, httptest.NewRequest("GET", "/snippet?"+q.Encode(), nil))
+			if w.Code != tt.code {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", tt.code, w.Code, w.Body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("w.Body: want line containing %q\ngot:\n%s", want, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package kuberos
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultStateTTL is the default duration for which a state parameter
+	// remains valid. Users must complete authentication with their OIDC
+	// provider within this duration.
+	DefaultStateTTL = cookieMaxAge * time.Second
+
+	stateExpiryBytes = 8
+	stateKeyContext  = "kuberos state"
+)
+
+// stateBinding binds a state parameter to the user agent's nonce cookie and
+// the URL to which the OIDC provider returns it, ensuring a state issued to
+// one user agent cannot be used to complete authentication in another.
+func stateBinding(nonce, returnURL string) []byte {
+	return []byte(nonce + "\x00" + returnURL)
+}
+
+// signState returns a state parameter that expires at the supplied time, bound
+// to the supplied value and signed using the supplied key.
+func signState(key, binding []byte, expiry time.Time) string {
+	b := make([]byte, stateExpiryBytes, stateExpiryBytes+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(expiry.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(b, stateMAC(key, b, binding)...))
+}
+
+// verifyState returns an error unless the supplied state parameter was signed
+// using the supplied key, is bound to the supplied value, and had not expired
+// at the supplied time.
+func verifyState(key, binding []byte, state string, now time.Time) error {
+	b, err := base64.RawURLEncoding.DecodeString(state)
+	if err != nil || len(b) != stateExpiryBytes+sha256.Size {
+		return ErrInvalidState
+	}
+	if !hmac.Equal(b[stateExpiryBytes:], stateMAC(key, b[:stateExpiryBytes], binding)) {
+		return ErrInvalidState
+	}
+	if now.Unix() > int64(binary.BigEndian.Uint64(b[:stateExpiryBytes])) {
+		return ErrExpiredState
+	}
+	return nil
+}
+
+// Writing to a hash never returns an error.
+// nolint: errcheck, gas
+func stateMAC(key, expiry, binding []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(expiry)
+	m.Write(binding)
+	return m.Sum(nil)
+}
+
+// StateKey configures the key used to sign state parameters. All replicas
+// serving the same users must share a key. By default the key is derived from
+// the OAuth2 client secret, or generated at random for public clients.
+func StateKey(key []byte) Option {
+	return func(h *Handlers) error {
+		if len(key) == 0 {
+			return errors.New("state signing key cannot be empty")
+		}
+		h.stateKey = key
+		return nil
+	}
+}
+
+// StateTTL configures the duration for which state parameters remain valid.
+func StateTTL(d time.Duration) Option {
+	return func(h *Handlers) error {
+		if d <= 0 {
+			return errors.New("state TTL must be positive")
+		}
+		h.stateTTL = d
+		return nil
+	}
+}
+
+// newState returns the state parameter for an authentication request.
+func (h *Handlers) newState(r *http.Request, nonce, returnURL string) string {
+	if h.state != nil {
+		return h.state(r)
+	}
+	return signState(h.stateKey, stateBinding(nonce, returnURL), time.Now().Add(h.stateTTL))
+}
+
+// checkState returns an error unless the state parameter of the supplied
+// authentication response was issued by newState for the supplied session and
+// return URL.
+func (h *Handlers) checkState(r *http.Request, s *Session, returnURL string) error {
+	state := r.FormValue(urlParamState)
+	if h.state != nil {
+		if state != h.state(r) {
+			return ErrInvalidState
+		}
+		return nil
+	}
+	if s.Nonce == "" {
+		return ErrMissingNonce
+	}
+	if !hmac.Equal([]byte(state), []byte(s.State)) {
+		return ErrInvalidState
+	}
+	return verifyState(h.stateKey, stateBinding(s.Nonce, returnURL), state, time.Now())
+}
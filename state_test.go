@@ -0,0 +1,76 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestState(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{p: &extractor.OIDCAuthenticationParams{}}
+	h, err := NewHandlers(c, e, StateKey([]byte("key")))
+	if err != nil {
+		t.Fatalf("NewHandlers(%v, %v): %v", c, e, err)
+	}
+
+	w := httptest.NewRecorder()
+	h.Login(w, httptest.NewRequest("GET", "/", nil))
+	s := loginSession(t, h, w)
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("url.Parse(%v): %v", w.Header().Get("Location"), err)
+	}
+	state := u.Query().Get(urlParamState)
+	if state != s.State {
+		t.Errorf("state:\nwant %v\ngot %v\n", s.State, state)
+	}
+	tampered := []byte(state)
+	tampered[0] ^= 1
+
+	cases := []struct {
+		name    string
+		state   string
+		session *Session
+		host    string
+		want    int
+	}{
+		{name: "Valid", state: state, session: s, host: "example.com", want: http.StatusOK},
+		{name: "WrongNonce", state: state, session: &Session{State: state, Nonce: "other"}, host: "example.com", want: http.StatusForbidden},
+		{name: "WrongReturnURL", state: state, session: s, host: "evil.example.com", want: http.StatusForbidden},
+		{name: "Tampered", state: string(tampered), session: s, host: "example.com", want: http.StatusForbidden},
+		{name: "MissingSession", state: state, host: "example.com", want: http.StatusBadRequest},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?code=code&state="+url.QueryEscape(tt.state), nil)
+			r.Host = tt.host
+			if tt.session != nil {
+				r.AddCookie(sessionCookie(t, h, tt.session))
+			}
+			h.KubeCfg(w, r)
+			if w.Code != tt.want {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.want, w.Code)
+			}
+		})
+	}
+
+	t.Run("Expired", func(t *testing.T) {
+		b := stateBinding(s.Nonce, "http://example.com/ui")
+		s := signState(h.stateKey, b, time.Now().Add(-time.Second))
+		if err := verifyState(h.stateKey, b, s, time.Now()); err != ErrExpiredState {
+			t.Errorf("verifyState(...):\nwant %v\ngot %v\n", ErrExpiredState, err)
+		}
+	})
+}
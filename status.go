@@ -0,0 +1,94 @@
+package kuberos
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const cookieStatus = "kuberos_status"
+
+// A SessionStatus describes the authentication flow most recently completed
+// by a browser, so that portals may decide whether to offer a kubeconfig
+// download or ask the user to log in again.
+type SessionStatus struct {
+	// Authenticated is true if the browser completed an authentication flow
+	// whose ID token has not yet expired.
+	Authenticated bool `json:"authenticated"`
+
+	// Username is the authenticated user.
+	Username string `json:"email,omitempty"`
+
+	// Expiry is when the ID token issued to the user expires.
+	Expiry *time.Time `json:"expiry,omitempty"`
+
+	// Refreshable is true if a refresh token was issued with the ID token,
+	// allowing kubectl to renew it once it expires.
+	Refreshable bool `json:"refreshable"`
+}
+
+// A completedFlow is stored in the status cookie once a flow is completed.
+type completedFlow struct {
+	Username    string `json:"u"`
+	Expiry      int64  `json:"e"`
+	Refreshable bool   `json:"r,omitempty"`
+}
+
+// setStatus stores a summary of the supplied completed flow in an encrypted
+// cookie that expires with the ID token. No tokens are stored.
+func (h *Handlers) setStatus(w http.ResponseWriter, r *http.Request, p *extractor.OIDCAuthenticationParams) {
+	ttl := time.Until(p.Expiry)
+	if ttl <= 0 {
+		return
+	}
+	value, err := h.sessions.seal(cookieStatus, &completedFlow{Username: p.Username, Expiry: p.Expiry.Unix(), Refreshable: p.RefreshToken != ""})
+	if err != nil {
+		h.logger(r).Info("cannot store session status", zap.Error(err))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieStatus,
+		Value:    value,
+		Path:     h.basePath,
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearStatus clears the cookie stored by setStatus.
+func (h *Handlers) clearStatus(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: cookieStatus, Path: h.basePath, MaxAge: -1})
+}
+
+// Status returns the status of the authentication flow most recently completed
+// by the requesting browser as JSON. Browsers that have not completed a flow,
+// or whose ID token has expired, are reported as unauthenticated.
+func (h *Handlers) Status(w http.ResponseWriter, r *http.Request) {
+	// The status depends on the caller's cookies, and must not be cached.
+	w.Header().Set("Cache-Control", "no-store")
+
+	s := &SessionStatus{}
+	ck, err := r.Cookie(cookieStatus)
+	if err != nil {
+		writeJSON(w, s)
+		return
+	}
+	f := &completedFlow{}
+	if err := h.sessions.open(cookieStatus, ck.Value, f); err != nil {
+		h.logger(r).Debug("cannot read session status", zap.Error(err))
+		writeJSON(w, s)
+		return
+	}
+	expiry := time.Unix(f.Expiry, 0).UTC()
+	if !time.Now().Before(expiry) {
+		writeJSON(w, s)
+		return
+	}
+	s.Authenticated, s.Username, s.Expiry, s.Refreshable = true, f.Username, &expiry, f.Refreshable
+	writeJSON(w, s)
+}
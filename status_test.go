@@ -0,0 +1,83 @@
+package kuberos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestSessionStatus(t *testing.T) {
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	cases := []struct {
+		name string
+		p    *extractor.OIDCAuthenticationParams
+		want *SessionStatus
+	}{
+		{
+			name: "Refreshable",
+			p:    &extractor.OIDCAuthenticationParams{Username: "example@example.org", RefreshToken: "refresh", Expiry: expiry},
+			want: &SessionStatus{Authenticated: true, Username: "example@example.org", Expiry: &expiry, Refreshable: true},
+		},
+		{
+			name: "NotRefreshable",
+			p:    &extractor.OIDCAuthenticationParams{Username: "example@example.org", Expiry: expiry},
+			want: &SessionStatus{Authenticated: true, Username: "example@example.org", Expiry: &expiry},
+		},
+		{
+			name: "Expired",
+			p:    &extractor.OIDCAuthenticationParams{Username: "example@example.org", Expiry: time.Now().Add(-time.Minute)},
+			want: &SessionStatus{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &predictableExtractor{p: tt.p}
+			h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }))
+			if err != nil {
+				t.Fatalf("NewHandlers(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+			r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+			h.KubeCfg(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("w.Code:\nwant %v\ngot %v\n%s", http.StatusOK, w.Code, w.Body)
+			}
+
+			r = httptest.NewRequest("GET", "/api/v1/session", nil)
+			for _, ck := range w.Result().Cookies() {
+				if ck.Name != cookieStatus {
+					continue
+				}
+				if !ck.HttpOnly || ck.SameSite != http.SameSiteLaxMode {
+					t.Errorf("status cookie: want HttpOnly and SameSite=Lax, got %v", ck)
+				}
+				r.AddCookie(ck)
+			}
+			w = httptest.NewRecorder()
+			h.Status(w, r)
+			got := &SessionStatus{}
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("json.Unmarshal(...): %v", err)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("h.Status(...): want != got %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package kuberos
+
+import (
+	"bytes"
+	"html/template"
+	ttemplate "text/template"
+
+	"github.com/Masterminds/sprig"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// ParseHTMLTemplate parses the supplied HTML template, e.g. a custom error
+// page. The sprig function set is available to the template.
+//
+// See http://masterminds.github.io/sprig/
+func ParseHTMLTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(sprig.HtmlFuncMap()).Parse(text)
+	return t, errors.Wrapf(err, "cannot parse %s template", name)
+}
+
+// ErrorPageTemplate configures the HTML template with which error pages are
+// rendered, in place of the default. See errorPage for the template's data.
+func ErrorPageTemplate(text string) Option {
+	return func(h *Handlers) error {
+		t, err := ParseHTMLTemplate("error", text)
+		if err != nil {
+			return err
+		}
+		h.errorPage = t
+		return nil
+	}
+}
+
+// LoadKubeCfgTemplate loads the kubecfg template in the supplied file, which
+// may use Go template syntax. The template is executed once, when it is
+// loaded, with sprig's hermetic functions available to it. These exclude
+// functions that read the environment or depend on the time or randomness, so
+// that every replica renders the same clusters.
+//
+// Each cluster may specify the namespace in which users of the cluster work by
+// default. This is recorded as the namespace of a context named after the
+// cluster, as kubecfg files have no namespace field for clusters, and is copied
+// to the context of each kubeconfig issued for the cluster. Each cluster may
+// also specify the exec options of kubelogin users of the cluster, and a user
+// or groups for its users to impersonate.
+func LoadKubeCfgTemplate(filename string) (*api.Config, error) {
+	text, err := afero.ReadFile(appFs, filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read kubecfg template")
+	}
+	t, err := ttemplate.New(filename).Funcs(sprig.HermeticTxtFuncMap()).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse kubecfg template")
+	}
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, nil); err != nil {
+		return nil, errors.Wrap(err, "cannot execute kubecfg template")
+	}
+	cfg, err := clientcmd.Load(b.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load kubecfg template")
+	}
+	for _, c := range cfg.Clusters {
+		c.LocationOfOrigin = filename
+	}
+	if err := loadClusterOptions(cfg, b.Bytes()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// templateClusters is the subset of a kubecfg template that clientcmd does not
+// load, i.e. the namespace, exec options, and impersonation of each cluster.
+type templateClusters struct {
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Namespace   string       `json:"namespace"`
+			Exec        *ExecOptions `json:"exec"`
+			As          string       `json:"as"`
+			AsGroups    []string     `json:"as-groups"`
+			AsForGroups []string     `json:"as-for-groups"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+}
+
+const extensionClusterOptions = "kuberos.cluster-options"
+
+// clusterOptions are the options of the clusters of a kubecfg template that
+// kubecfg files cannot express, keyed by cluster name. They are carried as an
+// extension of the template, which is never written.
+type clusterOptions map[string]clusterOption
+
+type clusterOption struct {
+	exec        *ExecOptions
+	impersonate *Impersonation
+}
+
+func (o clusterOptions) GetObjectKind() schema.ObjectKind { return schema.EmptyObjectKind }
+
+func (o clusterOptions) DeepCopyObject() runtime.Object {
+	c := make(clusterOptions, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// optionsOf returns the options of the named cluster of the supplied kubecfg
+// template.
+func optionsOf(cfg *api.Config, cluster string) clusterOption {
+	opts, _ := cfg.Extensions[extensionClusterOptions].(clusterOptions)
+	return opts[cluster]
+}
+
+// loadClusterOptions records the namespace of each cluster in the supplied
+// kubecfg template that specifies one as the namespace of the template's
+// context of the same name, creating the context if necessary. The exec
+// options and impersonation of each cluster that specifies them are recorded
+// as an extension.
+func loadClusterOptions(cfg *api.Config, text []byte) error {
+	tc := &templateClusters{}
+	if err := yaml.Unmarshal(text, tc); err != nil {
+		return errors.Wrap(err, "cannot load kubecfg template cluster options")
+	}
+	opts := clusterOptions{}
+	for _, c := range tc.Clusters {
+		o := clusterOption{}
+		if c.Cluster.Exec != nil {
+			eo, err := c.Cluster.Exec.defaulted()
+			if err != nil {
+				return errors.Wrapf(err, "invalid exec options for cluster %s", c.Name)
+			}
+			o.exec = &eo
+		}
+		if c.Cluster.As != "" || len(c.Cluster.AsGroups) > 0 || len(c.Cluster.AsForGroups) > 0 {
+			i := &Impersonation{As: c.Cluster.As, AsGroups: c.Cluster.AsGroups, ForGroups: c.Cluster.AsForGroups}
+			if err := i.validate(); err != nil {
+				return errors.Wrapf(err, "invalid impersonation for cluster %s", c.Name)
+			}
+			o.impersonate = i
+		}
+		if o.exec != nil || o.impersonate != nil {
+			opts[c.Name] = o
+		}
+		if c.Cluster.Namespace == "" {
+			continue
+		}
+		ctx, ok := cfg.Contexts[c.Name]
+		if !ok {
+			ctx = &api.Context{Cluster: c.Name}
+			cfg.Contexts[c.Name] = ctx
+		}
+		ctx.Namespace = c.Cluster.Namespace
+	}
+	if len(opts) > 0 {
+		cfg.Extensions[extensionClusterOptions] = opts
+	}
+	return nil
+}
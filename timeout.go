@@ -0,0 +1,103 @@
+package kuberos
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRequestTimeout is the default maximum duration of a request. It
+// exceeds the default timeout of requests to the OIDC provider, so that a
+// slow provider's errors are reported in preference to a timeout.
+const DefaultRequestTimeout = 90 * time.Second
+
+// ErrRequestTimeout indicates a request was not handled before its deadline,
+// typically because the OIDC provider did not respond.
+var ErrRequestTimeout = errors.New("request timed out: the identity provider may be unavailable, please try again later")
+
+// TimeoutHandler returns a handler that calls the supplied handler with a
+// request context that is cancelled after the supplied duration. If the
+// supplied handler has not returned by then the client is sent the response of
+// the supplied timed out handler, typically Handlers.TimedOut, and anything the
+// handler subsequently writes is discarded.
+func TimeoutHandler(h http.Handler, d time.Duration, timedOut http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{h: http.Header{}, code: http.StatusOK}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			h.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.h {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes()) // nolint: errcheck, gas
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			timedOut.ServeHTTP(w, r)
+		}
+	})
+}
+
+// TimedOut responds 504 Gateway Timeout with ErrRequestTimeout, explaining the
+// timeout to browsers with the error page.
+func (h *Handlers) TimedOut(w http.ResponseWriter, r *http.Request) {
+	h.fail(w, r, http.StatusGatewayTimeout, ErrRequestTimeout)
+}
+
+// A timeoutWriter buffers a response until the handler writing it returns.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	h        http.Header
+	buf      bytes.Buffer
+	code     int
+	wrote    bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wrote = true
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wrote {
+		return
+	}
+	tw.wrote = true
+	tw.code = code
+}
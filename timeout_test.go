@@ -0,0 +1,82 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	h, err := NewHandlers(&oauth2.Config{}, &predictableExtractor{})
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+	late := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Write([]byte("too late")) // nolint: errcheck, gas
+	}
+
+	cases := []struct {
+		name        string
+		h           http.HandlerFunc
+		accept      string
+		code        int
+		contentType string
+		body        []string
+	}{
+		{
+			name: "Completed",
+			h: func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/example")
+				w.WriteHeader(http.StatusTeapot)
+				w.Write([]byte("ok")) // nolint: errcheck, gas
+			},
+			code:        http.StatusTeapot,
+			contentType: "text/example",
+			body:        []string{"ok"},
+		},
+		{
+			name:        "TimedOutBrowser",
+			h:           late,
+			accept:      "text/html",
+			code:        http.StatusGatewayTimeout,
+			contentType: contentTypeHTML,
+			body:        []string{"<h1>Request timed out</h1>", "504 Gateway Timeout: " + ErrRequestTimeout.Error()},
+		},
+		{
+			name:        "TimedOutFrontend",
+			h:           late,
+			accept:      "application/json",
+			code:        http.StatusGatewayTimeout,
+			contentType: "text/plain; charset=utf-8",
+			body:        []string{ErrRequestTimeout.Error() + "\n"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			TimeoutHandler(tt.h, 10*time.Millisecond, http.HandlerFunc(h.TimedOut)).ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("w.Code:\nwant %v\ngot %v\n", tt.code, w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type:\nwant %v\ngot %v\n", tt.contentType, got)
+			}
+			for _, want := range tt.body {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("w.Body: want %q in\n%s", want, w.Body.String())
+				}
+			}
+			if strings.Contains(w.Body.String(), "too late") {
+				t.Errorf("w.Body: want nothing written after the timeout, got\n%s", w.Body.String())
+			}
+		})
+	}
+}
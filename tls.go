@@ -0,0 +1,172 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// DefaultCertificateReloadInterval is the default interval at which a
+// CertificateReloader checks whether its files have changed.
+const DefaultCertificateReloadInterval = 10 * time.Second
+
+// ErrClientCertificateNotAllowed indicates a TLS client certificate that was
+// signed by a trusted CA, but is not issued to an allowed name.
+var ErrClientCertificateNotAllowed = errors.New("client certificate is not issued to an allowed name")
+
+// RequireClientCertificates configures the supplied TLS config to require
+// clients to present a certificate signed by one of the supplied PEM encoded
+// CA certificates, e.g. those of enrolled devices. If any names are supplied
+// the certificate's subject common name, or one of its DNS, email, or URI
+// subject alternative names, must be one of them.
+func RequireClientCertificates(c *tls.Config, caPEM []byte, names []string) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return errors.New("cannot parse any PEM encoded CA certificates")
+	}
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	c.ClientCAs = pool
+	if len(names) == 0 {
+		return nil
+	}
+
+	allowed := map[string]bool{}
+	for _, n := range names {
+		allowed[n] = true
+	}
+	c.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			if len(chain) > 0 && certificateAllowed(chain[0], allowed) {
+				return nil
+			}
+		}
+		return ErrClientCertificateNotAllowed
+	}
+	return nil
+}
+
+// certificateAllowed returns true if the supplied certificate was issued to
+// one of the supplied names.
+func certificateAllowed(cert *x509.Certificate, allowed map[string]bool) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, n := range names {
+		if n != "" && allowed[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// A CertificateReloader serves a TLS certificate read from a pair of PEM
+// encoded files, reading them again whenever either is modified. This allows
+// certificates to be rotated, e.g. by cert-manager, without restarting.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	log      *zap.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertificateReloader returns a CertificateReloader that serves the
+// certificate and private key in the supplied files. The files are read
+// before NewCertificateReloader returns.
+func NewCertificateReloader(certFile, keyFile string, log *zap.Logger) (*CertificateReloader, error) {
+	c := &CertificateReloader{certFile: certFile, keyFile: keyFile, log: log}
+	_, err := c.reload()
+	return c, err
+}
+
+// GetCertificate returns the current certificate. It may be used as the
+// GetCertificate function of a tls.Config.
+func (c *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks whether the certificate or key file has been modified every
+// interval until the supplied context is cancelled, reading both files again
+// if so. The current certificate continues to be served if the files cannot
+// be read, e.g. because only one of them has been updated so far.
+func (c *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				c.log.Info("cannot reload TLS certificate", zap.Error(err))
+				continue
+			}
+			if reloaded {
+				c.log.Info("reloaded TLS certificate", zap.String("cert", c.certFile))
+			}
+		}
+	}
+}
+
+// reload reads the certificate and key files if either has been modified
+// since they were last read, returning true if they were.
+func (c *CertificateReloader) reload() (bool, error) {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	current := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+
+	certPEM, err := afero.ReadFile(appFs, c.certFile)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot read TLS certificate")
+	}
+	keyPEM, err := afero.ReadFile(appFs, c.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot read TLS private key")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot parse TLS certificate")
+	}
+
+	c.mu.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+// latestModTime returns the most recent modification time of the certificate
+// and key files.
+func (c *CertificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := appFs.Stat(f)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "cannot stat %s", f)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,148 @@
+package kuberos
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+)
+
+// writeCertificate writes a self-signed certificate for the supplied common
+// name and its private key to appFs at the supplied time.
+func writeCertificate(t *testing.T, cn string, at time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    at,
+		NotAfter:     at.Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey(...): %v", err)
+	}
+	files := map[string][]byte{
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+	}
+	for name, b := range files {
+		if err := afero.WriteFile(appFs, name, b, 0600); err != nil {
+			t.Fatalf("afero.WriteFile(%v): %v", name, err)
+		}
+		if err := appFs.Chtimes(name, at, at); err != nil {
+			t.Fatalf("appFs.Chtimes(%v): %v", name, err)
+		}
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	now := time.Now()
+	writeCertificate(t, "old", now.Add(-time.Minute))
+
+	c, err := NewCertificateReloader("tls.crt", "tls.key", zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewCertificateReloader(...): %v", err)
+	}
+	commonName := func() string {
+		cert, _ := c.GetCertificate(nil)
+		x, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("x509.ParseCertificate(...): %v", err)
+		}
+		return x.Subject.CommonName
+	}
+	if got := commonName(); got != "old" {
+		t.Errorf("commonName():\nwant old\ngot %v\n", got)
+	}
+
+	if reloaded, err := c.reload(); reloaded || err != nil {
+		t.Errorf("c.reload(): want false, nil; got %v, %v", reloaded, err)
+	}
+
+	writeCertificate(t, "new", now)
+	if reloaded, err := c.reload(); !reloaded || err != nil {
+		t.Errorf("c.reload(): want true, nil; got %v, %v", reloaded, err)
+	}
+	if got := commonName(); got != "new" {
+		t.Errorf("commonName():\nwant new\ngot %v\n", got)
+	}
+
+	if err := afero.WriteFile(appFs, "tls.key", []byte("garbage"), 0600); err != nil {
+		t.Fatalf("afero.WriteFile(...): %v", err)
+	}
+	if _, err := c.reload(); err == nil {
+		t.Errorf("c.reload(): want error, got nil")
+	}
+	if got := commonName(); got != "new" {
+		t.Errorf("commonName():\nwant new\ngot %v\n", got)
+	}
+}
+
+func TestRequireClientCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := RequireClientCertificates(&tls.Config{}, []byte("garbage"), nil); err == nil {
+		t.Errorf("RequireClientCertificates(garbage): want error")
+	}
+
+	c := &tls.Config{}
+	if err := RequireClientCertificates(c, ca, []string{"laptop.example.org", "spiffe://example.org/device"}); err != nil {
+		t.Fatalf("RequireClientCertificates(...): %v", err)
+	}
+	if c.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("c.ClientAuth:\nwant %v\ngot %v\n", tls.RequireAndVerifyClientCert, c.ClientAuth)
+	}
+
+	spiffe, _ := url.Parse("spiffe://example.org/device")
+	cases := []struct {
+		name string
+		cert *x509.Certificate
+		want error
+	}{
+		{name: "CommonName", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "laptop.example.org"}}},
+		{name: "URISAN", cert: &x509.Certificate{URIs: []*url.URL{spiffe}}},
+		{name: "NotAllowed", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, DNSNames: []string{"other.example.org"}}, want: ErrClientCertificateNotAllowed},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.VerifyPeerCertificate(nil, [][]*x509.Certificate{{tt.cert}}); err != tt.want {
+				t.Errorf("c.VerifyPeerCertificate(...):\nwant %v\ngot %v\n", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+const (
+	headerTraceParent = "traceparent"
+	headerTraceState  = "tracestate"
+
+	traceVersion = "00"
+
+	spanServer = "kuberos.http.server"
+	spanClient = "kuberos.http.client"
+)
+
+type spanKey struct{}
+
+// A SpanContext identifies a span within a W3C trace.
+//
+// See https://www.w3.org/TR/trace-context/
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Flags   byte
+	State   string
+}
+
+// parseTraceParent returns the span context described by the supplied
+// traceparent and tracestate headers, or false if the traceparent header is
+// absent or invalid.
+func parseTraceParent(parent, state string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(parent), "-")
+	if len(parts) < 4 || !lowerHex(parts[0], 2) || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// Future versions may append fields, but version 00 must not.
+	if parts[0] == traceVersion && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	if !validID(parts[1], 32) || !validID(parts[2], 16) || !lowerHex(parts[3], 2) {
+		return SpanContext{}, false
+	}
+	flags, _ := hex.DecodeString(parts[3]) // nolint: gas
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Flags: flags[0], State: strings.TrimSpace(state)}, true
+}
+
+// validID returns true if the supplied trace or span ID is of the supplied
+// length and not all zeros.
+func validID(id string, length int) bool {
+	return lowerHex(id, length) && strings.Trim(id, "0") != ""
+}
+
+// lowerHex returns true if the supplied string is lowercase hex of the
+// supplied length.
+func lowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// traceParent returns the traceparent header identifying the span.
+func (s SpanContext) traceParent() string {
+	return fmt.Sprintf("%s-%s-%s-%02x", traceVersion, s.TraceID, s.SpanID, s.Flags)
+}
+
+func newTraceID(bytes int) string {
+	b := make([]byte, bytes)
+	rand.Read(b) // nolint: errcheck, gas
+	return hex.EncodeToString(b)
+}
+
+// A span is an operation traced by a Tracer.
+type span struct {
+	SpanContext
+	parent string
+	name   string
+	start  time.Time
+	log    *zap.Logger
+	err    error
+}
+
+func (s *span) RecordError(err error) {
+	s.err = err
+}
+
+func (s *span) End() {
+	s.log.Debug("span",
+		zap.String("traceID", s.TraceID),
+		zap.String("spanID", s.SpanID),
+		zap.String("parentSpanID", s.parent),
+		zap.String("name", s.name),
+		zap.Duration("duration", time.Since(s.start)),
+		zap.Error(s.err))
+}
+
+// A Tracer continues W3C traces begun by callers of kuberos, e.g. an ingress,
+// and propagates them to the OIDC provider. Spans are written to the debug
+// log, annotated with their trace and span IDs, rather than exported to a
+// tracing backend. A Tracer satisfies extractor.Tracer.
+type Tracer struct {
+	// Log is the logger to which spans are written when the context in which
+	// they are started carries no logger.
+	Log *zap.Logger
+}
+
+// Start a span as a child of any span in the supplied context, or of a new
+// unsampled trace if there is none.
+func (t Tracer) Start(ctx context.Context, name string) (context.Context, extractor.Span) {
+	sc := SpanContext{TraceID: newTraceID(16)}
+	parent := ""
+	if p, ok := ctx.Value(spanKey{}).(SpanContext); ok {
+		sc, parent = p, p.SpanID
+	}
+	sc.SpanID = newTraceID(8)
+	s := &span{SpanContext: sc, parent: parent, name: name, start: time.Now(), log: extractor.LoggerFrom(ctx, t.Log)}
+	return context.WithValue(ctx, spanKey{}, sc), s
+}
+
+// Handler returns a handler that starts a span for each request, as a child of
+// the span identified by the request's traceparent header if it has a valid
+// one, before calling the supplied handler.
+func (t Tracer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if p, ok := parseTraceParent(r.Header.Get(headerTraceParent), r.Header.Get(headerTraceState)); ok {
+			ctx = context.WithValue(ctx, spanKey{}, p)
+		}
+		ctx, s := t.Start(ctx, spanServer)
+		defer s.End()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Transport returns an HTTP transport that starts a span for each request made
+// via the supplied transport, propagating it via the traceparent and
+// tracestate headers.
+func (t Tracer) Transport(rt http.RoundTripper) http.RoundTripper {
+	return tracingTransport{t: t, rt: rt}
+}
+
+type tracingTransport struct {
+	t  Tracer
+	rt http.RoundTripper
+}
+
+func (tt tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, s := tt.t.Start(r.Context(), spanClient)
+	sc := ctx.Value(spanKey{}).(SpanContext)
+
+	// RoundTrippers must not modify the supplied request.
+	c := r.WithContext(ctx)
+	c.Header = make(http.Header, len(r.Header)+2)
+	for k, v := range r.Header {
+		c.Header[k] = v
+	}
+	c.Header.Set(headerTraceParent, sc.traceParent())
+	if sc.State != "" {
+		c.Header.Set(headerTraceState, sc.State)
+	}
+
+	rsp, err := tt.rt.RoundTrip(c)
+	if err != nil {
+		s.RecordError(err)
+	}
+	s.End()
+	return rsp, err
+}
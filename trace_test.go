@@ -0,0 +1,70 @@
+package kuberos
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTracer(t *testing.T) {
+	var got string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(headerTraceParent)
+		if s := r.Header.Get(headerTraceState); s != "vendor=value" && s != "" {
+			t.Errorf("tracestate: want vendor=value, got %v", s)
+		}
+	}))
+	defer idp.Close()
+
+	tr := Tracer{Log: zap.NewNop()}
+	c := &http.Client{Transport: tr.Transport(http.DefaultTransport)}
+	h := tr.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest("GET", idp.URL, nil)
+		rsp, err := c.Do(req.WithContext(r.Context()))
+		if err != nil {
+			t.Fatalf("c.Do(...): %v", err)
+		}
+		rsp.Body.Close()
+	}))
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	cases := []struct {
+		name    string
+		parent  string
+		inherit bool
+	}{
+		{name: "Valid", parent: "00-" + traceID + "-" + spanID + "-01", inherit: true},
+		{name: "FutureVersion", parent: "cc-" + traceID + "-" + spanID + "-01-extra", inherit: true},
+		{name: "Absent"},
+		{name: "ZeroTraceID", parent: "00-00000000000000000000000000000000-" + spanID + "-01"},
+		{name: "UppercaseSpanID", parent: "00-" + traceID + "-00F067AA0BA902B7-01"},
+		{name: "ExtraFields", parent: "00-" + traceID + "-" + spanID + "-01-extra"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.parent != "" {
+				r.Header.Set(headerTraceParent, tt.parent)
+				r.Header.Set(headerTraceState, "vendor=value")
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			sc, ok := parseTraceParent(got, "")
+			if !ok {
+				t.Fatalf("traceparent: want valid propagated traceparent, got %q", got)
+			}
+			if sc.SpanID == spanID {
+				t.Errorf("traceparent: want a new span ID, got %v", sc.SpanID)
+			}
+			if inherited := sc.TraceID == traceID; inherited != tt.inherit {
+				t.Errorf("traceparent: want inherited trace ID %v, got %v", tt.inherit, got)
+			}
+		})
+	}
+}
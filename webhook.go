@@ -0,0 +1,168 @@
+package kuberos
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	headerWebhookSignature = "X-Kuberos-Signature"
+	headerWebhookEvent     = "X-Kuberos-Event"
+)
+
+// Webhook defaults.
+const (
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = time.Second
+	DefaultWebhookTimeout  = 10 * time.Second
+)
+
+// A Webhook is an AuditSink that POSTs each audit event as JSON to a URL, so
+// that e.g. security tooling may react to it in near real time. Each request
+// is signed using HMAC-SHA256; the hex encoded signature of the request body
+// is sent in the X-Kuberos-Signature header, prefixed with sha256=.
+type Webhook struct {
+	url      string
+	key      []byte
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	log      *zap.Logger
+
+	// pending tracks events that are still being sent.
+	pending sync.WaitGroup
+}
+
+// A WebhookOption configures a Webhook.
+type WebhookOption func(*Webhook)
+
+// WebhookHTTPClient configures the HTTP client with which events are sent.
+func WebhookHTTPClient(c *http.Client) WebhookOption {
+	return func(w *Webhook) {
+		w.client = c
+	}
+}
+
+// WebhookRetries configures the maximum number of attempts to send each event,
+// and the time to wait before the first retry, which doubles with each
+// subsequent retry.
+func WebhookRetries(attempts int, backoff time.Duration) WebhookOption {
+	return func(w *Webhook) {
+		w.attempts = attempts
+		w.backoff = backoff
+	}
+}
+
+// WebhookLogger configures the logger to which failures to send events are
+// logged.
+func WebhookLogger(l *zap.Logger) WebhookOption {
+	return func(w *Webhook) {
+		w.log = l
+	}
+}
+
+// NewWebhook returns a Webhook that sends events to the supplied URL, signed
+// using the supplied key.
+func NewWebhook(url string, key []byte, wo ...WebhookOption) *Webhook {
+	w := &Webhook{
+		url:      url,
+		key:      key,
+		client:   &http.Client{Timeout: DefaultWebhookTimeout},
+		attempts: DefaultWebhookAttempts,
+		backoff:  DefaultWebhookBackoff,
+		log:      zap.NewNop(),
+	}
+	for _, o := range wo {
+		o(w)
+	}
+	return w
+}
+
+// Record sends the supplied event to the webhook in the background, retrying
+// transient failures so as not to delay the request that caused the event.
+func (w *Webhook) Record(_ context.Context, e *AuditEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		w.log.Info("cannot encode webhook event", zap.Error(err))
+		return
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		if err := w.send(e.Type, b); err != nil {
+			w.log.Info("cannot send webhook event", zap.String("type", e.Type), zap.Error(err))
+		}
+	}()
+}
+
+// Flush waits for all events recorded so far to be sent, or to exhaust their
+// retries. It returns an error if the supplied context is done first.
+func (w *Webhook) Flush(ctx context.Context) error {
+	sent := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cannot send pending webhook events")
+	}
+}
+
+// sign returns the signature of the supplied request body.
+func (w *Webhook) sign(body []byte) string {
+	m := hmac.New(sha256.New, w.key)
+	m.Write(body) // nolint: errcheck, gas
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// send POSTs the supplied event body to the webhook, retrying network errors,
+// rate limiting, and server errors.
+func (w *Webhook) send(typ string, body []byte) error {
+	sig := w.sign(body)
+	backoff := w.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		if retryable, err = w.post(typ, sig, body); err == nil || !retryable || attempt >= w.attempts {
+			return err
+		}
+		w.log.Debug("retrying webhook", zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single attempt to send an event, returning whether any error
+// may be retried.
+func (w *Webhook) post(typ, sig string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "cannot create webhook request")
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set(headerWebhookEvent, typ)
+	req.Header.Set(headerWebhookSignature, sig)
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "cannot send webhook request")
+	}
+	rsp.Body.Close() // nolint: errcheck, gas
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.Errorf("webhook responded %s", rsp.Status)
+	return rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500, err
+}
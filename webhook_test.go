@@ -0,0 +1,106 @@
+package kuberos
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/negz/kuberos/extractor"
+)
+
+func TestWebhook(t *testing.T) {
+	key := []byte("key")
+	received := make(chan *AuditEvent, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("ioutil.ReadAll(...): %v", err)
+		}
+		m := hmac.New(sha256.New, key)
+		m.Write(b) // nolint: errcheck, gas
+		if got, want := r.Header.Get(headerWebhookSignature), "sha256="+hex.EncodeToString(m.Sum(nil)); got != want {
+			t.Errorf("%s:\nwant %v\ngot %v\n", headerWebhookSignature, want, got)
+		}
+		if got, want := r.Header.Get(headerWebhookEvent), AuditEventFailed; got != want {
+			t.Errorf("%s:\nwant %v\ngot %v\n", headerWebhookEvent, want, got)
+		}
+		e := &AuditEvent{}
+		if err := json.Unmarshal(b, e); err != nil {
+			t.Errorf("json.Unmarshal(...): %v", err)
+		}
+		received <- e
+	}))
+	defer srv.Close()
+
+	c := &oauth2.Config{
+		ClientID: "testClientID",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://auth.example.org", TokenURL: "https://token.example.org"},
+		Scopes:   DefaultScopes,
+	}
+	e := &predictableExtractor{err: &extractor.Error{Code: extractor.ErrorCodeVerifyFailed, Err: errors.New("bad signature")}}
+	wh := NewWebhook(srv.URL, key, WebhookRetries(2, time.Millisecond))
+	h, err := NewHandlers(c, e, StateFunction(func(_ *http.Request) string { return "state" }), Audit(wh))
+	if err != nil {
+		t.Fatalf("NewHandlers(...): %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/kubecfg?state=state&code=code", nil)
+	r.AddCookie(sessionCookie(t, h, &Session{Nonce: "nonce"}))
+	h.KubeCfg(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("w.Code:\nwant %v\ngot %v\n", http.StatusForbidden, w.Code)
+	}
+
+	select {
+	case got := <-received:
+		if got.Type != AuditEventFailed || got.Code != string(extractor.ErrorCodeVerifyFailed) {
+			t.Errorf("AuditEvent:\nwant type %v code %v\ngot type %v code %v\n", AuditEventFailed, extractor.ErrorCodeVerifyFailed, got.Type, got.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestWebhookFlush(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	wh := NewWebhook(srv.URL, []byte("key"))
+	if err := wh.Flush(context.Background()); err != nil {
+		t.Errorf("wh.Flush(...) with no pending events: %v", err)
+	}
+
+	wh.Record(context.Background(), &AuditEvent{Type: AuditEventIssued})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wh.Flush(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("wh.Flush(...) with undelivered event: want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wh.Flush(ctx); err != nil {
+		t.Errorf("wh.Flush(...) with delivered event: %v", err)
+	}
+}